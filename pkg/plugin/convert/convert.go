@@ -0,0 +1,51 @@
+// Package convert contains the converters of NATS messages to frames. A query converts its messages either via its
+// script (see Script), or instead via a WebAssembly module (see WasmTransform), expressions (see Expressions) or a
+// mapping (see Mapping).
+package convert
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+)
+
+// cacheSize bounds the number of compiled expressions and mappings kept in memory; the least recently used ones are evicted.
+const cacheSize = 1000
+
+// Converter converts a single NATS message to frames. It is used by Request/Reply and Subscribe queries, and by the
+// preview of the query editor.
+type Converter interface {
+	Convert(ctx context.Context, msg *nats.Msg) (data.Frames, error)
+}
+
+// Options configure the converters which are used instead of a script.
+type Options struct {
+	// Limits are the limits of the query; they apply to each message, like for scripts.
+	Limits goja.Limits
+	// MaxWasmMemoryBytes limits the memory of WebAssembly transforms (0 for unlimited). There is no such limit for
+	// scripts: goja does not track memory per runtime.
+	MaxWasmMemoryBytes uint64
+	// ServerLog is the level at which logs are additionally written to the Grafana server log.
+	ServerLog goja.ServerLogLevel
+	// Arrays sets how nested arrays are converted, see framestruct.ArrayMode.
+	Arrays framestruct.ArrayMode
+}
+
+// script converts messages via a script, see Script.
+type script struct {
+	nc   *nats.Conn
+	jsFn string
+	opts []goja.Option
+}
+
+// Script returns the converter which converts messages via the given script, see goja.ConvertMessage.
+func Script(nc *nats.Conn, jsFn string, opts ...goja.Option) Converter {
+	return &script{nc: nc, jsFn: jsFn, opts: opts}
+}
+
+func (s *script) Convert(ctx context.Context, msg *nats.Msg) (data.Frames, error) {
+	return goja.ConvertMessage(ctx, s.nc, msg, s.jsFn, s.opts...)
+}
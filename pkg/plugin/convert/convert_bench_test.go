@@ -0,0 +1,65 @@
+package convert
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+// This is here to avoid compiler optimizations that
+// could remove the actual call we are benchmarking
+// during benchmarks
+var benchmarkResult data.Frames
+
+func benchmarkConverter(b *testing.B, converter Converter) {
+	b.Helper()
+	msg := &nats.Msg{
+		Subject: "sensors.temperature",
+		Data:    []byte(`{"sensor": "s1", "value": 21.5}`),
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchmarkResult, _ = converter.Convert(context.Background(), msg)
+		}
+	})
+	// many subscriptions converting messages concurrently
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = converter.Convert(context.Background(), msg)
+			}
+		})
+	})
+}
+
+func BenchmarkConverters(b *testing.B) {
+	b.Run("script", func(b *testing.B) {
+		benchmarkConverter(b, Script(nil, `
+			const parsed = JSON.parse(msg.Data);
+			return {
+				sensor: parsed.sensor,
+				value: parsed.value * 1.8 + 32,
+				unit: "°F",
+				subject: msg.Subject,
+			};
+		`))
+	})
+	// the same conversion as the script, without a JS runtime
+	b.Run("expressions", func(b *testing.B) {
+		benchmarkConverter(b, newExpressionConverter(b, &Expressions{Columns: []ExpressionColumn{
+			{Name: "sensor", Expression: `data.sensor`},
+			{Name: "value", Expression: `data.value * 1.8 + 32.0`},
+			{Name: "unit", Expression: `"°F"`},
+			{Name: "subject", Expression: `subject`},
+		}}))
+	})
+	// extracting the fields declaratively, without conversion of the value
+	b.Run("mapping", func(b *testing.B) {
+		benchmarkConverter(b, newMappingConverter(b, &Mapping{Columns: []MappingColumn{
+			{Name: "sensor", Path: "sensor"},
+			{Name: "value", Path: "value", Type: MappingNumber},
+		}}))
+	})
+}
@@ -0,0 +1,353 @@
+package convert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Expressions convert messages by Common Expression Language (CEL) expressions instead of a JS script, see
+// NewExpressionConverter. They are evaluated in Go, without a JS runtime - which makes them a lot cheaper for high-volume
+// subscriptions.
+//
+// The expressions can access the following variables:
+//
+//   - data is the decoded JSON payload of the message - or the payload as string, if it is no JSON. All JSON
+//     numbers are doubles, so f.e. `data.value * 1.8 + 32.0`.
+//   - subject is the subject of the message.
+//   - headers are the headers of the message, with the first value of each header.
+//
+// Besides the CEL standard library, the string extensions (f.e. `subject.split(".")`) are available.
+type Expressions struct {
+	// Filter discards all messages for which it is false; all messages are kept if it is empty.
+	Filter string
+	// Columns are the fields of the resulting frame (a single row per message), in this order. If there are no
+	// columns, data is converted like the result of a script.
+	Columns []ExpressionColumn
+}
+
+// ExpressionColumn is a field of the frame converted by Expressions.
+type ExpressionColumn struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// ExpressionError is returned if an expression is invalid, or fails for a message.
+type ExpressionError struct {
+	// Column is the name of the failed column; empty for the filter.
+	Column  string
+	Message string
+}
+
+func (e *ExpressionError) Error() string {
+	if e.Column == "" {
+		return "filter expression: " + e.Message
+	}
+	return fmt.Sprintf("expression of column %s: %s", e.Column, e.Message)
+}
+
+// ErrMessageDiscarded is returned by a Converter if the message was discarded by the filter of Expressions.
+var ErrMessageDiscarded = errors.New("message was discarded by the filter expression")
+
+// expressionConverter converts messages via expressions, see NewExpressionConverter.
+type expressionConverter struct {
+	expressions *Expressions
+	compiled    *compiledExpressions
+	o           Options
+
+	mu sync.Mutex
+	// columnTypes are the field types of the columns whose checked type is dyn, by column name; see columnType.
+	columnTypes map[string]*cel.Type
+}
+
+// NewExpressionConverter returns the converter which converts messages via the given expressions. The time limit
+// applies to each message. The expressions are compiled here, so invalid expressions are returned as
+// *ExpressionError.
+//
+// The field types of the columns are kept for all messages of the converter - so a query should use a single
+// converter for all of its messages.
+func NewExpressionConverter(expressions *Expressions, o Options) (Converter, error) {
+	compiled, err := expressions.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &expressionConverter{expressions: expressions, compiled: compiled, o: o, columnTypes: map[string]*cel.Type{}}, nil
+}
+
+// celEnv declares the variables of Expressions.
+var celEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("data", cel.DynType),
+		cel.Variable("subject", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// compiledExpression is a checked expression, ready to be evaluated.
+type compiledExpression struct {
+	program    cel.Program
+	outputType *cel.Type
+}
+
+// compiledExpressions are the compiled Expressions; filter is nil if there is none.
+type compiledExpressions struct {
+	filter  *compiledExpression
+	columns []*compiledExpression
+}
+
+// expressionCache contains the compiled expressions by the hash of their sources.
+var expressionCache = ttlcache.New[string, *compiledExpressions](
+	ttlcache.WithCapacity[string, *compiledExpressions](cacheSize),
+)
+
+// Check compiles all expressions, and returns the first error as *ExpressionError.
+func (e *Expressions) Check() error {
+	_, err := e.compile()
+	return err
+}
+
+// compile returns the compiled expressions, from expressionCache if possible.
+func (e *Expressions) compile() (*compiledExpressions, error) {
+	key, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(hash[:])
+	if item := expressionCache.Get(cacheKey); item != nil {
+		return item.Value(), nil
+	}
+
+	compiled := &compiledExpressions{}
+	if strings.TrimSpace(e.Filter) != "" {
+		compiled.filter, err = compileExpression(e.Filter)
+		if err != nil {
+			return nil, &ExpressionError{Message: err.Error()}
+		}
+		if outputType := compiled.filter.outputType; outputType.Kind() != types.BoolKind && outputType.Kind() != types.DynKind {
+			return nil, &ExpressionError{Message: fmt.Sprintf("must be a bool, but is a %s", outputType)}
+		}
+	}
+	names := map[string]bool{}
+	for i, column := range e.Columns {
+		if column.Name == "" {
+			return nil, &ExpressionError{Column: fmt.Sprintf("#%d", i+1), Message: "the column has no name"}
+		}
+		if names[column.Name] {
+			return nil, &ExpressionError{Column: column.Name, Message: "the column is defined twice"}
+		}
+		names[column.Name] = true
+		expression, err := compileExpression(column.Expression)
+		if err != nil {
+			return nil, &ExpressionError{Column: column.Name, Message: err.Error()}
+		}
+		compiled.columns = append(compiled.columns, expression)
+	}
+	expressionCache.Set(cacheKey, compiled, ttlcache.NoTTL)
+	return compiled, nil
+}
+
+func compileExpression(source string) (*compiledExpression, error) {
+	ast, issues := celEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	// the interrupt check makes the time limit apply to comprehensions (f.e. all(), map()).
+	program, err := celEnv.Program(ast, cel.EvalOptions(cel.OptOptimize), cel.InterruptCheckFrequency(100))
+	if err != nil {
+		return nil, err
+	}
+	return &compiledExpression{program: program, outputType: ast.OutputType()}, nil
+}
+
+// Convert converts the given message to a single frame, see Expressions. If the message does not match the filter,
+// ErrMessageDiscarded is returned.
+func (c *expressionConverter) Convert(ctx context.Context, msg *nats.Msg) (data.Frames, error) {
+	e, compiled, o := c.expressions, c.compiled, c.o
+	if o.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Limits.Timeout)
+		defer cancel()
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		payload = string(msg.Data)
+	}
+	headers := map[string]string{}
+	for key := range msg.Header {
+		headers[key] = msg.Header.Get(key)
+	}
+	vars := map[string]interface{}{
+		"data":    payload,
+		"subject": msg.Subject,
+		"headers": headers,
+	}
+
+	if compiled.filter != nil {
+		result, err := compiled.filter.eval(ctx, vars, o.Limits, "")
+		if err != nil {
+			return nil, err
+		}
+		keep, ok := result.(types.Bool)
+		if !ok {
+			return nil, &ExpressionError{Message: fmt.Sprintf("must be a bool, but is a %s", result.Type().TypeName())}
+		}
+		if !keep {
+			return nil, ErrMessageDiscarded
+		}
+	}
+
+	if len(compiled.columns) == 0 {
+		return goja.ConvertResults(payload, o.Arrays)
+	}
+	frame := data.NewFrame("result")
+	for i, column := range e.Columns {
+		result, err := compiled.columns[i].eval(ctx, vars, o.Limits, column.Name)
+		if err != nil {
+			return nil, err
+		}
+		field, err := expressionField(column.Name, c.columnType(column.Name, compiled.columns[i].outputType, result), result)
+		if err != nil {
+			return nil, &ExpressionError{Column: column.Name, Message: err.Error()}
+		}
+		frame.Fields = append(frame.Fields, field)
+	}
+	return data.Frames{frame}, nil
+}
+
+// eval evaluates the expression of the given column (empty for the filter). Errors are returned as *ExpressionError;
+// exceeding the time limit as *LimitError, like for scripts.
+func (c *compiledExpression) eval(ctx context.Context, vars map[string]interface{}, limits goja.Limits, column string) (ref.Val, error) {
+	result, _, err := c.program.ContextEval(ctx, vars)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, &goja.LimitError{Reason: fmt.Sprintf("exceeded the time limit of %s", limits.Timeout)}
+	case ctx.Err() != nil:
+		return nil, &goja.LimitError{Reason: "the query was cancelled"}
+	case err != nil:
+		return nil, &ExpressionError{Column: column, Message: err.Error()}
+	}
+	return result, nil
+}
+
+// columnType returns the field type of a column: the type of the checked expression - or, if that is dyn (f.e. for
+// `data.temperature`), the type of the first value which is not null. This way, the field type is the same for all
+// messages; values of other types are converted to it, see expressionField.
+func (c *expressionConverter) columnType(column string, outputType *cel.Type, value ref.Val) *cel.Type {
+	if outputType.Kind() != types.DynKind {
+		return outputType
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if columnType, ok := c.columnTypes[column]; ok {
+		return columnType
+	}
+	valueType, ok := value.Type().(*types.Type)
+	if !ok || value.Type() == types.NullType {
+		return outputType
+	}
+	c.columnTypes[column] = valueType
+	return valueType
+}
+
+// expressionField returns a single-value field of the given type with the result of a column expression. All fields
+// are nullable, so that the field type does not change if a message lacks a value. Values of another type are
+// converted (f.e. 1 to 1.0 for a double field); lists, maps and other values become JSON.
+func expressionField(name string, fieldType *cel.Type, value ref.Val) (*data.Field, error) {
+	if value.Type() != types.NullType && value.Type() != fieldType && isScalar(fieldType) {
+		converted := value.ConvertToType(fieldType)
+		if types.IsError(converted) {
+			return nil, fmt.Errorf("the value is a %s, but the column is a %s", value.Type().TypeName(), fieldType.TypeName())
+		}
+		value = converted
+	}
+	switch fieldType.Kind() {
+	case types.BoolKind:
+		return data.NewField(name, nil, []*bool{nativeValue[bool](value)}), nil
+	case types.IntKind:
+		return data.NewField(name, nil, []*int64{nativeValue[int64](value)}), nil
+	case types.UintKind:
+		return data.NewField(name, nil, []*uint64{nativeValue[uint64](value)}), nil
+	case types.DoubleKind:
+		return data.NewField(name, nil, []*float64{nativeValue[float64](value)}), nil
+	case types.TimestampKind:
+		return data.NewField(name, nil, []*time.Time{nativeValue[time.Time](value)}), nil
+	case types.StringKind:
+		return data.NewField(name, nil, []*string{nativeValue[string](value)}), nil
+	case types.BytesKind:
+		var s *string
+		if b := nativeValue[[]byte](value); b != nil {
+			s = stringPtr(string(*b))
+		}
+		return data.NewField(name, nil, []*string{s}), nil
+	case types.DurationKind:
+		var s *string
+		if d := nativeValue[time.Duration](value); d != nil {
+			s = stringPtr(d.String())
+		}
+		return data.NewField(name, nil, []*string{s}), nil
+	}
+	if value.Type() == types.NullType {
+		return data.NewField(name, nil, []*string{nil}), nil
+	}
+	// lists, maps and other values: as JSON
+	native, err := value.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(native.(*structpb.Value).AsInterface())
+	if err != nil {
+		return nil, err
+	}
+	return data.NewField(name, nil, []*string{stringPtr(string(encoded))}), nil
+}
+
+// isScalar returns whether expressionField converts values of the given type to a field of this type.
+func isScalar(t *cel.Type) bool {
+	switch t.Kind() {
+	case types.BoolKind, types.IntKind, types.UintKind, types.DoubleKind, types.TimestampKind, types.StringKind, types.BytesKind, types.DurationKind:
+		return true
+	}
+	return false
+}
+
+// nativeValue returns the Go value of value, or nil if it is null.
+func nativeValue[T any](value ref.Val) *T {
+	if value.Type() == types.NullType {
+		return nil
+	}
+	native, err := value.ConvertToNative(reflect.TypeOf(*new(T)))
+	if err != nil {
+		return nil
+	}
+	v := native.(T)
+	return &v
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
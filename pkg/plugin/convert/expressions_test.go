@@ -0,0 +1,177 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+func TestExpressions(t *testing.T) {
+	expressions := &Expressions{
+		Filter: `data.temperature > 20 && subject.startsWith("plc.")`,
+		Columns: []ExpressionColumn{
+			{Name: "plc", Expression: `subject.split(".")[1]`},
+			{Name: "fahrenheit", Expression: `data.temperature * 1.8 + 32.0`},
+			{Name: "unit", Expression: `headers.Unit`},
+			{Name: "alarm", Expression: `data.temperature > 30`},
+			{Name: "sensors", Expression: `data.sensors`},
+			{Name: "humidity", Expression: `has(data.humidity) ? data.humidity : null`},
+			{Name: "count", Expression: `size(data.sensors)`},
+		},
+	}
+	msg := &nats.Msg{
+		Subject: "plc.1",
+		Data:    []byte(`{"temperature": 25, "sensors": ["s1", "s2"]}`),
+		Header:  nats.Header{"Unit": []string{"celsius"}},
+	}
+	frames, err := newExpressionConverter(t, expressions).Convert(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Rows() != 1 {
+		t.Fatalf("expected a frame with a single row, got %v", frames)
+	}
+	frame := frames[0]
+	expected := []struct {
+		name      string
+		fieldType data.FieldType
+		value     interface{}
+	}{
+		{"plc", data.FieldTypeNullableString, "1"},
+		{"fahrenheit", data.FieldTypeNullableFloat64, 77.0},
+		{"unit", data.FieldTypeNullableString, "celsius"},
+		{"alarm", data.FieldTypeNullableBool, false},
+		{"sensors", data.FieldTypeNullableString, `["s1","s2"]`},
+		{"humidity", data.FieldTypeNullableString, nil},
+		{"count", data.FieldTypeNullableInt64, int64(2)},
+	}
+	if len(frame.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(frame.Fields))
+	}
+	for i, e := range expected {
+		field := frame.Fields[i]
+		if field.Name != e.name || field.Type() != e.fieldType {
+			t.Errorf("field %d: expected %s of type %s, got %s of type %s", i, e.name, e.fieldType, field.Name, field.Type())
+			continue
+		}
+		value, ok := field.ConcreteAt(0)
+		if (e.value == nil && ok) || (e.value != nil && value != e.value) {
+			t.Errorf("field %s: expected %v, got %v", e.name, e.value, value)
+		}
+	}
+
+	_, err = newExpressionConverter(t, expressions).Convert(context.Background(), &nats.Msg{Subject: "plc.1", Data: []byte(`{"temperature": 15}`)})
+	if !errors.Is(err, ErrMessageDiscarded) {
+		t.Errorf("expected the message to be discarded, got: %v", err)
+	}
+}
+
+func TestExpressionsWithoutColumns(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`[{"temperature": 21.5}, {"temperature": 22.5}]`)}
+	frames, err := newExpressionConverter(t, &Expressions{Filter: `size(data) > 1`}).Convert(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Rows() != 2 {
+		t.Errorf("expected the payload as frame with 2 rows, got %v", frames)
+	}
+
+	// no JSON: data is the payload as string
+	frames, err = newExpressionConverter(t, &Expressions{Columns: []ExpressionColumn{{Name: "state", Expression: `data == "on"`}}}).
+		Convert(context.Background(), &nats.Msg{Data: []byte(`on`)})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if value, _ := frames[0].Fields[0].ConcreteAt(0); value != true {
+		t.Errorf("expected the payload as string, got %v", value)
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		expressions Expressions
+		column      string
+	}{
+		{"syntax error in filter", Expressions{Filter: `data.temperature >`}, ""},
+		{"filter is no bool", Expressions{Filter: `subject + "x"`}, ""},
+		{"unknown variable", Expressions{Columns: []ExpressionColumn{{Name: "a", Expression: `msg.data`}}}, "a"},
+		{"column without name", Expressions{Columns: []ExpressionColumn{{Expression: `subject`}}}, "#1"},
+		{"duplicate column", Expressions{Columns: []ExpressionColumn{{Name: "a", Expression: `1`}, {Name: "a", Expression: `2`}}}, "a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.expressions.Check()
+			var expressionErr *ExpressionError
+			if !errors.As(err, &expressionErr) || expressionErr.Column != tc.column {
+				t.Errorf("expected an expression error for column %q, got: %v", tc.column, err)
+			}
+			// invalid expressions fail before the first message
+			if _, err := NewExpressionConverter(&tc.expressions, Options{}); !errors.As(err, &expressionErr) {
+				t.Errorf("expected the converter to fail with an expression error, got: %v", err)
+			}
+		})
+	}
+
+	// errors at runtime, f.e. a missing key
+	_, err := newExpressionConverter(t, &Expressions{Columns: []ExpressionColumn{{Name: "t", Expression: `data.temperature`}}}).
+		Convert(context.Background(), &nats.Msg{Data: []byte(`{}`)})
+	var expressionErr *ExpressionError
+	if !errors.As(err, &expressionErr) || expressionErr.Column != "t" {
+		t.Errorf("expected an expression error for column t, got: %v", err)
+	}
+	_, err = newExpressionConverter(t, &Expressions{Filter: `data`}).
+		Convert(context.Background(), &nats.Msg{Data: []byte(`"on"`)})
+	if !errors.As(err, &expressionErr) || expressionErr.Error() != "filter expression: must be a bool, but is a string" {
+		t.Errorf("expected the filter to fail for a string, got: %v", err)
+	}
+}
+
+func TestExpressionTypesAreStable(t *testing.T) {
+	converter := newExpressionConverter(t, &Expressions{Columns: []ExpressionColumn{{Name: "value", Expression: `data.value`}}})
+	for _, tc := range []struct {
+		data  string
+		value interface{}
+	}{
+		{`{"value": null}`, nil},
+		// the type of a dyn column is taken from the first value which is not null...
+		{`{"value": 21.5}`, 21.5},
+		// ...and later values are converted to it.
+		{`{"value": "22"}`, 22.0},
+		{`{"value": null}`, nil},
+	} {
+		frames, err := converter.Convert(context.Background(), &nats.Msg{Data: []byte(tc.data)})
+		if err != nil {
+			t.Fatalf("%s: conversion failed: %s", tc.data, err)
+		}
+		field := frames[0].Fields[0]
+		value, ok := field.ConcreteAt(0)
+		if tc.value == nil {
+			if ok {
+				t.Errorf("%s: expected null, got %v", tc.data, value)
+			}
+			continue
+		}
+		if field.Type() != data.FieldTypeNullableFloat64 || value != tc.value {
+			t.Errorf("%s: expected the float64 %v, got the %s %v", tc.data, tc.value, field.Type(), value)
+		}
+	}
+
+	_, err := converter.Convert(context.Background(), &nats.Msg{Data: []byte(`{"value": [1]}`)})
+	var expressionErr *ExpressionError
+	if !errors.As(err, &expressionErr) || expressionErr.Column != "value" {
+		t.Errorf("expected an expression error for a list in a double column, got: %v", err)
+	}
+}
+
+// newExpressionConverter returns the converter of the given expressions, which must be valid.
+func newExpressionConverter(tb testing.TB, expressions *Expressions) Converter {
+	tb.Helper()
+	converter, err := NewExpressionConverter(expressions, Options{})
+	if err != nil {
+		tb.Fatalf("invalid expressions: %s", err)
+	}
+	return converter
+}
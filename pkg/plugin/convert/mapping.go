@@ -0,0 +1,344 @@
+package convert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/jmespath/go-jmespath"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+)
+
+// Mapping converts messages declaratively by JMESPath expressions instead of a JS script, see NewMappingConverter - so that
+// panels can be built without programming, and without the cost of a JS runtime per message.
+//
+// The JSON payload is split into rows by the Rows selector; each column then extracts its value from a row:
+//
+//	Rows: "sensors[?active]"
+//	Columns: [{Name: "id", Path: "id", Type: "string"}, {Name: "temperature", Path: "values[0].celsius", Type: "number"}]
+type Mapping struct {
+	// Rows selects the rows from the payload: an array results in a row per element, null in no rows, and any other
+	// value in a single row. If empty, the payload itself is used.
+	Rows string `json:"rows"`
+	// Columns are the fields of the resulting frame, in this order. If there are no columns, the rows are converted
+	// like the result of a script.
+	Columns []MappingColumn `json:"columns"`
+}
+
+// MappingColumn is a field of the frame converted by Mapping.
+type MappingColumn struct {
+	Name string `json:"name"`
+	// Path is the JMESPath expression of the value, relative to the row (f.e. `a.b[0].c`; `@` is the row itself).
+	Path string      `json:"path"`
+	Type MappingType `json:"type"`
+	// Default is used if the value is null or missing; it is given as text, f.e. "0" for a number. Without default,
+	// the field is null.
+	Default *string `json:"default"`
+}
+
+// MappingType is the type of a MappingColumn; values are converted to it (f.e. strings to numbers).
+type MappingType string
+
+const (
+	// MappingString columns convert numbers and booleans to text, and other values to JSON. This is the default.
+	MappingString MappingType = "string"
+	MappingNumber MappingType = "number"
+	// MappingInteger columns reject numbers with a fraction.
+	MappingInteger MappingType = "integer"
+	MappingBoolean MappingType = "boolean"
+	// MappingTime columns accept RFC 3339 strings, and numbers as milliseconds since the epoch.
+	MappingTime MappingType = "time"
+	// MappingJson columns contain the value as JSON.
+	MappingJson MappingType = "json"
+)
+
+// MappingError is returned if a mapping is invalid, or cannot convert a message.
+type MappingError struct {
+	// Column is the name of the failed column; empty for the rows selector.
+	Column  string
+	Message string
+}
+
+func (e *MappingError) Error() string {
+	if e.Column == "" {
+		return "rows selector: " + e.Message
+	}
+	return fmt.Sprintf("mapping of column %s: %s", e.Column, e.Message)
+}
+
+// mappingConverter converts messages via a mapping, see NewMappingConverter.
+type mappingConverter struct {
+	mapping *compiledMapping
+	o       Options
+}
+
+// NewMappingConverter returns the converter which converts messages via the given mapping. The mapping is compiled
+// here, so an invalid mapping is returned as *MappingError.
+func NewMappingConverter(mapping *Mapping, o Options) (Converter, error) {
+	compiled, err := mapping.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &mappingConverter{mapping: compiled, o: o}, nil
+}
+
+func (c *mappingConverter) Convert(_ context.Context, msg *nats.Msg) (data.Frames, error) {
+	return c.mapping.convert(msg, c.o)
+}
+
+// compiledMapping is the compiled Mapping; rows is nil if the payload itself is used.
+type compiledMapping struct {
+	rows    *jmespath.JMESPath
+	columns []compiledMappingColumn
+}
+
+type compiledMappingColumn struct {
+	MappingColumn
+	path *jmespath.JMESPath
+	// defaultValue is the converted Default; nil if there is none.
+	defaultValue interface{}
+}
+
+// mappingCache contains the compiled mappings by the hash of their definition, like expressionCache.
+var mappingCache = ttlcache.New[string, *compiledMapping](
+	ttlcache.WithCapacity[string, *compiledMapping](cacheSize),
+)
+
+// Check compiles the mapping, and returns the first error as *MappingError.
+func (m *Mapping) Check() error {
+	_, err := m.compile()
+	return err
+}
+
+// compile returns the compiled mapping, from mappingCache if possible.
+func (m *Mapping) compile() (*compiledMapping, error) {
+	key, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(hash[:])
+	if item := mappingCache.Get(cacheKey); item != nil {
+		return item.Value(), nil
+	}
+
+	compiled := &compiledMapping{}
+	if m.Rows != "" {
+		compiled.rows, err = jmespath.Compile(m.Rows)
+		if err != nil {
+			return nil, &MappingError{Message: err.Error()}
+		}
+	}
+	names := map[string]bool{}
+	for i, column := range m.Columns {
+		if column.Name == "" {
+			return nil, &MappingError{Column: fmt.Sprintf("#%d", i+1), Message: "the column has no name"}
+		}
+		if names[column.Name] {
+			return nil, &MappingError{Column: column.Name, Message: "the column is defined twice"}
+		}
+		names[column.Name] = true
+		if column.Type == "" {
+			column.Type = MappingString
+		}
+		if _, err := column.Type.fieldType(); err != nil {
+			return nil, &MappingError{Column: column.Name, Message: err.Error()}
+		}
+		path, err := jmespath.Compile(column.Path)
+		if err != nil {
+			return nil, &MappingError{Column: column.Name, Message: err.Error()}
+		}
+		c := compiledMappingColumn{MappingColumn: column, path: path}
+		if column.Default != nil {
+			c.defaultValue, err = column.Type.convertDefault(*column.Default)
+			if err != nil {
+				return nil, &MappingError{Column: column.Name, Message: "invalid default: " + err.Error()}
+			}
+		}
+		compiled.columns = append(compiled.columns, c)
+	}
+	mappingCache.Set(cacheKey, compiled, ttlcache.NoTTL)
+	return compiled, nil
+}
+
+// convert converts the given message to a single frame, see Mapping.
+func (compiled *compiledMapping) convert(msg *nats.Msg, o Options) (data.Frames, error) {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return nil, fmt.Errorf("the message is no JSON: %w", err)
+	}
+
+	var err error
+	selected := payload
+	if compiled.rows != nil {
+		selected, err = compiled.rows.Search(payload)
+		if err != nil {
+			return nil, &MappingError{Message: err.Error()}
+		}
+	}
+	var rows []interface{}
+	switch value := selected.(type) {
+	case []interface{}:
+		rows = value
+	case nil:
+	default:
+		rows = []interface{}{value}
+	}
+
+	if len(compiled.columns) == 0 && len(rows) > 0 {
+		// like the result of a script
+		return goja.ConvertResults(rows, o.Arrays)
+	}
+	frame := data.NewFrame("result")
+	for _, column := range compiled.columns {
+		fieldType, _ := column.Type.fieldType()
+		field := data.NewFieldFromFieldType(fieldType, len(rows))
+		field.Name = column.Name
+		for i, row := range rows {
+			value, err := column.path.Search(row)
+			if err != nil {
+				return nil, &MappingError{Column: column.Name, Message: err.Error()}
+			}
+			converted := column.defaultValue
+			if value != nil {
+				converted, err = column.Type.convert(value)
+				if err != nil {
+					return nil, &MappingError{Column: column.Name, Message: fmt.Sprintf("row %d: %s", i, err)}
+				}
+			}
+			if converted != nil {
+				field.Set(i, converted)
+			}
+		}
+		frame.Fields = append(frame.Fields, field)
+	}
+	return data.Frames{frame}, nil
+}
+
+// fieldType returns the (nullable) field type of columns of type t.
+func (t MappingType) fieldType() (data.FieldType, error) {
+	switch t {
+	case MappingString, MappingJson:
+		return data.FieldTypeNullableString, nil
+	case MappingNumber:
+		return data.FieldTypeNullableFloat64, nil
+	case MappingInteger:
+		return data.FieldTypeNullableInt64, nil
+	case MappingBoolean:
+		return data.FieldTypeNullableBool, nil
+	case MappingTime:
+		return data.FieldTypeNullableTime, nil
+	}
+	return data.FieldTypeUnknown, fmt.Errorf("unknown type %q", t)
+}
+
+// convertDefault converts the text of a default value to t; for MappingJson, the text must be JSON.
+func (t MappingType) convertDefault(text string) (interface{}, error) {
+	if t == MappingJson {
+		if !json.Valid([]byte(text)) {
+			return nil, fmt.Errorf("%q is no JSON", text)
+		}
+		return &text, nil
+	}
+	return t.convert(text)
+}
+
+// convert converts a value decoded from JSON to a pointer to the Go type of t's field type.
+func (t MappingType) convert(value interface{}) (interface{}, error) {
+	switch t {
+	case MappingString:
+		switch v := value.(type) {
+		case string:
+			return &v, nil
+		case float64:
+			s := strconv.FormatFloat(v, 'f', -1, 64)
+			return &s, nil
+		case bool:
+			s := strconv.FormatBool(v)
+			return &s, nil
+		}
+		return MappingJson.convert(value)
+	case MappingJson:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		s := string(encoded)
+		return &s, nil
+	case MappingNumber:
+		switch v := value.(type) {
+		case float64:
+			return &v, nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is no number", v)
+			}
+			return &f, nil
+		}
+	case MappingInteger:
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) || math.Abs(v) > math.MaxInt64 {
+				return nil, fmt.Errorf("%v is no integer", v)
+			}
+			i := int64(v)
+			return &i, nil
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is no integer", v)
+			}
+			return &i, nil
+		}
+	case MappingBoolean:
+		switch v := value.(type) {
+		case bool:
+			return &v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%q is no boolean", v)
+			}
+			return &b, nil
+		}
+	case MappingTime:
+		switch v := value.(type) {
+		case float64:
+			ts := time.UnixMilli(int64(v)).UTC()
+			return &ts, nil
+		case string:
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("%q is no RFC 3339 time", v)
+			}
+			return &ts, nil
+		}
+	}
+	return nil, fmt.Errorf("%s cannot be converted to %s", jsonKind(value), t)
+}
+
+// jsonKind names the JSON type of a decoded value, for error messages.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
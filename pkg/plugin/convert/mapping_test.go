@@ -0,0 +1,151 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+func TestMapping(t *testing.T) {
+	zero := "0"
+	mapping := &Mapping{
+		Rows: "plc.sensors[?active]",
+		Columns: []MappingColumn{
+			{Name: "id", Path: "id"},
+			{Name: "temperature", Path: "values[0].celsius", Type: MappingNumber},
+			{Name: "errors", Path: "errors", Type: MappingInteger, Default: &zero},
+			{Name: "ok", Path: "ok", Type: MappingBoolean},
+			{Name: "time", Path: "ts", Type: MappingTime},
+			{Name: "values", Path: "values", Type: MappingJson},
+		},
+	}
+	msg := &nats.Msg{Data: []byte(`{"plc": {"sensors": [
+		{"id": 1, "active": true, "values": [{"celsius": 21.5}], "errors": 2, "ok": "true", "ts": "2023-06-01T10:00:00Z"},
+		{"id": "s2", "active": false},
+		{"id": "s3", "active": true, "values": [{"celsius": "22.5"}], "ts": 1685613600000}
+	]}}`)}
+	frames, err := newMappingConverter(t, mapping).Convert(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Rows() != 2 {
+		t.Fatalf("expected a frame with the 2 active sensors, got %v", frames)
+	}
+	ts := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	expected := []struct {
+		fieldType data.FieldType
+		values    []interface{}
+	}{
+		{data.FieldTypeNullableString, []interface{}{"1", "s3"}},
+		{data.FieldTypeNullableFloat64, []interface{}{21.5, 22.5}},
+		{data.FieldTypeNullableInt64, []interface{}{int64(2), int64(0)}},
+		{data.FieldTypeNullableBool, []interface{}{true, nil}},
+		{data.FieldTypeNullableTime, []interface{}{ts, ts}},
+		{data.FieldTypeNullableString, []interface{}{`[{"celsius":21.5}]`, `[{"celsius":"22.5"}]`}},
+	}
+	for i, e := range expected {
+		field := frames[0].Fields[i]
+		if field.Type() != e.fieldType {
+			t.Errorf("field %s: expected type %s, got %s", field.Name, e.fieldType, field.Type())
+			continue
+		}
+		for row, expectedValue := range e.values {
+			value, ok := field.ConcreteAt(row)
+			if (expectedValue == nil && ok) || (expectedValue != nil && value != expectedValue) {
+				t.Errorf("field %s, row %d: expected %v, got %v", field.Name, row, expectedValue, value)
+			}
+		}
+	}
+}
+
+func TestMappingRows(t *testing.T) {
+	tests := []struct {
+		name         string
+		rows         string
+		data         string
+		expectedRows int
+	}{
+		{"payload array", "", `[{"a": 1}, {"a": 2}]`, 2},
+		{"payload object", "", `{"a": 1}`, 1},
+		{"missing rows", "items", `{"a": 1}`, 0},
+		{"selected object", "item", `{"item": {"a": 1}}`, 1},
+		{"projection", "items[*].inner", `{"items": [{"inner": {"a": 1}}, {"inner": {"a": 2}}]}`, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mapping := &Mapping{Rows: tc.rows, Columns: []MappingColumn{{Name: "a", Path: "a", Type: MappingNumber}}}
+			frames, err := newMappingConverter(t, mapping).Convert(context.Background(), &nats.Msg{Data: []byte(tc.data)})
+			if err != nil {
+				t.Fatalf("conversion failed: %s", err)
+			}
+			if frames[0].Rows() != tc.expectedRows {
+				t.Errorf("expected %d rows, got %d", tc.expectedRows, frames[0].Rows())
+			}
+		})
+	}
+
+	// without columns, the rows are converted like the result of a script
+	frames, err := newMappingConverter(t, &Mapping{Rows: "items"}).Convert(context.Background(), &nats.Msg{Data: []byte(`{"items": [{"a": 1}, {"a": 2}]}`)})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if frames[0].Rows() != 2 || frames[0].Fields[0].Name != "a" {
+		t.Errorf("expected the rows as they are, got %v", frames[0])
+	}
+}
+
+func TestMappingErrors(t *testing.T) {
+	invalid := "warm"
+	for _, tc := range []struct {
+		name    string
+		mapping Mapping
+		column  string
+	}{
+		{"invalid rows selector", Mapping{Rows: "items[?"}, ""},
+		{"invalid path", Mapping{Columns: []MappingColumn{{Name: "a", Path: "a.["}}}, "a"},
+		{"unknown type", Mapping{Columns: []MappingColumn{{Name: "a", Path: "a", Type: "decimal"}}}, "a"},
+		{"invalid default", Mapping{Columns: []MappingColumn{{Name: "a", Path: "a", Type: MappingNumber, Default: &invalid}}}, "a"},
+		{"column without name", Mapping{Columns: []MappingColumn{{Path: "a"}}}, "#1"},
+		{"duplicate column", Mapping{Columns: []MappingColumn{{Name: "a", Path: "a"}, {Name: "a", Path: "b"}}}, "a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.mapping.Check()
+			var mappingErr *MappingError
+			if !errors.As(err, &mappingErr) || mappingErr.Column != tc.column {
+				t.Errorf("expected a mapping error for column %q, got: %v", tc.column, err)
+			}
+			// an invalid mapping fails before the first message
+			if _, err := NewMappingConverter(&tc.mapping, Options{}); !errors.As(err, &mappingErr) {
+				t.Errorf("expected the converter to fail with a mapping error, got: %v", err)
+			}
+		})
+	}
+
+	mapping := &Mapping{Columns: []MappingColumn{{Name: "count", Path: "count", Type: MappingInteger}}}
+	_, err := newMappingConverter(t, mapping).Convert(context.Background(), &nats.Msg{Data: []byte(`[{"count": 1}, {"count": 1.5}]`)})
+	if err == nil || err.Error() != "mapping of column count: row 1: 1.5 is no integer" {
+		t.Errorf("expected a conversion error, got: %v", err)
+	}
+	_, err = newMappingConverter(t, mapping).Convert(context.Background(), &nats.Msg{Data: []byte(`{"count": [1]}`)})
+	if err == nil || err.Error() != "mapping of column count: row 0: an array cannot be converted to integer" {
+		t.Errorf("expected a conversion error, got: %v", err)
+	}
+	_, err = newMappingConverter(t, mapping).Convert(context.Background(), &nats.Msg{Data: []byte(`no json`)})
+	if err == nil {
+		t.Errorf("expected an error for a message which is no JSON")
+	}
+}
+
+// newMappingConverter returns the converter of the given mapping, which must be valid.
+func newMappingConverter(tb testing.TB, mapping *Mapping) Converter {
+	tb.Helper()
+	converter, err := NewMappingConverter(mapping, Options{})
+	if err != nil {
+		tb.Fatalf("invalid mapping: %s", err)
+	}
+	return converter
+}
@@ -0,0 +1,397 @@
+package convert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"golang.org/x/sync/singleflight"
+)
+
+// WasmTransform is a WebAssembly module which converts messages instead of a JS script, see NewWasmConverter. It is run
+// by wazero (pure Go, no cgo), with WASI available - so f.e. Rust (wasm32-wasi) and Go (wasip1) modules work.
+//
+// The module must export:
+//
+//   - memory
+//   - alloc(size: i32) -> i32, which returns a pointer to size bytes, where the host writes the input
+//   - transform(dataPtr: i32, dataLen: i32, metaPtr: i32, metaLen: i32) -> i64, which converts the message:
+//     data is the message data as is; meta is JSON {"subject": "...", "reply": "...", "headers": {"k": ["v"]}}.
+//     The result is the pointer (upper 32 bits) and length (lower 32 bits) of the rows as JSON - like the result of
+//     a script: an object, an array of objects, or {"name": rows} for multiple frames.
+//
+// The module may import the following functions from "env":
+//
+//   - log(ptr: i32, len: i32) logs the given UTF-8 string; it is shown as notice on the frame (see goja.Logs).
+//   - fail(ptr: i32, len: i32) stops the transform with the given error message.
+//
+// The module is instantiated for every message (calling _initialize, if it is exported), so no state is kept
+// between messages.
+type WasmTransform struct {
+	// Name of the module in the data source settings, for error messages.
+	Name   string
+	Binary []byte
+	// hash identifies the binary in wasmModuleCache.
+	hash string
+}
+
+// NewWasmTransform returns the transform of the given module. The binary is only hashed here, not for every message.
+func NewWasmTransform(name string, binary []byte) *WasmTransform {
+	hash := sha256.Sum256(binary)
+	return &WasmTransform{Name: name, Binary: binary, hash: hex.EncodeToString(hash[:])}
+}
+
+// wasmConverter converts messages via a WebAssembly module, see NewWasmConverter.
+type wasmConverter struct {
+	transform *WasmTransform
+	o         Options
+}
+
+// NewWasmConverter returns the converter which converts messages via the given WebAssembly module. The limits apply
+// as well: the time limit to each message, and the memory limit to the memory of the module.
+func NewWasmConverter(transform *WasmTransform, o Options) Converter {
+	return &wasmConverter{transform: transform, o: o}
+}
+
+func (c *wasmConverter) Convert(ctx context.Context, msg *nats.Msg) (data.Frames, error) {
+	return c.transform.convert(ctx, msg, c.o)
+}
+
+// wasmPageSize is the size of a WebAssembly memory page.
+const wasmPageSize = 64 * 1024
+
+// wasmMaxPages is the maximum memory of a (32 bit) WebAssembly module, in pages.
+const wasmMaxPages = 65536
+
+// wasmRuntimes are the wazero runtimes by their memory limit (in pages; 0 for unlimited) - the memory limit is
+// configured per runtime. Each has WASI and the "env" functions of WasmTransform instantiated. The limits are rounded
+// up to powers of two (see wasmRuntimePages), so that there are at most 18 runtimes.
+var (
+	wasmRuntimesMu sync.Mutex
+	wasmRuntimes   = map[uint32]wazero.Runtime{}
+)
+
+// wasmModuleCache contains the compiled modules by memory limit and hash, so that modules are only compiled once.
+var wasmModuleCache = ttlcache.New[string, *wasmModule](
+	ttlcache.WithCapacity[string, *wasmModule](100),
+)
+
+// wasmCompilations makes concurrent compilations of the same module (by cache key) wait for a single one.
+var wasmCompilations singleflight.Group
+
+func init() {
+	wasmModuleCache.OnEviction(func(_ context.Context, _ ttlcache.EvictionReason, item *ttlcache.Item[string, *wasmModule]) {
+		item.Value().evict()
+	})
+}
+
+// wasmModule is a compiled module of wasmModuleCache. As it may still be used after it was evicted, it is only
+// closed once it is no longer in use, see acquire and release.
+type wasmModule struct {
+	compiled wazero.CompiledModule
+
+	mu      sync.Mutex
+	refs    int
+	evicted bool
+	closed  bool
+}
+
+// acquire marks the module as in use; it returns false if the module was already closed.
+func (m *wasmModule) acquire() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.refs++
+	return true
+}
+
+// release marks the module as no longer in use by the caller of acquire.
+func (m *wasmModule) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs--
+	m.closeIfUnused()
+}
+
+func (m *wasmModule) evict() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evicted = true
+	m.closeIfUnused()
+}
+
+func (m *wasmModule) closeIfUnused() {
+	if m.evicted && m.refs == 0 && !m.closed {
+		m.closed = true
+		_ = m.compiled.Close(context.Background())
+	}
+}
+
+// wasmCall is the state of a single transform, which the "env" functions access via the context.
+type wasmCall struct {
+	logs    *goja.Logs
+	failure string
+}
+
+type wasmCallKey struct{}
+
+// wasmRuntimePages returns the memory limit of the runtime for the given memory limit (in bytes; 0 for unlimited):
+// the limit in pages, rounded up to a power of two. The exact limit is checked after each call, see checkMemory.
+func wasmRuntimePages(maxMemoryBytes uint64) uint32 {
+	if maxMemoryBytes == 0 {
+		return 0
+	}
+	pages := uint64(1)
+	for pages*wasmPageSize < maxMemoryBytes && pages < wasmMaxPages {
+		pages *= 2
+	}
+	return uint32(pages)
+}
+
+func wasmRuntime(memoryLimitPages uint32) (wazero.Runtime, error) {
+	wasmRuntimesMu.Lock()
+	defer wasmRuntimesMu.Unlock()
+	if r, ok := wasmRuntimes[memoryLimitPages]; ok {
+		return r, nil
+	}
+
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if memoryLimitPages > 0 {
+		config = config.WithMemoryLimitPages(memoryLimitPages)
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		return nil, err
+	}
+	_, err := r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(wasmLog), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil).
+		Export("log").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(wasmFail), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil).
+		Export("fail").
+		Instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wasmRuntimes[memoryLimitPages] = r
+	return r, nil
+}
+
+// wasmString reads the string at the pointer and length on the stack of a host function call.
+func wasmString(m api.Module, stack []uint64) string {
+	bytes, ok := m.Memory().Read(api.DecodeU32(stack[0]), api.DecodeU32(stack[1]))
+	if !ok {
+		return "(out of memory range)"
+	}
+	return string(bytes)
+}
+
+func wasmLog(ctx context.Context, m api.Module, stack []uint64) {
+	if call, ok := ctx.Value(wasmCallKey{}).(*wasmCall); ok {
+		call.logs.Add(data.NoticeSeverityInfo, wasmString(m, stack))
+	}
+}
+
+func wasmFail(ctx context.Context, m api.Module, stack []uint64) {
+	if call, ok := ctx.Value(wasmCallKey{}).(*wasmCall); ok {
+		call.failure = wasmString(m, stack)
+	}
+	// stops the transform; see WasmTransform.error
+	_ = m.CloseWithExitCode(ctx, 1)
+}
+
+// compile returns the compiled module for the given runtime, from wasmModuleCache if possible. The module is
+// acquired; the caller must release it once it is no longer used.
+func (t *WasmTransform) compile(r wazero.Runtime, memoryLimitPages uint32) (*wasmModule, error) {
+	key := fmt.Sprintf("%d:%s", memoryLimitPages, t.hash)
+	for {
+		if item := wasmModuleCache.Get(key); item != nil && item.Value().acquire() {
+			return item.Value(), nil
+		}
+		module, err, _ := wasmCompilations.Do(key, func() (interface{}, error) {
+			// the module may have been compiled since the cache was checked above.
+			previous := wasmModuleCache.Get(key)
+			if previous != nil && previous.Value().acquire() {
+				previous.Value().release()
+				return previous.Value(), nil
+			}
+			compiled, err := r.CompileModule(context.Background(), t.Binary)
+			if err != nil {
+				return nil, fmt.Errorf("wasm module %s could not be compiled: %w", t.Name, err)
+			}
+			module := &wasmModule{compiled: compiled}
+			wasmModuleCache.Set(key, module, ttlcache.NoTTL)
+			// replacing an item is no eviction for the cache, so the displaced module is evicted here.
+			if previous != nil {
+				previous.Value().evict()
+			}
+			return module, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// the module may have been evicted and closed before it is acquired here; then it is looked up again.
+		if module.(*wasmModule).acquire() {
+			return module.(*wasmModule), nil
+		}
+	}
+}
+
+// Check compiles the module, and checks that it has the exports of the ABI (see WasmTransform).
+func (t *WasmTransform) Check() error {
+	r, err := wasmRuntime(0)
+	if err != nil {
+		return err
+	}
+	module, err := t.compile(r, 0)
+	if err != nil {
+		return err
+	}
+	defer module.release()
+	exports := module.compiled.ExportedFunctions()
+	if exports["alloc"] == nil || exports["transform"] == nil || len(module.compiled.ExportedMemories()) == 0 {
+		return fmt.Errorf("wasm module %s must export memory, alloc(size) and transform(dataPtr, dataLen, metaPtr, metaLen)", t.Name)
+	}
+	return nil
+}
+
+// wasmMeta is the meta data of the message passed to transform.
+type wasmMeta struct {
+	Subject string              `json:"subject"`
+	Reply   string              `json:"reply"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// convert converts the given message to frames, see WasmTransform.
+func (t *WasmTransform) convert(ctx context.Context, msg *nats.Msg, o Options) (data.Frames, error) {
+	memoryLimitPages := wasmRuntimePages(o.MaxWasmMemoryBytes)
+	r, err := wasmRuntime(memoryLimitPages)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := t.compile(r, memoryLimitPages)
+	if err != nil {
+		return nil, err
+	}
+	defer compiled.release()
+
+	if o.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Limits.Timeout)
+		defer cancel()
+	}
+	call := &wasmCall{logs: goja.NewLogs(o.ServerLog)}
+	ctx = context.WithValue(ctx, wasmCallKey{}, call)
+
+	// without name, the module can be instantiated multiple times concurrently.
+	module, err := r.InstantiateModule(ctx, compiled.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, t.error(err, call, o.Limits)
+	}
+	defer module.Close(context.Background())
+	alloc := module.ExportedFunction("alloc")
+	transform := module.ExportedFunction("transform")
+	if alloc == nil || transform == nil || module.Memory() == nil {
+		return nil, fmt.Errorf("wasm module %s must export memory, alloc(size) and transform(dataPtr, dataLen, metaPtr, metaLen)", t.Name)
+	}
+	if err := checkMemory(module, o.MaxWasmMemoryBytes); err != nil {
+		return nil, err
+	}
+
+	headers := msg.Header
+	if headers == nil {
+		headers = nats.Header{}
+	}
+	meta, err := json.Marshal(wasmMeta{Subject: msg.Subject, Reply: msg.Reply, Headers: headers})
+	if err != nil {
+		return nil, err
+	}
+	dataPtr, err := t.write(ctx, module, alloc, msg.Data, call, o.Limits)
+	if err != nil {
+		return nil, err
+	}
+	metaPtr, err := t.write(ctx, module, alloc, meta, call, o.Limits)
+	if err != nil {
+		return nil, err
+	}
+	results, err := transform.Call(ctx, dataPtr, uint64(len(msg.Data)), metaPtr, uint64(len(meta)))
+	if err != nil {
+		return nil, t.error(err, call, o.Limits)
+	}
+	if err := checkMemory(module, o.MaxWasmMemoryBytes); err != nil {
+		return nil, err
+	}
+
+	output, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, fmt.Errorf("wasm module %s returned a result out of its memory", t.Name)
+	}
+	var result interface{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("wasm module %s returned invalid JSON: %w", t.Name, err)
+	}
+	frames, err := goja.ConvertResults(result, o.Arrays)
+	if err != nil {
+		return nil, err
+	}
+	call.logs.AttachTo(frames...)
+	return frames, nil
+}
+
+// write copies the given bytes to memory allocated via alloc, and returns the pointer.
+func (t *WasmTransform) write(ctx context.Context, module api.Module, alloc api.Function, bytes []byte, call *wasmCall, limits goja.Limits) (uint64, error) {
+	results, err := alloc.Call(ctx, uint64(len(bytes)))
+	if err != nil {
+		return 0, t.error(err, call, limits)
+	}
+	if !module.Memory().Write(uint32(results[0]), bytes) {
+		return 0, fmt.Errorf("wasm module %s: alloc(%d) returned a pointer out of its memory", t.Name, len(bytes))
+	}
+	return results[0], nil
+}
+
+// checkMemory returns a *goja.LimitError if the memory of the module exceeds the memory limit (rounded up to whole
+// pages) - the runtime only enforces it rounded up to a power of two, see wasmRuntimePages.
+func checkMemory(module api.Module, maxMemoryBytes uint64) error {
+	if maxMemoryBytes == 0 {
+		return nil
+	}
+	maxPages := (maxMemoryBytes + wasmPageSize - 1) / wasmPageSize
+	if uint64(module.Memory().Size()) > maxPages*wasmPageSize {
+		return &goja.LimitError{Reason: fmt.Sprintf("exceeded the memory limit of %d bytes", maxMemoryBytes)}
+	}
+	return nil
+}
+
+// error describes why a call of the module failed; like for scripts, exceeded limits are returned as *LimitError.
+func (t *WasmTransform) error(err error, call *wasmCall, limits goja.Limits) error {
+	if call.failure != "" {
+		return fmt.Errorf("wasm module %s failed: %s", t.Name, call.failure)
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case sys.ExitCodeDeadlineExceeded:
+			return &goja.LimitError{Reason: fmt.Sprintf("exceeded the time limit of %s", limits.Timeout)}
+		case sys.ExitCodeContextCanceled:
+			return &goja.LimitError{Reason: "the query was cancelled"}
+		}
+	}
+	return fmt.Errorf("wasm module %s: %w", t.Name, err)
+}
@@ -0,0 +1,211 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+	"github.com/tetratelabs/wazero"
+)
+
+// testWasmModule encodes a minimal WebAssembly module with the ABI of WasmTransform: it imports env.log and
+// env.fail, and exports memory, alloc (a bump allocator starting at 1024) and transform with the given body
+// (including its end). data is placed at address 0.
+func testWasmModule(memoryPages byte, transformBody []byte, data string) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append(append([]byte{id}, leb128(len(content))...), content...)
+	}
+	name := func(s string) []byte {
+		return append(leb128(len(s)), s...)
+	}
+	function := func(body ...byte) []byte {
+		// no locals
+		body = append([]byte{0x00}, body...)
+		return append(leb128(len(body)), body...)
+	}
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1,
+		0x03,
+		0x60, 0x02, 0x7f, 0x7f, 0x00, // (i32, i32) -> ()
+		0x60, 0x01, 0x7f, 0x01, 0x7f, // (i32) -> i32
+		0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7e, // (i32, i32, i32, i32) -> i64
+	)...)
+	imports := []byte{0x02}
+	imports = append(append(append(imports, name("env")...), name("log")...), 0x00, 0x00)
+	imports = append(append(append(imports, name("env")...), name("fail")...), 0x00, 0x00)
+	module = append(module, section(2, imports...)...)
+	module = append(module, section(3, 0x02, 0x01, 0x02)...)
+	module = append(module, section(5, 0x01, 0x00, memoryPages)...)
+	// mutable i32 heap pointer, initially 1024
+	module = append(module, section(6, 0x01, 0x7f, 0x01, 0x41, 0x80, 0x08, 0x0b)...)
+	exports := []byte{0x03}
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	exports = append(append(exports, name("alloc")...), 0x00, 0x02)
+	exports = append(append(exports, name("transform")...), 0x00, 0x03)
+	module = append(module, section(7, exports...)...)
+	code := []byte{0x02}
+	// alloc: return heap; heap += size
+	code = append(code, function(0x23, 0x00, 0x23, 0x00, 0x20, 0x00, 0x6a, 0x24, 0x00, 0x0b)...)
+	code = append(code, function(transformBody...)...)
+	module = append(module, section(10, code...)...)
+	segment := append([]byte{0x01, 0x00, 0x41, 0x00, 0x0b}, name(data)...)
+	return append(module, section(11, segment...)...)
+}
+
+func leb128(v int) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+var (
+	// log(metaPtr, metaLen); return dataPtr << 32 | dataLen
+	wasmEcho = []byte{0x20, 0x02, 0x20, 0x03, 0x10, 0x00, 0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84, 0x0b}
+	// fail(0, 8); return 0
+	wasmFailure = []byte{0x41, 0x00, 0x41, 0x08, 0x10, 0x01, 0x42, 0x00, 0x0b}
+	// loop forever
+	wasmEndlessLoop = []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00, 0x0b}
+)
+
+func TestWasmTransform(t *testing.T) {
+	transform := NewWasmTransform("echo", testWasmModule(1, wasmEcho, ""))
+	msg := &nats.Msg{Subject: "plc.1", Data: []byte(`[{"temperature": 21.5}, {"temperature": 22}]`), Header: nats.Header{"Unit": []string{"celsius"}}}
+	frames, err := NewWasmConverter(transform, Options{}).Convert(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("transform failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Rows() != 2 {
+		t.Fatalf("expected a frame with 2 rows, got %v", frames)
+	}
+	notices := frames[0].Meta.Notices
+	if len(notices) != 1 || notices[0].Text != `{"subject":"plc.1","reply":"","headers":{"Unit":["celsius"]}}` {
+		t.Errorf("expected the meta data to be logged, got %v", notices)
+	}
+
+}
+
+func TestWasmTransformErrors(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{}`)}
+	_, err := NewWasmConverter(NewWasmTransform("failing", testWasmModule(1, wasmFailure, "bad data")), Options{}).Convert(context.Background(), msg)
+	if err == nil || err.Error() != "wasm module failing failed: bad data" {
+		t.Errorf("expected the failure of the module, got: %v", err)
+	}
+
+	_, err = NewWasmConverter(NewWasmTransform("echo", testWasmModule(1, wasmEcho, "")), Options{}).Convert(context.Background(), &nats.Msg{Data: []byte(`{`)})
+	if err == nil || !strings.Contains(err.Error(), "wasm module echo returned invalid JSON") {
+		t.Errorf("expected invalid JSON error, got: %v", err)
+	}
+
+	broken := NewWasmTransform("broken", []byte("no wasm"))
+	_, err = NewWasmConverter(broken, Options{}).Convert(context.Background(), msg)
+	if err == nil || !strings.Contains(err.Error(), "wasm module broken could not be compiled") {
+		t.Errorf("expected compile error, got: %v", err)
+	}
+	if err := broken.Check(); err == nil {
+		t.Errorf("expected Check to fail for an invalid module")
+	}
+	if err := NewWasmTransform("echo", testWasmModule(1, wasmEcho, "")).Check(); err != nil {
+		t.Errorf("expected a valid module, got: %s", err)
+	}
+}
+
+func TestWasmTransformLimits(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{}`)}
+	start := time.Now()
+	_, err := NewWasmConverter(
+		NewWasmTransform("endless", testWasmModule(1, wasmEndlessLoop, "")),
+		Options{Limits: goja.Limits{Timeout: 100 * time.Millisecond}},
+	).Convert(context.Background(), msg)
+	var limitErr *goja.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != "exceeded the time limit of 100ms" {
+		t.Fatalf("expected time limit error, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the module was not stopped in time")
+	}
+
+	// 32 pages are 2 MB
+	_, err = NewWasmConverter(
+		NewWasmTransform("large", testWasmModule(32, wasmEcho, "")),
+		Options{MaxWasmMemoryBytes: 1024 * 1024},
+	).Convert(context.Background(), msg)
+	if err == nil || !strings.Contains(err.Error(), "wasm module large") {
+		t.Errorf("expected memory limit error, got: %v", err)
+	}
+}
+
+func TestWasmMemoryLimitOfSharedRuntime(t *testing.T) {
+	if pages := wasmRuntimePages(20 * wasmPageSize); pages != 32 {
+		t.Fatalf("expected the limit of the runtime to be rounded up to 32 pages, got %d", pages)
+	}
+	// the runtime allows 32 pages, but the limit is 20.
+	_, err := NewWasmConverter(
+		NewWasmTransform("large", testWasmModule(32, wasmEcho, "")),
+		Options{MaxWasmMemoryBytes: 20 * wasmPageSize},
+	).Convert(context.Background(), &nats.Msg{Data: []byte(`{}`)})
+	var limitErr *goja.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != "exceeded the memory limit of 1310720 bytes" {
+		t.Errorf("expected memory limit error, got: %v", err)
+	}
+}
+
+func TestWasmModuleIsClosedWhenUnused(t *testing.T) {
+	transform := NewWasmTransform("echo", testWasmModule(1, wasmEcho, ""))
+	r, err := wasmRuntime(0)
+	if err != nil {
+		t.Fatalf("no runtime: %s", err)
+	}
+	module, err := transform.compile(r, 0)
+	if err != nil {
+		t.Fatalf("compile failed: %s", err)
+	}
+
+	// evicted from the cache while it is in use: it must stay usable.
+	module.evict()
+	if _, err := r.InstantiateModule(context.Background(), module.compiled, wazero.NewModuleConfig().WithName("")); err != nil {
+		t.Fatalf("the evicted module is not usable while it is in use: %s", err)
+	}
+	module.release()
+	if !module.closed || module.acquire() {
+		t.Errorf("expected the module to be closed once it is no longer used")
+	}
+}
+
+func TestWasmModuleIsCompiledOnce(t *testing.T) {
+	transform := NewWasmTransform("echo", testWasmModule(3, wasmEcho, ""))
+	r, err := wasmRuntime(0)
+	if err != nil {
+		t.Fatalf("no runtime: %s", err)
+	}
+
+	modules := make(chan *wasmModule, 10)
+	for i := 0; i < cap(modules); i++ {
+		go func() {
+			module, err := transform.compile(r, 0)
+			if err != nil {
+				t.Errorf("compile failed: %s", err)
+			}
+			modules <- module
+		}()
+	}
+	first := <-modules
+	for i := 1; i < cap(modules); i++ {
+		if module := <-modules; module != first {
+			t.Errorf("expected concurrent calls to share a single compiled module")
+		}
+	}
+	if first.refs != cap(modules) {
+		t.Errorf("expected the module to be acquired %d times, got %d", cap(modules), first.refs)
+	}
+}
@@ -2,16 +2,20 @@ package plugin
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
-	"github.com/grafana/grafana-plugin-sdk-go/live"
 	"github.com/jellydator/ttlcache/v3"
 	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/convert"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
 	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
@@ -22,8 +26,9 @@ import (
 // since otherwise we will only get a not implemented error response from plugin in
 // runtime.
 var (
-	_ backend.QueryDataHandler   = (*Datasource)(nil)
-	_ backend.CheckHealthHandler = (*Datasource)(nil)
+	_ backend.QueryDataHandler    = (*Datasource)(nil)
+	_ backend.CheckHealthHandler  = (*Datasource)(nil)
+	_ backend.CallResourceHandler = (*Datasource)(nil)
 
 	// TODO: https://grafana.com/tutorials/build-a-streaming-data-source-plugin/
 	_ backend.StreamHandler         = (*Datasource)(nil)
@@ -32,11 +37,23 @@ var (
 
 // NewDatasource creates a new datasource instance.
 func NewDatasource(config backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	return &Datasource{
-		uid:                  config.UID,
-		natsConnOnce:         &sync.Once{},
-		streamResponsesSoFar: ttlcache.New[string, *streamResponse](),
-	}, nil
+	ds := &Datasource{
+		uid:          config.UID,
+		natsConnOnce: &sync.Once{},
+		streamResponsesSoFar: ttlcache.New[string, *streamResponse](
+			// reading a stream must not postpone the deadline for subscribing to it.
+			ttlcache.WithDisableTouchOnHit[string, *streamResponse](),
+		),
+		streamSubscribeTimeout: defaultStreamSubscribeTimeout,
+	}
+	// a stream ends once it is removed: if no panel subscribed to it in time, or once the panel unsubscribed (see
+	// RunStream).
+	ds.streamResponsesSoFar.OnEviction(func(_ context.Context, _ ttlcache.EvictionReason, item *ttlcache.Item[string, *streamResponse]) {
+		item.Value().cancelNatsSubscription()
+	})
+	go ds.streamResponsesSoFar.Start()
+	ds.resourceHandler = ds.newResourceHandler()
+	return ds, nil
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -44,6 +61,8 @@ func NewDatasource(config backend.DataSourceInstanceSettings) (instancemgmt.Inst
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (ds *Datasource) Dispose() {
 	// Clean up datasource instance resources.
+	ds.streamResponsesSoFar.Stop()
+	ds.streamResponsesSoFar.DeleteAll()
 }
 
 // Datasource is an example datasource which can respond to data queries, reports
@@ -51,6 +70,10 @@ func (ds *Datasource) Dispose() {
 type Datasource struct {
 	uid                  string
 	streamResponsesSoFar *ttlcache.Cache[string, *streamResponse]
+	// streamSubscribeTimeout is how long a stream waits for a panel to subscribe to it, see newStream.
+	streamSubscribeTimeout time.Duration
+	// resourceHandler serves the endpoints of the query editor, see CallResource.
+	resourceHandler backend.CallResourceHandler
 
 	// natsConnOnce is implementation detail of connectNats to ensure we only create one NATS connection without any race conditions
 	natsConnOnce *sync.Once
@@ -60,15 +83,6 @@ type Datasource struct {
 	natsConnErr error
 }
 
-type streamResponse struct {
-	onNewMessages          chan bool
-	currentFrame           *data.Frame
-	currentErr             error
-	cancelNatsSubscription context.CancelFunc
-	// set to true once the NATS subscription is set up. Required for deterministic tests.
-	subscribed bool
-}
-
 func (ds *Datasource) SubscribeStream(_ context.Context, request *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
 	status := backend.SubscribeStreamStatusNotFound
 
@@ -92,26 +106,44 @@ func (ds *Datasource) PublishStream(_ context.Context, _ *backend.PublishStreamR
 func (ds *Datasource) RunStream(ctx context.Context, request *backend.RunStreamRequest, sender *backend.StreamSender) error {
 	value := ds.streamResponsesSoFar.Get(request.Path)
 	if value != nil {
+		sr := value.Value()
+		// the stream does not expire while the panel is subscribed; afterwards, it is removed - which ends it.
+		ds.streamResponsesSoFar.Set(request.Path, sr, ttlcache.NoTTL)
+		defer ds.streamResponsesSoFar.Delete(request.Path)
+
+		// with a max. frame rate, we send the collected messages on every tick; otherwise as soon as they arrive.
+		var tick <-chan time.Time
+		wakeUp := sr.onNewMessages
+		if interval := sr.policy.tickInterval(); interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+			wakeUp = nil
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
 				// we are done.
-				value.Value().cancelNatsSubscription()
+				sr.cancelNatsSubscription()
 				return nil
-			case <-value.Value().onNewMessages:
-				// new message
-				if value.Value().currentErr != nil {
-					// error while processing messages -> exit stream
-					return value.Value().currentErr
-				}
+			case <-tick:
+			case <-wakeUp:
+			}
 
-				// no error -> send the updated frame to the user.
-				if value.Value().currentFrame != nil {
-					err := sender.SendFrame(value.Value().currentFrame, data.IncludeAll)
-					if err != nil {
-						// TODO: close NATS subscription!
-						return value.Value().currentErr
-					}
+			// new messages
+			frames, err := sr.next()
+			if err != nil {
+				// error while processing messages -> exit stream
+				return err
+			}
+
+			// no error -> send the updated frames to the user.
+			for _, frame := range frames {
+				err := sender.SendFrame(frame, data.IncludeAll)
+				if err != nil {
+					sr.cancelNatsSubscription()
+					return err
 				}
 			}
 		}
@@ -162,6 +194,219 @@ func (ds *Datasource) loadDataSourceOptions(pCtx backend.PluginContext) (*MyData
 	return dataSourceOptions, dataSourceSecureOptions, nil
 }
 
+// defaultScriptTimeout is used if neither the query nor the data source configure a script timeout.
+const defaultScriptTimeout = 30 * time.Second
+
+// scriptLimits returns the resource limits for the scripts of a query: the data source settings are the maximum,
+// which a query can only lower - otherwise, every dashboard editor could lift them.
+func scriptLimits(options *MyDataSourceOptions, qm queryModel) goja.Limits {
+	limits := goja.Limits{
+		Timeout:    options.ScriptTimeout.Duration,
+		MaxNatsOps: options.ScriptMaxNatsOps,
+	}
+	if limits.Timeout == 0 {
+		limits.Timeout = defaultScriptTimeout
+	}
+	if qm.ScriptTimeout.Duration > 0 && qm.ScriptTimeout.Duration < limits.Timeout {
+		limits.Timeout = qm.ScriptTimeout.Duration
+	}
+	if qm.ScriptMaxNatsOps > 0 && (limits.MaxNatsOps == 0 || qm.ScriptMaxNatsOps < limits.MaxNatsOps) {
+		limits.MaxNatsOps = qm.ScriptMaxNatsOps
+	}
+	return limits
+}
+
+// wasmMaxMemoryBytes returns the memory limit of the WebAssembly transform of a query (0 for unlimited); like the
+// script limits, a query can only lower the limit of the data source.
+func wasmMaxMemoryBytes(options *MyDataSourceOptions, qm queryModel) uint64 {
+	maxMemoryMb := options.WasmMaxMemoryMb
+	if qm.WasmMaxMemoryMb > 0 && (maxMemoryMb == 0 || qm.WasmMaxMemoryMb < maxMemoryMb) {
+		maxMemoryMb = qm.WasmMaxMemoryMb
+	}
+	return uint64(maxMemoryMb) * 1024 * 1024
+}
+
+// scriptPermissions returns the permissions of scripts on the NATS connection. In contrast to the limits, they
+// cannot be changed per query - otherwise, every dashboard editor could lift them.
+func scriptPermissions(options *MyDataSourceOptions) goja.Permissions {
+	return goja.Permissions{
+		ReadOnly:       options.ScriptReadOnly,
+		PublishAllow:   subjectPatterns(options.ScriptPublishAllow),
+		PublishDeny:    subjectPatterns(options.ScriptPublishDeny),
+		RequestAllow:   subjectPatterns(options.ScriptRequestAllow),
+		RequestDeny:    subjectPatterns(options.ScriptRequestDeny),
+		SubscribeAllow: subjectPatterns(options.ScriptSubscribeAllow),
+		SubscribeDeny:  subjectPatterns(options.ScriptSubscribeDeny),
+	}
+}
+
+// scriptModules returns the script library of the data source. Modules are checked by CheckHealth, which is run
+// when the data source is saved.
+func scriptModules(options *MyDataSourceOptions) goja.Modules {
+	modules := goja.Modules{}
+	for _, module := range options.ScriptModules {
+		modules[module.Name] = module.Source
+	}
+	return modules
+}
+
+// checkScriptModules validates the script library of the data source: names must be unique, and all modules must
+// compile.
+func checkScriptModules(options *MyDataSourceOptions) error {
+	names := map[string]bool{}
+	for _, module := range options.ScriptModules {
+		if names[module.Name] {
+			return fmt.Errorf("module %s is defined multiple times", module.Name)
+		}
+		names[module.Name] = true
+	}
+	return scriptModules(options).Check()
+}
+
+// wasmTransform returns the WebAssembly module which converts the messages of the query instead of its script; nil
+// if the query uses its script.
+func wasmTransform(options *MyDataSourceOptions, qm queryModel) (*convert.WasmTransform, error) {
+	if qm.WasmModule == "" {
+		return nil, nil
+	}
+	if (qm.QueryType != QueryTypeRequestReply && qm.QueryType != QueryTypeSubscribe) || qm.Stateful {
+		return nil, fmt.Errorf("WebAssembly modules can only be used by Request/Reply and (not stateful) Subscribe queries")
+	}
+	for _, module := range options.WasmModules {
+		if module.Name == qm.WasmModule {
+			return module.transform()
+		}
+	}
+	return nil, fmt.Errorf("WebAssembly module %s not found in the data source settings", qm.WasmModule)
+}
+
+// queryExpressions returns the CEL expressions which convert the messages of the query instead of its script; nil if
+// the query does not use expressions.
+func queryExpressions(qm queryModel) (*convert.Expressions, error) {
+	if !qm.UseExpressions {
+		return nil, nil
+	}
+	if (qm.QueryType != QueryTypeRequestReply && qm.QueryType != QueryTypeSubscribe) || qm.Stateful || qm.WasmModule != "" {
+		return nil, fmt.Errorf("expressions are only supported for Request/Reply and (stateless) Subscribe queries without WebAssembly module")
+	}
+	return &convert.Expressions{Filter: qm.FilterExpression, Columns: qm.ColumnExpressions}, nil
+}
+
+// queryMapping returns the declarative mapping which converts the messages of the query instead of its script; nil
+// if the query does not use a mapping.
+func queryMapping(qm queryModel) (*convert.Mapping, error) {
+	if !qm.UseMapping {
+		return nil, nil
+	}
+	if (qm.QueryType != QueryTypeRequestReply && qm.QueryType != QueryTypeSubscribe) || qm.Stateful || qm.WasmModule != "" || qm.UseExpressions {
+		return nil, fmt.Errorf("mappings are only supported for Request/Reply and (stateless) Subscribe queries without WebAssembly module or expressions")
+	}
+	return &convert.Mapping{Rows: qm.MappingRows, Columns: qm.MappingColumns}, nil
+}
+
+// messageConverter returns the converter of the messages of a Request/Reply or Subscribe query: its WebAssembly
+// module, its expressions, its mapping, or its script. On error, field is the query field of the invalid setting.
+func messageConverter(options *MyDataSourceOptions, qm queryModel, nc *nats.Conn, scriptOpts []goja.Option) (converter convert.Converter, field string, err error) {
+	transform, err := wasmTransform(options, qm)
+	if err != nil {
+		return nil, "wasmModule", err
+	}
+	expressions, err := queryExpressions(qm)
+	if err != nil {
+		return nil, "useExpressions", err
+	}
+	mapping, err := queryMapping(qm)
+	if err != nil {
+		return nil, "useMapping", err
+	}
+
+	if transform != nil {
+		return convert.NewWasmConverter(transform, converterOptions(options, qm)), "", nil
+	}
+	if expressions != nil {
+		// the expressions and mappings are compiled once per query, not for every message.
+		converter, err := convert.NewExpressionConverter(expressions, converterOptions(options, qm))
+		if err != nil {
+			return nil, expressionErrorField(err), err
+		}
+		return converter, "", nil
+	}
+	if mapping != nil {
+		converter, err := convert.NewMappingConverter(mapping, converterOptions(options, qm))
+		if err != nil {
+			return nil, mappingErrorField(err), err
+		}
+		return converter, "", nil
+	}
+	return convert.Script(nc, qm.JsFn, scriptOpts...), "", nil
+}
+
+// converterOptions are the options of the converters which are used instead of the script of a query.
+func converterOptions(options *MyDataSourceOptions, qm queryModel) convert.Options {
+	return convert.Options{
+		Limits:             scriptLimits(options, qm),
+		MaxWasmMemoryBytes: wasmMaxMemoryBytes(options, qm),
+		ServerLog:          goja.ServerLogLevel(options.ScriptServerLog),
+		Arrays:             framestruct.ArrayMode(qm.ArrayMode),
+	}
+}
+
+func (m WasmModule) transform() (*convert.WasmTransform, error) {
+	binary, err := base64.StdEncoding.DecodeString(m.Wasm)
+	if err != nil {
+		return nil, fmt.Errorf("WebAssembly module %s is not base64-encoded: %w", m.Name, err)
+	}
+	return convert.NewWasmTransform(m.Name, binary), nil
+}
+
+// checkWasmModules validates the WebAssembly modules of the data source: names must be unique, and all modules
+// must compile.
+func checkWasmModules(options *MyDataSourceOptions) error {
+	names := map[string]bool{}
+	for _, module := range options.WasmModules {
+		if names[module.Name] {
+			return fmt.Errorf("WebAssembly module %s is defined multiple times", module.Name)
+		}
+		names[module.Name] = true
+		transform, err := module.transform()
+		if err != nil {
+			return err
+		}
+		if err := transform.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subjectPatterns splits a list of subject patterns separated by commas or whitespace.
+func subjectPatterns(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// queryContext describes the query for its scripts, see goja.QueryContext.
+func queryContext(pCtx backend.PluginContext, query backend.DataQuery, qm queryModel) goja.QueryContext {
+	queryCtx := goja.QueryContext{
+		RefID:         query.RefID,
+		From:          query.TimeRange.From,
+		To:            query.TimeRange.To,
+		Interval:      query.Interval,
+		MaxDataPoints: query.MaxDataPoints,
+		Variables:     qm.Variables,
+	}
+	if pCtx.User != nil {
+		queryCtx.User = &goja.QueryUser{
+			Login: pCtx.User.Login,
+			Name:  pCtx.User.Name,
+			Email: pCtx.User.Email,
+			Role:  pCtx.User.Role,
+		}
+	}
+	return queryCtx
+}
+
 func (ds *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
 	//////////////
 	// 1) Data Source option loading
@@ -195,27 +440,43 @@ func (ds *Datasource) query(ctx context.Context, pCtx backend.PluginContext, que
 	if qm.RequestTimeout.Duration == 0 {
 		qm.RequestTimeout.Duration = 5 * time.Second
 	}
+	scriptOpts := []goja.Option{
+		goja.WithLimits(scriptLimits(dataSourceOptions, qm)),
+		goja.WithServerLog(goja.ServerLogLevel(dataSourceOptions.ScriptServerLog)),
+		goja.WithPermissions(scriptPermissions(dataSourceOptions)),
+		goja.WithLanguage(goja.Language(qm.ScriptLanguage)),
+		goja.WithModules(scriptModules(dataSourceOptions)),
+		goja.WithArrayMode(framestruct.ArrayMode(qm.ArrayMode)),
+		goja.WithQuery(queryContext(pCtx, query, qm)),
+	}
+	converter, _, err := messageConverter(dataSourceOptions, qm, nc, scriptOpts)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
 	if qm.QueryType == QueryTypeRequestReply {
-		frame, err := ds.requestReply(nc, qm)
+		frames, err := ds.requestReply(ctx, nc, qm, converter)
 		if err != nil {
 			return backend.ErrDataResponse(backend.StatusBadRequest, "Response conversion error: "+err.Error())
 		}
 
 		return backend.DataResponse{
-			Frames: data.Frames{
-				frame,
-			},
+			Frames: frames,
 			Status: backend.StatusOK,
 		}
 	} else if qm.QueryType == QueryTypeSubscribe {
-		return ds.subscribe(ctx, qm, nc)
+		return ds.subscribe(ctx, qm, nc, converter, scriptOpts)
 	} else if qm.QueryType == QueryTypeScript {
-		return ds.script(ctx, qm, nc)
+		return ds.script(ctx, qm, nc, scriptOpts)
+	} else if qm.QueryType == QueryTypeStreamingScript {
+		return ds.streamingScript(ctx, qm, nc, scriptOpts)
 	} else {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "Invalid Query Type: "+qm.QueryType)
 	}
 }
 
+// healthCheckTimeout is how long CheckHealth waits for the NATS server to respond.
+const healthCheckTimeout = 5 * time.Second
+
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
@@ -236,6 +497,19 @@ func (ds *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthReq
 		}, nil
 	}
 
+	if err := checkScriptModules(dataSourceOptions); err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "Script library is invalid: " + err.Error(),
+		}, nil
+	}
+	if err := checkWasmModules(dataSourceOptions); err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "WebAssembly modules are invalid: " + err.Error(),
+		}, nil
+	}
+
 	//////////////
 	// 2) Connect
 	//////////////
@@ -246,7 +520,14 @@ func (ds *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthReq
 			Message: "NATS could not be connected to: " + err.Error(),
 		}, nil
 	}
-	natsConn.Close()
+	// the connection is shared with all queries and streams of the data source, so it must stay open; a round trip
+	// to the server shows whether it is working.
+	if err := natsConn.FlushTimeout(healthCheckTimeout); err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "NATS is not reachable: " + err.Error(),
+		}, nil
+	}
 
 	return &backend.CheckHealthResult{
 		Status:  backend.HealthStatusOk,
@@ -254,131 +535,227 @@ func (ds *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthReq
 	}, nil
 }
 
-func (ds *Datasource) requestReply(nc *nats.Conn, qm queryModel) (*data.Frame, error) {
+func (ds *Datasource) requestReply(ctx context.Context, nc *nats.Conn, qm queryModel, converter convert.Converter) (data.Frames, error) {
 	resp, err := nc.Request(qm.NatsSubject, []byte(qm.RequestData), qm.RequestTimeout.Duration)
 	if err != nil {
 		return nil, err
 	}
 
-	return goja.ConvertMessage(nc, resp, qm.JsFn)
+	frames, err := converter.Convert(ctx, resp)
+	if errors.Is(err, convert.ErrMessageDiscarded) {
+		return discardedMessageFrames(), nil
+	}
+	return frames, err
+}
+
+// discardedMessageFrames is the result of a Request/Reply query (or a preview) whose message was discarded by the
+// filter expression.
+func discardedMessageFrames() data.Frames {
+	frame := data.NewFrame("result")
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     "The message was discarded by the filter expression.",
+	})
+	return data.Frames{frame}
 }
 
 // subscribe handles a NATS subscription call in streaming fashion.
-// TODO explain how done
+//
+// The NATS subscription is created right away; every received message is converted and handed over to
+// RunStream via the streamResponse stored under a random request UUID (which is also the Grafana Live channel path).
+//
+// The query itself does not block until a message arrives: it waits at most qm.FirstMessageTimeout (or until the
+// request is cancelled) for the 1st message. If one arrives in time, it is returned as the initial frame; otherwise
+// an empty frame with a notice is returned, and all messages are streamed.
+//
 // inspired by https://github.com/grafana/grafana-iot-twinmaker-app/blob/0947ce1ff0afec8372cae624566726e68687137b/pkg/plugin/datasource.go
-func (ds *Datasource) subscribe(_ context.Context, qm queryModel, nc *nats.Conn) backend.DataResponse {
-	requestUuid := uuid.NewString()
-	if len(qm.StreamRequestUuidForTesting) > 0 {
-		requestUuid = qm.StreamRequestUuidForTesting
+func (ds *Datasource) subscribe(requestCtx context.Context, qm queryModel, nc *nats.Conn, converter convert.Converter, scriptOpts []goja.Option) backend.DataResponse {
+	// if the context is cancelled, the NATS subscription should end.
+	requestUuid, sr, ctx, err := ds.newStream(qm)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "invalid stream output settings: "+err.Error())
 	}
 
-	// if the context is cancelled, the NATS subscription should end.
-	ctx, cancel := context.WithCancel(context.Background())
-	sr := &streamResponse{
-		onNewMessages:          make(chan bool, 100), // we use a buffered channel here, because we do not want to block at all, if possible.
-		currentFrame:           nil,
-		cancelNatsSubscription: cancel,
+	convertMessage := func(msg *nats.Msg) (*data.Frame, error) {
+		frames, err := converter.Convert(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		if len(frames) != 1 {
+			// all messages of a stream are appended to the same frame in the panel.
+			return nil, fmt.Errorf("subscribe scripts must return a single frame, but returned %d", len(frames))
+		}
+		return frames[0], nil
+	}
+	if qm.Stateful {
+		// the converter (and its state) lives as long as the stream; its teardown script runs once the stream ends.
+		stateful, err := goja.NewStatefulConverter(ctx, nc, qm.JsFn, qm.JsInitFn, qm.JsTeardownFn, scriptOpts...)
+		if err != nil {
+			sr.cancelNatsSubscription()
+			return backend.ErrDataResponse(backend.StatusBadRequest, "error in init script: "+err.Error())
+		}
+		convertMessage = stateful.ConvertMessage
+		cancelNatsSubscription := sr.cancelNatsSubscription
+		sr.cancelNatsSubscription = func() {
+			cancelNatsSubscription()
+			if err := stateful.Close(); err != nil {
+				log.DefaultLogger.Error(fmt.Sprintf("%s: error in teardown script: %s", requestUuid, err))
+			}
+		}
 	}
 
-	// TODO: do not hardcode TTL here.
-	ds.streamResponsesSoFar.Set(requestUuid, sr, 5*time.Minute)
+	// The 1st converted message is either returned synchronously by this function, or - if we stopped waiting
+	// for it - streamed like all later messages. firstMessageOnce decides which of the two happens.
+	firstMessageOnce := sync.Once{}
+	firstMessage := make(chan *data.Frame, 1)
+	firstMessageErr := make(chan error, 1)
 
-	// NOTE: we wait until the 1st message is received
-	wg := sync.WaitGroup{}
-	wg.Add(1)
 	i := 0
-	var subscription *nats.Subscription
-	var err error
-	var firstFrame *data.Frame
-	subscription, err = nc.Subscribe(qm.NatsSubject, func(msg *nats.Msg) {
+	handleMsg := func(msg *nats.Msg) {
 		select {
 		case <-ctx.Done():
 			log.DefaultLogger.Debug("Cancelling NATS subscription")
-			_ = subscription.Unsubscribe()
+			sr.unsubscribe()
 		default:
 			log.DefaultLogger.Debug("Received NATS Message")
-			// extend TTL everytime we receive a msg.
-			ds.streamResponsesSoFar.Touch(requestUuid)
 			i++
-			frame, err := goja.ConvertMessage(nc, msg, qm.JsFn)
-			if err != nil {
-				log.DefaultLogger.Error(fmt.Sprintf("could not convert message %d - error in tamarin script: %s", i, err))
-
-				sr.currentErr = fmt.Errorf("could not convert message %d - error in tamarin script: %w", i, err)
-				sr.onNewMessages <- true
-				_ = subscription.Unsubscribe()
-				if i == 1 {
-					// for 1st message, answer synchronously
-					wg.Done()
-				}
+			frame, err := convertMessage(msg)
+			if errors.Is(err, convert.ErrMessageDiscarded) {
+				// the 1st message which is not discarded is answered synchronously.
 				return
 			}
+
+			answeredSynchronously := false
+			firstMessageOnce.Do(func() {
+				// for 1st message, answer synchronously (if subscribe() is still waiting for it)
+				answeredSynchronously = true
+				if err != nil {
+					firstMessageErr <- err
+				} else {
+					firstMessage <- frame
+				}
+			})
+
 			if err != nil {
-				log.DefaultLogger.Error(fmt.Sprintf("could not convert message %d - could not be converted to data frame: %s", i, err))
-
-				sr.currentErr = fmt.Errorf("could not convert message %d - could not be converted to data frame: %w", i, err)
-				sr.onNewMessages <- true
-				_ = subscription.Unsubscribe()
-				if i == 1 {
-					// for 1st message, answer synchronously
-					wg.Done()
+				log.DefaultLogger.Error(fmt.Sprintf("could not convert message %d - error in tamarin script: %s", i, err))
+				sr.unsubscribe()
+				if !answeredSynchronously {
+					sr.setErr(fmt.Errorf("could not convert message %d - error in tamarin script: %w", i, err))
 				}
 				return
 			}
 
 			// no error :) -> notify sender
-			if i == 1 {
-				// for 1st message, answer synchronously
-				firstFrame = frame
-				wg.Done()
+			if answeredSynchronously {
+				sr.mu.Lock()
+				sr.lastFrame = frame
+				sr.mu.Unlock()
 			} else {
-				sr.currentFrame = frame
-				sr.onNewMessages <- true
+				sr.addFrame(frame)
 			}
 		}
-	})
+	}
 
+	sr.mu.Lock()
+	subscription, err := nc.Subscribe(qm.NatsSubject, handleMsg)
+	sr.subscription = subscription
+	sr.mu.Unlock()
 	if err != nil {
+		sr.cancelNatsSubscription()
 		return backend.ErrDataResponse(backend.StatusBadRequest, "could not create subscription: "+err.Error())
 	}
+	// like for streaming scripts: messages published right after the query returned must not be missed.
+	if err := nc.FlushTimeout(qm.RequestTimeout.Duration); err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("%s: could not flush NATS connection: %s", requestUuid, err))
+	}
 	log.DefaultLogger.Debug(fmt.Sprintf("%s: Subscription set up for %s", requestUuid, qm.NatsSubject))
 	sr.subscribed = true
 
-	// wait until the 1st NATS message was received
-	wg.Wait()
-
-	log.DefaultLogger.Debug(fmt.Sprintf("Finished waiting"))
-	if sr.currentErr != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "error handling 1st message: "+sr.currentErr.Error())
+	// wait until the 1st NATS message was received, the timeout passed, or the request was cancelled.
+	var firstFrame *data.Frame
+	select {
+	case firstFrame = <-firstMessage:
+	case err = <-firstMessageErr:
+	case <-time.After(qm.FirstMessageTimeout.Duration):
+	case <-requestCtx.Done():
+	}
+	firstMessageOnce.Do(func() {
+		// we stopped waiting before the 1st message arrived; so it will be streamed.
+	})
+	// the 1st message might have arrived just while we stopped waiting; in this case, it is already in the channel.
+	select {
+	case firstFrame = <-firstMessage:
+	case err = <-firstMessageErr:
+	default:
 	}
 
-	channel := live.Channel{
-		Scope:     live.ScopeDatasource,
-		Namespace: ds.uid,
-		Path:      requestUuid, // because request UUID is random, we cannot snoop on other people's values (security). and we have one subscription per user (which is what we want in our case)
+	log.DefaultLogger.Debug("Finished waiting")
+	if err != nil {
+		sr.cancelNatsSubscription()
+		return backend.ErrDataResponse(backend.StatusBadRequest, "error handling 1st message: "+err.Error())
 	}
-	firstFrame.SetMeta(&data.FrameMeta{Channel: channel.String()})
-	return backend.DataResponse{
-		Frames: data.Frames{
-			firstFrame,
-		},
-		Status: backend.StatusOK,
+
+	if firstFrame == nil {
+		// no message so far: we do not know the schema yet, so we answer with an empty frame; and the data
+		// arrives via streaming.
+		firstFrame = data.NewFrame("result")
+		firstFrame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("No message received on %s yet - waiting for messages to arrive.", qm.NatsSubject),
+		})
 	}
+
+	return ds.streamingResponse(requestUuid, firstFrame)
 }
 
 // script allows free-form scripts
 // TODO explain how done
-func (ds *Datasource) script(_ context.Context, qm queryModel, natsConn *nats.Conn) backend.DataResponse {
-	frame, err := goja.RunScript(natsConn, qm.JsFn)
+func (ds *Datasource) script(ctx context.Context, qm queryModel, natsConn *nats.Conn, scriptOpts []goja.Option) backend.DataResponse {
+	frames, err := goja.RunScript(ctx, natsConn, qm.JsFn, scriptOpts...)
 
 	if err != nil {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "error handling 1st message: "+err.Error())
 	}
 
 	return backend.DataResponse{
-		Frames: data.Frames{
-			frame,
-		},
+		Frames: frames,
 		Status: backend.StatusOK,
 	}
 }
+
+// streamingScript runs a free-form script which can emit(rows) to the UI via Grafana Live, as long as the
+// panel is subscribed. See goja.RunStreamingScript for details.
+func (ds *Datasource) streamingScript(requestCtx context.Context, qm queryModel, natsConn *nats.Conn, scriptOpts []goja.Option) backend.DataResponse {
+	requestUuid, sr, ctx, err := ds.newStream(qm)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "invalid stream output settings: "+err.Error())
+	}
+
+	firstFrame, err := goja.RunStreamingScript(requestCtx, ctx, natsConn, qm.JsFn, func(frame *data.Frame, err error) {
+		if err != nil {
+			log.DefaultLogger.Error(fmt.Sprintf("%s: streaming script failed: %s", requestUuid, err))
+			sr.setErr(err)
+			return
+		}
+		sr.addFrame(frame)
+	}, scriptOpts...)
+	if err != nil {
+		sr.cancelNatsSubscription()
+		return backend.ErrDataResponse(backend.StatusBadRequest, "error running script: "+err.Error())
+	}
+	// make sure the subscriptions of the script are known to the server before we answer; otherwise, messages
+	// published right afterwards might be missed.
+	if err := natsConn.FlushTimeout(qm.RequestTimeout.Duration); err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("%s: could not flush NATS connection: %s", requestUuid, err))
+	}
+	sr.subscribed = true
+
+	if firstFrame == nil {
+		firstFrame = data.NewFrame("result")
+		firstFrame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     "The script did not return any rows - waiting for rows to be emitted.",
+		})
+	}
+	return ds.streamingResponse(requestUuid, firstFrame)
+}
@@ -2,13 +2,17 @@ package plugin
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/experimental"
 	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/convert"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
 	"github.com/sandstormmedia/nats/pkg/plugin/integration_test"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -206,9 +210,10 @@ func TestValidStreaming(t *testing.T) {
 				`{"s1": "my string2", "i1": 21, "f1": 21.0, "b1": false}`,
 			},
 			q: queryModel{
-				QueryType:   "SUBSCRIBE",
-				NatsSubject: "subject1",
-				JsFn:        ``,
+				QueryType:           "SUBSCRIBE",
+				NatsSubject:         "subject1",
+				JsFn:                ``,
+				FirstMessageTimeout: Duration{time.Second},
 			},
 			ExpectedMessages: 2,
 		},
@@ -226,9 +231,10 @@ func TestValidStreaming(t *testing.T) {
 				]`,
 			},
 			q: queryModel{
-				QueryType:   "SUBSCRIBE",
-				NatsSubject: "subject1",
-				JsFn:        ``,
+				QueryType:           "SUBSCRIBE",
+				NatsSubject:         "subject1",
+				JsFn:                ``,
+				FirstMessageTimeout: Duration{time.Second},
 			},
 			ExpectedMessages: 2,
 		},
@@ -301,6 +307,600 @@ func TestValidStreaming(t *testing.T) {
 
 }
 
+func TestSubscribeReturnsBeforeFirstMessage(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType:                   "SUBSCRIBE",
+		NatsSubject:                 "quietSubject",
+		StreamRequestUuidForTesting: "stream-quiet",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	// nothing is published before QueryData returns - so the query must not wait for a message.
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	queryResponse := resp.Responses["A"]
+	AssertNoError(t, queryResponse.Error)
+	AssertEqual(t, backend.StatusOK, queryResponse.Status, "resp.Responses[0].Status")
+	AssertEqual(t, "ds/uid1/stream-quiet", queryResponse.Frames[0].Meta.Channel, "channel does not match")
+	AssertEqual(t, 0, queryResponse.Frames[0].Rows(), "rows of initial frame")
+	AssertEqual(t, 1, len(queryResponse.Frames[0].Meta.Notices), "notices of initial frame")
+
+	// the 1st message is then delivered via streaming.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	go ds.RunStream(ctx, &backend.RunStreamRequest{
+		Path: q.StreamRequestUuidForTesting,
+	}, backend.NewStreamSender(&customPacketSender{
+		c: streamedMessagesChan,
+	}))
+	AssertNoError(t, nc.Publish(q.NatsSubject, []byte(`{"s1": "my string", "i1": 42}`)))
+
+	select {
+	case msg := <-streamedMessagesChan:
+		var streamedFrame data.Frame
+		AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+		AssertEqual(t, 1, streamedFrame.Rows(), "rows of streamed frame")
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving 1st message")
+	}
+}
+
+func TestSubscribeWithFilterExpression(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType:                   "SUBSCRIBE",
+		NatsSubject:                 "filteredSubject",
+		UseExpressions:              true,
+		FilterExpression:            `data.v > 20`,
+		ColumnExpressions:           []convert.ExpressionColumn{{Name: "v", Expression: `data.v`}},
+		StreamRequestUuidForTesting: "stream-filtered",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: query}},
+		},
+	)
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["A"].Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	go ds.RunStream(ctx, &backend.RunStreamRequest{
+		Path: q.StreamRequestUuidForTesting,
+	}, backend.NewStreamSender(&customPacketSender{
+		c: streamedMessagesChan,
+	}))
+	// the 1st message is discarded by the filter; only the 2nd one is streamed.
+	AssertNoError(t, nc.Publish(q.NatsSubject, []byte(`{"v": 1}`)))
+	AssertNoError(t, nc.Publish(q.NatsSubject, []byte(`{"v": 21}`)))
+
+	select {
+	case msg := <-streamedMessagesChan:
+		var streamedFrame data.Frame
+		AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+		AssertEqual(t, 1, streamedFrame.Rows(), "rows of streamed frame")
+		value, _ := streamedFrame.Fields[0].ConcreteAt(0)
+		AssertEqual[interface{}](t, 21.0, value, "v")
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving the message")
+	}
+}
+
+func TestSubscribeReportsGapAfterReconnect(t *testing.T) {
+	natsServer, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType:                   "SUBSCRIBE",
+		NatsSubject:                 "reconnectSubject",
+		FirstMessageTimeout:         Duration{time.Second},
+		StreamRequestUuidForTesting: "stream-reconnect",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	go func() {
+		waitUntilDatasourceIsListeningToStream(t, ds, q)
+		nc.Publish(q.NatsSubject, []byte(`{"i1": 1}`))
+	}()
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["A"].Error)
+	AssertEqual(t, 1, resp.Responses["A"].Frames[0].Rows(), "rows of initial frame")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	go ds.RunStream(ctx, &backend.RunStreamRequest{
+		Path: q.StreamRequestUuidForTesting,
+	}, backend.NewStreamSender(&customPacketSender{
+		c: streamedMessagesChan,
+	}))
+
+	// restart the NATS server; the datasource reconnects automatically.
+	natsServer.Shutdown()
+	restartedServer := integration_test.RunServerOnPort(integration_test.TEST_PORT)
+	t.Cleanup(restartedServer.Shutdown)
+
+	// the interruption is reported without waiting for the next message ...
+	select {
+	case msg := <-streamedMessagesChan:
+		var streamedFrame data.Frame
+		AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+		AssertEqual(t, 0, streamedFrame.Rows(), "rows of gap notice frame")
+		AssertEqual(t, 1, len(streamedFrame.Meta.Notices), "notices of gap notice frame")
+		AssertEqual(t, data.NoticeSeverityWarning, streamedFrame.Meta.Notices[0].Severity, "notice severity")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout receiving gap notice")
+	}
+
+	// ... and the subscription is still active: the NATS client re-sent it to the restarted server.
+	sr := ds.streamResponsesSoFar.Get(q.StreamRequestUuidForTesting).Value()
+	sr.mu.Lock()
+	subscription := sr.subscription
+	sr.mu.Unlock()
+	AssertEqual(t, true, subscription != nil && subscription.IsValid(), "subscription is valid after reconnect")
+	for i := 0; i < 100 && !nc.IsConnected(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	AssertNoError(t, nc.Publish(q.NatsSubject, []byte(`{"i1": 2}`)))
+	select {
+	case msg := <-streamedMessagesChan:
+		var streamedFrame data.Frame
+		AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+		AssertEqual(t, 1, streamedFrame.Rows(), "rows of streamed frame")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout receiving message after reconnect")
+	}
+}
+
+func TestHealthCheckKeepsStreamsOpen(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType:                   "SUBSCRIBE",
+		NatsSubject:                 "healthSubject",
+		StreamRequestUuidForTesting: "stream-health",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["A"].Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	go ds.RunStream(ctx, &backend.RunStreamRequest{
+		Path: q.StreamRequestUuidForTesting,
+	}, backend.NewStreamSender(&customPacketSender{
+		c: streamedMessagesChan,
+	}))
+
+	// the health check uses the connection shared with the stream ...
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{PluginContext: pluginContext})
+	AssertNoError(t, err)
+	AssertEqual(t, backend.HealthStatusOk, health.Status, "health status")
+	AssertEqual(t, false, ds.natsConn.IsClosed(), "NATS connection is closed")
+
+	// ... and the stream still receives messages afterwards.
+	AssertNoError(t, nc.Publish(q.NatsSubject, []byte(`{"i1": 1}`)))
+	select {
+	case msg := <-streamedMessagesChan:
+		var streamedFrame data.Frame
+		AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+		AssertEqual(t, 1, streamedFrame.Rows(), "rows of streamed frame")
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving message after health check")
+	}
+}
+
+func TestStreamingScript(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType: "STREAMING_SCRIPT",
+		JsFn: `
+			let count = 0;
+			nc.Subscribe("scriptSubject", (msg) => {
+				count++;
+				emit({count, payload: JSON.parse(msg.Data).i1});
+			});
+		`,
+		StreamRequestUuidForTesting: "stream-script",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	queryResponse := resp.Responses["A"]
+	AssertNoError(t, queryResponse.Error)
+	AssertEqual(t, "ds/uid1/stream-script", queryResponse.Frames[0].Meta.Channel, "channel does not match")
+	AssertEqual(t, 0, queryResponse.Frames[0].Rows(), "rows of initial frame")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	streamEnded := make(chan bool)
+	go func() {
+		ds.RunStream(ctx, &backend.RunStreamRequest{
+			Path: q.StreamRequestUuidForTesting,
+		}, backend.NewStreamSender(&customPacketSender{
+			c: streamedMessagesChan,
+		}))
+		close(streamEnded)
+	}()
+
+	for i := int64(1); i <= 2; i++ {
+		AssertNoError(t, nc.Publish("scriptSubject", []byte(fmt.Sprintf(`{"i1": %d}`, i*10))))
+		select {
+		case msg := <-streamedMessagesChan:
+			var streamedFrame data.Frame
+			AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+			AssertEqual(t, 1, streamedFrame.Rows(), "rows of streamed frame")
+			AssertEqual(t, i, *streamedFrame.Fields[0].At(0).(*int64), "count")
+			AssertEqual(t, i*10, *streamedFrame.Fields[1].At(0).(*int64), "payload")
+		case <-time.After(time.Second):
+			t.Fatalf("timeout receiving emitted row %d", i)
+		}
+	}
+
+	// when the panel unsubscribes, the subscriptions of the script are ended, and the stream is removed.
+	sr := ds.streamResponsesSoFar.Get(q.StreamRequestUuidForTesting).Value()
+	cancel()
+	<-streamEnded
+	AssertEqual(t, true, ds.streamResponsesSoFar.Get(q.StreamRequestUuidForTesting) == nil, "stream removed")
+	AssertNoError(t, nc.Publish("scriptSubject", []byte(`{"i1": 30}`)))
+	AssertNoError(t, nc.Flush())
+	time.Sleep(50 * time.Millisecond)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	AssertEqual(t, int64(2), sr.buffer.stats.received, "rows emitted")
+}
+
+func TestStreamingScriptEndsIfNotSubscribed(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType: "STREAMING_SCRIPT",
+		JsFn: `
+			nc.Subscribe("unwatchedSubject", (msg) => {
+				nc.Publish("unwatchedEcho", msg.Data);
+			});
+		`,
+		StreamRequestUuidForTesting: "stream-unwatched",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	ds.streamSubscribeTimeout = 500 * time.Millisecond
+	query, _ := json.Marshal(q)
+
+	echo, err := nc.SubscribeSync("unwatchedEcho")
+	AssertNoError(t, err)
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["A"].Error)
+
+	// the script runs until the deadline for a panel to subscribe has passed ...
+	AssertNoError(t, nc.Publish("unwatchedSubject", []byte("1")))
+	_, err = echo.NextMsg(time.Second)
+	AssertNoError(t, err)
+
+	// ... and is ended afterwards.
+	for i := 0; i < 50 && ds.streamResponsesSoFar.Get(q.StreamRequestUuidForTesting) != nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	AssertEqual(t, true, ds.streamResponsesSoFar.Get(q.StreamRequestUuidForTesting) == nil, "stream removed")
+	time.Sleep(50 * time.Millisecond)
+	AssertNoError(t, nc.Publish("unwatchedSubject", []byte("2")))
+	_, err = echo.NextMsg(200 * time.Millisecond)
+	AssertEqual(t, nats.ErrTimeout, err, "no echo after the stream ended")
+}
+
+func TestScriptQueryContext(t *testing.T) {
+	integration_test.StartTestNats(t)
+
+	q := queryModel{
+		QueryType: "SCRIPT",
+		JsFn: `
+			return {
+				refId: query.refId,
+				from: query.from,
+				team: query.variables.team,
+				login: query.user.login,
+			};
+		`,
+		Variables: map[string]string{"team": "blue"},
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	pluginContext.User = &backend.User{Login: "jane"}
+	query, _ := json.Marshal(q)
+	from := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "X",
+					JSON:      query,
+					TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	queryResponse := resp.Responses["X"]
+	AssertNoError(t, queryResponse.Error)
+	frame := queryResponse.Frames[0]
+	field := func(name string) interface{} {
+		f, _ := frame.FieldByName(name)
+		value, _ := f.ConcreteAt(0)
+		return value
+	}
+	AssertEqual[interface{}](t, "X", field("refId"), "refId")
+	AssertEqual[interface{}](t, from.UnixMilli(), field("from"), "from")
+	AssertEqual[interface{}](t, "blue", field("team"), "team")
+	AssertEqual[interface{}](t, "jane", field("login"), "login")
+}
+
+func TestScriptPermissionsOfDatasource(t *testing.T) {
+	integration_test.StartTestNats(t)
+
+	ds, pluginContext := newDatasourceForTesting()
+	pluginContext.DataSourceInstanceSettings.JSONData, _ = json.Marshal(MyDataSourceOptions{
+		NatsUrl:            fmt.Sprintf("127.0.0.1:%d", integration_test.TEST_PORT),
+		Authentication:     "NONE",
+		ScriptPublishAllow: "events.>, audit.*",
+		ScriptPublishDeny:  "events.internal.>",
+	})
+	run := func(jsFn string) backend.DataResponse {
+		query, _ := json.Marshal(queryModel{QueryType: "SCRIPT", JsFn: jsFn})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries:       []backend.DataQuery{{RefID: "X", JSON: query}},
+		})
+		AssertNoError(t, err)
+		return resp.Responses["X"]
+	}
+
+	AssertNoError(t, run(`nc.Publish("audit.login", "x"); return {};`).Error)
+	resp := run(`nc.Publish("events.internal.reset", "x"); return {};`)
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), "denied by events.internal.>") {
+		t.Fatalf("expected permission error, got: %v", resp.Error)
+	}
+	resp = run(`nc.Publish("orders.created", "x"); return {};`)
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), "not in the allowed subjects") {
+		t.Fatalf("expected permission error, got: %v", resp.Error)
+	}
+}
+
+func TestScriptLimitsCannotExceedDatasource(t *testing.T) {
+	for _, testcase := range []struct {
+		name     string
+		options  MyDataSourceOptions
+		q        queryModel
+		expected goja.Limits
+	}{
+		{
+			name:     "defaults",
+			expected: goja.Limits{Timeout: defaultScriptTimeout},
+		},
+		{
+			name:     "query lowers the limits",
+			options:  MyDataSourceOptions{ScriptTimeout: Duration{time.Minute}, ScriptMaxNatsOps: 10},
+			q:        queryModel{ScriptTimeout: Duration{time.Second}, ScriptMaxNatsOps: 5},
+			expected: goja.Limits{Timeout: time.Second, MaxNatsOps: 5},
+		},
+		{
+			name:     "query cannot raise the limits",
+			options:  MyDataSourceOptions{ScriptTimeout: Duration{time.Minute}, ScriptMaxNatsOps: 10},
+			q:        queryModel{ScriptTimeout: Duration{time.Hour}, ScriptMaxNatsOps: 50},
+			expected: goja.Limits{Timeout: time.Minute, MaxNatsOps: 10},
+		},
+		{
+			name:     "query cannot raise the default timeout",
+			q:        queryModel{ScriptTimeout: Duration{time.Hour}, ScriptMaxNatsOps: 50},
+			expected: goja.Limits{Timeout: defaultScriptTimeout, MaxNatsOps: 50},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			AssertEqual(t, testcase.expected, scriptLimits(&testcase.options, testcase.q), "limits")
+		})
+	}
+}
+
+func TestWasmMemoryLimitCannotExceedDatasource(t *testing.T) {
+	AssertEqual(t, uint64(0), wasmMaxMemoryBytes(&MyDataSourceOptions{}, queryModel{}), "unlimited")
+	AssertEqual(t, uint64(5*1024*1024), wasmMaxMemoryBytes(&MyDataSourceOptions{}, queryModel{WasmMaxMemoryMb: 5}), "query limit")
+	AssertEqual(t, uint64(5*1024*1024), wasmMaxMemoryBytes(&MyDataSourceOptions{WasmMaxMemoryMb: 10}, queryModel{WasmMaxMemoryMb: 5}), "lowered")
+	AssertEqual(t, uint64(10*1024*1024), wasmMaxMemoryBytes(&MyDataSourceOptions{WasmMaxMemoryMb: 10}, queryModel{WasmMaxMemoryMb: 50}), "not raised")
+}
+
+func TestStatefulSubscribe(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	teardownMessages := make(chan *nats.Msg, 1)
+	_, err := nc.ChanSubscribe("statefulTeardown", teardownMessages)
+	AssertNoError(t, err)
+
+	q := queryModel{
+		QueryType:   "SUBSCRIBE",
+		NatsSubject: "statefulSubject",
+		Stateful:    true,
+		JsInitFn: `
+			return {count: 0, last: null};
+		`,
+		JsFn: `
+			const value = JSON.parse(msg.Data).value;
+			const delta = state.last === null ? 0 : value - state.last;
+			state.count++;
+			state.last = value;
+			return {count: state.count, delta};
+		`,
+		JsTeardownFn: `
+			nc.Publish("statefulTeardown", JSON.stringify(state));
+		`,
+		StreamRequestUuidForTesting: "stream-stateful",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  query,
+				},
+			},
+		},
+	)
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["A"].Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streamedMessagesChan := make(chan json.RawMessage, 100)
+	streamEnded := make(chan bool)
+	go func() {
+		ds.RunStream(ctx, &backend.RunStreamRequest{
+			Path: q.StreamRequestUuidForTesting,
+		}, backend.NewStreamSender(&customPacketSender{
+			c: streamedMessagesChan,
+		}))
+		close(streamEnded)
+	}()
+
+	expectedDeltas := []int64{0, 5, -3}
+	for i, value := range []int{10, 15, 12} {
+		AssertNoError(t, nc.Publish("statefulSubject", []byte(fmt.Sprintf(`{"value": %d}`, value))))
+		select {
+		case msg := <-streamedMessagesChan:
+			var streamedFrame data.Frame
+			AssertNoError(t, json.Unmarshal(msg, &streamedFrame))
+			AssertEqual(t, int64(i+1), *streamedFrame.Fields[0].At(0).(*int64), "count")
+			AssertEqual(t, expectedDeltas[i], *streamedFrame.Fields[1].At(0).(*int64), "delta")
+		case <-time.After(time.Second):
+			t.Fatalf("timeout receiving message %d", i)
+		}
+	}
+
+	// when the panel unsubscribes, the teardown script runs with the final state.
+	cancel()
+	<-streamEnded
+	select {
+	case msg := <-teardownMessages:
+		AssertEqual(t, `{"count":3,"last":12}`, string(msg.Data), "final state")
+	case <-time.After(time.Second):
+		t.Fatalf("teardown script did not run")
+	}
+}
+
+func TestStatefulSubscribeRunsTeardownIfSubscriptionFails(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	teardownMessages := make(chan *nats.Msg, 1)
+	_, err := nc.ChanSubscribe("statefulTeardown", teardownMessages)
+	AssertNoError(t, err)
+
+	q := queryModel{
+		QueryType:                   "SUBSCRIBE",
+		NatsSubject:                 "invalid subject",
+		Stateful:                    true,
+		JsInitFn:                    `return {count: 0};`,
+		JsFn:                        `return {};`,
+		JsTeardownFn:                `nc.Publish("statefulTeardown", "done");`,
+		StreamRequestUuidForTesting: "stream-invalid",
+	}
+	ds, pluginContext := newDatasourceForTesting()
+	query, _ := json.Marshal(q)
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			PluginContext: pluginContext,
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: query}},
+		},
+	)
+	AssertNoError(t, err)
+	if resp.Responses["A"].Error == nil {
+		t.Fatalf("expected the subscription to fail")
+	}
+	select {
+	case msg := <-teardownMessages:
+		AssertEqual(t, "done", string(msg.Data), "teardown message")
+	case <-time.After(time.Second):
+		t.Fatalf("teardown script did not run")
+	}
+}
+
 func readAndValidateAllStreamedMessages(t *testing.T, testcase testCaseStreaming, streamedMessagesChan chan json.RawMessage) {
 	// we already received a message during setup, that's why we start counting at 1.
 	for i := 1; i < testcase.ExpectedMessages; i++ {
@@ -388,3 +988,142 @@ func AssertNoError(t *testing.T, err error) {
 		t.Fatalf("error is non-null: %v", err)
 	}
 }
+
+func TestScriptLibraryOfDatasource(t *testing.T) {
+	integration_test.StartTestNats(t)
+
+	ds, pluginContext := newDatasourceForTesting()
+	pluginContext.DataSourceInstanceSettings.JSONData, _ = json.Marshal(MyDataSourceOptions{
+		NatsUrl:        fmt.Sprintf("127.0.0.1:%d", integration_test.TEST_PORT),
+		Authentication: "NONE",
+		ScriptModules: []ScriptModule{
+			{Name: "greeting", Source: `exports.greet = (name) => "Hello " + name;`},
+		},
+	})
+	query, _ := json.Marshal(queryModel{QueryType: "SCRIPT", JsFn: `return {greeting: require("greeting").greet("NATS")};`})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginContext,
+		Queries:       []backend.DataQuery{{RefID: "X", JSON: query}},
+	})
+	AssertNoError(t, err)
+	AssertNoError(t, resp.Responses["X"].Error)
+	greeting, _ := resp.Responses["X"].Frames[0].Fields[0].ConcreteAt(0)
+	AssertEqual(t, "Hello NATS", greeting, "greeting")
+
+	pluginContext.DataSourceInstanceSettings.JSONData, _ = json.Marshal(MyDataSourceOptions{
+		NatsUrl:        fmt.Sprintf("127.0.0.1:%d", integration_test.TEST_PORT),
+		Authentication: "NONE",
+		ScriptModules: []ScriptModule{
+			{Name: "greeting", Source: "exports.greet = (name) => {\n\treturn 'Hello ' + ;\n};"},
+		},
+	})
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{PluginContext: pluginContext})
+	AssertNoError(t, err)
+	AssertEqual(t, backend.HealthStatusError, health.Status, "health status")
+	if !strings.Contains(health.Message, "module greeting: ") || !strings.Contains(health.Message, "line 2") {
+		t.Errorf("expected the syntax error of the module, got: %s", health.Message)
+	}
+
+	pluginContext.DataSourceInstanceSettings.JSONData, _ = json.Marshal(MyDataSourceOptions{
+		NatsUrl:        fmt.Sprintf("127.0.0.1:%d", integration_test.TEST_PORT),
+		Authentication: "NONE",
+		ScriptModules:  []ScriptModule{{Name: "a", Source: ""}, {Name: "a", Source: ""}},
+	})
+	health, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{PluginContext: pluginContext})
+	AssertNoError(t, err)
+	AssertEqual(t, "Script library is invalid: module a is defined multiple times", health.Message, "health message")
+}
+
+func TestWasmTransformOfQuery(t *testing.T) {
+	options := &MyDataSourceOptions{WasmModules: []WasmModule{
+		{Name: "plc", Wasm: base64.StdEncoding.EncodeToString([]byte("\x00asm"))},
+		{Name: "broken", Wasm: "not base64!"},
+	}}
+
+	transform, err := wasmTransform(options, queryModel{QueryType: QueryTypeSubscribe})
+	AssertNoError(t, err)
+	if transform != nil {
+		t.Errorf("expected no transform without wasmModule")
+	}
+	transform, err = wasmTransform(options, queryModel{QueryType: QueryTypeSubscribe, WasmModule: "plc"})
+	AssertNoError(t, err)
+	AssertEqual(t, "plc", transform.Name, "name")
+	AssertEqual(t, "\x00asm", string(transform.Binary), "binary")
+
+	tests := []struct {
+		qm            queryModel
+		expectedError string
+	}{
+		{queryModel{QueryType: QueryTypeRequestReply, WasmModule: "missing"}, "WebAssembly module missing not found"},
+		{queryModel{QueryType: QueryTypeRequestReply, WasmModule: "broken"}, "WebAssembly module broken is not base64-encoded"},
+		{queryModel{QueryType: QueryTypeScript, WasmModule: "plc"}, "can only be used by Request/Reply"},
+		{queryModel{QueryType: QueryTypeSubscribe, Stateful: true, WasmModule: "plc"}, "can only be used by Request/Reply"},
+	}
+	for _, test := range tests {
+		_, err := wasmTransform(options, test.qm)
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("expected error %q, got: %v", test.expectedError, err)
+		}
+	}
+	if err := checkWasmModules(&MyDataSourceOptions{WasmModules: options.WasmModules[:1]}); err == nil {
+		t.Errorf("expected the incomplete module to be invalid")
+	}
+}
+
+func TestExpressionsOfQuery(t *testing.T) {
+	expressions, err := queryExpressions(queryModel{QueryType: QueryTypeSubscribe, FilterExpression: "true"})
+	AssertNoError(t, err)
+	if expressions != nil {
+		t.Errorf("expected no expressions without useExpressions")
+	}
+	expressions, err = queryExpressions(queryModel{
+		QueryType:         QueryTypeRequestReply,
+		UseExpressions:    true,
+		FilterExpression:  "data.v > 1",
+		ColumnExpressions: []convert.ExpressionColumn{{Name: "v", Expression: "data.v"}},
+	})
+	AssertNoError(t, err)
+	AssertEqual(t, "data.v > 1", expressions.Filter, "filter")
+	AssertEqual(t, 1, len(expressions.Columns), "number of columns")
+
+	for _, qm := range []queryModel{
+		{QueryType: QueryTypeScript, UseExpressions: true},
+		{QueryType: QueryTypeSubscribe, Stateful: true, UseExpressions: true},
+		{QueryType: QueryTypeSubscribe, WasmModule: "plc", UseExpressions: true},
+	} {
+		if _, err := queryExpressions(qm); err == nil {
+			t.Errorf("expected expressions to be rejected for %+v", qm)
+		}
+	}
+
+	frames := discardedMessageFrames()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, 1, len(frames[0].Meta.Notices), "number of notices")
+}
+
+func TestMappingOfQuery(t *testing.T) {
+	mapping, err := queryMapping(queryModel{QueryType: QueryTypeSubscribe, MappingRows: "items"})
+	AssertNoError(t, err)
+	if mapping != nil {
+		t.Errorf("expected no mapping without useMapping")
+	}
+	mapping, err = queryMapping(queryModel{
+		QueryType:      QueryTypeRequestReply,
+		UseMapping:     true,
+		MappingRows:    "items",
+		MappingColumns: []convert.MappingColumn{{Name: "v", Path: "v", Type: convert.MappingNumber}},
+	})
+	AssertNoError(t, err)
+	AssertEqual(t, "items", mapping.Rows, "rows")
+	AssertEqual(t, 1, len(mapping.Columns), "number of columns")
+
+	for _, qm := range []queryModel{
+		{QueryType: QueryTypeScript, UseMapping: true},
+		{QueryType: QueryTypeSubscribe, Stateful: true, UseMapping: true},
+		{QueryType: QueryTypeSubscribe, UseExpressions: true, UseMapping: true},
+	} {
+		if _, err := queryMapping(qm); err == nil {
+			t.Errorf("expected the mapping to be rejected for %+v", qm)
+		}
+	}
+}
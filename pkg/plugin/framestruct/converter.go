@@ -1,6 +1,7 @@
 package framestruct
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -15,18 +16,36 @@ const frameTag = "frame"
 
 type converter struct {
 	fieldNames []string
-	fields     map[string]*data.Field
+	fields     map[string]*column
 	tags       []string
 	anyMap     bool
 	col0       string
 	maxLen     int
 	converters map[string]FieldConverter
+	arrays     ArrayMode
+	// choice is the element of each nested array in the row being converted, by arrayKey; see ArraysExplode.
+	choice map[string]reflect.Value
 }
 
+// ArrayMode is how arrays nested in the converted value (f.e. `tags: ["a", "b"]`) are handled. By default, nested
+// slices of structs and maps are flattened into additional rows, and other nested slices are unsupported.
+type ArrayMode string
+
+const (
+	// ArraysExplode converts each element of a nested array to its own row, with the fields of the parent repeated.
+	// If a row contains multiple arrays, a row is created for each combination of their elements; an empty array
+	// results in a single row, without fields for the array.
+	ArraysExplode ArrayMode = "explode"
+	// ArraysIndex converts the elements of a nested array to columns named by their index: field.0, field.1, ...
+	ArraysIndex ArrayMode = "index"
+	// ArraysJson converts a nested array to a single string field, containing the array as JSON.
+	ArraysJson ArrayMode = "json"
+)
+
 // ToDataFrame flattens an arbitrary struct or slice of structs into a *data.Frame
 func ToDataFrame(name string, toConvert interface{}, opts ...FramestructOption) (*data.Frame, error) {
 	cr := &converter{
-		fields:     make(map[string]*data.Field),
+		fields:     make(map[string]*column),
 		tags:       make([]string, 3),
 		converters: make(map[string]FieldConverter),
 	}
@@ -62,6 +81,12 @@ func ToDataFrames(name string, toConvert interface{}, opts ...FramestructOption)
 // and returns the new value as an interface
 type FieldConverter func(interface{}) (interface{}, error)
 
+// FieldFromValues returns a nullable field with the given values (pointers or values; nil for null). Like the fields of
+// ToDataFrame, its type is inferred from all values, and widened if they differ (f.e. 1 and 1.5 to float64).
+func FieldFromValues(name string, values []interface{}) *data.Field {
+	return (&column{values: values}).toField(name)
+}
+
 // FramestructOption takes a converter and applies some configuration to it
 type FramestructOption func(cr *converter)
 
@@ -83,12 +108,27 @@ func WithColumn0(fieldname string) FramestructOption {
 	}
 }
 
+// WithArrayMode configures how arrays nested in the converted value are handled, see ArrayMode.
+func WithArrayMode(mode ArrayMode) FramestructOption {
+	return func(cr *converter) {
+		cr.arrays = mode
+	}
+}
+
 func (c *converter) toDataframe(name string, toConvert interface{}) (*data.Frame, error) {
 	v := c.ensureValue(reflect.ValueOf(toConvert))
 	if !supportedToplevelType(v) {
 		return nil, errors.New("unsupported type: can only convert structs, slices, and maps")
 	}
 
+	if v.Kind() != reflect.Slice && c.arrays == ArraysExplode {
+		// a single row, which may be exploded to multiple ones.
+		if err := c.convertRow(v, func() error { return c.handleValue(v, "", "") }); err != nil {
+			return nil, err
+		}
+		return c.createFrame(name), nil
+	}
+
 	if err := c.handleValue(v, "", ""); err != nil {
 		return nil, err
 	}
@@ -106,6 +146,9 @@ func (c *converter) ensureValue(v reflect.Value) reflect.Value {
 func (c *converter) handleValue(field reflect.Value, tags, fieldName string) error {
 	switch field.Kind() {
 	case reflect.Slice:
+		if fieldName != "" && c.arrays != "" {
+			return c.convertNestedSlice(field, fieldName, fieldName)
+		}
 		return c.convertSlice(field, fieldName)
 	case reflect.Struct:
 		return c.convertStruct(field, fieldName)
@@ -127,22 +170,190 @@ func (c *converter) convertStruct(field reflect.Value, fieldName string) error {
 
 func (c *converter) convertSlice(s reflect.Value, prefix string) error {
 	for i := 0; i < s.Len(); i++ {
+		v := s.Index(i)
+		convert := func() error {
+			switch v.Kind() {
+			case reflect.Map:
+				return c.convertMap(v.Interface(), "", prefix)
+			default:
+				return c.convertStruct(v, prefix)
+			}
+		}
+		if c.arrays == ArraysExplode && prefix == "" {
+			if err := c.convertRow(v, convert); err != nil {
+				return err
+			}
+			continue
+		}
 		// SK BUGFIX START
 		c.maxLen++
 		// SK BUGFIX END
-		v := s.Index(i)
-		switch v.Kind() {
-		case reflect.Map:
-			if err := c.convertMap(v.Interface(), "", prefix); err != nil {
-				return err
+		if err := convert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertRow converts a single row (via convert) once for each combination of the elements of its nested arrays,
+// see ArraysExplode.
+func (c *converter) convertRow(v reflect.Value, convert func() error) error {
+	defer func() {
+		c.choice = nil
+	}()
+	for _, choice := range c.arrayChoices(v, "", "", "") {
+		c.choice = choice
+		c.maxLen++
+		if err := convert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertNestedSlice converts an array nested in a row according to c.arrays. key identifies the array in
+// c.choice: it is the field name, with a "[]" suffix for each level of arrays in arrays.
+func (c *converter) convertNestedSlice(s reflect.Value, key, fieldName string) error {
+	switch c.arrays {
+	case ArraysExplode:
+		element, ok := c.choice[key]
+		if !ok {
+			// the array is empty
+			return nil
+		}
+		if element.Kind() == reflect.Slice {
+			return c.convertNestedSlice(element, key+"[]", fieldName)
+		}
+		return c.handleValue(element, "", fieldName)
+	case ArraysIndex:
+		for i := 0; i < s.Len(); i++ {
+			element, ok := elementValue(s.Index(i))
+			if !ok {
+				continue
 			}
-		default:
-			if err := c.convertStruct(v, prefix); err != nil {
+			if err := c.handleValue(element, "", fmt.Sprintf("%s.%d", fieldName, i)); err != nil {
 				return err
 			}
 		}
+		return nil
+	case ArraysJson:
+		encoded, err := json.Marshal(s.Interface())
+		if err != nil {
+			return fmt.Errorf("field %s could not be converted to JSON: %w", fieldName, err)
+		}
+		return c.upsertField(reflect.ValueOf(string(encoded)), fieldName)
+	default:
+		return fmt.Errorf("unsupported array mode %q", c.arrays)
+	}
+}
+
+// arrayChoices returns the combinations of the elements of all arrays nested in v, which is named fieldName (and
+// identified by key in a choice, see convertNestedSlice). Each combination is a row for ArraysExplode.
+func (c *converter) arrayChoices(v reflect.Value, tags, key, fieldName string) []map[string]reflect.Value {
+	choices := []map[string]reflect.Value{{}}
+	v, ok := elementValue(v)
+	if !ok {
+		return choices
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		if fieldName == "" {
+			// not nested
+			return choices
+		}
+		choices = nil
+		for i := 0; i < v.Len(); i++ {
+			element, ok := elementValue(v.Index(i))
+			if !ok {
+				continue
+			}
+			elementKey := key
+			if element.Kind() == reflect.Slice {
+				elementKey = key + "[]"
+			}
+			for _, choice := range c.arrayChoices(element, "", elementKey, fieldName) {
+				choice[key] = element
+				choices = append(choices, choice)
+			}
+		}
+		if len(choices) == 0 {
+			return []map[string]reflect.Value{{}}
+		}
+		return choices
+	case reflect.Struct:
+		if _, isTime := v.Interface().(time.Time); isTime {
+			return choices
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !exported(v.Field(i)) {
+				continue
+			}
+			structField := v.Type().Field(i)
+			fieldTags := structField.Tag.Get(frameTag)
+			if fieldTags == "-" {
+				continue
+			}
+			name := c.fieldName(structField.Name, fieldTags, fieldName)
+			choices = combineChoices(choices, c.arrayChoices(v.Field(i), fieldTags, name, name))
+		}
+		return choices
+	case reflect.Map:
+		iter := v.MapRange()
+		keys := []string{}
+		values := map[string]reflect.Value{}
+		for iter.Next() {
+			k, isString := iter.Key().Interface().(string)
+			if !isString {
+				// reported by convertMap
+				return choices
+			}
+			keys = append(keys, k)
+			values[k] = iter.Value()
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			name := c.fieldName(k, tags, fieldName)
+			choices = combineChoices(choices, c.arrayChoices(values[k], "", name, name))
+		}
+		return choices
+	default:
+		return choices
 	}
-	return nil
+}
+
+// combineChoices returns all combinations of a and b.
+func combineChoices(a, b []map[string]reflect.Value) []map[string]reflect.Value {
+	if len(b) == 1 && len(b[0]) == 0 {
+		return a
+	}
+	combined := make([]map[string]reflect.Value, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			choice := make(map[string]reflect.Value, len(x)+len(y))
+			for k, v := range x {
+				choice[k] = v
+			}
+			for k, v := range y {
+				choice[k] = v
+			}
+			combined = append(combined, choice)
+		}
+	}
+	return combined
+}
+
+// elementValue returns the value inside interfaces and pointers; ok is false for nil.
+func elementValue(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return v, false
+		}
+		if _, isTime := v.Interface().(*time.Time); isTime {
+			return v, true
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
 }
 
 func (c *converter) convertStructFields(v reflect.Value, prefix string) error {
@@ -229,19 +440,18 @@ func (c *converter) upsertField(v reflect.Value, fieldName string) error {
 		return err
 	}
 
+	if _, err := sliceFor(valueOf); err != nil {
+		return err
+	}
+
 	if _, exists := c.fields[fieldName]; !exists {
 		// keep track of unique fields in the order they appear
 		c.fieldNames = append(c.fieldNames, fieldName)
-		v, err := sliceFor(valueOf)
-		if err != nil {
-			return err
-		}
-
-		c.fields[fieldName] = data.NewField(fieldName, nil, v)
+		c.fields[fieldName] = &column{}
 	}
 
 	c.padField(c.fields[fieldName], c.maxLen-1)
-	c.appendToField(fieldName, toPointer(valueOf))
+	c.appendToField(fieldName, valueOf)
 	return nil
 }
 
@@ -257,7 +467,7 @@ func (c *converter) convertField(v reflect.Value, fieldName string) (interface{}
 }
 
 func (c *converter) appendToField(name string, value interface{}) {
-	c.fields[name].Append(value)
+	c.fields[name].values = append(c.fields[name].values, value)
 	// SK BUGFIX START
 	/*if c.fields[name].Len() > c.maxLen {
 		c.maxLen++
@@ -272,14 +482,14 @@ func (c *converter) createFrame(name string) *data.Frame {
 
 	frame := data.NewFrame(name)
 	for _, f := range c.getFieldnames() {
-		frame.Fields = append(frame.Fields, c.fields[f])
+		frame.Fields = append(frame.Fields, c.fields[f].toField(f))
 	}
 	return frame
 }
 
-func (c *converter) padField(f *data.Field, maxLen int) {
-	for f.Len() < maxLen {
-		f.Append(nil)
+func (c *converter) padField(f *column, maxLen int) {
+	for len(f.values) < maxLen {
+		f.values = append(f.values, nil)
 	}
 }
 
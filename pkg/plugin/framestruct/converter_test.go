@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
-	"github.com/grafana/grafana-plugin-sdk-go/data/framestruct"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
 	"github.com/stretchr/testify/require"
 )
 
@@ -497,6 +497,178 @@ func TestMaps(t *testing.T) {
 	})
 }
 
+func TestArrays(t *testing.T) {
+	// like JSON decoded by encoding/json, or exported from JS
+	sensor := func() map[string]interface{} {
+		return map[string]interface{}{
+			"id":   "s1",
+			"tags": []interface{}{"a", "b"},
+			"readings": []interface{}{
+				map[string]interface{}{"value": 21.5},
+				map[string]interface{}{"value": 22.5, "unit": "celsius"},
+			},
+		}
+	}
+
+	t.Run("it explodes arrays into rows, repeating the parent fields", func(t *testing.T) {
+		m := sensor()
+		delete(m, "readings")
+
+		frame, err := framestruct.ToDataFrame("results", m, framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, 2, frame.Rows())
+		require.Equal(t, []interface{}{"s1", "s1"}, fieldValues(frame, "id"))
+		require.Equal(t, []interface{}{"a", "b"}, fieldValues(frame, "tags"))
+	})
+
+	t.Run("it explodes arrays of objects into fields of the rows", func(t *testing.T) {
+		m := sensor()
+		delete(m, "tags")
+
+		frame, err := framestruct.ToDataFrame("results", []map[string]interface{}{m, {"id": "s2"}}, framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, 3, frame.Rows())
+		require.Equal(t, []interface{}{"s1", "s1", "s2"}, fieldValues(frame, "id"))
+		require.Equal(t, []interface{}{21.5, 22.5, nil}, fieldValues(frame, "readings.value"))
+		require.Equal(t, []interface{}{nil, "celsius", nil}, fieldValues(frame, "readings.unit"))
+	})
+
+	t.Run("it explodes multiple arrays into all combinations", func(t *testing.T) {
+		frame, err := framestruct.ToDataFrame("results", sensor(), framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, 4, frame.Rows())
+		require.Equal(t, []interface{}{21.5, 21.5, 22.5, 22.5}, fieldValues(frame, "readings.value"))
+		require.Equal(t, []interface{}{"a", "b", "a", "b"}, fieldValues(frame, "tags"))
+	})
+
+	t.Run("it explodes nested arrays and keeps rows with empty arrays", func(t *testing.T) {
+		m := []map[string]interface{}{
+			{"id": "s1", "matrix": []interface{}{[]interface{}{1.0, 2.0}, []interface{}{3.0}}},
+			{"id": "s2", "matrix": []interface{}{}},
+		}
+
+		frame, err := framestruct.ToDataFrame("results", m, framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, 4, frame.Rows())
+		require.Equal(t, []interface{}{"s1", "s1", "s1", "s2"}, fieldValues(frame, "id"))
+		require.Equal(t, []interface{}{1.0, 2.0, 3.0, nil}, fieldValues(frame, "matrix"))
+	})
+
+	t.Run("it explodes slices of structs", func(t *testing.T) {
+		strct := unsupportedTypeSlice{
+			Foo: []string{"1", "2", "3"},
+		}
+
+		frame, err := framestruct.ToDataFrame("results", strct, framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, []interface{}{"1", "2", "3"}, fieldValues(frame, "Foo"))
+	})
+
+	t.Run("it flattens arrays into indexed fields", func(t *testing.T) {
+		frame, err := framestruct.ToDataFrame("results", []map[string]interface{}{sensor(), {"id": "s2", "tags": []interface{}{"c"}}}, framestruct.WithArrayMode(framestruct.ArraysIndex))
+		require.Nil(t, err)
+
+		require.Equal(t, 2, frame.Rows())
+		require.Equal(t, []interface{}{"s1", "s2"}, fieldValues(frame, "id"))
+		require.Equal(t, []interface{}{21.5, nil}, fieldValues(frame, "readings.0.value"))
+		require.Equal(t, []interface{}{"celsius", nil}, fieldValues(frame, "readings.1.unit"))
+		require.Equal(t, []interface{}{"a", "c"}, fieldValues(frame, "tags.0"))
+		require.Equal(t, []interface{}{"b", nil}, fieldValues(frame, "tags.1"))
+	})
+
+	t.Run("it converts arrays to JSON fields", func(t *testing.T) {
+		frame, err := framestruct.ToDataFrame("results", sensor(), framestruct.WithArrayMode(framestruct.ArraysJson))
+		require.Nil(t, err)
+
+		require.Equal(t, 1, frame.Rows())
+		require.Equal(t, []interface{}{`["a","b"]`}, fieldValues(frame, "tags"))
+		require.Equal(t, []interface{}{`[{"value":21.5},{"unit":"celsius","value":22.5}]`}, fieldValues(frame, "readings"))
+
+		strct := unsupportedTypeSlice{
+			Foo: []string{"1", "2", "3"},
+		}
+		frame, err = framestruct.ToDataFrame("results", strct, framestruct.WithArrayMode(framestruct.ArraysJson))
+		require.Nil(t, err)
+		require.Equal(t, []interface{}{`["1","2","3"]`}, fieldValues(frame, "Foo"))
+	})
+
+	t.Run("it does not support nested arrays by default", func(t *testing.T) {
+		_, err := framestruct.ToDataFrame("results", sensor())
+		require.Error(t, err)
+	})
+}
+
+func TestTypeInference(t *testing.T) {
+	t.Run("it widens integers and floats to float64", func(t *testing.T) {
+		rows := []map[string]interface{}{{"v": int64(1)}, {"v": 1.5}, {"v": int32(2)}}
+
+		frame, err := framestruct.ToDataFrame("results", rows)
+		require.Nil(t, err)
+
+		require.Equal(t, data.FieldTypeNullableFloat64, frame.Fields[0].Type())
+		require.Equal(t, []interface{}{1.0, 1.5, 2.0}, fieldValues(frame, "v"))
+	})
+
+	t.Run("it widens integers of different sizes to int64, or uint64 if all are unsigned", func(t *testing.T) {
+		rows := []map[string]interface{}{
+			{"i": int8(1), "u": uint8(1)},
+			{"i": uint32(2), "u": uint64(2)},
+		}
+
+		frame, err := framestruct.ToDataFrame("results", rows)
+		require.Nil(t, err)
+
+		require.Equal(t, []interface{}{int64(1), int64(2)}, fieldValues(frame, "i"))
+		require.Equal(t, []interface{}{uint64(1), uint64(2)}, fieldValues(frame, "u"))
+	})
+
+	t.Run("it widens other mixed types to string", func(t *testing.T) {
+		ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		rows := []map[string]interface{}{{"v": 1.5}, {"v": "n/a"}, {"v": true}, {"v": ts}, {"v": int64(3)}}
+
+		frame, err := framestruct.ToDataFrame("results", rows)
+		require.Nil(t, err)
+
+		require.Equal(t, data.FieldTypeNullableString, frame.Fields[0].Type())
+		require.Equal(t, []interface{}{"1.5", "n/a", "true", "2024-01-02T03:04:05Z", "3"}, fieldValues(frame, "v"))
+	})
+
+	t.Run("it ignores null and missing values", func(t *testing.T) {
+		rows := []map[string]interface{}{{"v": nil}, {"v": int64(1)}, {"w": "x"}, {"v": 2.5}}
+
+		frame, err := framestruct.ToDataFrame("results", rows)
+		require.Nil(t, err)
+
+		require.Equal(t, []interface{}{nil, 1.0, nil, 2.5}, fieldValues(frame, "v"))
+		require.Equal(t, []interface{}{nil, nil, "x", nil}, fieldValues(frame, "w"))
+	})
+
+	t.Run("it keeps the declared type of fields without values", func(t *testing.T) {
+		type row struct {
+			V *int32
+		}
+		frame, err := framestruct.ToDataFrame("results", []row{{}, {}})
+		require.Nil(t, err)
+
+		require.Equal(t, data.FieldTypeNullableInt32, frame.Fields[0].Type())
+		require.Equal(t, []interface{}{nil, nil}, fieldValues(frame, "V"))
+	})
+
+	t.Run("it widens exploded array elements", func(t *testing.T) {
+		m := map[string]interface{}{"values": []interface{}{int64(1), 1.5}}
+
+		frame, err := framestruct.ToDataFrame("results", m, framestruct.WithArrayMode(framestruct.ArraysExplode))
+		require.Nil(t, err)
+
+		require.Equal(t, []interface{}{1.0, 1.5}, fieldValues(frame, "values"))
+	})
+}
+
 func TestStructTags(t *testing.T) {
 	t.Run("it ignores fields when the struct tag is a '-'", func(t *testing.T) {
 		strct := structWithIgnoredTag{"foo", "bar", "baz"}
@@ -952,6 +1124,21 @@ func (f *mockFramer) Frames() (data.Frames, error) {
 	return []*data.Frame{frame}, nil
 }
 
+// fieldValues returns the values of the field with the given name; nil for null values.
+func fieldValues(frame *data.Frame, name string) []interface{} {
+	field, _ := frame.FieldByName(name)
+	if field == nil {
+		return nil
+	}
+	values := make([]interface{}, field.Len())
+	for i := range values {
+		if value, ok := field.ConcreteAt(i); ok {
+			values[i] = value
+		}
+	}
+	return values
+}
+
 func fromPointer(value interface{}) interface{} {
 	switch v := value.(type) {
 	case *int8:
@@ -3,9 +3,126 @@ package framestruct
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
+// column collects the values of a field (nil for missing ones). Its type is only inferred once all rows are
+// converted, see toField - so that values of different types in different rows (f.e. 1 and 1.5) can be combined.
+type column struct {
+	values []interface{}
+}
+
+// toField returns the field with the values of the column, converted to the type inferred by fieldType.
+func (col *column) toField(name string) *data.Field {
+	t := col.fieldType()
+	slice, _ := sliceFor(reflect.Zero(t).Interface())
+	field := data.NewField(name, nil, slice)
+	for _, value := range col.values {
+		field.Append(convertTo(value, t))
+	}
+	return field
+}
+
+// fieldType infers the type of the field from all values: if all (non-null) values have the same type, it is used.
+// Otherwise, the type is widened: integers and floats to float64, integers of different sizes to int64 (or uint64 if
+// all are unsigned), and any other mix to string.
+func (col *column) fieldType() reflect.Type {
+	var types []reflect.Type
+	seen := map[reflect.Type]bool{}
+	var declared reflect.Type
+	for _, value := range col.values {
+		if value == nil {
+			continue
+		}
+		v := reflect.ValueOf(value)
+		t := v.Type()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+			if v.IsNil() {
+				// a null value of a declared type: only used if there are no other values.
+				declared = t
+				continue
+			}
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+
+	switch {
+	case len(types) == 0:
+		return declared
+	case len(types) == 1:
+		return types[0]
+	}
+	anyFloat, allUnsigned := false, true
+	for _, t := range types {
+		switch t.Kind() {
+		case reflect.Float32, reflect.Float64:
+			anyFloat = true
+			allUnsigned = false
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			allUnsigned = false
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return reflect.TypeOf("")
+		}
+	}
+	switch {
+	case anyFloat:
+		return reflect.TypeOf(float64(0))
+	case allUnsigned:
+		return reflect.TypeOf(uint64(0))
+	default:
+		return reflect.TypeOf(int64(0))
+	}
+}
+
+// convertTo converts the value of a column to a pointer of the field type t (see column.fieldType); nil for null.
+func convertTo(value interface{}, t reflect.Type) interface{} {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem() == t {
+			return value
+		}
+		v = v.Elem()
+	}
+	if v.Type() == t {
+		return toPointer(value)
+	}
+	if t.Kind() == reflect.String {
+		s := formatValue(v.Interface())
+		return &s
+	}
+	return toPointer(v.Convert(t).Interface())
+}
+
+// formatValue formats a value of a field which was widened to string.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
 func sliceFor(value interface{}) (interface{}, error) {
 	switch v := value.(type) {
 	case int8:
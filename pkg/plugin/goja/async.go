@@ -0,0 +1,79 @@
+package goja
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/nats-io/nats.go"
+)
+
+// Asynchronous NATS calls (f.e. nc.RequestAsync) run on their own goroutine, and return a Promise. As a goja
+// runtime is not goroutine-safe, the promise is settled on the goroutine of the script: Once the call finished,
+// its completion is sent to the execution, which runs it in await - this is a minimal event loop per execution.
+//
+// This way, a script can run independent requests concurrently:
+//
+//	const [a, b] = await Promise.all([nc.RequestAsync("a", "", "1s"), nc.RequestAsync("b", "", "1s")]);
+
+// RequestAsync is like Request, but does not block the script.
+func (e *execution) RequestAsync(nc *scriptConn, subj string, data []byte, timeout time.Duration) *goja.Promise {
+	return e.async(func() (interface{}, error) {
+		return e.Request(nc, subj, data, timeout)
+	})
+}
+
+// RequestMsgAsync is like RequestMsg, but does not block the script.
+func (e *execution) RequestMsgAsync(nc *scriptConn, msg *nats.Msg, timeout time.Duration) *goja.Promise {
+	return e.async(func() (interface{}, error) {
+		return e.RequestMsg(nc, msg, timeout)
+	})
+}
+
+// async runs fn on its own goroutine, and returns a promise for its result. It must be called from the script.
+func (e *execution) async(fn func() (interface{}, error)) *goja.Promise {
+	promise, resolve, reject := e.vm.NewPromise()
+	e.pending++
+	go func() {
+		result, err := fn()
+		complete := func() {
+			e.pending--
+			if err != nil {
+				reject(e.vm.NewGoError(err))
+			} else {
+				resolve(result)
+			}
+		}
+		select {
+		case e.completions <- complete:
+		case <-e.ctx.Done():
+			// the script already finished, or was stopped.
+		}
+	}()
+	return promise
+}
+
+// await runs the completions of all pending asynchronous calls, until there are none left and the given result is
+// settled (if it is a promise). It returns the value of the promise; or the result itself, if it is no promise.
+func (e *execution) await(result goja.Value) (goja.Value, error) {
+	promise, isPromise := exportOf(result).(*goja.Promise)
+	for e.pending > 0 || (isPromise && promise.State() == goja.PromiseStatePending) {
+		if e.pending == 0 {
+			return nil, errors.New("the promise returned by the script never settles")
+		}
+		select {
+		case <-e.ctx.Done():
+			// the watchdog set the reason, see runGuarded.
+			return nil, e.ctx.Err()
+		case complete := <-e.completions:
+			complete()
+		}
+	}
+	if !isPromise {
+		return result, nil
+	}
+	if promise.State() == goja.PromiseStateRejected {
+		return nil, &promiseRejection{reason: promise.Result()}
+	}
+	return promise.Result(), nil
+}
@@ -0,0 +1,126 @@
+package goja
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/integration_test"
+)
+
+// startSlowService replies to requests on subject after the given delay, with the subject as payload.
+func startSlowService(t *testing.T, nc *nats.Conn, subject string, delay time.Duration) {
+	t.Helper()
+	_, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		go func() {
+			time.Sleep(delay)
+			_ = msg.Respond([]byte(`{"service": "` + msg.Subject + `"}`))
+		}()
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %s", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("could not flush: %s", err)
+	}
+}
+
+func TestAsyncRequestsRunConcurrently(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	startSlowService(t, nc, "status.>", 200*time.Millisecond)
+
+	start := time.Now()
+	frames, err := RunScript(context.Background(), nc, `
+		const services = [];
+		for (let i = 0; i < 10; i++) {
+			services.push("status." + i);
+		}
+		const replies = await Promise.all(services.map((s) => nc.RequestAsync(s, "", "2s")));
+		return replies.map((reply) => JSON.parse(reply.Data));
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if frames[0].Rows() != 10 {
+		t.Fatalf("expected 10 rows, got %d", frames[0].Rows())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected requests to run concurrently, took %s", elapsed)
+	}
+}
+
+func TestAsyncRequestAll(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	startSlowService(t, nc, "status.ok", 10*time.Millisecond)
+
+	frames, err := RunScript(context.Background(), nc, `
+		const replies = await nc.RequestAll([
+			{subject: "status.ok", data: ""},
+			{subject: "status.nobody.listens", data: ""},
+		], "500ms");
+		return replies.map((reply) => ({ok: reply !== null}));
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	for i, expected := range []bool{true, false} {
+		if v, _ := frames[0].Fields[0].ConcreteAt(i); v != expected {
+			t.Errorf("reply %d: expected ok=%v, was %v", i, expected, v)
+		}
+	}
+}
+
+func TestAsyncPromiseReturnedFromMessageConversion(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	startSlowService(t, nc, "enrich", 10*time.Millisecond)
+
+	frames, err := ConvertMessage(context.Background(), nc, &nats.Msg{Data: []byte(`{}`)}, `
+		return nc.RequestAsync("enrich", msg.Data, "1s").then((reply) => JSON.parse(reply.Data));
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if v, _ := frames[0].Fields[0].ConcreteAt(0); v != "enrich" {
+		t.Fatalf("expected the awaited reply, was %v", v)
+	}
+}
+
+func TestAsyncErrors(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	_, err := RunScript(context.Background(), nc, `
+		await nc.RequestAsync("nobody.listens", "", "50ms");
+		return {};
+	`)
+	if err == nil || !strings.Contains(err.Error(), "unhandled promise rejection") {
+		t.Fatalf("expected the rejection as error, was: %v", err)
+	}
+
+	_, err = RunScript(context.Background(), nc, `
+		await new Promise(() => {});
+		return {};
+	`)
+	if err == nil || !strings.Contains(err.Error(), "never settles") {
+		t.Fatalf("expected an error for a promise which never settles, was: %v", err)
+	}
+}
+
+func TestAsyncRespectsLimits(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	startSlowService(t, nc, "slow", 5*time.Second)
+
+	_, err := RunScript(context.Background(), nc, `
+		await nc.RequestAsync("slow", "", "1h");
+		return {};
+	`, WithLimits(Limits{Timeout: 100 * time.Millisecond}))
+	assertLimitError(t, err, "time limit of 100ms")
+
+	// goja does not fully unwind interrupted scripts, so the interrupted runtime must not be reused.
+	for i := 0; i < 10; i++ {
+		if _, err := RunScript(context.Background(), nc, `return await Promise.resolve({k: "v"});`); err != nil {
+			t.Fatalf("script after interrupted script failed: %s", err)
+		}
+	}
+}
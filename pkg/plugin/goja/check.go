@@ -0,0 +1,118 @@
+package goja
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/parser"
+)
+
+// ScriptKind is the way a script is run (ConvertMessage, RunScript, ...); it determines how the user-defined
+// script is wrapped, see Check.
+type ScriptKind int
+
+const (
+	// MessageScript converts a single message, see ConvertMessage.
+	MessageScript ScriptKind = iota
+	// FreeFormScript is run by RunScript.
+	FreeFormScript
+	// StreamingScript is run by RunStreamingScript.
+	StreamingScript
+	// StatefulScript is the message, init or teardown script of a StatefulConverter.
+	StatefulScript
+	// ModuleScript is a module of the script library, see Modules.
+	ModuleScript
+)
+
+// wrap wraps the user-defined script like it is run.
+func (k ScriptKind) wrap(js string) string {
+	switch k {
+	case FreeFormScript:
+		return wrapJsScript(js)
+	case StreamingScript:
+		return wrapJsStreamingScript(js)
+	case StatefulScript:
+		return wrapJsStateful(js)
+	case ModuleScript:
+		return wrapJsModule(js)
+	default:
+		return wrapJs(js)
+	}
+}
+
+// userPosition translates a (1-based) position in the wrapped script to the position in the user-defined script
+// jsFn. ok is false if the position is inside of the wrapper.
+func (k ScriptKind) userPosition(jsFn string, line, column int) (userLine, userColumn int, ok bool) {
+	// the wrapper is the same for all scripts, so its prefix is found via a marker.
+	const marker = "\x00"
+	prefix := k.wrap(marker)
+	prefix = prefix[:strings.Index(prefix, marker)]
+	prefixLines := strings.Count(prefix, "\n")
+	prefixColumns := len(prefix) - strings.LastIndex(prefix, "\n") - 1
+
+	userLine = line - prefixLines
+	userColumn = column
+	if userLine == 1 {
+		userColumn = column - prefixColumns
+	}
+	if userLine < 1 || userColumn < 1 || userLine > strings.Count(jsFn, "\n")+1 {
+		return 0, 0, false
+	}
+	return userLine, userColumn, true
+}
+
+// Check compiles the given script like it would be run as kind, without running it. It returns a *ScriptError if
+// the script has a syntax error. Only the language option (see WithLanguage) is relevant.
+func Check(jsFn string, kind ScriptKind, opts ...Option) error {
+	if buildOptions(opts).language == TypeScript {
+		return checkTypeScript(jsFn, kind)
+	}
+	wrapped := kind.wrap(jsFn)
+	// goja.Compile drops the position of parser errors, so the script is parsed separately first.
+	if _, err := parser.ParseFile(nil, "", wrapped, 0); err != nil {
+		var errorList parser.ErrorList
+		if errors.As(err, &errorList) && len(errorList) > 0 {
+			return kind.scriptError(jsFn, errorList[0].Message, errorList[0].Position.Line, errorList[0].Position.Column)
+		}
+		return &ScriptError{Message: err.Error()}
+	}
+	_, err := compile(wrapped)
+	if err == nil {
+		return nil
+	}
+
+	var compilerErr *goja.CompilerSyntaxError
+	switch {
+	case errors.As(err, &compilerErr) && compilerErr.File != nil:
+		position := compilerErr.File.Position(compilerErr.Offset)
+		return kind.scriptError(jsFn, compilerErr.Message, position.Line, position.Column)
+	default:
+		return &ScriptError{Message: err.Error()}
+	}
+}
+
+// checkTypeScript is Check for TypeScript: syntax errors are found by transpile; the remaining (rare) compile
+// errors of goja are mapped back to the TypeScript script.
+func checkTypeScript(jsFn string, kind ScriptKind) error {
+	t, err := transpile(kind.wrap(jsFn))
+	var transpileErr *transpileError
+	switch {
+	case errors.As(err, &transpileErr):
+		return kind.scriptError(jsFn, transpileErr.Message, transpileErr.Line, transpileErr.Column)
+	case err != nil:
+		return &ScriptError{Message: err.Error()}
+	}
+	_, err = compile(t.js)
+	if err == nil {
+		return nil
+	}
+	var compilerErr *goja.CompilerSyntaxError
+	if errors.As(err, &compilerErr) && compilerErr.File != nil {
+		position := compilerErr.File.Position(compilerErr.Offset)
+		if line, column, ok := t.sourcePosition(position.Line, position.Column); ok {
+			return kind.scriptError(jsFn, compilerErr.Message, line, column)
+		}
+	}
+	return &ScriptError{Message: err.Error()}
+}
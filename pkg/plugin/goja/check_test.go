@@ -0,0 +1,49 @@
+package goja
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		js             string
+		kind           ScriptKind
+		expectedLine   int
+		expectedColumn int
+	}{
+		{"valid message script", `return JSON.parse(msg.Data);`, MessageScript, 0, 0},
+		{"valid free-form script with await", `return await nc.RequestAsync("a", "", "1s");`, FreeFormScript, 0, 0},
+		{"error in first line", `return JSON.parse(msg.Data));`, MessageScript, 1, 28},
+		{"error in later line", "const a = 1;\nconst b = ;\nreturn {a, b};", MessageScript, 2, 11},
+		{"error in streaming script", "emit({k: 1});\n\nemit({k: });", StreamingScript, 3, 10},
+		{"error in stateful script", "state.count = (state.count || 0) + 1;\nreturn {count: state.count}}", StatefulScript, 2, 29},
+		{"error after the end of the script", "if (msg) {\n\treturn {};", MessageScript, -1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Check(test.js, test.kind)
+			if test.expectedLine == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got: %s", err)
+				}
+				return
+			}
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("expected ScriptError, got: %v", err)
+			}
+			if test.expectedLine == -1 {
+				// the position is inside of the wrapper, and thus unknown.
+				if scriptErr.Line != 0 {
+					t.Fatalf("expected no position, was at %d:%d (%s)", scriptErr.Line, scriptErr.Column, scriptErr.Message)
+				}
+				return
+			}
+			if scriptErr.Line != test.expectedLine || scriptErr.Column != test.expectedColumn {
+				t.Fatalf("expected error at %d:%d, was at %d:%d (%s)", test.expectedLine, test.expectedColumn, scriptErr.Line, scriptErr.Column, scriptErr.Message)
+			}
+		})
+	}
+}
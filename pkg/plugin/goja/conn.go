@@ -0,0 +1,359 @@
+package goja
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Permissions restrict what scripts may do with the NATS connection. The connection is shared by all queries of a
+// data source, so scripts never get the *nats.Conn itself, but a scriptConn - which offers the messaging calls only,
+// and checks them against the permissions.
+//
+// Subject patterns use the NATS wildcards: "*" matches a single token, ">" all remaining tokens. A call is denied
+// if its subject may match any of the Deny patterns; or if Allow patterns are given, and none of them covers the
+// subject. For subscriptions with wildcards, this means f.e. that "orders.>" is denied by "orders.internal.*".
+type Permissions struct {
+	// ReadOnly forbids everything with side effects: publishing, JetStream publishing, and modifying KV and object
+	// store buckets. Requests and subscriptions are still allowed - except for requests to the JetStream API which
+	// are not read-only (see readOnlyRequests), and to the KV and object store subjects.
+	ReadOnly bool
+
+	PublishAllow   []string
+	PublishDeny    []string
+	RequestAllow   []string
+	RequestDeny    []string
+	SubscribeAllow []string
+	SubscribeDeny  []string
+}
+
+// WithPermissions restricts the script's use of the NATS connection, see Permissions.
+func WithPermissions(permissions Permissions) Option {
+	return func(o *options) {
+		o.permissions = permissions
+	}
+}
+
+// PermissionError is returned if a script calls a NATS method which it is not allowed to.
+type PermissionError struct {
+	// Operation is f.e. "publish to orders.delete"
+	Operation string
+	Reason    string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s is not allowed: %s", e.Operation, e.Reason)
+}
+
+// checkSubject checks the given subject against the allow and deny patterns of one kind of operation.
+func checkSubject(operation, subject string, allow, deny []string) error {
+	for _, pattern := range deny {
+		if subjectsOverlap(pattern, subject) {
+			return &PermissionError{Operation: fmt.Sprintf("%s %s", operation, subject), Reason: fmt.Sprintf("denied by %s", pattern)}
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, pattern := range allow {
+		if subjectCovers(pattern, subject) {
+			return nil
+		}
+	}
+	return &PermissionError{Operation: fmt.Sprintf("%s %s", operation, subject), Reason: "not in the allowed subjects"}
+}
+
+func (p Permissions) checkPublish(subject string) error {
+	if p.ReadOnly {
+		return &PermissionError{Operation: fmt.Sprintf("publish to %s", subject), Reason: "the connection is read-only"}
+	}
+	return checkSubject("publish to", subject, p.PublishAllow, p.PublishDeny)
+}
+
+func (p Permissions) checkRequest(subject string) error {
+	if p.ReadOnly && !isReadOnlyRequest(subject) {
+		return &PermissionError{Operation: fmt.Sprintf("request to %s", subject), Reason: "the connection is read-only"}
+	}
+	return checkSubject("request to", subject, p.RequestAllow, p.RequestDeny)
+}
+
+// jetStreamRequests are the subjects of JetStream (incl. KV and object stores) which can be modified by plain
+// requests, f.e. nc.Request("$JS.API.STREAM.DELETE.ORDERS"); for read-only connections, only the readOnlyRequests
+// among them are allowed.
+var jetStreamRequests = []string{"$JS.>", "$KV.>", "$O.>"}
+
+// readOnlyRequests are the requests to the JetStream API without side effects.
+var readOnlyRequests = []string{
+	"$JS.API.INFO",
+	"$JS.API.STREAM.NAMES",
+	"$JS.API.STREAM.LIST",
+	"$JS.API.STREAM.INFO.*",
+	"$JS.API.STREAM.MSG.GET.*",
+	"$JS.API.DIRECT.GET.>",
+	"$JS.API.CONSUMER.NAMES.*",
+	"$JS.API.CONSUMER.LIST.*",
+	"$JS.API.CONSUMER.INFO.*.*",
+	"$JS.API.CONSUMER.MSG.NEXT.*.*",
+}
+
+// isReadOnlyRequest returns whether a request to the given subject cannot modify JetStream, see jetStreamRequests.
+func isReadOnlyRequest(subject string) bool {
+	for _, pattern := range readOnlyRequests {
+		if subjectCovers(pattern, subject) {
+			return true
+		}
+	}
+	for _, pattern := range jetStreamRequests {
+		if subjectsOverlap(pattern, subject) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Permissions) checkSubscribe(subject string) error {
+	return checkSubject("subscribe to", subject, p.SubscribeAllow, p.SubscribeDeny)
+}
+
+// checkWrite is used for JetStream calls with side effects, which are not bound to a single subject.
+func (p Permissions) checkWrite(operation string) error {
+	if p.ReadOnly {
+		return &PermissionError{Operation: operation, Reason: "the connection is read-only"}
+	}
+	return nil
+}
+
+// subjectCovers returns whether all subjects matched by subject are matched by pattern as well.
+func subjectCovers(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		switch {
+		case token == ">":
+			return i < len(subjectTokens)
+		case i >= len(subjectTokens) || subjectTokens[i] == ">":
+			return false
+		case token != "*" && token != subjectTokens[i]:
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// subjectsOverlap returns whether there is a subject matched by both a and b.
+func subjectsOverlap(a, b string) bool {
+	aTokens := strings.Split(a, ".")
+	bTokens := strings.Split(b, ".")
+	for i := 0; i < len(aTokens) && i < len(bTokens); i++ {
+		switch {
+		case aTokens[i] == ">" || bTokens[i] == ">":
+			return true
+		case aTokens[i] != "*" && bTokens[i] != "*" && aTokens[i] != bTokens[i]:
+			return false
+		}
+	}
+	return len(aTokens) == len(bTokens)
+}
+
+// scriptConn is the facade of the NATS connection exposed to scripts as __nc (and wrapped by wrapNc). Only its
+// exported methods are visible to JS; the connection itself is not reachable.
+type scriptConn struct {
+	nc          *nats.Conn
+	permissions Permissions
+}
+
+// newScriptConn returns the facade for the given connection; nil (which is null in JS) if there is no connection,
+// f.e. in the preview.
+func newScriptConn(nc *nats.Conn, permissions Permissions) interface{} {
+	if nc == nil {
+		return nil
+	}
+	return &scriptConn{nc: nc, permissions: permissions}
+}
+
+func (c *scriptConn) Publish(subj string, data []byte) error {
+	if err := c.permissions.checkPublish(subj); err != nil {
+		return err
+	}
+	return c.nc.Publish(subj, data)
+}
+
+func (c *scriptConn) PublishMsg(msg *nats.Msg) error {
+	if err := c.permissions.checkPublish(msg.Subject); err != nil {
+		return err
+	}
+	return c.nc.PublishMsg(msg)
+}
+
+func (c *scriptConn) PublishRequest(subj, reply string, data []byte) error {
+	if err := c.permissions.checkPublish(subj); err != nil {
+		return err
+	}
+	return c.nc.PublishRequest(subj, reply, data)
+}
+
+func (c *scriptConn) RequestWithContext(ctx context.Context, subj string, data []byte) (*nats.Msg, error) {
+	if err := c.permissions.checkRequest(subj); err != nil {
+		return nil, err
+	}
+	return c.nc.RequestWithContext(ctx, subj, data)
+}
+
+func (c *scriptConn) RequestMsgWithContext(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+	if err := c.permissions.checkRequest(msg.Subject); err != nil {
+		return nil, err
+	}
+	return c.nc.RequestMsgWithContext(ctx, msg)
+}
+
+func (c *scriptConn) Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	if err := c.permissions.checkSubscribe(subj); err != nil {
+		return nil, err
+	}
+	return c.nc.Subscribe(subj, cb)
+}
+
+func (c *scriptConn) SubscribeSync(subj string) (*nats.Subscription, error) {
+	if err := c.permissions.checkSubscribe(subj); err != nil {
+		return nil, err
+	}
+	return c.nc.SubscribeSync(subj)
+}
+
+func (c *scriptConn) QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	if err := c.permissions.checkSubscribe(subj); err != nil {
+		return nil, err
+	}
+	return c.nc.QueueSubscribe(subj, queue, cb)
+}
+
+func (c *scriptConn) QueueSubscribeSync(subj, queue string) (*nats.Subscription, error) {
+	if err := c.permissions.checkSubscribe(subj); err != nil {
+		return nil, err
+	}
+	return c.nc.QueueSubscribeSync(subj, queue)
+}
+
+func (c *scriptConn) NewInbox() string {
+	return c.nc.NewInbox()
+}
+
+func (c *scriptConn) AuthRequired() bool {
+	return c.nc.AuthRequired()
+}
+
+func (c *scriptConn) IsConnected() bool {
+	return c.nc.IsConnected()
+}
+
+func (c *scriptConn) ConnectedUrl() string {
+	return c.nc.ConnectedUrlRedacted()
+}
+
+func (c *scriptConn) ConnectedServerName() string {
+	return c.nc.ConnectedServerName()
+}
+
+func (c *scriptConn) ConnectedServerVersion() string {
+	return c.nc.ConnectedServerVersion()
+}
+
+func (c *scriptConn) MaxPayload() int64 {
+	return c.nc.MaxPayload()
+}
+
+// Respond publishes data to the reply subject of msg, like msg.Respond (see scriptFieldNameMapper).
+func (c *scriptConn) Respond(msg *nats.Msg, data []byte) error {
+	if msg.Reply == "" {
+		return nats.ErrMsgNoReply
+	}
+	if err := c.permissions.checkPublish(msg.Reply); err != nil {
+		return err
+	}
+	return c.nc.Publish(msg.Reply, data)
+}
+
+// RespondMsg publishes response to the reply subject of request, like request.RespondMsg (see scriptFieldNameMapper).
+func (c *scriptConn) RespondMsg(request *nats.Msg, response *nats.Msg) error {
+	if request.Reply == "" {
+		return nats.ErrMsgNoReply
+	}
+	response.Subject = request.Reply
+	return c.PublishMsg(response)
+}
+
+// Acknowledge acknowledges a JetStream message like msg.Ack, msg.Nak, ... (see scriptFieldNameMapper); kind is the
+// name of the method. As this changes the state of the consumer, it is not allowed for read-only connections.
+func (c *scriptConn) Acknowledge(msg *nats.Msg, kind string, delay string) error {
+	if err := c.permissions.checkWrite(fmt.Sprintf("%s of a message of %s", kind, msg.Subject)); err != nil {
+		return err
+	}
+	switch kind {
+	case "Ack":
+		return msg.Ack()
+	case "AckSync":
+		return msg.AckSync()
+	case "Nak":
+		return msg.Nak()
+	case "NakWithDelay":
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return err
+		}
+		return msg.NakWithDelay(d)
+	case "Term":
+		return msg.Term()
+	case "InProgress":
+		return msg.InProgress()
+	}
+	return fmt.Errorf("unknown acknowledgement %s", kind)
+}
+
+// scriptFieldNameMapper hides the members of *nats.Msg which would bypass scriptConn: the methods which publish via
+// the connection of the message's subscription, and the subscription itself (for SUBSCRIBE queries, this is the
+// subscription of the data source). wrapMsg offers the methods again, checked by scriptConn.
+type scriptFieldNameMapper struct{}
+
+var hiddenMsgMethods = map[string]bool{
+	"Respond": true, "RespondMsg": true,
+	"Ack": true, "AckSync": true, "Nak": true, "NakWithDelay": true, "Term": true, "InProgress": true,
+}
+
+var msgType = reflect.TypeOf(nats.Msg{})
+
+func (scriptFieldNameMapper) FieldName(t reflect.Type, f reflect.StructField) string {
+	if t == msgType && f.Name == "Sub" {
+		return ""
+	}
+	return f.Name
+}
+
+func (scriptFieldNameMapper) MethodName(t reflect.Type, m reflect.Method) string {
+	if (t == msgType || t == reflect.PtrTo(msgType)) && hiddenMsgMethods[m.Name] {
+		return ""
+	}
+	return m.Name
+}
+
+// The lifecycle of the shared connection is managed by the data source; scripts get a clear error instead of
+// "not a function".
+
+func (c *scriptConn) Close() error {
+	return &PermissionError{Operation: "nc.Close()", Reason: "the connection is shared by all queries of the data source"}
+}
+
+func (c *scriptConn) Drain() error {
+	return &PermissionError{Operation: "nc.Drain()", Reason: "the connection is shared by all queries of the data source"}
+}
+
+func (c *scriptConn) Flush() error {
+	return &PermissionError{Operation: "nc.Flush()", Reason: "the connection is shared by all queries of the data source"}
+}
+
+func (c *scriptConn) FlushTimeout(_ string) error {
+	return &PermissionError{Operation: "nc.FlushTimeout()", Reason: "the connection is shared by all queries of the data source"}
+}
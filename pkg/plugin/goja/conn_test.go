@@ -0,0 +1,225 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/integration_test"
+)
+
+func TestSubjectPatterns(t *testing.T) {
+	tests := []struct {
+		pattern          string
+		subject          string
+		expectedCovers   bool
+		expectedOverlaps bool
+	}{
+		{"orders.created", "orders.created", true, true},
+		{"orders.created", "orders.deleted", false, false},
+		{"orders.*", "orders.created", true, true},
+		{"orders.*", "orders.eu.created", false, false},
+		{"orders.>", "orders.eu.created", true, true},
+		{"orders.>", "orders", false, false},
+		{"orders.*", "orders.>", false, true},
+		{"orders.eu.*", "orders.>", false, true},
+		{"orders.>", "orders.*", true, true},
+		{"orders.*.created", "orders.eu.*", false, true},
+		{">", "anything.at.all", true, true},
+		{"*", "orders.created", false, false},
+	}
+	for _, test := range tests {
+		if covers := subjectCovers(test.pattern, test.subject); covers != test.expectedCovers {
+			t.Errorf("subjectCovers(%s, %s): expected %v", test.pattern, test.subject, test.expectedCovers)
+		}
+		if overlaps := subjectsOverlap(test.pattern, test.subject); overlaps != test.expectedOverlaps {
+			t.Errorf("subjectsOverlap(%s, %s): expected %v", test.pattern, test.subject, test.expectedOverlaps)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	startSlowService(t, nc, "status.>", 0)
+	startSlowService(t, nc, "admin.>", 0)
+	startRequester(t, nc, "in", "forbidden.reply")
+
+	permissions := Permissions{
+		PublishAllow:  []string{"events.>"},
+		PublishDeny:   []string{"events.internal.*"},
+		RequestAllow:  []string{"status.>"},
+		SubscribeDeny: []string{"secrets.>"},
+	}
+	tests := []struct {
+		name          string
+		script        string
+		permissions   Permissions
+		expectedError string
+	}{
+		{"allowed publish", `nc.Publish("events.created", "x")`, permissions, ""},
+		{"publish outside of allowed subjects", `nc.Publish("orders.created", "x")`, permissions, "publish to orders.created is not allowed: not in the allowed subjects"},
+		{"denied publish", `nc.Publish("events.internal.audit", "x")`, permissions, "publish to events.internal.audit is not allowed: denied by events.internal.*"},
+		{"denied publish of a message", `const m = nats.NewMsg("orders.created"); nc.PublishMsg(m)`, permissions, "publish to orders.created is not allowed"},
+		{"allowed request", `nc.Request("status.1", "", "1s")`, permissions, ""},
+		{"denied request", `nc.Request("admin.shutdown", "", "1s")`, permissions, "request to admin.shutdown is not allowed"},
+		{"denied async request", `await nc.RequestAsync("admin.shutdown", "", "1s")`, permissions, "request to admin.shutdown is not allowed"},
+		{"allowed subscription", `nc.SubscribeSync("orders.>").Unsubscribe()`, permissions, ""},
+		{"subscription overlapping a denied subject", `nc.SubscribeSync(">")`, permissions, "subscribe to > is not allowed: denied by secrets.>"},
+		{"read-only publish", `nc.Publish("events.created", "x")`, Permissions{ReadOnly: true}, "the connection is read-only"},
+		{"read-only request", `nc.Request("status.1", "", "1s")`, Permissions{ReadOnly: true}, ""},
+		{"read-only JetStream info request", `nc.Request("$JS.API.INFO", "", "1s")`, Permissions{ReadOnly: true}, ""},
+		{"read-only stream delete request", `nc.Request("$JS.API.STREAM.DELETE.ORDERS", "", "1s")`, Permissions{ReadOnly: true}, "request to $JS.API.STREAM.DELETE.ORDERS is not allowed: the connection is read-only"},
+		{"read-only stream purge request", `await nc.RequestAsync("$JS.API.STREAM.PURGE.ORDERS", "", "1s")`, Permissions{ReadOnly: true}, "request to $JS.API.STREAM.PURGE.ORDERS is not allowed: the connection is read-only"},
+		{"read-only consumer delete request", `nc.Request("$JS.API.CONSUMER.DELETE.ORDERS.eu", "", "1s")`, Permissions{ReadOnly: true}, "the connection is read-only"},
+		{"read-only KV request", `nc.Request("$KV.config.key", "x", "1s")`, Permissions{ReadOnly: true}, "request to $KV.config.key is not allowed: the connection is read-only"},
+		{"read-only object store request", `nc.Request("$O.files.C.x", "x", "1s")`, Permissions{ReadOnly: true}, "the connection is read-only"},
+		{"close", `nc.Close()`, Permissions{}, "nc.Close() is not allowed"},
+		{"drain", `nc.Drain()`, Permissions{}, "nc.Drain() is not allowed"},
+		{"flush", `nc.Flush()`, Permissions{}, "nc.Flush() is not allowed"},
+		{"connection is not reachable", `Object.getPrototypeOf(nc).nc.Close()`, Permissions{}, "Cannot read property 'Close' of undefined"},
+		{"allowed respond", `nc.SubscribeSync("in").NextMsg("1s").Respond("x")`, Permissions{}, ""},
+		{"denied respond", `nc.SubscribeSync("in").NextMsg("1s").Respond("x")`, Permissions{PublishDeny: []string{"forbidden.>"}}, "publish to forbidden.reply is not allowed: denied by forbidden.>"},
+		{"read-only respond", `nc.SubscribeSync("in").NextMsg("1s").Respond("x")`, Permissions{ReadOnly: true}, "the connection is read-only"},
+		{"denied respond with a message", `nc.SubscribeSync("in").NextMsg("1s").RespondMsg(nats.NewMsg("x"))`, Permissions{PublishDeny: []string{"forbidden.>"}}, "publish to forbidden.reply is not allowed"},
+		{"raw respond is not reachable", `Object.getPrototypeOf(nc.SubscribeSync("in").NextMsg("1s")).Respond("x")`, Permissions{}, "Object has no member 'Respond'"},
+		{"read-only ack", `nc.SubscribeSync("in").NextMsg("1s").Ack()`, Permissions{ReadOnly: true}, "Ack of a message of in is not allowed: the connection is read-only"},
+		{"read-only nak", `nc.SubscribeSync("in").NextMsg("1s").NakWithDelay("1s")`, Permissions{ReadOnly: true}, "NakWithDelay of a message of in is not allowed"},
+		{"read-only term", `nc.SubscribeSync("in").NextMsg("1s").Term()`, Permissions{ReadOnly: true}, "Term of a message of in is not allowed"},
+		{"subscription of a message is not reachable", `nc.SubscribeSync("in").NextMsg("1s").Sub.Unsubscribe()`, Permissions{}, "Cannot read property 'Unsubscribe' of undefined"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RunScript(context.Background(), nc, test.script+"; return {};", WithPermissions(test.permissions))
+			if test.expectedError == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Fatalf("expected error %q, got: %v", test.expectedError, err)
+			}
+		})
+	}
+	if !nc.IsConnected() {
+		t.Errorf("expected the connection to stay open")
+	}
+}
+
+func TestMessageOfSubscribeQueryIsDetached(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	sub, err := nc.SubscribeSync("in")
+	if err != nil {
+		t.Fatalf("could not subscribe: %s", err)
+	}
+	if err := nc.PublishRequest("in", "forbidden.reply", []byte(`{}`)); err != nil {
+		t.Fatalf("could not publish: %s", err)
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("no message: %s", err)
+	}
+
+	for _, script := range []string{`__msg.Sub.Drain()`, `__msg.Respond("x")`, `Object.getPrototypeOf(msg).Respond("x")`} {
+		_, err = ConvertMessage(context.Background(), nc, msg, script+"; return {};", WithPermissions(Permissions{ReadOnly: true}))
+		if err == nil {
+			t.Errorf("expected %s to fail", script)
+		}
+	}
+	if !sub.IsValid() {
+		t.Errorf("expected the subscription of the query to stay valid")
+	}
+}
+
+// startRequester publishes requests to subject, with the given reply subject, until the test ends.
+func startRequester(t *testing.T, nc *nats.Conn, subject, reply string) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+	})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = nc.PublishRequest(subject, reply, []byte("x"))
+			}
+		}
+	}()
+}
+
+func TestReadOnlyJetStream(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "config"}); err != nil {
+		t.Fatalf("could not create bucket: %s", err)
+	}
+	_, err := RunScript(context.Background(), nc, `
+		js.KeyValue("config").Put("a", "1");
+		return {};
+	`, WithPermissions(Permissions{ReadOnly: true}))
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || !strings.Contains(scriptErr.Message, "put to KV bucket config is not allowed: the connection is read-only") {
+		t.Fatalf("expected permission error, got: %v", err)
+	}
+}
+
+func TestJetStreamPermissions(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{Durable: "worker", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("could not create consumer: %s", err)
+	}
+	if _, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{Durable: "eu", FilterSubject: "orders.eu.>", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("could not create consumer: %s", err)
+	}
+	if _, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "config"}); err != nil {
+		t.Fatalf("could not create bucket: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := js.Publish("orders.eu.new", []byte(`{}`)); err != nil {
+			t.Fatalf("could not publish: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		script        string
+		permissions   Permissions
+		expectedError string
+	}{
+		{"allowed API request", `js.StreamInfo("ORDERS")`, Permissions{RequestAllow: []string{"$JS.API.STREAM.INFO.*"}}, ""},
+		{"API request outside of allowed subjects", `js.StreamNames()`, Permissions{RequestAllow: []string{"$JS.API.STREAM.INFO.*"}}, "request to $JS.API.STREAM.NAMES is not allowed"},
+		{"denied API request", `js.ConsumerInfo("ORDERS", "worker")`, Permissions{RequestDeny: []string{"$JS.API.>"}}, "request to $JS.API.CONSUMER.INFO.ORDERS.worker is not allowed"},
+		{"denied direct get", `js.GetLastMsg("ORDERS", "orders.eu.new", {direct: true})`, Permissions{RequestDeny: []string{"$JS.API.DIRECT.>"}}, "request to $JS.API.DIRECT.GET.ORDERS.orders.eu.new is not allowed"},
+		{"denied KV get", `js.KeyValue("config").Get("a")`, Permissions{RequestDeny: []string{"$JS.API.STREAM.MSG.GET.KV_config"}}, "is not allowed"},
+		{"denied KV keys", `js.KeyValue("config").Keys()`, Permissions{SubscribeDeny: []string{"$KV.config.secret"}}, "subscribe to $KV.config.> is not allowed"},
+		{"denied KV put", `js.KeyValue("config").Put("secret", "x")`, Permissions{PublishDeny: []string{"$KV.config.secret"}}, "publish to $KV.config.secret is not allowed"},
+		{"allowed fetch", `js.Fetch("ORDERS", "eu", 1, {timeout: "500ms"})`, Permissions{SubscribeAllow: []string{"orders.eu.>"}}, ""},
+		{"fetch of a consumer with a denied subject", `js.Fetch("ORDERS", "eu", 1)`, Permissions{SubscribeDeny: []string{"orders.eu.*"}}, "subscribe to orders.eu.> is not allowed"},
+		{"fetch of all messages of a stream with a denied subject", `js.Fetch("ORDERS", "worker", 1)`, Permissions{SubscribeAllow: []string{"orders.eu.>"}}, "subscribe to orders.> is not allowed"},
+		{"denied fetch request", `js.Fetch("ORDERS", "eu", 1)`, Permissions{RequestDeny: []string{"$JS.API.CONSUMER.MSG.NEXT.>"}}, "request to $JS.API.CONSUMER.MSG.NEXT.ORDERS.eu is not allowed"},
+		{"read-only fetch", `js.Fetch("ORDERS", "eu", 1, {timeout: "500ms"})`, Permissions{ReadOnly: true}, ""},
+		{"read-only ack of a fetched message", `js.Fetch("ORDERS", "eu", 1, {timeout: "500ms"})[0].Ack()`, Permissions{ReadOnly: true}, "Ack of a message of orders.eu.new is not allowed: the connection is read-only"},
+		{"read-only nak of a fetched message", `js.Fetch("ORDERS", "eu", 1, {timeout: "500ms"})[0].Nak()`, Permissions{ReadOnly: true}, "Nak of a message of orders.eu.new is not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RunScript(context.Background(), nc, test.script+"; return {};", WithPermissions(test.permissions))
+			if test.expectedError == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Fatalf("expected error %q, got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package goja
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// ScriptError describes an error in a user-defined script. Line and Column (both 1-based) refer to the script as
+// written by the user - and not to the wrapped script, which is actually run; they are 0 if the position is unknown.
+//
+// Snippet is the affected line of the user's script, followed by a line marking the column with ^. Stack contains
+// the call stack of a runtime error, restricted to the user's script (innermost call first).
+type ScriptError struct {
+	Message string   `json:"message"`
+	Line    int      `json:"line"`
+	Column  int      `json:"column"`
+	Snippet string   `json:"snippet,omitempty"`
+	Stack   []string `json:"stack,omitempty"`
+}
+
+func (e *ScriptError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (line %d, column %d)", e.Message, e.Line, e.Column)
+}
+
+// scriptError describes why the script jsFn (run as kind, written in language) failed. Limit violations are
+// returned as they are; all other errors are converted to a *ScriptError, with the position mapped to the user's
+// script.
+func scriptError(err error, jsFn string, kind ScriptKind, language Language) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr
+	}
+	var transpileErr *transpileError
+	if errors.As(err, &transpileErr) {
+		return kind.scriptError(jsFn, transpileErr.Message, transpileErr.Line, transpileErr.Column)
+	}
+	var compilerErr *goja.CompilerSyntaxError
+	if errors.As(err, &compilerErr) {
+		// the position of syntax errors is only known when parsing the script separately, see Check.
+		if checkErr := Check(jsFn, kind, WithLanguage(language)); checkErr != nil {
+			return checkErr
+		}
+	}
+
+	var exception *goja.Exception
+	var rejection *promiseRejection
+	switch {
+	case errors.As(err, &exception) && exception.Value() != nil:
+		return kind.runtimeError(jsFn, language, exception.Value().String(), exception.String())
+	case errors.As(err, &rejection):
+		// the stack is only known if an Error was thrown.
+		stack := ""
+		if obj, isObject := rejection.reason.(*goja.Object); isObject {
+			if stackValue := obj.Get("stack"); stackValue != nil {
+				stack = stackValue.String()
+			}
+		}
+		return kind.runtimeError(jsFn, language, rejection.Error(), stack)
+	default:
+		return &ScriptError{Message: err.Error()}
+	}
+}
+
+// promiseRejection is returned by execution.await if the promise returned by a script was rejected.
+type promiseRejection struct {
+	reason goja.Value
+}
+
+func (r *promiseRejection) Error() string {
+	return fmt.Sprintf("unhandled promise rejection: %s", r.reason.String())
+}
+
+// stackFrameLine matches a frame of the user's script (compiled without name, see compile) or of a module (see
+// compileModule) in a goja stack trace, f.e. "\tat f (<eval>:6:29(2))", "\tat <eval>:7:4(31)" or
+// "\tat ping (module:helpers:3:5(12))".
+var stackFrameLine = regexp.MustCompile(`^\tat (?:(.+) \()?(<eval>|module:[^:]+):(\d+):(\d+)\(\d+\)\)?$`)
+
+// runtimeError converts a goja stack trace (see goja.Exception.String) to a *ScriptError: the innermost frame inside
+// the user's script determines the position; frames inside the wrapper, _setup or Go functions are left out. For
+// TypeScript, the positions in the transpiled script are mapped back via its source map first.
+func (k ScriptKind) runtimeError(jsFn string, language Language, message string, stack string) *ScriptError {
+	scriptErr := &ScriptError{Message: message}
+	for _, line := range strings.Split(stack, "\n") {
+		match := stackFrameLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		frameLine, _ := strconv.Atoi(match[3])
+		frameColumn, _ := strconv.Atoi(match[4])
+		if module := strings.TrimPrefix(match[2], "module:"); module != match[2] {
+			// frames inside of modules are part of the stack, but the position of the error is in the user's script.
+			// The module source starts on the 2nd line, see wrapJsModule.
+			scriptErr.Stack = append(scriptErr.Stack, stackFrame(match[1], fmt.Sprintf("module %s, line %d, column %d", module, frameLine-1, frameColumn)))
+			continue
+		}
+		if language == TypeScript {
+			var ok bool
+			if frameLine, frameColumn, ok = k.typeScriptPosition(jsFn, frameLine, frameColumn); !ok {
+				continue
+			}
+		}
+		userLine, userColumn, ok := k.userPosition(jsFn, frameLine, frameColumn)
+		if !ok {
+			continue
+		}
+		if scriptErr.Line == 0 {
+			scriptErr.Line, scriptErr.Column = userLine, userColumn
+			scriptErr.Snippet = snippet(jsFn, userLine, userColumn)
+		}
+		scriptErr.Stack = append(scriptErr.Stack, stackFrame(match[1], fmt.Sprintf("line %d, column %d", userLine, userColumn)))
+	}
+	return scriptErr
+}
+
+// stackFrame formats a frame of ScriptError.Stack: the position, prefixed by the function name (if any).
+func stackFrame(function, position string) string {
+	if function == "" {
+		return position
+	}
+	return fmt.Sprintf("%s (%s)", function, position)
+}
+
+// scriptError converts an error at the given position of the wrapped script to a *ScriptError.
+func (k ScriptKind) scriptError(jsFn string, message string, line, column int) *ScriptError {
+	userLine, userColumn, ok := k.userPosition(jsFn, line, column)
+	if !ok {
+		// f.e. an unclosed block in the user script is only detected at the end of the wrapper.
+		return &ScriptError{Message: message}
+	}
+	return &ScriptError{Message: message, Line: userLine, Column: userColumn, Snippet: snippet(jsFn, userLine, userColumn)}
+}
+
+// snippet returns the given line of jsFn, followed by a line with ^ below the given column. Tabs are kept, so that
+// the marker is aligned however tabs are displayed.
+func snippet(jsFn string, line, column int) string {
+	lines := strings.Split(jsFn, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	source := strings.TrimRight(lines[line-1], "\r")
+	marker := strings.Builder{}
+	for i, r := range []rune(source) {
+		if i >= column-1 {
+			break
+		}
+		if r == '\t' {
+			marker.WriteRune('\t')
+		} else {
+			marker.WriteRune(' ')
+		}
+	}
+	marker.WriteRune('^')
+	return source + "\n" + marker.String()
+}
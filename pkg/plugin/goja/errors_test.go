@@ -0,0 +1,131 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	tests := []struct {
+		name            string
+		js              string
+		kind            ScriptKind
+		expectedMessage string
+		expectedLine    int
+		expectedColumn  int
+		expectedSnippet string
+		expectedStack   []string
+	}{
+		{
+			name:            "error in first line",
+			js:              `return JSON.parse(msg.Data).x.y;`,
+			kind:            MessageScript,
+			expectedMessage: "TypeError: Cannot read property 'y' of undefined",
+			expectedLine:    1,
+			expectedColumn:  31,
+			expectedSnippet: "return JSON.parse(msg.Data).x.y;\n                              ^",
+			expectedStack:   []string{"line 1, column 31"},
+		},
+		{
+			name:            "error in nested function",
+			js:              "function parse(data) {\n\treturn JSON.parse(data);\n}\nreturn parse(msg.Data + '{');",
+			kind:            MessageScript,
+			expectedMessage: "SyntaxError: Unexpected token at the end: {",
+			expectedLine:    2,
+			expectedColumn:  19,
+			expectedSnippet: "\treturn JSON.parse(data);\n\t                 ^",
+			expectedStack:   []string{"parse (line 2, column 19)", "line 4, column 13"},
+		},
+		{
+			name:            "thrown string",
+			js:              "const a = 1;\nthrow 'failed: ' + a;",
+			kind:            MessageScript,
+			expectedMessage: "failed: 1",
+			expectedLine:    2,
+			expectedColumn:  1,
+			expectedSnippet: "throw 'failed: ' + a;\n^",
+			expectedStack:   []string{"line 2, column 1"},
+		},
+		{
+			name:            "rejected promise in free-form script",
+			js:              "await null;\nthrow new Error('async failure');",
+			kind:            FreeFormScript,
+			expectedMessage: "unhandled promise rejection: Error: async failure",
+			expectedLine:    2,
+			expectedColumn:  7,
+			expectedSnippet: "throw new Error('async failure');\n      ^",
+			expectedStack:   []string{"line 2, column 7"},
+		},
+		{
+			name:            "error of a Go function",
+			js:              "\n  return {v: std.base64.decode('%%%')};",
+			kind:            MessageScript,
+			expectedMessage: "GoError: illegal base64 data at input byte 0",
+			expectedLine:    2,
+			expectedColumn:  31,
+			expectedSnippet: "  return {v: std.base64.decode('%%%')};\n                              ^",
+			expectedStack:   []string{"line 2, column 31"},
+		},
+		{
+			name:            "syntax error",
+			js:              "const a = ;\nreturn {a};",
+			kind:            MessageScript,
+			expectedMessage: "Unexpected token ;",
+			expectedLine:    1,
+			expectedColumn:  11,
+			expectedSnippet: "const a = ;\n          ^",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if test.kind == FreeFormScript {
+				_, err = RunScript(context.Background(), nil, test.js)
+			} else {
+				_, err = ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`{"a": 1}`)}, test.js)
+			}
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("expected ScriptError, got: %v", err)
+			}
+			if scriptErr.Message != test.expectedMessage {
+				t.Errorf("expected message %q, was %q", test.expectedMessage, scriptErr.Message)
+			}
+			if scriptErr.Line != test.expectedLine || scriptErr.Column != test.expectedColumn {
+				t.Errorf("expected error at %d:%d, was at %d:%d", test.expectedLine, test.expectedColumn, scriptErr.Line, scriptErr.Column)
+			}
+			if scriptErr.Snippet != test.expectedSnippet {
+				t.Errorf("expected snippet\n%s\nwas\n%s", test.expectedSnippet, scriptErr.Snippet)
+			}
+			if !reflect.DeepEqual(scriptErr.Stack, test.expectedStack) {
+				t.Errorf("expected stack %v, was %v", test.expectedStack, scriptErr.Stack)
+			}
+		})
+	}
+}
+
+func TestRuntimeErrorDoesNotContainWrapper(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, `throw new Error("boom");`)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), "_setup") {
+		t.Errorf("expected error without the wrapped script, was: %s", err)
+	}
+}
+
+func TestStatefulErrorsArePositioned(t *testing.T) {
+	_, err := NewStatefulConverter(context.Background(), nil, "", "state.a = 1;\nstate.b.c = 2;", "")
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 2 {
+		t.Fatalf("expected ScriptError in line 2, got: %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "could not run init script: ") {
+		t.Errorf("expected error of init script, was: %s", err)
+	}
+}
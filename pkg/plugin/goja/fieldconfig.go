@@ -0,0 +1,112 @@
+package goja
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// configuredFrame is returned by the JS helper frame(rows, config): the rows are converted like any other result,
+// and the config is applied to the resulting frame afterwards, see convertNamedResult.
+type configuredFrame struct {
+	rows   interface{}
+	config frameConfig
+}
+
+// frameConfig is the config object of frame(rows, config). It uses the JSON names of Grafana's field config and
+// frame meta, so that settings can be copied from the panel JSON:
+//
+//	return frame(rows, {
+//		name: "temperatures",
+//		fields: {temperature: {unit: "celsius", decimals: 1, thresholds: {mode: "absolute", steps: [...]}}},
+//		meta: {preferredVisualisationType: "graph", executedQueryString: "sensors.>"},
+//	});
+type frameConfig struct {
+	Name   string                      `json:"name"`
+	Fields map[string]data.FieldConfig `json:"fields"`
+	Meta   *data.FrameMeta             `json:"meta"`
+}
+
+// frameHelper returns the JS function frame(rows, config), see frameConfig.
+func frameHelper() func(rows goja.Value, config goja.Value) (*configuredFrame, error) {
+	return func(rows goja.Value, config goja.Value) (*configuredFrame, error) {
+		if rows == nil || goja.IsUndefined(rows) || goja.IsNull(rows) {
+			return nil, fmt.Errorf("frame() expects the rows as first argument")
+		}
+		c := frameConfig{}
+		if config != nil && !goja.IsUndefined(config) && !goja.IsNull(config) {
+			if err := decodeFrameConfig(config.Export(), &c); err != nil {
+				return nil, fmt.Errorf("invalid frame config: %w", err)
+			}
+		}
+		return &configuredFrame{rows: rows.Export(), config: c}, nil
+	}
+}
+
+// decodeFrameConfig decodes the exported JS config via JSON, so that the JSON unmarshalers of the SDK (f.e. for
+// value mappings) are used. Unknown properties are rejected, so that typos do not go unnoticed.
+func decodeFrameConfig(exported interface{}, c *frameConfig) error {
+	encoded, err := json.Marshal(finiteNumbers(exported))
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return err
+	}
+	for name, fieldConfig := range c.Fields {
+		if fieldConfig.Thresholds != nil && len(fieldConfig.Thresholds.Steps) > 0 {
+			// like in Grafana, the first step is the base - whatever its value (usually null or -Infinity) is.
+			fieldConfig.Thresholds.Steps[0].Value = data.ConfFloat64(math.Inf(-1))
+			c.Fields[name] = fieldConfig
+		}
+	}
+	return nil
+}
+
+// finiteNumbers replaces Infinity and NaN (which cannot be encoded as JSON) by null.
+func finiteNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return nil
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = finiteNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = finiteNumbers(item)
+		}
+	}
+	return v
+}
+
+// apply sets the configured name, field configs and meta on the given frame.
+func (c frameConfig) apply(frame *data.Frame) error {
+	if c.Name != "" {
+		frame.Name = c.Name
+	}
+	for name, fieldConfig := range c.Fields {
+		field, _ := frame.FieldByName(name)
+		if field == nil {
+			return fmt.Errorf("frame() has a config for the field %s, which does not exist", name)
+		}
+		fieldConfig := fieldConfig
+		field.Config = &fieldConfig
+	}
+	if c.Meta != nil {
+		if frame.Meta != nil {
+			// f.e. notices which were already added
+			c.Meta.Notices = append(frame.Meta.Notices, c.Meta.Notices...)
+		}
+		frame.Meta = c.Meta
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package goja
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestFrameConfig(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		return frame([{temperature: 21.5, sensor: "a"}, {temperature: 31.5, sensor: "b"}], {
+			name: "temperatures",
+			fields: {
+				temperature: {
+					unit: "celsius",
+					decimals: 1,
+					min: 0,
+					thresholds: {mode: "absolute", steps: [{value: -Infinity, color: "green"}, {value: 30, color: "red"}]},
+				},
+				sensor: {displayName: "Sensor", mappings: [{type: "value", options: {a: {text: "Kitchen"}}}]},
+			},
+			meta: {preferredVisualisationType: "table", executedQueryString: "sensors.>", custom: {source: "script"}},
+		});
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Name != "temperatures" {
+		t.Fatalf("expected a single frame temperatures, got %v", frames)
+	}
+	frame := frames[0]
+
+	temperature, _ := frame.FieldByName("temperature")
+	if temperature == nil || temperature.Config == nil {
+		t.Fatalf("expected field config for temperature")
+	}
+	if temperature.Config.Unit != "celsius" || temperature.Config.Decimals == nil || *temperature.Config.Decimals != 1 {
+		t.Errorf("unexpected unit or decimals: %+v", temperature.Config)
+	}
+	if temperature.Config.Min == nil || *temperature.Config.Min != 0 || temperature.Config.Max != nil {
+		t.Errorf("expected min 0 and no max: %+v", temperature.Config)
+	}
+	steps := temperature.Config.Thresholds.Steps
+	if len(steps) != 2 || !math.IsInf(float64(steps[0].Value), -1) || steps[1].Value != 30 || steps[1].Color != "red" {
+		t.Errorf("unexpected threshold steps: %+v", steps)
+	}
+
+	sensor, _ := frame.FieldByName("sensor")
+	if sensor.Config == nil || sensor.Config.DisplayName != "Sensor" || len(sensor.Config.Mappings) != 1 {
+		t.Errorf("unexpected field config for sensor: %+v", sensor.Config)
+	}
+
+	if frame.Meta == nil || frame.Meta.PreferredVisualization != data.VisTypeTable || frame.Meta.ExecutedQueryString != "sensors.>" {
+		t.Fatalf("unexpected frame meta: %+v", frame.Meta)
+	}
+	if custom, ok := frame.Meta.Custom.(map[string]interface{}); !ok || custom["source"] != "script" {
+		t.Errorf("unexpected custom meta: %+v", frame.Meta.Custom)
+	}
+}
+
+func TestFrameConfigInMultipleFrames(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		return frames({
+			servers: frame([{port: 4222}], {fields: {port: {displayName: "Port"}}}),
+			routes: {count: 3},
+		});
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 2 || frames[0].Name != "servers" {
+		t.Fatalf("expected frames servers and routes, got %v", frames)
+	}
+	if frames[0].Fields[0].Config == nil || frames[0].Fields[0].Config.DisplayName != "Port" {
+		t.Errorf("expected field config in frame servers")
+	}
+
+	frames, err = RunScript(context.Background(), nil, `
+		return [frame({a: 1}, {name: "first"}), frame({b: 2}, {name: "second"})];
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 2 || frames[0].Name != "first" || frames[1].Name != "second" {
+		t.Fatalf("expected frames first and second, got %v", frames)
+	}
+}
+
+func TestInvalidFrameConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        string
+		expectedError string
+	}{
+		{"unknown field", `return frame({a: 1}, {fields: {b: {unit: "s"}}})`, "config for the field b, which does not exist"},
+		{"unknown property", `return frame({a: 1}, {fields: {a: {units: "s"}}})`, `unknown field "units"`},
+		{"wrong type", `return frame({a: 1}, {fields: {a: {decimals: "two"}}})`, "invalid frame config"},
+		{"missing rows", `return frame()`, "frame() expects the rows as first argument"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RunScript(context.Background(), nil, test.script)
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Fatalf("expected error %q, got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
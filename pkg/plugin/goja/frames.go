@@ -0,0 +1,144 @@
+package goja
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+)
+
+// WithArrayMode sets how arrays nested in the results (f.e. `tags: ["a", "b"]`) are converted, see
+// framestruct.ArrayMode. Without it, they become JSON fields.
+func WithArrayMode(mode framestruct.ArrayMode) Option {
+	return func(o *options) {
+		o.arrays = mode
+	}
+}
+
+// frameOptions are the options for converting results to frames via framestruct.
+func (o options) frameOptions() []framestruct.FramestructOption {
+	arrays := o.arrays
+	if arrays == "" {
+		arrays = framestruct.ArraysJson
+	}
+	return []framestruct.FramestructOption{framestruct.WithArrayMode(arrays)}
+}
+
+// ConvertResults converts a result like the one of a script to frames, see convertResults; for the message converters
+// outside of this package (see package convert).
+func ConvertResults(result interface{}, arrays framestruct.ArrayMode) (data.Frames, error) {
+	return convertResults(result, options{arrays: arrays}.frameOptions()...)
+}
+
+// frameSet is returned by the JS helper frames({name: rows, ...}): multiple named results, each of which is
+// converted to its own frame (in the given order).
+type frameSet struct {
+	names   []string
+	results []interface{}
+}
+
+// framesHelper returns the JS function frames(), which scripts use to return multiple frames:
+//
+//	return frames({servers: [...], routes: [...]});
+func framesHelper(vm *goja.Runtime) func(named *goja.Object) (*frameSet, error) {
+	return func(named *goja.Object) (*frameSet, error) {
+		if named == nil {
+			return nil, fmt.Errorf("frames() expects an object of {frameName: rows}")
+		}
+		set := &frameSet{}
+		// Keys() keeps the order of the object, so that frames appear in the order they were defined.
+		for _, name := range named.Keys() {
+			set.names = append(set.names, name)
+			set.results = append(set.results, named.Get(name).Export())
+		}
+		return set, nil
+	}
+}
+
+// convertResults converts the result of a script to one or multiple frames. Multiple frames are returned
+// via frames({name: rows}), or as an array of frames.
+func convertResults(result interface{}, frameOpts ...framestruct.FramestructOption) (data.Frames, error) {
+	if set, isFrameSet := result.(*frameSet); isFrameSet {
+		frames := make(data.Frames, 0, len(set.names))
+		for i, name := range set.names {
+			frame, err := convertNamedResult(name, set.results[i], frameOpts...)
+			if err != nil {
+				return nil, fmt.Errorf("frame %s: %w", name, err)
+			}
+			if frame.Name == "" {
+				frame.Name = name
+			}
+			frames = append(frames, frame)
+		}
+		return frames, nil
+	}
+
+	if arr, isArray := result.([]interface{}); isArray && len(arr) > 0 && isFrame(arr[0]) {
+		frames := make(data.Frames, 0, len(arr))
+		for i, v := range arr {
+			if !isFrame(v) {
+				return nil, fmt.Errorf("result of script was an array of frames, but index %d was no frame", i)
+			}
+			frame, err := convertNamedResult("result", v, frameOpts...)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, frame)
+		}
+		return frames, nil
+	}
+
+	frame, err := convertNamedResult("result", result, frameOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return data.Frames{frame}, nil
+}
+
+func isFrame(v interface{}) bool {
+	switch v.(type) {
+	case data.Frame, *data.Frame, *configuredFrame:
+		return true
+	}
+	return false
+}
+
+// decodeJson decodes a JSON payload like JSON.parse, but keeps the notation of numbers: 42 becomes int64, and 42.0
+// float64 - so that the field types do not depend on whether a value happens to be integral. It returns false if the
+// payload is no JSON.
+func decodeJson(payload []byte) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return nil, false
+	}
+	return convertNumbers(value), true
+}
+
+// convertNumbers replaces the json.Number values in a decoded value by int64 or float64, see decodeJson.
+func convertNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if !strings.ContainsAny(v.String(), ".eE") {
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = convertNumbers(element)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = convertNumbers(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,146 @@
+package goja
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+)
+
+func TestMultipleNamedFrames(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		return frames({
+			servers: [{name: "n1", port: 4222}, {name: "n2", port: 4223}],
+			routes: {count: 3},
+			accounts: [],
+		});
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	expected := []struct {
+		name string
+		rows int
+	}{
+		{"servers", 2},
+		{"routes", 1},
+		{"accounts", 0},
+	}
+	for i, e := range expected {
+		if frames[i].Name != e.name {
+			t.Errorf("frame %d: expected name %s, was %s", i, e.name, frames[i].Name)
+		}
+		if frames[i].Rows() != e.rows {
+			t.Errorf("frame %s: expected %d rows, was %d", e.name, e.rows, frames[i].Rows())
+		}
+	}
+}
+
+func TestSingleResultIsOneFrame(t *testing.T) {
+	frames, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`[{"k": "v1"}, {"k": "v2"}]`)}, "")
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Name != "result" || frames[0].Rows() != 2 {
+		t.Fatalf("expected a single frame 'result' with 2 rows, got %v", frames)
+	}
+}
+
+func TestArrayOfFrames(t *testing.T) {
+	frames, err := convertResults([]interface{}{
+		data.NewFrame("first", data.NewField("a", nil, []int64{1})),
+		data.NewFrame("second", data.NewField("b", nil, []string{"x"})),
+	})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if len(frames) != 2 || frames[0].Name != "first" || frames[1].Name != "second" {
+		t.Fatalf("expected frames first and second, got %v", frames)
+	}
+
+	_, err = convertResults([]interface{}{
+		data.NewFrame("first"),
+		map[string]interface{}{"k": "v"},
+	})
+	if err == nil {
+		t.Fatalf("expected error for mixed array of frames and rows")
+	}
+}
+
+func TestMultipleFramesAreRejectedForSingleFrameResults(t *testing.T) {
+	converter, err := NewStatefulConverter(context.Background(), nil, `return frames({a: {k: 1}, b: {k: 2}})`, "", "")
+	if err != nil {
+		t.Fatalf("could not create converter: %s", err)
+	}
+	defer converter.Close()
+	if _, err := converter.ConvertMessage(&nats.Msg{}); err == nil {
+		t.Fatalf("expected error for multiple frames")
+	}
+}
+
+func TestNestedArrays(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{"id": "s1", "tags": ["a", "b"]}`)}
+
+	// by default, arrays are kept as JSON
+	frames, err := ConvertMessage(context.Background(), nil, msg, "")
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	tags, _ := frames[0].FieldByName("tags")
+	if value, _ := tags.ConcreteAt(0); frames[0].Rows() != 1 || value != `["a","b"]` {
+		t.Errorf("expected the tags as JSON, got %v", frames[0])
+	}
+
+	frames, err = ConvertMessage(context.Background(), nil, msg, "", WithArrayMode(framestruct.ArraysExplode))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if frames[0].Rows() != 2 {
+		t.Errorf("expected a row per tag, got %d rows", frames[0].Rows())
+	}
+
+	frames, err = ConvertMessage(context.Background(), nil, msg, "", WithArrayMode(framestruct.ArraysIndex))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if field, _ := frames[0].FieldByName("tags.1"); field == nil {
+		t.Errorf("expected a field per index, got %v", frames[0])
+	}
+}
+
+func TestHeterogeneousRows(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`[{"v": 1, "f": 42.0}, {"v": 1.5}, {"v": 2}]`)}
+
+	frames, err := ConvertMessage(context.Background(), nil, msg, "")
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	v, _ := frames[0].FieldByName("v")
+	if v.Type() != data.FieldTypeNullableFloat64 || frames[0].Rows() != 3 {
+		t.Errorf("expected v to be widened to float64, got %v", frames[0])
+	}
+	if f, _ := frames[0].FieldByName("f"); f.Type() != data.FieldTypeNullableFloat64 {
+		t.Errorf("expected 42.0 to be a float64, got %s", f.Type())
+	}
+
+	frames, err = ConvertMessage(context.Background(), nil, msg, `return [{v: 1}, {v: "n/a"}];`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	v, _ = frames[0].FieldByName("v")
+	if value, _ := v.ConcreteAt(0); value != "1" {
+		t.Errorf("expected mixed values to be widened to string, got %v", frames[0])
+	}
+}
+
+func TestInvalidJsonWithoutScript(t *testing.T) {
+	_, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`{"v": 1`)}, "")
+	if err == nil {
+		t.Fatalf("expected an error for invalid JSON")
+	}
+}
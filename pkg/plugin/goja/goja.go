@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"github.com/dop251/goja"
-	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/nats-io/nats.go"
 	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
@@ -19,62 +18,101 @@ import (
 //
 // - Msg.Data in NATS is a []byte, but in JS we only know about strings.
 // - Timeouts are accepted as strings and auto-converted.
+// - Common helpers (base64, hashing, time zones, gzip, ...) are available as `std`, see stdLib.
 //
 // JS variables starting with "_" are internal, and are immutable. JS Variables
-// starting with "__" are request-scoped.
+// starting with "__" are request-scoped. Scripts are isolated from each other, see isolationFn.
 var gojaPool = sync.Pool{
 	New: func() any {
-		vm := goja.New()
-		vm.Set("log", func(msg string) {
-			log.DefaultLogger.Info(msg)
-		})
-		vm.Set("_bytesToStr", func(bytes []byte) string {
-			return string(bytes)
-		})
-		vm.Set("_strToBytes", func(in string) []byte {
-			return []byte(in)
-		})
-		vm.Set("_strToBytes", func(in string) []byte {
-			return []byte(in)
-		})
-		vm.Set("_parseDuration", func(in string) (time.Duration, error) {
-			return time.ParseDuration(in)
-		})
-		vm.Set("_nats", &natsW{
-			NewInbox: nats.NewInbox,
-			Context:  nats.Context,
-			NewMsg:   nats.NewMsg,
-		})
-
-		vm.RunString(setupFn)
-		return vm
+		return newRuntime()
 	},
 }
 
-// natsW is a struct wrapper for static functions of the nats.* package, to be able
-// to pass them to JavaScript as "nats" (because we cannot pass a *package* by reference).
-type natsW struct {
-	NewInbox func() string
-	Context  func(ctx context.Context) nats.ContextOpt
-	NewMsg   func(subject string) *nats.Msg
+// newRuntime creates a goja Javascript Engine with the _setup function defined; see gojaPool.
+func newRuntime() *goja.Runtime {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(maxCallStackSize)
+	vm.SetFieldNameMapper(scriptFieldNameMapper{})
+	vm.Set("log", logFunc(vm, data.NoticeSeverityInfo))
+	vm.Set("console", consoleObject(vm))
+	vm.Set("_bytesToStr", func(bytes []byte) string {
+		return string(bytes)
+	})
+	vm.Set("_strToBytes", func(in goja.Value) []byte {
+		// binary data (f.e. from std.gzip.compress) is sent as is; everything else as string.
+		if b, err := valueToBytes(vm, in); err == nil {
+			return b
+		}
+		return []byte(in.String())
+	})
+	vm.Set("_bytesToArrayBuffer", func(bytes []byte) goja.ArrayBuffer {
+		return vm.NewArrayBuffer(bytes)
+	})
+	vm.Set("_parseDuration", func(in string) (time.Duration, error) {
+		return time.ParseDuration(in)
+	})
+	vm.Set("_nats", natsObject(vm))
+	vm.Set("_jetStream", func(nc *scriptConn) *jetStream {
+		return newJetStream(vm, nc)
+	})
+	vm.Set("frames", framesHelper(vm))
+	vm.Set("frame", frameHelper())
+	vm.Set("require", requireFunc(vm))
+	vm.Set("std", stdLib(vm))
+
+	vm.RunProgram(setupProgram)
+	vm.RunProgram(isolationProgram)
+	return vm
+}
+
+// natsObject wraps static functions of the nats.* package, to be able to pass them to JavaScript as "nats"
+// (because we cannot pass a *package* by reference). It is a plain JS object (and no Go struct), so that it is
+// frozen by isolationFn.
+func natsObject(vm *goja.Runtime) *goja.Object {
+	obj := vm.NewObject()
+	_ = obj.Set("NewInbox", nats.NewInbox)
+	_ = obj.Set("Context", nats.Context)
+	_ = obj.Set("NewMsg", nats.NewMsg)
+	return obj
 }
 
 // setupFn is the JS setup function registered during construction of Goja. See gojaPool for details.
 const setupFn = `
 "use strict";
 function _setup(_nats, _bytesToStr, _strToBytes, _parseDuration) {
-    function wrapNc(__nc) {
+    // the connection facade of the script (see the returned function); messages respond via it, see wrapMsg.
+    let conn = null;
+
+    // hooks allow long-running scripts (see streaming.go) to run subscription callbacks on their event loop,
+    // and to end all subscriptions once the script is stopped.
+    const defaultHooks = {
+        schedule: (cb) => cb,
+        track: (subscription) => subscription,
+    };
+
+    function wrapNc(__nc, hooks) {
+        // __nc is the connection facade (see scriptConn), which checks the Permissions.
         const nc = Object.create(__nc);
         
-        nc.Publish = (subj, data) => __nc.Publish(subj, _strToBytes(data));
-        nc.PublishRequest = (subj, reply, data) => __nc.PublishRequest(subj, reply, _strToBytes(data));
-        nc.QueueSubscribe = (subj, queue, cb) => wrapSubscription(__nc.QueueSubscribe(subj, queue, (__msg) => cb(wrapMsg(__msg))));
-        nc.QueueSubscribeSync = (subj, queue) => wrapSubscription(__nc.QueueSubscribeSync(subj, queue));
-        nc.Request = (subj, data, timeout) => wrapMsg(__nc.Request(subj, _strToBytes(data), _parseDuration(timeout)));
-        nc.RequestMsg = (msg, timeout) => wrapMsg(__nc.RequestMsg(msg, _parseDuration(timeout)));
-        nc.RequestWithContext = (ctx, subj, data) => wrapMsg(__nc.RequestWithContext(ctx, subj, _strToBytes(data)));
-        nc.Subscribe = (subj, cb) => wrapSubscription(__nc.Subscribe(subj, (__msg) => cb(wrapMsg(__msg))));
-        nc.SubscribeSync = (subj) => wrapSubscription(__nc.SubscribeSync(subj));
+        // every NATS call is counted (see Limits.MaxNatsOps); blocking calls go through __exec, so that they
+        // are cancelled together with the script.
+        nc.Publish = (subj, data) => __exec.NatsOp() || __nc.Publish(subj, _strToBytes(data));
+        nc.PublishMsg = (msg) => __exec.NatsOp() || __nc.PublishMsg(msg);
+        nc.PublishRequest = (subj, reply, data) => __exec.NatsOp() || __nc.PublishRequest(subj, reply, _strToBytes(data));
+        nc.QueueSubscribe = (subj, queue, cb) => __exec.NatsOp() || wrapSubscription(hooks.track(__nc.QueueSubscribe(subj, queue, hooks.schedule((__msg) => cb(wrapMsg(__msg))))));
+        nc.QueueSubscribeSync = (subj, queue) => __exec.NatsOp() || wrapSubscription(hooks.track(__nc.QueueSubscribeSync(subj, queue)));
+        nc.Request = (subj, data, timeout) => __exec.NatsOp() || wrapMsg(__exec.Request(__nc, subj, _strToBytes(data), _parseDuration(timeout)));
+        nc.RequestMsg = (msg, timeout) => __exec.NatsOp() || wrapMsg(__exec.RequestMsg(__nc, msg, _parseDuration(timeout)));
+        nc.RequestAsync = (subj, data, timeout) => __exec.NatsOp() || __exec.RequestAsync(__nc, subj, _strToBytes(data), _parseDuration(timeout)).then(wrapMsg);
+        nc.RequestMsgAsync = (msg, timeout) => __exec.NatsOp() || __exec.RequestMsgAsync(__nc, msg, _parseDuration(timeout)).then(wrapMsg);
+        // gather-style: all requests run concurrently; failed requests (f.e. timeouts) result in null.
+        nc.RequestAll = (requests, timeout) => Promise.all(requests.map(
+            (request) => nc.RequestAsync(request.subject, request.data, timeout).catch(() => null)
+        ));
+        nc.RequestWithContext = (ctx, subj, data) => __exec.NatsOp() || wrapMsg(__nc.RequestWithContext(ctx, subj, _strToBytes(data)));
+        nc.RequestMsgWithContext = (ctx, msg) => __exec.NatsOp() || wrapMsg(__nc.RequestMsgWithContext(ctx, msg));
+        nc.Subscribe = (subj, cb) => __exec.NatsOp() || wrapSubscription(hooks.track(__nc.Subscribe(subj, hooks.schedule((__msg) => cb(wrapMsg(__msg))))));
+        nc.SubscribeSync = (subj) => __exec.NatsOp() || wrapSubscription(hooks.track(__nc.SubscribeSync(subj)));
 		return nc;
     }
     
@@ -92,17 +130,47 @@ function _setup(_nats, _bytesToStr, _strToBytes, _parseDuration) {
                 __msg.Data = _strToBytes(value);
 			}
 		});
+		// binary payloads (f.e. gzip-compressed) can be processed via std on the raw bytes.
+		Object.defineProperty(msg, "RawData", {
+			get() {
+				return _bytesToArrayBuffer(__msg.Data);
+			}
+		});
+		// the methods of *nats.Msg which publish are hidden (see scriptFieldNameMapper); these check the Permissions.
+		msg.Respond = (data) => __exec.NatsOp() || conn.Respond(__msg, _strToBytes(data));
+		msg.RespondMsg = (response) => __exec.NatsOp() || conn.RespondMsg(__msg, response);
+		for (const kind of ["Ack", "AckSync", "Nak", "Term", "InProgress"]) {
+			msg[kind] = () => __exec.NatsOp() || conn.Acknowledge(__msg, kind, "");
+		}
+		msg.NakWithDelay = (delay) => __exec.NatsOp() || conn.Acknowledge(__msg, "NakWithDelay", delay);
 		return msg;
 	}
 
     function wrapNats(__nats) {
 		const nats = Object.create(__nats);
         
-        nats.NewMsg = (subject) => wrapMsg(__nats.NewMsg(subject));
+        // __nats is frozen (see isolationFn), so we cannot simply assign to the inherited property.
+        Object.defineProperty(nats, "NewMsg", {
+            value: (subject) => wrapMsg(__nats.NewMsg(subject)),
+            writable: true,
+            enumerable: true,
+        });
         
         return nats;
 	}
     
+    function wrapJetStream(__js) {
+        if (!__js) {
+            // no connection, f.e. in tests
+            return __js;
+        }
+        const js = Object.create(__js);
+        // messages are wrapped like the ones of nc; all other calls return plain objects already (see jetstream.go).
+        js.Fetch = (stream, consumer, batch, opts) => __js.Fetch(stream, consumer, batch, opts).map(wrapMsg);
+        js.FetchAsync = (stream, consumer, batch, opts) => __js.FetchAsync(stream, consumer, batch, opts).then((msgs) => msgs.map(wrapMsg));
+        return js;
+    }
+
     function nullOnTimeout(func) {
         return function() {
             try {
@@ -120,19 +188,22 @@ function _setup(_nats, _bytesToStr, _strToBytes, _parseDuration) {
         }
         
         const subscription = Object.create(__subscription);
-        subscription.NextMsg = nullOnTimeout((timeout) => wrapMsg(__subscription.NextMsg(_parseDuration(timeout))));
-        subscription.NextMsgWithContext = (ctx) => wrapMsg(__subscription.NextMsgWithContext(ctx));
+        subscription.NextMsg = nullOnTimeout((timeout) => __exec.NatsOp() || wrapMsg(__exec.NextMsg(__subscription, _parseDuration(timeout))));
+        subscription.NextMsgWithContext = (ctx) => __exec.NatsOp() || wrapMsg(__subscription.NextMsgWithContext(ctx));
         
         return subscription;
     } 
     
-    return function(__nc, __msg = null) {
+    return function(__nc, __msg = null, __hooks = defaultHooks) {
+        conn = __nc;
 		const nats = wrapNats(_nats);
-        const nc = wrapNc(__nc);
+        const nc = wrapNc(__nc, __hooks);
+        const js = wrapJetStream(_jetStream(__nc));
 		const msg = wrapMsg(__msg);
 		return {
             nats,
             nc,
+            js,
             msg
 		};  
     }
@@ -141,79 +212,142 @@ function _setup(_nats, _bytesToStr, _strToBytes, _parseDuration) {
 }
 `
 
+// setupProgram is setupFn compiled once, as it is run for every new runtime.
+var setupProgram = goja.MustCompile("setup", setupFn, false)
+
 // wrapJs wraps the user-defined script.
 func wrapJs(in string) string {
 	return fmt.Sprintf(`
 	"use strict";
 	(function() {
-		const {nats, nc, msg} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, __msg);
+		const {nats, nc, js, msg} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, __msg);
+		const query = __query;
 		%s;
     })()
 `, in)
 }
+
+// wrapJsScript wraps the user-defined script of RunScript as async function, so that it can use await.
 func wrapJsScript(in string) string {
 	return fmt.Sprintf(`
 	"use strict";
-	(function() {
-		const {nats, nc} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, undefined);
+	(async function() {
+		const {nats, nc, js} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, undefined);
+		const query = __query;
 		%s;
     })()
 `, in)
 }
 
-func ConvertMessage(nc *nats.Conn, msg *nats.Msg, jsFn string) (*data.Frame, error) {
+// ConvertMessage converts a single NATS message to frames, via the user-defined script jsFn. The script is stopped
+// if ctx is cancelled, or if it exceeds the limits given via WithLimits.
+//
+// Usually, this is a single frame; the script can return multiple frames via frames({name: rows}), see
+// convertResults.
+func ConvertMessage(ctx context.Context, nc *nats.Conn, msg *nats.Msg, jsFn string, opts ...Option) (data.Frames, error) {
+	o := buildOptions(opts)
 	if jsFn == "" {
+		// without script, the payload is decoded here - unlike JSON.parse, this keeps 42.0 apart from 42.
+		if payload, ok := decodeJson(msg.Data); ok {
+			return convertResults(payload, o.frameOptions()...)
+		}
 		jsFn = `
 			return JSON.parse(msg.Data);
 		`
 	}
-	vm := gojaPool.Get().(*goja.Runtime)
-	defer gojaPool.Put(vm)
-	if err := vm.Set("__nc", nc); err != nil {
+	// releasing the runtime resets request-scoped variables - this way, we can have a clean VM again.
+	vm := acquireRuntime()
+	var runErr error
+	defer func() {
+		releaseRuntime(vm, runErr)
+	}()
+	if err := vm.Set("__nc", newScriptConn(nc, o.permissions)); err != nil {
 		return nil, err
 	}
 	if err := vm.Set("__msg", msg); err != nil {
 		return nil, err
 	}
-	// reset request-scoped variables - this way, we can have a clean VM again.
-	defer func() {
-		_ = vm.GlobalObject().Delete("__nc")
-		_ = vm.GlobalObject().Delete("__msg")
-	}()
+	if err := vm.Set("__query", o.query.toJs(vm)); err != nil {
+		return nil, err
+	}
+	logs := newScriptLogs(o.serverLog)
+	if err := vm.Set("__logs", logs); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__modules", newModuleLoader(o.modules)); err != nil {
+		return nil, err
+	}
 
-	resultWrapper, err := vm.RunString(wrapJs(jsFn))
+	resultWrapper, err := runGuarded(ctx, vm, o.limits, func() (goja.Value, error) {
+		return runUserScript(vm, jsFn, MessageScript, o.language)
+	})
+	runErr = err
 	if err != nil {
-		return nil, fmt.Errorf("could not run JS: %w  - JS was: %s", err, wrapJs(jsFn))
+		return nil, scriptError(err, jsFn, MessageScript, o.language)
 	}
 
-	result := resultWrapper.Export()
-	return convertResult(result)
+	frames, err := convertResults(resultWrapper.Export(), o.frameOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	logs.attachTo(frames...)
+	return frames, nil
 }
 
-func RunScript(nc *nats.Conn, jsFn string) (*data.Frame, error) {
+// RunScript runs a free-form script, and converts its result to frames (see ConvertMessage). The script is stopped
+// if ctx is cancelled, or if it exceeds the limits given via WithLimits.
+//
+// The script may use await (f.e. on nc.RequestAsync); its result is converted once all asynchronous calls completed.
+func RunScript(ctx context.Context, nc *nats.Conn, jsFn string, opts ...Option) (data.Frames, error) {
+	o := buildOptions(opts)
 	if jsFn == "" {
 		return nil, fmt.Errorf("script must be specified")
 	}
-	vm := gojaPool.Get().(*goja.Runtime)
-	defer gojaPool.Put(vm)
-	if err := vm.Set("__nc", nc); err != nil {
-		return nil, err
-	}
-	// reset request-scoped variables - this way, we can have a clean VM again.
+	// releasing the runtime resets request-scoped variables - this way, we can have a clean VM again.
+	vm := acquireRuntime()
+	var runErr error
 	defer func() {
-		_ = vm.GlobalObject().Delete("__nc")
+		releaseRuntime(vm, runErr)
 	}()
+	if err := vm.Set("__nc", newScriptConn(nc, o.permissions)); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__query", o.query.toJs(vm)); err != nil {
+		return nil, err
+	}
+	logs := newScriptLogs(o.serverLog)
+	if err := vm.Set("__logs", logs); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__modules", newModuleLoader(o.modules)); err != nil {
+		return nil, err
+	}
 
-	resultWrapper, err := vm.RunString(wrapJsScript(jsFn))
+	resultWrapper, err := runGuarded(ctx, vm, o.limits, func() (goja.Value, error) {
+		return runUserScript(vm, jsFn, FreeFormScript, o.language)
+	})
+	runErr = err
 	if err != nil {
-		return nil, fmt.Errorf("could not run JS: %w  - JS was: %s", err, wrapJs(jsFn))
+		return nil, scriptError(err, jsFn, FreeFormScript, o.language)
 	}
 
-	result := resultWrapper.Export()
-	return convertResult(result)
+	frames, err := convertResults(resultWrapper.Export(), o.frameOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	logs.attachTo(frames...)
+	return frames, nil
 }
 
-func convertResult(result interface{}) (*data.Frame, error) {
+// convertResult converts the result of a script to a single frame; see convertResults for multiple frames.
+func convertResult(result interface{}, frameOpts ...framestruct.FramestructOption) (*data.Frame, error) {
+	if _, isFrameSet := result.(*frameSet); isFrameSet {
+		return nil, fmt.Errorf("multiple frames are not supported here - only for Request/Reply and Script queries")
+	}
+	return convertNamedResult("result", result, frameOpts...)
+}
+
+func convertNamedResult(name string, result interface{}, frameOpts ...framestruct.FramestructOption) (*data.Frame, error) {
 	_, isMap := result.(map[string]interface{})
 	_, isArray := result.([]interface{})
 	_, isFrame := result.(data.Frame)
@@ -227,9 +361,19 @@ func convertResult(result interface{}) (*data.Frame, error) {
 		frame := result.(*data.Frame)
 		return frame, nil
 	}
+	if configured, isConfigured := result.(*configuredFrame); isConfigured {
+		frame, err := convertNamedResult(name, configured.rows, frameOpts...)
+		if err != nil {
+			return nil, err
+		}
+		if err := configured.config.apply(frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
 	if isMap {
 		mapEl := result.(map[string]interface{})
-		return framestruct.ToDataFrame("result", mapEl)
+		return framestruct.ToDataFrame(name, mapEl, frameOpts...)
 	}
 	if isArray {
 		arr := result.([]interface{})
@@ -241,7 +385,7 @@ func convertResult(result interface{}) (*data.Frame, error) {
 			}
 			arrayOfMap = append(arrayOfMap, conv)
 		}
-		return framestruct.ToDataFrame("result", arrayOfMap)
+		return framestruct.ToDataFrame(name, arrayOfMap, frameOpts...)
 	}
 
 	return nil, fmt.Errorf("result of script must be map[string]interface{}, []map[string]interface{}, or data.Frame. Was: %v", reflect.TypeOf(result))
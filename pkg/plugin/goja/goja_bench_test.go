@@ -0,0 +1,95 @@
+package goja
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+// This is here to avoid compiler optimizations that
+// could remove the actual call we are benchmarking
+// during benchmarks
+var benchmarkResult data.Frames
+
+const benchmarkScript = `
+	const parsed = JSON.parse(msg.Data);
+	return {
+		sensor: parsed.sensor,
+		value: parsed.value * 1.8 + 32,
+		unit: "°F",
+		subject: msg.Subject,
+	};
+`
+
+// convertMessageUncached is ConvertMessage without the program cache, i.e. the script is compiled for every message.
+func convertMessageUncached(nc *nats.Conn, msg *nats.Msg, jsFn string) (data.Frames, error) {
+	vm := gojaPool.Get().(*goja.Runtime)
+	defer gojaPool.Put(vm)
+	_ = vm.Set("__nc", newScriptConn(nc, Permissions{}))
+	_ = vm.Set("__msg", msg)
+	_ = vm.Set("__query", QueryContext{}.toJs(vm))
+	defer func() {
+		_ = vm.GlobalObject().Delete("__nc")
+		_ = vm.GlobalObject().Delete("__msg")
+	}()
+	resultWrapper, err := runGuarded(context.Background(), vm, Limits{}, func() (goja.Value, error) {
+		return vm.RunString(wrapJs(jsFn))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convertResults(resultWrapper.Export())
+}
+
+func benchmarkConvertMessage(b *testing.B, convert func(msg *nats.Msg) (data.Frames, error)) {
+	b.Helper()
+	msg := &nats.Msg{
+		Subject: "sensors.temperature",
+		Data:    []byte(`{"sensor": "s1", "value": 21.5}`),
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchmarkResult, _ = convert(msg)
+		}
+	})
+	// many subscriptions converting messages concurrently
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = convert(msg)
+			}
+		})
+	})
+}
+
+func BenchmarkConvertMessage(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		benchmarkConvertMessage(b, func(msg *nats.Msg) (data.Frames, error) {
+			return ConvertMessage(context.Background(), nil, msg, benchmarkScript)
+		})
+	})
+	b.Run("uncached", func(b *testing.B) {
+		benchmarkConvertMessage(b, func(msg *nats.Msg) (data.Frames, error) {
+			return convertMessageUncached(nil, msg, benchmarkScript)
+		})
+	})
+}
+
+func BenchmarkStatefulConverter(b *testing.B) {
+	converter, err := NewStatefulConverter(context.Background(), nil, `
+		state.count++;
+		return {count: state.count, value: JSON.parse(msg.Data).value};
+	`, `return {count: 0}`, "")
+	if err != nil {
+		b.Fatalf("could not create converter: %s", err)
+	}
+	defer converter.Close()
+	msg := &nats.Msg{Data: []byte(`{"value": 21.5}`)}
+	for i := 0; i < b.N; i++ {
+		frame, _ := converter.ConvertMessage(msg)
+		benchmarkResult = data.Frames{frame}
+	}
+}
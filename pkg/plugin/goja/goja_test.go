@@ -1,9 +1,14 @@
 package goja
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+
 	"github.com/dop251/goja"
 	"github.com/nats-io/nats.go"
-	"testing"
 )
 
 func TestJsonDecode(t *testing.T) {
@@ -37,3 +42,98 @@ Object.defineProperty(msg, "Data", {
 		t.Fatalf("JSON could not be parsed")
 	}
 }
+
+func TestStdLib(t *testing.T) {
+	vm := newRuntime()
+	tests := []struct {
+		name     string
+		js       string
+		expected string
+	}{
+		{"base64 encode", `std.base64.encode("hello")`, "aGVsbG8="},
+		{"base64 decode", `std.base64.decodeString("aGVsbG8=")`, "hello"},
+		{"base64 decode unpadded", `std.base64.decodeString("aGVsbG8")`, "hello"},
+		{"base64 decode url-safe", `std.hex.encode(std.base64.decode("-_8"))`, "fbff"},
+		{"base64 round trip binary", `std.hex.encode(std.base64.decode(std.base64.encode(std.hex.decode("00ff10"))))`, "00ff10"},
+		{"hex encode", `std.hex.encode("hi")`, "6869"},
+		{"hex encode Uint8Array", `std.hex.encode(new Uint8Array([1, 2, 255]).subarray(1))`, "02ff"},
+		{"sha256", `std.hash.sha256("abc")`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"md5", `std.hash.md5("abc")`, "900150983cd24fb0d6963f7d28e17f72"},
+		{"hmac", `std.hmac("sha256", "key", "The quick brown fox jumps over the lazy dog")`, "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{"time parse RFC3339", `String(std.time.parse("2023-01-02T03:04:05Z"))`, "1672628645000"},
+		{"time parse in zone", `String(std.time.parse("2023-07-01 12:00:00", "DateTime", "Europe/Berlin"))`, "1688205600000"},
+		{"time parse with undefined layout", `String(std.time.parse("2023-01-02T03:04:05Z", undefined, "Europe/Berlin"))`, "1672628645000"},
+		{"time format in zone", `std.time.format(1688205600000, "2006-01-02 15:04 MST", "Europe/Berlin")`, "2023-07-01 12:00 CEST"},
+		{"time format default", `std.time.format(1672628645000)`, "2023-01-02T03:04:05Z"},
+		{"url parse", `const u = std.url.parse("https://user@example.com:8080/a/b?x=1&x=2#frag"); [u.hostname, u.port, u.path, u.query.x.join(","), u.fragment].join(" ")`, "example.com 8080 /a/b 1,2 frag"},
+		{"url parseQuery", `std.url.parseQuery("?a=1&b=x%20y").b[0]`, "x y"},
+		{"url encodeQuery", `std.url.encodeQuery({b: "x y", a: [1, 2]})`, "a=1&a=2&b=x+y"},
+		{"gzip round trip", `std.text.decode(std.gzip.decompress(std.gzip.compress("hello gzip")))`, "hello gzip"},
+		{"text decode latin1", `std.text.decode(std.hex.decode("e4f6fc"), "latin1")`, "äöü"},
+		{"text decode utf-16le", `std.text.decode(std.hex.decode("680069"+"00"), "utf-16le")`, "hi"},
+		{"text decode utf-16be", `std.text.decode(std.hex.decode("00680069"), "UTF-16BE")`, "hi"},
+		{"text encode", `std.hex.encode(std.text.encode("ä"))`, "c3a4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := vm.RunString(test.js)
+			if err != nil {
+				t.Fatalf("script failed: %s", err)
+			}
+			if result.String() != test.expected {
+				t.Fatalf("expected %q, was %q", test.expected, result.String())
+			}
+		})
+	}
+}
+
+func TestStdLibErrors(t *testing.T) {
+	vm := newRuntime()
+	tests := []struct {
+		name          string
+		js            string
+		expectedError string
+	}{
+		{"unknown hmac algorithm", `std.hmac("sha3", "key", "data")`, "unknown hash algorithm sha3"},
+		{"unknown time zone", `std.time.parse("2023-01-02T03:04:05Z", "RFC3339", "Mars/Olympus")`, "unknown time zone"},
+		{"invalid time", `std.time.parse("yesterday")`, "cannot parse"},
+		{"invalid gzip", `std.gzip.decompress("this is not gzip")`, "invalid header"},
+		{"unknown text encoding", `std.text.decode("x", "ebcdic")`, "unsupported text encoding"},
+		{"no binary data", `std.hex.encode({})`, "expected string, ArrayBuffer or typed array"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := vm.RunString(test.js)
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Fatalf("expected error containing %q, was: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestStdLibRawData(t *testing.T) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write([]byte(`{"k": "v"}`))
+	_ = w.Close()
+
+	frames, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: compressed.Bytes()}, `
+		return JSON.parse(std.text.decode(std.gzip.decompress(msg.RawData)));
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if v, _ := frames[0].Fields[0].ConcreteAt(0); v != "v" {
+		t.Fatalf("expected decompressed value v, was %v", v)
+	}
+}
+
+func TestStdLibIsFrozen(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, `
+		std.hash.sha256 = () => "forged";
+		return {};
+	`)
+	if err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Fatalf("expected std to be read-only, was: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package goja
+
+import (
+	"errors"
+
+	"github.com/dop251/goja"
+)
+
+// isolationFn is run once on every new runtime, after setupFn. As runtimes are reused across queries of different
+// dashboards and users (see gojaPool), no script may be able to influence the scripts running after it:
+//
+//   - all intrinsics (JSON, Array.prototype, Object, ...) and internal helpers (_setup, ...) are frozen deeply,
+//     so that f.e. JSON.parse cannot be replaced.
+//   - frozen prototype properties which scripts commonly shadow on their own objects (f.e. err.name = "..." or
+//     obj.toString = ...) are turned into accessors before, like SES does it: Otherwise, the assignment would fail
+//     in strict mode, as an inherited read-only property cannot be overridden by assignment.
+//   - all globals existing at this point are made read-only.
+//   - _resetGlobals removes all globals created afterwards (f.e. via globalThis.x = 1, or by sloppy-mode code
+//     created via Function()); it is called after every execution, see releaseRuntime.
+const isolationFn = `
+(function() {
+	"use strict";
+	const {defineProperty, getOwnPropertyDescriptor} = Object;
+	const hasOwn = Function.prototype.call.bind(Object.prototype.hasOwnProperty);
+
+	// tame replaces the given data properties ("*" for all) of obj by accessors, whose setter defines an own
+	// property on the receiver - so that assigning them on an object inheriting from obj works after freezing it.
+	function tame(obj, keys) {
+		for (const key of keys === "*" ? Reflect.ownKeys(obj) : keys) {
+			const descriptor = getOwnPropertyDescriptor(obj, key);
+			if (!descriptor || !("value" in descriptor) || !descriptor.configurable) {
+				continue;
+			}
+			const value = descriptor.value;
+			defineProperty(obj, key, {
+				get() {
+					return value;
+				},
+				set(newValue) {
+					if (this === obj) {
+						throw new TypeError("Cannot assign to read only property '" + String(key) + "'");
+					}
+					if (hasOwn(this, key)) {
+						this[key] = newValue;
+					} else {
+						defineProperty(this, key, {value: newValue, writable: true, enumerable: true, configurable: true});
+					}
+				},
+				enumerable: descriptor.enumerable,
+				configurable: false,
+			});
+		}
+	}
+	tame(Object.prototype, "*");
+	tame(Array.prototype, ["constructor", "toString", "toLocaleString"]);
+	tame(Function.prototype, ["constructor", "name", "toString", "bind", "call", "apply"]);
+	tame(Promise.prototype, ["constructor"]);
+	for (const error of [Error, EvalError, RangeError, ReferenceError, SyntaxError, TypeError, URIError]) {
+		tame(error.prototype, ["constructor", "name", "message", "toString"]);
+	}
+
+	// globalThis itself must stay extensible, to be able to set the request-scoped variables.
+	const frozen = new Set([globalThis]);
+	function deepFreeze(value) {
+		if ((typeof value !== "object" && typeof value !== "function") || value === null || frozen.has(value)) {
+			return;
+		}
+		frozen.add(value);
+		try {
+			Object.freeze(value);
+		} catch (e) {
+			// wrapped Go values cannot always be frozen; they are protected by being read-only globals.
+			return;
+		}
+		for (const key of Reflect.ownKeys(value)) {
+			const descriptor = Object.getOwnPropertyDescriptor(value, key);
+			if (!descriptor) {
+				continue;
+			}
+			deepFreeze(descriptor.value);
+			deepFreeze(descriptor.get);
+			deepFreeze(descriptor.set);
+		}
+		deepFreeze(Object.getPrototypeOf(value));
+	}
+
+	const knownGlobals = new Set(Object.getOwnPropertyNames(globalThis));
+	knownGlobals.add("_resetGlobals");
+	const resetGlobals = function() {
+		for (const name of Object.getOwnPropertyNames(globalThis)) {
+			if (!knownGlobals.has(name) && !Reflect.deleteProperty(globalThis, name)) {
+				// f.e. a non-configurable global defined by a script
+				return false;
+			}
+		}
+		return Object.isExtensible(globalThis);
+	};
+	Object.defineProperty(globalThis, "_resetGlobals", {value: resetGlobals});
+
+	for (const name of knownGlobals) {
+		const descriptor = Object.getOwnPropertyDescriptor(globalThis, name);
+		if (!descriptor) {
+			continue;
+		}
+		deepFreeze(descriptor.value);
+		if ("value" in descriptor && descriptor.writable) {
+			Object.defineProperty(globalThis, name, {writable: false, configurable: false});
+		}
+	}
+})()
+`
+
+var isolationProgram = goja.MustCompile("isolation", isolationFn, false)
+
+var resetGlobalsProgram = goja.MustCompile("resetGlobals", "_resetGlobals()", false)
+
+// resetRuntime removes all globals which were created since the runtime was set up, including the request-scoped
+// "__" variables. It returns false if this was not possible; the runtime must not be reused then.
+func resetRuntime(vm *goja.Runtime) bool {
+	clean, err := vm.RunProgram(resetGlobalsProgram)
+	return err == nil && clean.ToBoolean()
+}
+
+// acquireRuntime returns a runtime from the gojaPool.
+func acquireRuntime() *goja.Runtime {
+	return gojaPool.Get().(*goja.Runtime)
+}
+
+// releaseRuntime resets the given runtime and returns it to the gojaPool; or discards it, if it cannot be reset.
+//
+// runErr is the error of runGuarded: after a *LimitError, the script was interrupted - goja does not fully unwind the
+// call stack of an interrupted script, so that f.e. promise jobs are not run anymore on this runtime; thus, it is
+// discarded as well.
+func releaseRuntime(vm *goja.Runtime, runErr error) {
+	var limitErr *LimitError
+	if errors.As(runErr, &limitErr) {
+		return
+	}
+	if resetRuntime(vm) {
+		gojaPool.Put(vm)
+	}
+}
@@ -0,0 +1,197 @@
+package goja
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/nats-io/nats.go"
+)
+
+// runOnRuntime runs a script like ConvertMessage does, but on the given runtime - so that we can test that
+// two scripts running one after another on the same (pooled) runtime cannot influence each other.
+func runOnRuntime(t *testing.T, vm *goja.Runtime, jsFn string) (goja.Value, error) {
+	t.Helper()
+	if err := vm.Set("__nc", newScriptConn(nil, Permissions{})); err != nil {
+		t.Fatalf("could not set __nc: %s", err)
+	}
+	if err := vm.Set("__msg", &nats.Msg{Data: []byte(`{"k": "v"}`)}); err != nil {
+		t.Fatalf("could not set __msg: %s", err)
+	}
+	if err := vm.Set("__query", QueryContext{}.toJs(vm)); err != nil {
+		t.Fatalf("could not set __query: %s", err)
+	}
+	return runGuarded(context.Background(), vm, Limits{}, func() (goja.Value, error) {
+		return runCached(vm, wrapJs(jsFn))
+	})
+}
+
+func TestIsolationGlobalsDoNotLeak(t *testing.T) {
+	vm := newRuntime()
+
+	_, err := runOnRuntime(t, vm, `
+		globalThis.leaked = "secret";
+		Function("sloppyLeak = 'secret'")();
+		return {};
+	`)
+	if err != nil {
+		t.Fatalf("1st script failed: %s", err)
+	}
+	if !resetRuntime(vm) {
+		t.Fatalf("runtime could not be reset")
+	}
+
+	result, err := runOnRuntime(t, vm, `
+		return {
+			leaked: typeof leaked,
+			sloppyLeak: typeof sloppyLeak,
+			msg: typeof __msg,
+		};
+	`)
+	if err != nil {
+		t.Fatalf("2nd script failed: %s", err)
+	}
+	exported := result.Export().(map[string]interface{})
+	for _, name := range []string{"leaked", "sloppyLeak"} {
+		if exported[name] != "undefined" {
+			t.Errorf("global %s leaked into the next script", name)
+		}
+	}
+	if exported["msg"] != "object" {
+		t.Errorf("request-scoped variables must still be settable after reset")
+	}
+}
+
+func TestIsolationIntrinsicsAreFrozen(t *testing.T) {
+	vm := newRuntime()
+
+	for _, script := range []string{
+		`JSON.parse = () => ({hacked: true})`,
+		`Array.prototype.map = () => []`,
+		`Object.prototype.hacked = true`,
+		`Object.prototype.toString = () => "hacked"`,
+		`Error.prototype.name = "hacked"`,
+		`globalThis.JSON = {parse: () => ({hacked: true})}`,
+		`_setup = () => ({})`,
+		`_nats.NewInbox = () => "hacked"`,
+		`delete globalThis.Math`,
+	} {
+		_, err := runOnRuntime(t, vm, script)
+		if err == nil {
+			t.Errorf("expected modification to fail: %s", script)
+		}
+		resetRuntime(vm)
+	}
+
+	result, err := runOnRuntime(t, vm, `
+		return {
+			parsed: JSON.stringify(JSON.parse(msg.Data)),
+			mapped: [1, 2].map(x => x * 2).length,
+			hacked: ({}).hacked === undefined && String({}) === "[object Object]" && new Error().name === "Error" ? "no" : "yes",
+			inbox: nats.NewInbox().startsWith("_INBOX."),
+			math: typeof Math.max,
+		};
+	`)
+	if err != nil {
+		t.Fatalf("script after modification attempts failed: %s", err)
+	}
+	exported := result.Export().(map[string]interface{})
+	if exported["parsed"] != `{"k":"v"}` || exported["mapped"] != int64(2) || exported["hacked"] != "no" ||
+		exported["inbox"] != true || exported["math"] != "function" {
+		t.Fatalf("intrinsics were modified: %v", exported)
+	}
+}
+
+func TestIsolationInheritedPropertiesCanBeShadowed(t *testing.T) {
+	vm := newRuntime()
+
+	// assigning a property which is inherited from a frozen prototype must define it on the object itself.
+	result, err := runOnRuntime(t, vm, `
+		const e = new Error("x");
+		e.name = "MyError";
+		const o = {};
+		o.toString = () => "custom";
+		o.constructor = "mine";
+		function F() {}
+		F.prototype.constructor = "replaced";
+		class MyError extends TypeError {}
+		const m = new MyError("y");
+		m.name = "MyError";
+		return {
+			error: String(e),
+			object: String(o),
+			constructor: o.constructor,
+			fn: F.prototype.constructor,
+			subclass: String(m),
+			untouched: String({}) + " " + new Error("z").name,
+		};
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	exported := result.Export().(map[string]interface{})
+	expected := map[string]interface{}{
+		"error":       "MyError: x",
+		"object":      "custom",
+		"constructor": "mine",
+		"fn":          "replaced",
+		"subclass":    "MyError: y",
+		"untouched":   "[object Object] Error",
+	}
+	for k, v := range expected {
+		if exported[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, exported[k])
+		}
+	}
+}
+
+func TestIsolationTaintedRuntimeIsDiscarded(t *testing.T) {
+	vm := newRuntime()
+
+	_, err := runOnRuntime(t, vm, `
+		Object.defineProperty(globalThis, "sticky", {value: "secret", configurable: false});
+		return {};
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if resetRuntime(vm) {
+		t.Fatalf("a runtime with non-removable globals must not be reused")
+	}
+
+	vm = newRuntime()
+	_, err = runOnRuntime(t, vm, `
+		Object.preventExtensions(globalThis);
+		return {};
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if resetRuntime(vm) {
+		t.Fatalf("a non-extensible runtime must not be reused")
+	}
+}
+
+func TestIsolationBetweenPooledExecutions(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		frames, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`{}`)}, `
+			const seen = typeof globalThis.counter === "undefined" ? 0 : globalThis.counter;
+			globalThis.counter = seen + 1;
+			return {seen};
+		`)
+		if err != nil {
+			t.Fatalf("execution %d failed: %s", i, err)
+		}
+		if seen := *frames[0].Fields[0].At(0).(*int64); seen != 0 {
+			t.Fatalf("execution %d saw state of an earlier execution: %v", i, seen)
+		}
+	}
+
+	_, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`{}`)}, `
+		JSON.parse = () => ({});
+	`)
+	if err == nil || !strings.Contains(err.Error(), "read-only") && !strings.Contains(err.Error(), "Cannot assign") {
+		t.Fatalf("expected error when modifying JSON.parse, got: %v", err)
+	}
+}
@@ -0,0 +1,716 @@
+package goja
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/nats-io/nats.go"
+)
+
+// defaultJetStreamTimeout is used for JetStream calls without a timeout option; like the default of nats.go.
+const defaultJetStreamTimeout = 5 * time.Second
+
+// jetStream is exposed to scripts as `js` (see wrapJetStream in setupFn). In contrast to the Go API, it is
+// JS-friendly: Data is passed and returned as string (or binary data, see std), timeouts are given as strings, and
+// options are plain objects instead of Go option functions:
+//
+//	js.StreamInfo("ORDERS", {timeout: "1s"})
+//
+// Infos (StreamInfo, ConsumerInfo, PubAck, ObjectInfo, ...) are returned as plain objects with the field names of
+// the JetStream JSON API; messages and KV entries with the Go field names, like nc does.
+//
+// Publish, Fetch and kv.Get have asynchronous variants (PublishAsync, FetchAsync and kv.GetAsync), which return a
+// Promise like nc.RequestAsync (see async.go): they are prepared on the goroutine of the script, and the blocking
+// part runs on its own goroutine.
+//
+// Every call counts as NATS operation (see Limits.MaxNatsOps), and is cancelled together with the script. Like the
+// calls of nc, it is checked against the Permissions: Calls of the JetStream API are requests to the subject of the
+// API (see jsApi), and KV and object store calls publish or subscribe to the subjects of their bucket.
+type jetStream struct {
+	vm *goja.Runtime
+	nc *scriptConn
+}
+
+// jetStreamOptions are the options accepted by all JetStream calls of scripts.
+type jetStreamOptions struct {
+	// Timeout of the call, f.e. "1s"; defaultJetStreamTimeout if empty.
+	Timeout string `json:"timeout"`
+	// Direct enables direct get for GetMsg and GetLastMsg, so that the message can be served by any replica.
+	Direct bool `json:"direct"`
+}
+
+func newJetStream(vm *goja.Runtime, nc *scriptConn) *jetStream {
+	if nc == nil {
+		return nil
+	}
+	return &jetStream{vm: vm, nc: nc}
+}
+
+// jsApi returns the subject of a request to the JetStream API, f.e. $JS.API.STREAM.INFO.ORDERS.
+func jsApi(tokens ...string) string {
+	return "$JS.API." + strings.Join(tokens, ".")
+}
+
+// call prepares a JetStream call of the script, which first requests the given API subject: the returned context
+// ends after the timeout given in opts, or if the script is stopped; the returned JetStream context uses the same
+// timeout.
+func (j *jetStream) call(opts goja.Value, api string) (context.Context, context.CancelFunc, nats.JetStreamContext, jetStreamOptions, error) {
+	o := jetStreamOptions{}
+	if opts != nil && !goja.IsUndefined(opts) && !goja.IsNull(opts) {
+		// via JSON, as ExportTo matches the Go field names instead of the JSON ones.
+		encoded, err := json.Marshal(opts.Export())
+		if err == nil {
+			err = json.Unmarshal(encoded, &o)
+		}
+		if err != nil {
+			return nil, nil, nil, o, fmt.Errorf("invalid JetStream options: %w", err)
+		}
+	}
+	timeout := defaultJetStreamTimeout
+	if o.Timeout != "" {
+		parsed, err := time.ParseDuration(o.Timeout)
+		if err != nil {
+			return nil, nil, nil, o, err
+		}
+		timeout = parsed
+	}
+	if api != "" {
+		if err := j.nc.permissions.checkRequest(api); err != nil {
+			return nil, nil, nil, o, err
+		}
+	}
+
+	e, err := j.execution()
+	if err != nil {
+		return nil, nil, nil, o, err
+	}
+	if err := e.NatsOp(); err != nil {
+		return nil, nil, nil, o, err
+	}
+	js, err := j.nc.nc.JetStream(nats.MaxWait(timeout))
+	if err != nil {
+		return nil, nil, nil, o, err
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	return ctx, cancel, js, o, nil
+}
+
+func (j *jetStream) execution() (*execution, error) {
+	e, isExecution := exportOf(j.vm.Get("__exec")).(*execution)
+	if !isExecution {
+		return nil, errors.New("JetStream can only be used while the script runs")
+	}
+	return e, nil
+}
+
+// jetStreamAsync runs a prepared JetStream call (see f.e. jetStream.publish) on its own goroutine, and returns a
+// promise for its result.
+func jetStreamAsync[T any](j *jetStream, run func() (T, error), err error) (*goja.Promise, error) {
+	if err != nil {
+		return nil, err
+	}
+	e, err := j.execution()
+	if err != nil {
+		return nil, err
+	}
+	return e.async(func() (interface{}, error) {
+		result, err := run()
+		return result, err
+	}), nil
+}
+
+// StreamNames returns the names of all streams.
+func (j *jetStream) StreamNames(opts goja.Value) ([]string, error) {
+	ctx, cancel, js, _, err := j.call(opts, jsApi("STREAM", "NAMES"))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	names := make([]string, 0)
+	for name := range js.StreamNames(nats.Context(ctx)) {
+		names = append(names, name)
+	}
+	return names, ctx.Err()
+}
+
+func (j *jetStream) StreamInfo(stream string, opts goja.Value) (map[string]interface{}, error) {
+	ctx, cancel, js, _, err := j.call(opts, jsApi("STREAM", "INFO", stream))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return toJsonObject(js.StreamInfo(stream, nats.Context(ctx)))
+}
+
+func (j *jetStream) ConsumerInfo(stream string, consumer string, opts goja.Value) (map[string]interface{}, error) {
+	ctx, cancel, js, _, err := j.call(opts, jsApi("CONSUMER", "INFO", stream, consumer))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return toJsonObject(js.ConsumerInfo(stream, consumer, nats.Context(ctx)))
+}
+
+// ConsumerNames returns the names of all consumers of the given stream.
+func (j *jetStream) ConsumerNames(stream string, opts goja.Value) ([]string, error) {
+	ctx, cancel, js, _, err := j.call(opts, jsApi("CONSUMER", "NAMES", stream))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	names := make([]string, 0)
+	for name := range js.ConsumerNames(stream, nats.Context(ctx)) {
+		names = append(names, name)
+	}
+	return names, ctx.Err()
+}
+
+// Publish publishes to a stream, and returns the PubAck.
+func (j *jetStream) Publish(subj string, data goja.Value, opts goja.Value) (map[string]interface{}, error) {
+	run, err := j.publish(subj, data, opts)
+	if err != nil {
+		return nil, err
+	}
+	return run()
+}
+
+// PublishAsync is like Publish, but does not block the script.
+func (j *jetStream) PublishAsync(subj string, data goja.Value, opts goja.Value) (*goja.Promise, error) {
+	run, err := j.publish(subj, data, opts)
+	return jetStreamAsync(j, run, err)
+}
+
+// publish prepares Publish; the returned function does the call itself, and may run on any goroutine.
+func (j *jetStream) publish(subj string, data goja.Value, opts goja.Value) (func() (map[string]interface{}, error), error) {
+	if err := j.nc.permissions.checkPublish(subj); err != nil {
+		return nil, err
+	}
+	ctx, cancel, js, _, err := j.call(opts, "")
+	if err != nil {
+		return nil, err
+	}
+	b := j.bytes(data)
+	return func() (map[string]interface{}, error) {
+		defer cancel()
+		return toJsonObject(js.Publish(subj, b, nats.Context(ctx)))
+	}, nil
+}
+
+// GetMsg returns the message with the given sequence from the stream; null if it does not exist.
+func (j *jetStream) GetMsg(stream string, seq int64, opts goja.Value) (map[string]interface{}, error) {
+	ctx, cancel, js, o, err := j.call(opts, jsApi("STREAM", "MSG", "GET", stream))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if err := j.checkDirectGet(o, stream); err != nil {
+		return nil, err
+	}
+	return streamMsg(js.GetMsg(stream, uint64(seq), getMsgOpts(ctx, o)...))
+}
+
+// GetLastMsg returns the last message of the given subject from the stream; null if it does not exist.
+func (j *jetStream) GetLastMsg(stream string, subject string, opts goja.Value) (map[string]interface{}, error) {
+	ctx, cancel, js, o, err := j.call(opts, jsApi("STREAM", "MSG", "GET", stream))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if err := j.checkDirectGet(o, stream, subject); err != nil {
+		return nil, err
+	}
+	return streamMsg(js.GetLastMsg(stream, subject, getMsgOpts(ctx, o)...))
+}
+
+// Fetch pulls up to batch messages from an existing durable pull consumer. It returns fewer messages (or none)
+// if no more messages arrive within the timeout. The messages are not acknowledged automatically; use msg.Ack().
+//
+// As the messages are received like via a subscription, the subjects of the consumer must be allowed to subscribe.
+func (j *jetStream) Fetch(stream string, consumer string, batch int, opts goja.Value) ([]*nats.Msg, error) {
+	run, err := j.fetch(stream, consumer, batch, opts)
+	if err != nil {
+		return nil, err
+	}
+	return run()
+}
+
+// FetchAsync is like Fetch, but does not block the script.
+func (j *jetStream) FetchAsync(stream string, consumer string, batch int, opts goja.Value) (*goja.Promise, error) {
+	run, err := j.fetch(stream, consumer, batch, opts)
+	return jetStreamAsync(j, run, err)
+}
+
+// fetch prepares Fetch; the returned function does the call itself, and may run on any goroutine.
+func (j *jetStream) fetch(stream string, consumer string, batch int, opts goja.Value) (func() ([]*nats.Msg, error), error) {
+	if err := j.nc.permissions.checkRequest(jsApi("CONSUMER", "MSG", "NEXT", stream, consumer)); err != nil {
+		return nil, err
+	}
+	ctx, cancel, js, _, err := j.call(opts, jsApi("CONSUMER", "INFO", stream, consumer))
+	if err != nil {
+		return nil, err
+	}
+	return func() ([]*nats.Msg, error) {
+		defer cancel()
+		consumerInfo, err := js.ConsumerInfo(stream, consumer, nats.Context(ctx))
+		if err != nil {
+			return nil, err
+		}
+		subjects := []string{consumerInfo.Config.FilterSubject}
+		if consumerInfo.Config.FilterSubject == "" {
+			// the consumer delivers all messages of the stream.
+			if err := j.nc.permissions.checkRequest(jsApi("STREAM", "INFO", stream)); err != nil {
+				return nil, err
+			}
+			streamInfo, err := js.StreamInfo(stream, nats.Context(ctx))
+			if err != nil {
+				return nil, err
+			}
+			subjects = streamInfo.Config.Subjects
+		}
+		for _, subject := range subjects {
+			if err := j.nc.permissions.checkSubscribe(subject); err != nil {
+				return nil, err
+			}
+		}
+		subscription, err := js.PullSubscribe(consumerInfo.Config.FilterSubject, consumer, nats.Bind(stream, consumer), nats.Context(ctx))
+		if err != nil {
+			return nil, err
+		}
+		// bound consumers are not deleted on unsubscribe.
+		defer subscription.Unsubscribe()
+
+		msgs, err := subscription.Fetch(batch, nats.Context(ctx))
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+			return msgs, nil
+		}
+		return msgs, err
+	}, nil
+}
+
+// KeyValue returns the KV bucket with the given name.
+func (j *jetStream) KeyValue(bucket string, opts goja.Value) (*keyValue, error) {
+	kv := &keyValue{jetStream: j, bucket: bucket}
+	_, _, cancel, err := kv.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	cancel()
+	return kv, nil
+}
+
+// ObjectStore returns the object store bucket with the given name.
+func (j *jetStream) ObjectStore(bucket string, opts goja.Value) (*objectStore, error) {
+	store := &objectStore{jetStream: j, bucket: bucket}
+	_, _, cancel, err := store.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	cancel()
+	return store, nil
+}
+
+// checkDirectGet checks the request of a direct get, if enabled in the options.
+func (j *jetStream) checkDirectGet(o jetStreamOptions, tokens ...string) error {
+	if !o.Direct {
+		return nil
+	}
+	return j.nc.permissions.checkRequest(jsApi(append([]string{"DIRECT", "GET"}, tokens...)...))
+}
+
+func (j *jetStream) bytes(data goja.Value) []byte {
+	if b, err := valueToBytes(j.vm, data); err == nil {
+		return b
+	}
+	return []byte(data.String())
+}
+
+// withContext runs fn, but returns early if ctx ends first - for JetStream calls which do not accept a context. fn
+// itself ends after the timeout of the JetStream context (see call) at the latest.
+func withContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// keyValue is a KV bucket; the bucket is looked up for every call, so that every call has its own timeout.
+type keyValue struct {
+	jetStream *jetStream
+	bucket    string
+}
+
+func (kv *keyValue) open(opts goja.Value) (nats.KeyValue, context.Context, context.CancelFunc, error) {
+	ctx, cancel, js, _, err := kv.jetStream.call(opts, jsApi("STREAM", "INFO", "KV_"+kv.bucket))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bucket, err := kv.lookup(ctx, js)
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	return bucket, ctx, cancel, nil
+}
+
+func (kv *keyValue) lookup(ctx context.Context, js nats.JetStreamContext) (nats.KeyValue, error) {
+	return withContext(ctx, func() (nats.KeyValue, error) {
+		return js.KeyValue(kv.bucket)
+	})
+}
+
+// checkRead checks reading the given keys (">" for all), which are messages on the subjects of the bucket.
+func (kv *keyValue) checkRead(key string) error {
+	return kv.jetStream.nc.permissions.checkSubscribe("$KV." + kv.bucket + "." + key)
+}
+
+// checkWrite checks modifying the given key, which is a publish to its subject.
+func (kv *keyValue) checkWrite(operation string, key string) error {
+	if err := kv.jetStream.nc.permissions.checkWrite(operation + " KV bucket " + kv.bucket); err != nil {
+		return err
+	}
+	return kv.jetStream.nc.permissions.checkPublish("$KV." + kv.bucket + "." + key)
+}
+
+// Get returns the entry for the given key; null if it does not exist (or was deleted).
+func (kv *keyValue) Get(key string, opts goja.Value) (map[string]interface{}, error) {
+	run, err := kv.get(key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return run()
+}
+
+// GetAsync is like Get, but does not block the script.
+func (kv *keyValue) GetAsync(key string, opts goja.Value) (*goja.Promise, error) {
+	run, err := kv.get(key, opts)
+	return jetStreamAsync(kv.jetStream, run, err)
+}
+
+// get prepares Get; the returned function does the call itself, and may run on any goroutine.
+func (kv *keyValue) get(key string, opts goja.Value) (func() (map[string]interface{}, error), error) {
+	if err := kv.jetStream.nc.permissions.checkRequest(jsApi("STREAM", "MSG", "GET", "KV_"+kv.bucket)); err != nil {
+		return nil, err
+	}
+	ctx, cancel, js, _, err := kv.jetStream.call(opts, jsApi("STREAM", "INFO", "KV_"+kv.bucket))
+	if err != nil {
+		return nil, err
+	}
+	return func() (map[string]interface{}, error) {
+		defer cancel()
+		bucket, err := kv.lookup(ctx, js)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := withContext(ctx, func() (nats.KeyValueEntry, error) {
+			return bucket.Get(key)
+		})
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return kvEntry(entry), nil
+	}, nil
+}
+
+// Put sets the value of the given key, and returns the new revision.
+func (kv *keyValue) Put(key string, value goja.Value, opts goja.Value) (uint64, error) {
+	if err := kv.checkWrite("put to", key); err != nil {
+		return 0, err
+	}
+	bucket, ctx, cancel, err := kv.open(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+	data := kv.jetStream.bytes(value)
+	return withContext(ctx, func() (uint64, error) {
+		return bucket.Put(key, data)
+	})
+}
+
+// Create sets the value of the given key only if it does not exist yet, and returns the new revision.
+func (kv *keyValue) Create(key string, value goja.Value, opts goja.Value) (uint64, error) {
+	if err := kv.checkWrite("create in", key); err != nil {
+		return 0, err
+	}
+	bucket, ctx, cancel, err := kv.open(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+	data := kv.jetStream.bytes(value)
+	return withContext(ctx, func() (uint64, error) {
+		return bucket.Create(key, data)
+	})
+}
+
+func (kv *keyValue) Delete(key string, opts goja.Value) error {
+	if err := kv.checkWrite("delete from", key); err != nil {
+		return err
+	}
+	bucket, ctx, cancel, err := kv.open(opts)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	_, err = withContext(ctx, func() (struct{}, error) {
+		return struct{}{}, bucket.Delete(key)
+	})
+	return err
+}
+
+// Keys returns all keys of the bucket; an empty list if there are none.
+func (kv *keyValue) Keys(opts goja.Value) ([]string, error) {
+	if err := kv.checkRead(">"); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := kv.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	keys, err := bucket.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return []string{}, nil
+	}
+	return keys, err
+}
+
+// History returns all entries of the given key, oldest first.
+func (kv *keyValue) History(key string, opts goja.Value) ([]map[string]interface{}, error) {
+	if err := kv.checkRead(key); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := kv.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	entries, err := bucket.History(key, nats.Context(ctx))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return []map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, kvEntry(entry))
+	}
+	return result, nil
+}
+
+// objectStore is an object store bucket; like keyValue, the bucket is looked up for every call.
+type objectStore struct {
+	jetStream *jetStream
+	bucket    string
+}
+
+func (o *objectStore) open(opts goja.Value) (nats.ObjectStore, context.Context, context.CancelFunc, error) {
+	ctx, cancel, js, _, err := o.jetStream.call(opts, jsApi("STREAM", "INFO", "OBJ_"+o.bucket))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bucket, err := withContext(ctx, func() (nats.ObjectStore, error) {
+		return js.ObjectStore(o.bucket)
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	return bucket, ctx, cancel, nil
+}
+
+// checkRead checks reading objects, which are messages on the subjects of the bucket.
+func (o *objectStore) checkRead() error {
+	return o.jetStream.nc.permissions.checkSubscribe("$O." + o.bucket + ".>")
+}
+
+// checkWrite checks modifying objects, which is a publish to the subjects of the bucket.
+func (o *objectStore) checkWrite(operation string) error {
+	if err := o.jetStream.nc.permissions.checkWrite(operation + " object store " + o.bucket); err != nil {
+		return err
+	}
+	return o.jetStream.nc.permissions.checkPublish("$O." + o.bucket + ".>")
+}
+
+// Get returns the content of the given object as string; null if it does not exist.
+func (o *objectStore) Get(name string, opts goja.Value) (interface{}, error) {
+	b, err := o.getBytes(name, opts)
+	if b == nil || err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// GetRaw returns the content of the given object as ArrayBuffer; null if it does not exist.
+func (o *objectStore) GetRaw(name string, opts goja.Value) (interface{}, error) {
+	b, err := o.getBytes(name, opts)
+	if b == nil || err != nil {
+		return nil, err
+	}
+	return o.jetStream.vm.NewArrayBuffer(b), nil
+}
+
+func (o *objectStore) getBytes(name string, opts goja.Value) ([]byte, error) {
+	if err := o.checkRead(); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := o.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	b, err := bucket.GetBytes(name, nats.Context(ctx))
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if b == nil && err == nil {
+		// empty objects
+		b = []byte{}
+	}
+	return b, err
+}
+
+// GetInfo returns the ObjectInfo of the given object; null if it does not exist.
+func (o *objectStore) GetInfo(name string, opts goja.Value) (map[string]interface{}, error) {
+	if err := o.checkRead(); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := o.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	info, err := bucket.GetInfo(name, nats.Context(ctx))
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return nil, nil
+	}
+	return toJsonObject(info, err)
+}
+
+// Put stores the given data as object, and returns its ObjectInfo.
+func (o *objectStore) Put(name string, data goja.Value, opts goja.Value) (map[string]interface{}, error) {
+	if err := o.checkWrite("put to"); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := o.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return toJsonObject(bucket.PutBytes(name, o.jetStream.bytes(data), nats.Context(ctx)))
+}
+
+func (o *objectStore) Delete(name string, opts goja.Value) error {
+	if err := o.checkWrite("delete from"); err != nil {
+		return err
+	}
+	bucket, ctx, cancel, err := o.open(opts)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	_, err = withContext(ctx, func() (struct{}, error) {
+		return struct{}{}, bucket.Delete(name)
+	})
+	return err
+}
+
+// List returns the ObjectInfos of all objects in the bucket; an empty list if there are none.
+func (o *objectStore) List(opts goja.Value) ([]map[string]interface{}, error) {
+	if err := o.checkRead(); err != nil {
+		return nil, err
+	}
+	bucket, ctx, cancel, err := o.open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	infos, err := bucket.List(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoObjectsFound) {
+		return []map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(infos))
+	for _, info := range infos {
+		converted, err := toJsonObject(info, nil)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+func getMsgOpts(ctx context.Context, o jetStreamOptions) []nats.JSOpt {
+	opts := []nats.JSOpt{nats.Context(ctx)}
+	if o.Direct {
+		opts = append(opts, nats.DirectGet())
+	}
+	return opts
+}
+
+// toJsonObject converts a JetStream API response to a plain object, with the field names of the JSON API.
+func toJsonObject(v interface{}, err error) (map[string]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(encoded, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func streamMsg(msg *nats.RawStreamMsg, err error) (map[string]interface{}, error) {
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"Subject":  msg.Subject,
+		"Sequence": msg.Sequence,
+		"Header":   map[string][]string(msg.Header),
+		"Data":     string(msg.Data),
+		"Time":     msg.Time.UnixMilli(),
+	}, nil
+}
+
+func kvEntry(entry nats.KeyValueEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"Bucket":    entry.Bucket(),
+		"Key":       entry.Key(),
+		"Value":     string(entry.Value()),
+		"Revision":  entry.Revision(),
+		"Created":   entry.Created().UnixMilli(),
+		"Operation": entry.Operation().String(),
+	}
+}
@@ -0,0 +1,286 @@
+package goja
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/integration_test"
+)
+
+func setupJetStream(t *testing.T) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	_, nc := integration_test.StartTestNats(t)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("could not create JetStream context: %s", err)
+	}
+	// the JetStream store of the test server is kept across tests (and test runs).
+	deleteStreams := func() {
+		for name := range js.StreamNames() {
+			_ = js.DeleteStream(name)
+		}
+	}
+	deleteStreams()
+	t.Cleanup(deleteStreams)
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}, AllowDirect: true}); err != nil {
+		t.Fatalf("could not create stream: %s", err)
+	}
+	return nc, js
+}
+
+// runJetStreamScript runs the script, and fails the test on errors.
+func runJetStreamScript(t *testing.T, nc *nats.Conn, script string) data.Frames {
+	t.Helper()
+	frames, err := RunScript(context.Background(), nc, script)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	return frames
+}
+
+func assertField(t *testing.T, frame *data.Frame, name string, row int, expected interface{}) {
+	t.Helper()
+	field, _ := frame.FieldByName(name)
+	if field == nil {
+		t.Fatalf("field %s not found in frame %v", name, frame)
+	}
+	if v, _ := field.ConcreteAt(row); v != expected {
+		t.Fatalf("field %s, row %d: expected %v (%T), was %v (%T)", name, row, expected, expected, v, v)
+	}
+}
+
+func TestJetStreamStreamsAndMessages(t *testing.T) {
+	nc, _ := setupJetStream(t)
+
+	frames := runJetStreamScript(t, nc, `
+		const ack = js.Publish("orders.new", JSON.stringify({id: 1}));
+		js.Publish("orders.new", JSON.stringify({id: 2}), {timeout: "1s"});
+		const info = js.StreamInfo("ORDERS");
+		const first = js.GetMsg("ORDERS", ack.seq);
+		const last = js.GetLastMsg("ORDERS", "orders.new", {direct: true});
+		return {
+			streams: js.StreamNames().join(","),
+			ackStream: ack.stream,
+			messages: info.state.messages,
+			first: JSON.parse(first.Data).id,
+			last: JSON.parse(last.Data).id,
+			lastSubject: last.Subject,
+			missing: js.GetMsg("ORDERS", 100) === null,
+		};
+	`)
+	assertField(t, frames[0], "streams", 0, "ORDERS")
+	assertField(t, frames[0], "ackStream", 0, "ORDERS")
+	assertField(t, frames[0], "messages", 0, int64(2))
+	assertField(t, frames[0], "first", 0, int64(1))
+	assertField(t, frames[0], "last", 0, int64(2))
+	assertField(t, frames[0], "lastSubject", 0, "orders.new")
+	assertField(t, frames[0], "missing", 0, true)
+}
+
+func TestJetStreamFetch(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{Durable: "worker", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("could not create consumer: %s", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := js.Publish("orders.new", []byte(`{"id": `+id+`}`)); err != nil {
+			t.Fatalf("could not publish: %s", err)
+		}
+	}
+
+	frames := runJetStreamScript(t, nc, `
+		const msgs = js.Fetch("ORDERS", "worker", 2, {timeout: "500ms"});
+		msgs.forEach((msg) => msg.Ack());
+		const rest = js.Fetch("ORDERS", "worker", 10, {timeout: "200ms"});
+		const consumer = js.ConsumerInfo("ORDERS", "worker");
+		return {
+			fetched: msgs.map((msg) => JSON.parse(msg.Data).id).join(","),
+			rest: rest.map((msg) => JSON.parse(msg.Data).id).join(","),
+			consumers: js.ConsumerNames("ORDERS").join(","),
+			durable: consumer.name,
+		};
+	`)
+	assertField(t, frames[0], "fetched", 0, "1,2")
+	assertField(t, frames[0], "rest", 0, "3")
+	assertField(t, frames[0], "consumers", 0, "worker")
+	assertField(t, frames[0], "durable", 0, "worker")
+}
+
+func TestJetStreamKeyValue(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "config", History: 5}); err != nil {
+		t.Fatalf("could not create KV bucket: %s", err)
+	}
+
+	frames := runJetStreamScript(t, nc, `
+		const kv = js.KeyValue("config");
+		kv.Put("color", "red");
+		const revision = kv.Put("color", "blue");
+		kv.Create("size", "XL");
+		kv.Delete("size");
+		const entry = kv.Get("color");
+		return {
+			value: entry.Value,
+			revision: entry.Revision === revision,
+			operation: entry.Operation,
+			history: kv.History("color").map((e) => e.Value).join(","),
+			keys: kv.Keys().join(","),
+			deleted: kv.Get("size") === null,
+			missing: kv.Get("nothing") === null,
+		};
+	`)
+	assertField(t, frames[0], "value", 0, "blue")
+	assertField(t, frames[0], "revision", 0, true)
+	assertField(t, frames[0], "operation", 0, "KeyValuePutOp")
+	assertField(t, frames[0], "history", 0, "red,blue")
+	assertField(t, frames[0], "keys", 0, "color")
+	assertField(t, frames[0], "deleted", 0, true)
+	assertField(t, frames[0], "missing", 0, true)
+}
+
+func TestJetStreamObjectStore(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "files"}); err != nil {
+		t.Fatalf("could not create object store: %s", err)
+	}
+
+	frames := runJetStreamScript(t, nc, `
+		const store = js.ObjectStore("files");
+		const info = store.Put("report.json", JSON.stringify({rows: 42}));
+		store.Put("data.gz", std.gzip.compress("compressed"));
+		store.Put("obsolete", "x");
+		store.Delete("obsolete");
+		return {
+			size: info.size,
+			rows: JSON.parse(store.Get("report.json")).rows,
+			gzip: std.text.decode(std.gzip.decompress(store.GetRaw("data.gz"))),
+			name: store.GetInfo("report.json").name,
+			list: store.List().map((i) => i.name).sort().join(","),
+			missing: store.Get("obsolete") === null,
+		};
+	`)
+	assertField(t, frames[0], "rows", 0, int64(42))
+	assertField(t, frames[0], "gzip", 0, "compressed")
+	assertField(t, frames[0], "name", 0, "report.json")
+	assertField(t, frames[0], "list", 0, "data.gz,report.json")
+	assertField(t, frames[0], "missing", 0, true)
+}
+
+func TestJetStreamErrorsAndLimits(t *testing.T) {
+	nc, _ := setupJetStream(t)
+
+	_, err := RunScript(context.Background(), nc, `return js.StreamInfo("UNKNOWN");`)
+	if err == nil {
+		t.Fatalf("expected an error for an unknown stream")
+	}
+
+	_, err = RunScript(context.Background(), nc, `
+		for (let i = 0; i < 5; i++) {
+			js.StreamInfo("ORDERS");
+		}
+		return {};
+	`, WithLimits(Limits{MaxNatsOps: 3}))
+	assertLimitError(t, err, "limit of 3 NATS operations")
+}
+
+func TestJetStreamOptions(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{Durable: "worker", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("could not create consumer: %s", err)
+	}
+
+	start := time.Now()
+	runJetStreamScript(t, nc, `
+		js.Fetch("ORDERS", "worker", 1, {timeout: "100ms"});
+		return {};
+	`)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the timeout option to apply, took %s", elapsed)
+	}
+
+	_, err := RunScript(context.Background(), nc, `return js.StreamInfo("ORDERS", {timeout: "soon"});`)
+	if err == nil || !strings.Contains(err.Error(), "invalid duration") {
+		t.Fatalf("expected an error for an invalid timeout, got: %v", err)
+	}
+}
+
+func TestJetStreamCallsEndWithScript(t *testing.T) {
+	// KV and object store calls without context support must not block a cancelled script until their timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	start := time.Now()
+	_, err := withContext(ctx, func() (int, error) {
+		<-blocked
+		return 0, nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected cancellation, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the call to return on cancellation, took %s", elapsed)
+	}
+}
+
+func TestJetStreamAsync(t *testing.T) {
+	nc, js := setupJetStream(t)
+	if _, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{Durable: "worker", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("could not create consumer: %s", err)
+	}
+	for _, durable := range []string{"a", "b", "c"} {
+		consumer := &nats.ConsumerConfig{Durable: durable, FilterSubject: "orders.never", AckPolicy: nats.AckExplicitPolicy}
+		if _, err := js.AddConsumer("ORDERS", consumer); err != nil {
+			t.Fatalf("could not create consumer: %s", err)
+		}
+	}
+	if _, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "config"}); err != nil {
+		t.Fatalf("could not create KV bucket: %s", err)
+	}
+	if _, err := js.Publish("orders.new", []byte(`{"id": 1}`)); err != nil {
+		t.Fatalf("could not publish: %s", err)
+	}
+
+	// the consumers a, b and c never get messages, so that every fetch waits for its timeout; thus, they must run
+	// concurrently.
+	start := time.Now()
+	frames := runJetStreamScript(t, nc, `
+		const kv = js.KeyValue("config");
+		kv.Put("color", "red");
+		const [a, b, c, fetched, ack, entry, missing] = await Promise.all([
+			js.FetchAsync("ORDERS", "a", 10, {timeout: "500ms"}),
+			js.FetchAsync("ORDERS", "b", 10, {timeout: "500ms"}),
+			js.FetchAsync("ORDERS", "c", 10, {timeout: "500ms"}),
+			js.FetchAsync("ORDERS", "worker", 1),
+			js.PublishAsync("orders.new", JSON.stringify({id: 2})),
+			kv.GetAsync("color"),
+			kv.GetAsync("nothing"),
+		]);
+		fetched.forEach((msg) => msg.Ack());
+		return {
+			empty: a.length + b.length + c.length,
+			fetched: JSON.parse(fetched[0].Data).id,
+			ackStream: ack.stream,
+			value: entry.Value,
+			missing: missing === null,
+		};
+	`)
+	if elapsed := time.Since(start); elapsed > 1200*time.Millisecond {
+		t.Fatalf("expected the calls to run concurrently, took %s", elapsed)
+	}
+	assertField(t, frames[0], "empty", 0, int64(0))
+	assertField(t, frames[0], "fetched", 0, int64(1))
+	assertField(t, frames[0], "ackStream", 0, "ORDERS")
+	assertField(t, frames[0], "value", 0, "red")
+	assertField(t, frames[0], "missing", 0, true)
+
+	_, err := RunScript(context.Background(), nc, `return await js.KeyValue("config").GetAsync("color", {timeout: "soon"});`)
+	if err == nil {
+		t.Fatalf("expected an error for invalid options")
+	}
+}
@@ -0,0 +1,212 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+)
+
+// maxCallStackSize protects against runaway recursion; without it, goja grows the Go stack until the whole
+// plugin process crashes.
+const maxCallStackSize = 10000
+
+// Limits restrict the resources a single script execution may use. Zero values mean "unlimited".
+//
+// For long-running scripts (stateful converters and streaming scripts), the limits apply to each message or
+// subscription callback individually.
+type Limits struct {
+	// Timeout is the wall-clock time after which the script is interrupted.
+	Timeout time.Duration
+	// MaxNatsOps limits the number of NATS calls (publish, request, subscribe, NextMsg, ...).
+	MaxNatsOps int
+}
+
+// LimitError is returned if a script was stopped because it exceeded its Limits, or because it was cancelled.
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return "script stopped: " + e.Reason
+}
+
+// Option configures a single script execution.
+type Option func(*options)
+
+type options struct {
+	limits      Limits
+	query       QueryContext
+	serverLog   ServerLogLevel
+	permissions Permissions
+	language    Language
+	modules     Modules
+	arrays      framestruct.ArrayMode
+}
+
+// WithLimits restricts the resources of the script execution, see Limits.
+func WithLimits(limits Limits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+func buildOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// execution guards a single run of a script, see runGuarded. It is exposed to JS as __exec, so that the
+// NATS wrappers of _setup can count operations and cancel blocking calls.
+type execution struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	vm     *goja.Runtime
+	limits Limits
+
+	mu        sync.Mutex
+	natsOps   int
+	violation *LimitError
+
+	// pending is the number of asynchronous calls which are not completed yet, see await. It is only accessed
+	// from the goroutine of the script.
+	pending     int
+	completions chan func()
+}
+
+// runGuarded runs fn on vm, enforcing the given limits: The vm is interrupted if ctx is cancelled or a limit
+// is exceeded; and blocking NATS calls of the script are cancelled.
+//
+// If fn returns a promise, or started asynchronous calls, runGuarded waits for them (see await); so the result is
+// never a promise.
+func runGuarded(ctx context.Context, vm *goja.Runtime, limits Limits, fn func() (goja.Value, error)) (goja.Value, error) {
+	execCtx, cancel := context.WithCancel(ctx)
+	e := &execution{
+		ctx:    execCtx,
+		cancel: cancel,
+		vm:     vm,
+		limits: limits,
+
+		completions: make(chan func()),
+	}
+	if err := vm.Set("__exec", e); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	watchdogStopped := make(chan struct{})
+	go func() {
+		defer close(watchdogStopped)
+		e.watch(ctx, done)
+	}()
+
+	result, err := fn()
+	if err == nil {
+		result, err = e.await(result)
+	}
+
+	close(done)
+	<-watchdogStopped
+	cancel()
+	// the vm might be reused (see gojaPool), so it must not stay interrupted.
+	vm.ClearInterrupt()
+	_ = vm.GlobalObject().Delete("__exec")
+
+	if violation := e.getViolation(); violation != nil {
+		// the script might have finished nevertheless, f.e. if it caught the error of a cancelled NATS call.
+		return nil, violation
+	}
+	if ctx.Err() != nil {
+		// cancelled just before the watchdog noticed it.
+		return nil, &LimitError{Reason: "the query was cancelled"}
+	}
+	var stackOverflow *goja.StackOverflowError
+	if errors.As(err, &stackOverflow) {
+		return nil, &LimitError{Reason: fmt.Sprintf("exceeded the maximum call stack size of %d", maxCallStackSize)}
+	}
+	return result, err
+}
+
+// watch stops the execution on timeout, or on cancellation of ctx.
+func (e *execution) watch(ctx context.Context, done <-chan struct{}) {
+	var timeout <-chan time.Time
+	if e.limits.Timeout > 0 {
+		timer := time.NewTimer(e.limits.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			e.stop(&LimitError{Reason: "the query was cancelled"})
+			return
+		case <-timeout:
+			e.stop(&LimitError{Reason: fmt.Sprintf("exceeded the time limit of %s", e.limits.Timeout)})
+			return
+		}
+	}
+}
+
+// stop interrupts the script, and cancels all blocking NATS calls.
+func (e *execution) stop(violation *LimitError) {
+	e.mu.Lock()
+	if e.violation == nil {
+		e.violation = violation
+	}
+	e.mu.Unlock()
+	e.vm.Interrupt(violation)
+	e.cancel()
+}
+
+func (e *execution) getViolation() *LimitError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.violation
+}
+
+// NatsOp is called by the NATS wrappers of _setup before every NATS call.
+func (e *execution) NatsOp() error {
+	e.mu.Lock()
+	e.natsOps++
+	exceeded := e.limits.MaxNatsOps > 0 && e.natsOps > e.limits.MaxNatsOps
+	e.mu.Unlock()
+	if exceeded {
+		violation := &LimitError{Reason: fmt.Sprintf("exceeded the limit of %d NATS operations", e.limits.MaxNatsOps)}
+		e.stop(violation)
+		return violation
+	}
+	return nil
+}
+
+// Request is like nc.Request, but is cancelled together with the script.
+func (e *execution) Request(nc *scriptConn, subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	defer cancel()
+	return nc.RequestWithContext(ctx, subj, data)
+}
+
+// RequestMsg is like nc.RequestMsg, but is cancelled together with the script.
+func (e *execution) RequestMsg(nc *scriptConn, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	defer cancel()
+	return nc.RequestMsgWithContext(ctx, msg)
+}
+
+// NextMsg is like subscription.NextMsg, but is cancelled together with the script.
+func (e *execution) NextMsg(subscription *nats.Subscription, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	defer cancel()
+	return subscription.NextMsgWithContext(ctx)
+}
@@ -0,0 +1,108 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/integration_test"
+)
+
+func assertLimitError(t *testing.T, err error, expectedReason string) {
+	t.Helper()
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected LimitError, got: %v", err)
+	}
+	if !strings.Contains(limitErr.Reason, expectedReason) {
+		t.Fatalf("expected reason to contain %q, was: %q", expectedReason, limitErr.Reason)
+	}
+}
+
+func TestLimitsTimeout(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, `while(true) {}`, WithLimits(Limits{Timeout: 50 * time.Millisecond}))
+	assertLimitError(t, err, "time limit of 50ms")
+
+	// the runtime is returned to the pool without the interrupt; so the next script must work.
+	frames, err := RunScript(context.Background(), nil, `return {k: "v"}`)
+	if err != nil {
+		t.Fatalf("script after interrupted script failed: %s", err)
+	}
+	if frames[0].Rows() != 1 {
+		t.Fatalf("expected 1 row, got %d", frames[0].Rows())
+	}
+}
+
+func TestLimitsCancellation(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// NextMsg blocks in Go (and not in JS); it must be cancelled as well.
+	_, err := RunScript(ctx, nc, `
+		const subscription = nc.SubscribeSync("nobody.publishes.here");
+		subscription.NextMsg("1h");
+		return {k: "v"};
+	`)
+	assertLimitError(t, err, "cancelled")
+}
+
+func TestLimitsInterruptedStatefulRuntimeIsFreed(t *testing.T) {
+	converter, err := NewStatefulConverter(context.Background(), nil, `while(true) {}`, "", "", WithLimits(Limits{Timeout: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("could not create converter: %s", err)
+	}
+	freed := make(chan struct{})
+	// the logs are only referenced by the converter and its runtime; unlike the runtime, they are no cycle, so that
+	// their finalizer runs.
+	runtime.SetFinalizer(converter.logs, func(*scriptLogs) {
+		close(freed)
+	})
+	_, err = converter.ConvertMessage(&nats.Msg{Data: []byte(`{}`)})
+	assertLimitError(t, err, "time limit of 50ms")
+	if err := converter.Close(); err != nil {
+		t.Fatalf("close failed: %s", err)
+	}
+
+	// the interrupted runtime must not be kept after the converter is gone.
+	converter = nil
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-freed:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("the runtime of the closed converter was not freed")
+}
+
+func TestLimitsNatsOps(t *testing.T) {
+	_, nc := integration_test.StartTestNats(t)
+
+	_, err := RunScript(context.Background(), nc, `
+		for (let i = 0; i < 10; i++) {
+			try {
+				nc.Publish("foo", "bar");
+			} catch (e) {
+				// the limit cannot be circumvented by catching the error.
+			}
+		}
+		return {k: "v"};
+	`, WithLimits(Limits{MaxNatsOps: 5}))
+	assertLimitError(t, err, "limit of 5 NATS operations")
+}
+
+func TestLimitsRecursion(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, `
+		function recurse() {
+			return recurse();
+		}
+		return recurse();
+	`)
+	assertLimitError(t, err, "maximum call stack size")
+}
@@ -0,0 +1,189 @@
+package goja
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The output of log(...) and console.log/info/warn/error(...) is collected per script execution (or per stream, for
+// long-running scripts), and returned as notices on the resulting frame - so that it is visible in the panel
+// inspector, instead of only in the Grafana server log.
+//
+// As a script might log in a tight loop, the collected messages are limited: at most maxLogsPerSecond messages are
+// kept per second, and at most maxLogNotices until they are returned (so that a long-running execution cannot pile
+// up messages), each one shortened to maxLogMessageLength bytes. All further messages are dropped, and reported as a
+// single notice.
+const (
+	maxLogsPerSecond    = 100
+	maxLogNotices       = 1000
+	maxLogMessageLength = 1000
+)
+
+// ServerLogLevel is the level at which script logs are additionally written to the Grafana server log.
+type ServerLogLevel string
+
+const (
+	// ServerLogInfo writes script logs to the server log at info level; this is the default.
+	ServerLogInfo ServerLogLevel = "info"
+	// ServerLogDebug writes script logs to the server log at debug level.
+	ServerLogDebug ServerLogLevel = "debug"
+	// ServerLogOff does not write script logs to the server log; they are only returned as notices.
+	ServerLogOff ServerLogLevel = "off"
+)
+
+// WithServerLog configures whether (and at which level) script logs are written to the Grafana server log.
+func WithServerLog(level ServerLogLevel) Option {
+	return func(o *options) {
+		o.serverLog = level
+	}
+}
+
+// scriptLogs collects the log output of a script. It is exposed to JS as __logs; the log functions of newRuntime
+// write to it.
+type scriptLogs struct {
+	serverLog ServerLogLevel
+
+	mu          sync.Mutex
+	notices     []data.Notice
+	dropped     int
+	windowStart time.Time
+	inWindow    int
+}
+
+func newScriptLogs(serverLog ServerLogLevel) *scriptLogs {
+	return &scriptLogs{serverLog: serverLog}
+}
+
+// add collects a log message, unless the rate limit or the number of collected messages is exceeded.
+func (l *scriptLogs) add(severity data.NoticeSeverity, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.inWindow = 0
+	}
+	if l.inWindow >= maxLogsPerSecond || len(l.notices) >= maxLogNotices {
+		l.dropped++
+		return
+	}
+	l.inWindow++
+
+	if len(message) > maxLogMessageLength {
+		message = strings.ToValidUTF8(message[:maxLogMessageLength], "") + "…"
+	}
+	l.notices = append(l.notices, data.Notice{Severity: severity, Text: message})
+	writeServerLog(l.serverLog, severity, message)
+}
+
+// Logs collects log messages like the log output of a script - rate-limited, and attached as notices to the
+// resulting frame - for the message converters outside of this package (see package convert).
+type Logs struct {
+	logs *scriptLogs
+}
+
+// NewLogs returns empty logs, which are additionally written to the server log at the given level.
+func NewLogs(serverLog ServerLogLevel) *Logs {
+	return &Logs{logs: newScriptLogs(serverLog)}
+}
+
+// Add collects a log message, unless the rate limit is exceeded.
+func (l *Logs) Add(severity data.NoticeSeverity, message string) {
+	l.logs.add(severity, message)
+}
+
+// AttachTo appends the collected messages as notices to the first of the given frames.
+func (l *Logs) AttachTo(frames ...*data.Frame) {
+	l.logs.attachTo(frames...)
+}
+
+// takeNotices returns the messages collected since the last call; dropped messages are reported as a warning.
+func (l *scriptLogs) takeNotices() []data.Notice {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	notices := l.notices
+	if l.dropped > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d log messages were dropped (at most %d messages per second, and %d in total are kept)", l.dropped, maxLogsPerSecond, maxLogNotices),
+		})
+	}
+	l.notices = nil
+	l.dropped = 0
+	return notices
+}
+
+// attachTo appends the collected messages as notices to the first of the given frames. Without frames, the messages
+// are kept, and attached to the next frame.
+func (l *scriptLogs) attachTo(frames ...*data.Frame) {
+	if len(frames) == 0 || frames[0] == nil {
+		return
+	}
+	if notices := l.takeNotices(); len(notices) > 0 {
+		frames[0].AppendNotices(notices...)
+	}
+}
+
+func writeServerLog(level ServerLogLevel, severity data.NoticeSeverity, message string) {
+	switch {
+	case level == ServerLogOff:
+	case level == ServerLogDebug:
+		log.DefaultLogger.Debug(message)
+	case severity == data.NoticeSeverityWarning:
+		log.DefaultLogger.Warn(message)
+	case severity == data.NoticeSeverityError:
+		log.DefaultLogger.Error(message)
+	default:
+		log.DefaultLogger.Info(message)
+	}
+}
+
+// logFunc returns the JS function for log(...) and console.*(...), which collects its arguments in the __logs of the
+// current execution.
+func logFunc(vm *goja.Runtime, severity data.NoticeSeverity) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		parts := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			parts[i] = formatLogArgument(arg)
+		}
+		message := strings.Join(parts, " ")
+		if logs, ok := exportOf(vm.Get("__logs")).(*scriptLogs); ok {
+			logs.add(severity, message)
+		} else {
+			// outside of a query, f.e. while setting up the runtime.
+			writeServerLog(ServerLogInfo, severity, message)
+		}
+		return goja.Undefined()
+	}
+}
+
+// consoleObject returns the JS console object. It is a plain JS object, so that it is frozen by isolationFn.
+func consoleObject(vm *goja.Runtime) *goja.Object {
+	console := vm.NewObject()
+	_ = console.Set("log", logFunc(vm, data.NoticeSeverityInfo))
+	_ = console.Set("info", logFunc(vm, data.NoticeSeverityInfo))
+	_ = console.Set("debug", logFunc(vm, data.NoticeSeverityInfo))
+	_ = console.Set("warn", logFunc(vm, data.NoticeSeverityWarning))
+	_ = console.Set("error", logFunc(vm, data.NoticeSeverityError))
+	return console
+}
+
+// formatLogArgument converts a logged value to text like browsers do: strings and errors as they are, objects as
+// JSON.
+func formatLogArgument(arg goja.Value) string {
+	obj, isObject := arg.(*goja.Object)
+	if !isObject || obj.ClassName() == "Error" || obj.ClassName() == "Function" {
+		return arg.String()
+	}
+	if encoded, err := json.Marshal(obj.Export()); err == nil {
+		return string(encoded)
+	}
+	return arg.String()
+}
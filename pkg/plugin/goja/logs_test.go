@@ -0,0 +1,161 @@
+package goja
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+func noticesOf(frame *data.Frame) []data.Notice {
+	if frame.Meta == nil {
+		return nil
+	}
+	return frame.Meta.Notices
+}
+
+func TestLogsAreReturnedAsNotices(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		log("plain", 42);
+		console.log({a: 1});
+		console.warn("careful");
+		console.error(new Error("broken"));
+		return {a: 1};
+	`, WithServerLog(ServerLogOff))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+
+	expected := []data.Notice{
+		{Severity: data.NoticeSeverityInfo, Text: "plain 42"},
+		{Severity: data.NoticeSeverityInfo, Text: `{"a":1}`},
+		{Severity: data.NoticeSeverityWarning, Text: "careful"},
+		{Severity: data.NoticeSeverityError, Text: "Error: broken"},
+	}
+	notices := noticesOf(frames[0])
+	if len(notices) != len(expected) {
+		t.Fatalf("expected %d notices, was %v", len(expected), notices)
+	}
+	for i, notice := range notices {
+		if notice.Severity != expected[i].Severity || notice.Text != expected[i].Text {
+			t.Errorf("notice %d: expected %v, was %v", i, expected[i], notice)
+		}
+	}
+}
+
+func TestLogsAreNotSharedBetweenExecutions(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{"a": 1}`)}
+	frames, err := ConvertMessage(context.Background(), nil, msg, `log("first"); return JSON.parse(msg.Data);`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(noticesOf(frames[0])) != 1 {
+		t.Fatalf("expected 1 notice, was %v", noticesOf(frames[0]))
+	}
+
+	frames, err = ConvertMessage(context.Background(), nil, msg, `return JSON.parse(msg.Data);`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(noticesOf(frames[0])) != 0 {
+		t.Errorf("expected no notices, was %v", noticesOf(frames[0]))
+	}
+}
+
+func TestLogsAreLimited(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		log("x".repeat(5000));
+		for (let i = 0; i < 1000; i++) {
+			log("message " + i);
+		}
+		return {a: 1};
+	`, WithServerLog(ServerLogOff))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+
+	notices := noticesOf(frames[0])
+	if len(notices) != maxLogsPerSecond+1 {
+		t.Fatalf("expected %d notices, was %d", maxLogsPerSecond+1, len(notices))
+	}
+	if len(notices[0].Text) > maxLogMessageLength+len("…") {
+		t.Errorf("expected long message to be shortened, was %d bytes", len(notices[0].Text))
+	}
+	dropped := notices[len(notices)-1]
+	if dropped.Severity != data.NoticeSeverityWarning || !strings.HasPrefix(dropped.Text, "901 log messages were dropped") {
+		t.Errorf("expected notice about dropped messages, was %v", dropped)
+	}
+}
+
+func TestLogsAreLimitedInTotal(t *testing.T) {
+	logs := newScriptLogs(ServerLogOff)
+	// a long execution, which logs within the rate limit every second
+	for i := 0; i < 2*maxLogNotices; i++ {
+		if i%maxLogsPerSecond == 0 {
+			logs.windowStart = time.Time{}
+		}
+		logs.add(data.NoticeSeverityInfo, "message")
+	}
+
+	notices := logs.takeNotices()
+	if len(notices) != maxLogNotices+1 {
+		t.Fatalf("expected %d notices, was %d", maxLogNotices+1, len(notices))
+	}
+	dropped := notices[len(notices)-1]
+	if dropped.Severity != data.NoticeSeverityWarning || !strings.HasPrefix(dropped.Text, "1000 log messages were dropped") {
+		t.Errorf("expected notice about dropped messages, was %v", dropped)
+	}
+}
+
+func TestStatefulLogsAreAttachedToNextFrame(t *testing.T) {
+	converter, err := NewStatefulConverter(context.Background(), nil, `
+		console.log("message", state.count++);
+		return {count: state.count};
+	`, `log("init"); return {count: 0};`, "", WithServerLog(ServerLogOff))
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+	defer converter.Close()
+
+	frame, err := converter.ConvertMessage(&nats.Msg{})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if notices := noticesOf(frame); len(notices) != 2 || notices[0].Text != "init" || notices[1].Text != "message 0" {
+		t.Errorf("expected notices of init and 1st message, was %v", notices)
+	}
+	frame, err = converter.ConvertMessage(&nats.Msg{})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if notices := noticesOf(frame); len(notices) != 1 || notices[0].Text != "message 1" {
+		t.Errorf("expected notice of 2nd message only, was %v", notices)
+	}
+}
+
+func TestStreamingLogsAreAttachedToEmittedFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	emitted := make(chan *data.Frame, 1)
+	_, err := RunStreamingScript(ctx, ctx, nil, `
+		console.warn("before emit");
+		emit({a: 1});
+	`, func(frame *data.Frame, err error) {
+		emitted <- frame
+	}, WithServerLog(ServerLogOff))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+
+	select {
+	case frame := <-emitted:
+		if notices := noticesOf(frame); len(notices) != 1 || notices[0].Severity != data.NoticeSeverityWarning {
+			t.Errorf("expected warning notice, was %v", notices)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no frame emitted")
+	}
+}
@@ -0,0 +1,148 @@
+package goja
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/dop251/goja"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// Modules is the script library of a data source: JS modules by their name, which all scripts can load via
+// require(name). A module is a CommonJS module - it assigns its API to exports (or module.exports):
+//
+//	exports.ping = function(subject) { ... };
+//
+// Modules are compiled once (see compileModule), but evaluated once per script run - so modules cannot share state
+// between queries.
+type Modules map[string]string
+
+// WithModules makes the given modules available to the script via require(name).
+func WithModules(modules Modules) Option {
+	return func(o *options) {
+		o.modules = modules
+	}
+}
+
+// moduleName restricts module names, so that they can be used in stack traces, see stackFrameLine.
+var moduleName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-/]*$`)
+
+// Check compiles all modules, and returns the first error - a *ScriptError, with the module name as prefix of the
+// message.
+func (m Modules) Check() error {
+	for name, source := range m {
+		if !moduleName.MatchString(name) {
+			return fmt.Errorf("invalid module name %q: only letters, digits, _, ., - and / are allowed", name)
+		}
+		if err := Check(source, ModuleScript); err != nil {
+			var scriptErr *ScriptError
+			if errors.As(err, &scriptErr) {
+				scriptErr.Message = fmt.Sprintf("module %s: %s", name, scriptErr.Message)
+				return scriptErr
+			}
+			return fmt.Errorf("module %s: %w", name, err)
+		}
+		if _, err := compileModule(name, source); err != nil {
+			return fmt.Errorf("module %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// wrapJsModule wraps the source of a module as function of exports, module and require. The source starts on its
+// own line, so that positions in the module are only shifted by one line.
+func wrapJsModule(in string) string {
+	return fmt.Sprintf("(function(exports, module, require) { \"use strict\";\n%s\n})", in)
+}
+
+// compileModule returns the compiled (wrapped) module, from programCache if possible. In contrast to compile, the
+// program is named after the module - so that stack frames inside the module are not mistaken for the user's
+// script.
+func compileModule(name, source string) (*goja.Program, error) {
+	wrapped := wrapJsModule(source)
+	hash := sha256.Sum256([]byte(name + "\x00" + wrapped))
+	key := "module:" + hex.EncodeToString(hash[:])
+	if item := programCache.Get(key); item != nil {
+		return item.Value(), nil
+	}
+
+	program, err := goja.Compile("module:"+name, wrapped, false)
+	if err != nil {
+		return nil, err
+	}
+	programCache.Set(key, program, ttlcache.NoTTL)
+	return program, nil
+}
+
+// moduleLoader loads the modules of a single script run (or StatefulConverter / streaming script); it is exposed to
+// JS as __modules, and used by the require function of newRuntime.
+type moduleLoader struct {
+	modules Modules
+	// exports of the modules loaded so far, by name
+	exports map[string]goja.Value
+}
+
+func newModuleLoader(modules Modules) *moduleLoader {
+	return &moduleLoader{modules: modules, exports: map[string]goja.Value{}}
+}
+
+// require returns the exports of the given module; each module is only evaluated once. Like in Node.js, modules
+// requiring each other get the exports which are defined so far.
+func (l *moduleLoader) require(vm *goja.Runtime, name string) (goja.Value, error) {
+	if exports, ok := l.exports[name]; ok {
+		return exports, nil
+	}
+	source, ok := l.modules[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s not found in the script library of the data source", name)
+	}
+	program, err := compileModule(name, source)
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %w", name, err)
+	}
+	moduleFnValue, err := vm.RunProgram(program)
+	if err != nil {
+		return nil, err
+	}
+	moduleFn, ok := goja.AssertFunction(moduleFnValue)
+	if !ok {
+		return nil, fmt.Errorf("module %s could not be loaded", name)
+	}
+
+	exports := vm.NewObject()
+	module := vm.NewObject()
+	if err := module.Set("exports", exports); err != nil {
+		return nil, err
+	}
+	l.exports[name] = exports
+	if _, err := moduleFn(goja.Undefined(), exports, module, vm.Get("require")); err != nil {
+		delete(l.exports, name)
+		return nil, err
+	}
+	l.exports[name] = module.Get("exports")
+	return l.exports[name], nil
+}
+
+// requireFunc returns the JS function require(name), which loads a module via the __modules of the current
+// execution. Exceptions of the module are rethrown as they are, so that their stack includes the module.
+func requireFunc(vm *goja.Runtime) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		name := call.Argument(0).String()
+		loader, ok := exportOf(vm.Get("__modules")).(*moduleLoader)
+		if !ok {
+			panic(vm.NewGoError(fmt.Errorf("module %s not found: there is no script library", name)))
+		}
+		exports, err := loader.require(vm, name)
+		var exception *goja.Exception
+		switch {
+		case errors.As(err, &exception):
+			panic(exception)
+		case err != nil:
+			panic(vm.NewGoError(err))
+		}
+		return exports
+	}
+}
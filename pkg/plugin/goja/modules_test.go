@@ -0,0 +1,103 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+var testModules = Modules{
+	"format": `
+		exports.percent = function(value) {
+			return Math.round(value * 100) + "%";
+		};
+	`,
+	"stats": `
+		const {percent} = require("format");
+		let loaded = 0;
+		loaded++;
+		module.exports = {
+			ratio: (a, b) => percent(a / b),
+			loaded: () => loaded,
+			fail: function() {
+				throw new Error("stats failed");
+			},
+		};
+	`,
+}
+
+func TestRequireModules(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		const stats = require("stats");
+		require("stats");
+		return {ratio: stats.ratio(1, 4), loaded: stats.loaded()};
+	`, WithModules(testModules))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	ratio, _ := frames[0].FieldByName("ratio")
+	if value, ok := ratio.ConcreteAt(0); !ok || value != "25%" {
+		t.Errorf("expected ratio 25%%, got %v", value)
+	}
+	loaded, _ := frames[0].FieldByName("loaded")
+	if value, ok := loaded.ConcreteAt(0); !ok || value != int64(1) {
+		t.Errorf("expected the module to be evaluated once, got %v", value)
+	}
+
+	// modules are evaluated again for every message.
+	msg := &nats.Msg{Data: []byte(`{}`)}
+	for i := 0; i < 2; i++ {
+		frames, err := ConvertMessage(context.Background(), nil, msg, `return {loaded: require("stats").loaded()};`, WithModules(testModules))
+		if err != nil {
+			t.Fatalf("script failed: %s", err)
+		}
+		if value, _ := frames[0].Fields[0].ConcreteAt(0); value != int64(1) {
+			t.Errorf("expected a fresh module for every message, got %v", value)
+		}
+	}
+}
+
+func TestRequireErrors(t *testing.T) {
+	_, err := RunScript(context.Background(), nil, `return require("missing");`, WithModules(testModules))
+	if err == nil || !strings.Contains(err.Error(), "module missing not found") {
+		t.Errorf("expected error for missing module, got: %v", err)
+	}
+
+	_, err = RunScript(context.Background(), nil, `return require("format");`)
+	if err == nil || !strings.Contains(err.Error(), "module format not found") {
+		t.Errorf("expected error without modules, got: %v", err)
+	}
+
+	_, err = ConvertMessage(context.Background(), nil, &nats.Msg{}, "const stats = require(\"stats\");\nreturn stats.fail();", WithModules(testModules))
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) {
+		t.Fatalf("expected a script error, got: %v", err)
+	}
+	if scriptErr.Message != "Error: stats failed" || scriptErr.Line != 2 || scriptErr.Column != 18 {
+		t.Errorf("expected the error at the call in the user's script, got %q at %d:%d", scriptErr.Message, scriptErr.Line, scriptErr.Column)
+	}
+	expectedStack := []string{"fail (module stats, line 9, column 11)", "line 2, column 18"}
+	if !reflect.DeepEqual(scriptErr.Stack, expectedStack) {
+		t.Errorf("expected stack %v, got %v", expectedStack, scriptErr.Stack)
+	}
+}
+
+func TestCheckModules(t *testing.T) {
+	if err := testModules.Check(); err != nil {
+		t.Fatalf("expected valid modules, got: %s", err)
+	}
+
+	err := Modules{"broken": "exports.a = 1;\nexports.b = ;"}.Check()
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || !strings.HasPrefix(scriptErr.Message, "module broken: ") || scriptErr.Line != 2 {
+		t.Errorf("expected syntax error in line 2 of module broken, got: %v", err)
+	}
+
+	if err := (Modules{"no spaces": ""}).Check(); err == nil {
+		t.Errorf("expected error for invalid module name")
+	}
+}
@@ -0,0 +1,44 @@
+package goja
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/dop251/goja"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// programCacheSize bounds the number of compiled scripts kept in memory; the least recently used ones are evicted.
+const programCacheSize = 1000
+
+// programCache contains the compiled (wrapped) scripts by their hash, so that f.e. the script of a subscription
+// is only parsed and compiled once, and not for every message. A *goja.Program can be run by multiple runtimes
+// concurrently.
+var programCache = ttlcache.New[string, *goja.Program](
+	ttlcache.WithCapacity[string, *goja.Program](programCacheSize),
+)
+
+// compile returns the compiled program for the given script, from programCache if possible.
+func compile(js string) (*goja.Program, error) {
+	hash := sha256.Sum256([]byte(js))
+	key := hex.EncodeToString(hash[:])
+	if item := programCache.Get(key); item != nil {
+		return item.Value(), nil
+	}
+
+	program, err := goja.Compile("", js, false)
+	if err != nil {
+		return nil, err
+	}
+	programCache.Set(key, program, ttlcache.NoTTL)
+	return program, nil
+}
+
+// runCached runs the given script on vm; like vm.RunString, but compiles the script only once.
+func runCached(vm *goja.Runtime, js string) (goja.Value, error) {
+	program, err := compile(js)
+	if err != nil {
+		return nil, err
+	}
+	return vm.RunProgram(program)
+}
@@ -0,0 +1,49 @@
+package goja
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompileIsCached(t *testing.T) {
+	programCache.DeleteAll()
+
+	first, err := compile(wrapJs(`return {k: "v"}`))
+	if err != nil {
+		t.Fatalf("could not compile: %s", err)
+	}
+	second, err := compile(wrapJs(`return {k: "v"}`))
+	if err != nil {
+		t.Fatalf("could not compile: %s", err)
+	}
+	if first != second {
+		t.Fatalf("expected the same script to be compiled only once")
+	}
+	if programCache.Len() != 1 {
+		t.Fatalf("expected 1 cached program, got %d", programCache.Len())
+	}
+}
+
+func TestCompileErrorsAreNotCached(t *testing.T) {
+	programCache.DeleteAll()
+
+	if _, err := compile(wrapJs(`return {`)); err == nil {
+		t.Fatalf("expected syntax error")
+	}
+	if programCache.Len() != 0 {
+		t.Fatalf("expected no cached program, got %d", programCache.Len())
+	}
+}
+
+func TestProgramCacheIsBounded(t *testing.T) {
+	programCache.DeleteAll()
+
+	for i := 0; i < programCacheSize+10; i++ {
+		if _, err := compile(wrapJs(fmt.Sprintf(`return {i: %d}`, i))); err != nil {
+			t.Fatalf("could not compile: %s", err)
+		}
+	}
+	if programCache.Len() != programCacheSize {
+		t.Fatalf("expected %d cached programs, got %d", programCacheSize, programCache.Len())
+	}
+}
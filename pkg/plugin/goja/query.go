@@ -0,0 +1,85 @@
+package goja
+
+import (
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// QueryContext describes the Grafana query a script runs for. It is exposed to every script as read-only
+// `query` object, f.e. to request data between query.from and query.to.
+type QueryContext struct {
+	RefID         string
+	From          time.Time
+	To            time.Time
+	Interval      time.Duration
+	MaxDataPoints int64
+	// Variables are the template variables of the dashboard, already interpolated by the frontend.
+	Variables map[string]string
+	// User is the Grafana user who sent the query; nil f.e. for alerting queries.
+	User *QueryUser
+}
+
+// QueryUser is the Grafana user who sent a query.
+type QueryUser struct {
+	Login string
+	Name  string
+	Email string
+	Role  string
+}
+
+// WithQuery exposes the given query context to the script as `query`.
+func WithQuery(query QueryContext) Option {
+	return func(o *options) {
+		o.query = query
+	}
+}
+
+// toJs converts the query context to a frozen JS object. Timestamps are given as Unix milliseconds, so that
+// they can be passed to new Date() directly.
+func (q QueryContext) toJs(vm *goja.Runtime) goja.Value {
+	unixMillis := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t.UnixMilli()
+	}
+	variables := make(map[string]interface{}, len(q.Variables))
+	for name, value := range q.Variables {
+		variables[name] = value
+	}
+	query := map[string]interface{}{
+		"refId":         q.RefID,
+		"from":          unixMillis(q.From),
+		"to":            unixMillis(q.To),
+		"intervalMs":    q.Interval.Milliseconds(),
+		"maxDataPoints": q.MaxDataPoints,
+		"variables":     variables,
+		"user":          nil,
+	}
+	if q.User != nil {
+		query["user"] = map[string]interface{}{
+			"login": q.User.Login,
+			"name":  q.User.Name,
+			"email": q.User.Email,
+			"role":  q.User.Role,
+		}
+	}
+	return frozenObject(vm, query)
+}
+
+// frozenObject converts the given map to a (deeply) frozen JS object; contrary to vm.ToValue(m), which would
+// allow the script to modify the underlying Go map.
+func frozenObject(vm *goja.Runtime, m map[string]interface{}) goja.Value {
+	obj := vm.NewObject()
+	for key, value := range m {
+		if nested, isMap := value.(map[string]interface{}); isMap {
+			_ = obj.Set(key, frozenObject(vm, nested))
+		} else {
+			_ = obj.Set(key, value)
+		}
+	}
+	freeze, _ := goja.AssertFunction(vm.Get("Object").ToObject(vm).Get("freeze"))
+	frozen, _ := freeze(goja.Undefined(), obj)
+	return frozen
+}
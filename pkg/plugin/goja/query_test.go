@@ -0,0 +1,85 @@
+package goja
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryContextIsExposed(t *testing.T) {
+	from := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	frames, err := RunScript(context.Background(), nil, `
+		return {
+			refId: query.refId,
+			from: new Date(query.from).toISOString(),
+			to: query.to - query.from,
+			intervalMs: query.intervalMs,
+			maxDataPoints: query.maxDataPoints,
+			team: query.variables.team,
+			login: query.user.login,
+		};
+	`, WithQuery(QueryContext{
+		RefID:         "A",
+		From:          from,
+		To:            from.Add(time.Hour),
+		Interval:      time.Minute,
+		MaxDataPoints: 500,
+		Variables:     map[string]string{"team": "blue"},
+		User:          &QueryUser{Login: "admin"},
+	}))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"refId":         "A",
+		"from":          "2023-01-02T03:04:05.000Z",
+		"to":            int64(time.Hour / time.Millisecond),
+		"intervalMs":    int64(60000),
+		"maxDataPoints": int64(500),
+		"team":          "blue",
+		"login":         "admin",
+	}
+	for name, expectedValue := range expected {
+		field, _ := frames[0].FieldByName(name)
+		if field == nil {
+			t.Fatalf("field %s missing", name)
+		}
+		value, _ := field.ConcreteAt(0)
+		if value != expectedValue {
+			t.Errorf("field %s: expected %v, was %v", name, expectedValue, value)
+		}
+	}
+}
+
+func TestQueryContextIsReadOnly(t *testing.T) {
+	for _, script := range []string{
+		`query.refId = "B"`,
+		`query.variables.team = "red"`,
+		`query.user.role = "Admin"`,
+	} {
+		_, err := RunScript(context.Background(), nil, script, WithQuery(QueryContext{
+			RefID:     "A",
+			Variables: map[string]string{"team": "blue"},
+			User:      &QueryUser{Role: "Viewer"},
+		}))
+		if err == nil {
+			t.Errorf("expected modification to fail: %s", script)
+		}
+	}
+}
+
+func TestQueryContextWithoutUser(t *testing.T) {
+	frames, err := RunScript(context.Background(), nil, `
+		return {hasUser: query.user !== null, hasFrom: query.from !== null};
+	`)
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	for _, name := range []string{"hasUser", "hasFrom"} {
+		field, _ := frames[0].FieldByName(name)
+		if value, _ := field.ConcreteAt(0); value != false {
+			t.Errorf("%s: expected false, was %v", name, value)
+		}
+	}
+}
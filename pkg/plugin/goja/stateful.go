@@ -0,0 +1,160 @@
+package goja
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+)
+
+// wrapJsStateful wraps the user-defined scripts of a StatefulConverter; in addition to wrapJs, the script
+// can read and modify the state object, which is kept across messages.
+func wrapJsStateful(in string) string {
+	return fmt.Sprintf(`
+	"use strict";
+	(function() {
+		const {nats, nc, js, msg} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, __msg);
+		const query = __query;
+		const state = __state;
+		%s;
+    })()
+`, in)
+}
+
+// StatefulConverter converts the messages of a single stream (like ConvertMessage), but keeps a JS `state`
+// object across messages, f.e. to calculate deltas, counters or moving averages.
+//
+// - The init script runs once on creation. It may fill `state`, or return the initial state object.
+// - The teardown script runs once on Close, f.e. to publish a summary.
+//
+// Each StatefulConverter has its own goja runtime (instead of one from the gojaPool), which lives as long as
+// the stream. It is safe for concurrent use, although messages are converted one after another.
+//
+// The limits given via WithLimits apply to the init script, each message, and the teardown script individually.
+type StatefulConverter struct {
+	mu         sync.Mutex
+	ctx        context.Context
+	vm         *goja.Runtime
+	limits     Limits
+	language   Language
+	frameOpts  []framestruct.FramestructOption
+	logs       *scriptLogs
+	jsFn       string
+	teardownFn string
+	closed     bool
+}
+
+// NewStatefulConverter runs the init script, and returns a converter for the messages of a stream. Message
+// conversion is stopped once ctx is cancelled.
+func NewStatefulConverter(ctx context.Context, nc *nats.Conn, jsFn, initFn, teardownFn string, opts ...Option) (*StatefulConverter, error) {
+	if jsFn == "" {
+		jsFn = `
+			return JSON.parse(msg.Data);
+		`
+	}
+	o := buildOptions(opts)
+	c := &StatefulConverter{
+		ctx:        ctx,
+		vm:         newRuntime(),
+		limits:     o.limits,
+		language:   o.language,
+		frameOpts:  o.frameOptions(),
+		logs:       newScriptLogs(o.serverLog),
+		jsFn:       jsFn,
+		teardownFn: teardownFn,
+	}
+	if err := c.vm.Set("__nc", newScriptConn(nc, o.permissions)); err != nil {
+		return nil, err
+	}
+	if err := c.vm.Set("__query", o.query.toJs(c.vm)); err != nil {
+		return nil, err
+	}
+	if err := c.vm.Set("__logs", c.logs); err != nil {
+		return nil, err
+	}
+	if err := c.vm.Set("__modules", newModuleLoader(o.modules)); err != nil {
+		return nil, err
+	}
+	if err := c.vm.Set("__state", c.vm.NewObject()); err != nil {
+		return nil, err
+	}
+	// the init and teardown scripts do not have a message.
+	if err := c.vm.Set("__msg", nil); err != nil {
+		return nil, err
+	}
+
+	if initFn != "" {
+		initialState, err := runGuarded(ctx, c.vm, c.limits, func() (goja.Value, error) {
+			return runUserScript(c.vm, initFn, StatefulScript, c.language)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not run init script: %w", scriptError(err, initFn, StatefulScript, c.language))
+		}
+		if obj, isObject := initialState.(*goja.Object); isObject {
+			if err := c.vm.Set("__state", obj); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// ConvertMessage runs the script for the given message, with access to the state of all former messages. Messages
+// logged by the script (including the ones of the init script) are attached to the frame as notices.
+func (c *StatefulConverter) ConvertMessage(msg *nats.Msg) (*data.Frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("converter is already closed")
+	}
+
+	if err := c.vm.Set("__msg", msg); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.vm.Set("__msg", nil)
+	}()
+
+	resultWrapper, err := runGuarded(c.ctx, c.vm, c.limits, func() (goja.Value, error) {
+		return runUserScript(c.vm, c.jsFn, StatefulScript, c.language)
+	})
+	if err != nil {
+		return nil, scriptError(err, c.jsFn, StatefulScript, c.language)
+	}
+
+	frame, err := convertResult(resultWrapper.Export(), c.frameOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.logs.attachTo(frame)
+	return frame, nil
+}
+
+// Close runs the teardown script (if any). Afterwards, no messages can be converted anymore. Calling Close
+// multiple times is allowed; the teardown script only runs once.
+//
+// As Close is usually called after the stream's context was cancelled, the teardown script is only restricted
+// by the limits, not by the context.
+func (c *StatefulConverter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if c.teardownFn == "" {
+		return nil
+	}
+	_, err := runGuarded(context.Background(), c.vm, c.limits, func() (goja.Value, error) {
+		return runUserScript(c.vm, c.teardownFn, StatefulScript, c.language)
+	})
+	if err != nil {
+		return fmt.Errorf("could not run teardown script: %w", scriptError(err, c.teardownFn, StatefulScript, c.language))
+	}
+	return nil
+}
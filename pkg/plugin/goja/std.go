@@ -0,0 +1,346 @@
+package goja
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+	// scripts can use any IANA time zone, also if the system has no time zone database installed.
+	_ "time/tzdata"
+	"unicode/utf16"
+
+	"github.com/dop251/goja"
+)
+
+// maxDecompressedBytes protects against decompression bombs in std.gzip.decompress.
+const maxDecompressedBytes = 64 * 1024 * 1024
+
+// timeLayouts are the named layouts accepted by std.time.parse and std.time.format; all other layouts are
+// interpreted as Go layouts (like "2006-01-02 15:04").
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"Kitchen":     time.Kitchen,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// stdLib returns the `std` object available to all scripts, with Go-backed helpers for common message
+// processing tasks. Binary data is accepted as string, ArrayBuffer or Uint8Array, and returned as ArrayBuffer.
+//
+//   - std.base64.encode(data), std.base64.decode(str), std.base64.decodeString(str)
+//   - std.hex.encode(data), std.hex.decode(str)
+//   - std.hash.md5|sha1|sha256|sha512(data) -> hex string; std.hmac(algorithm, key, data) -> hex string
+//   - std.time.parse(value, layout = "RFC3339", zone = "UTC") -> Unix ms; std.time.format(ms, layout, zone)
+//   - std.url.parse(str), std.url.parseQuery(str), std.url.encodeQuery(obj)
+//   - std.gzip.compress(data), std.gzip.decompress(data)
+//   - std.text.decode(data, encoding = "utf-8"), std.text.encode(str)
+func stdLib(vm *goja.Runtime) *goja.Object {
+	std := vm.NewObject()
+	toBytes := func(v goja.Value) ([]byte, error) {
+		return valueToBytes(vm, v)
+	}
+	arrayBuffer := func(b []byte) goja.ArrayBuffer {
+		return vm.NewArrayBuffer(b)
+	}
+
+	base64Obj := vm.NewObject()
+	_ = base64Obj.Set("encode", func(data goja.Value) (string, error) {
+		b, err := toBytes(data)
+		return base64.StdEncoding.EncodeToString(b), err
+	})
+	_ = base64Obj.Set("decode", func(str string) (goja.ArrayBuffer, error) {
+		b, err := decodeBase64(str)
+		return arrayBuffer(b), err
+	})
+	_ = base64Obj.Set("decodeString", func(str string) (string, error) {
+		b, err := decodeBase64(str)
+		return string(b), err
+	})
+	_ = std.Set("base64", base64Obj)
+
+	hexObj := vm.NewObject()
+	_ = hexObj.Set("encode", func(data goja.Value) (string, error) {
+		b, err := toBytes(data)
+		return hex.EncodeToString(b), err
+	})
+	_ = hexObj.Set("decode", func(str string) (goja.ArrayBuffer, error) {
+		b, err := hex.DecodeString(str)
+		return arrayBuffer(b), err
+	})
+	_ = std.Set("hex", hexObj)
+
+	hashObj := vm.NewObject()
+	for name, newHash := range hashes {
+		newHash := newHash
+		_ = hashObj.Set(name, func(data goja.Value) (string, error) {
+			b, err := toBytes(data)
+			if err != nil {
+				return "", err
+			}
+			h := newHash()
+			h.Write(b)
+			return hex.EncodeToString(h.Sum(nil)), nil
+		})
+	}
+	_ = std.Set("hash", hashObj)
+
+	_ = std.Set("hmac", func(algorithm string, key goja.Value, data goja.Value) (string, error) {
+		newHash, ok := hashes[strings.ToLower(algorithm)]
+		if !ok {
+			return "", fmt.Errorf("unknown hash algorithm %s - supported are md5, sha1, sha256 and sha512", algorithm)
+		}
+		k, err := toBytes(key)
+		if err != nil {
+			return "", err
+		}
+		b, err := toBytes(data)
+		if err != nil {
+			return "", err
+		}
+		mac := hmac.New(newHash, k)
+		mac.Write(b)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	})
+
+	timeObj := vm.NewObject()
+	_ = timeObj.Set("parse", func(value string, layout goja.Value, zone goja.Value) (int64, error) {
+		loc, err := loadLocation(optionalString(zone))
+		if err != nil {
+			return 0, err
+		}
+		t, err := time.ParseInLocation(timeLayout(optionalString(layout)), value, loc)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixMilli(), nil
+	})
+	_ = timeObj.Set("format", func(unixMillis int64, layout goja.Value, zone goja.Value) (string, error) {
+		loc, err := loadLocation(optionalString(zone))
+		if err != nil {
+			return "", err
+		}
+		return time.UnixMilli(unixMillis).In(loc).Format(timeLayout(optionalString(layout))), nil
+	})
+	_ = std.Set("time", timeObj)
+
+	urlObj := vm.NewObject()
+	_ = urlObj.Set("parse", func(str string) (map[string]interface{}, error) {
+		u, err := url.Parse(str)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"scheme":   u.Scheme,
+			"username": u.User.Username(),
+			"host":     u.Host,
+			"hostname": u.Hostname(),
+			"port":     u.Port(),
+			"path":     u.Path,
+			"query":    queryToMap(u.Query()),
+			"fragment": u.Fragment,
+		}, nil
+	})
+	_ = urlObj.Set("parseQuery", func(str string) (map[string]interface{}, error) {
+		values, err := url.ParseQuery(strings.TrimPrefix(str, "?"))
+		if err != nil {
+			return nil, err
+		}
+		return queryToMap(values), nil
+	})
+	_ = urlObj.Set("encodeQuery", func(params map[string]interface{}) string {
+		values := url.Values{}
+		for key, value := range params {
+			if list, isList := value.([]interface{}); isList {
+				for _, v := range list {
+					values.Add(key, fmt.Sprint(v))
+				}
+			} else {
+				values.Set(key, fmt.Sprint(value))
+			}
+		}
+		return values.Encode()
+	})
+	_ = std.Set("url", urlObj)
+
+	gzipObj := vm.NewObject()
+	_ = gzipObj.Set("compress", func(data goja.Value) (goja.ArrayBuffer, error) {
+		b, err := toBytes(data)
+		if err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		if err := w.Close(); err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		return arrayBuffer(buf.Bytes()), nil
+	})
+	_ = gzipObj.Set("decompress", func(data goja.Value) (goja.ArrayBuffer, error) {
+		b, err := toBytes(data)
+		if err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+		if err != nil {
+			return goja.ArrayBuffer{}, err
+		}
+		if len(decompressed) > maxDecompressedBytes {
+			return goja.ArrayBuffer{}, fmt.Errorf("decompressed data exceeds %d MB", maxDecompressedBytes/1024/1024)
+		}
+		return arrayBuffer(decompressed), nil
+	})
+	_ = std.Set("gzip", gzipObj)
+
+	textObj := vm.NewObject()
+	_ = textObj.Set("decode", func(data goja.Value, encoding goja.Value) (string, error) {
+		b, err := toBytes(data)
+		if err != nil {
+			return "", err
+		}
+		return decodeText(b, optionalString(encoding))
+	})
+	_ = textObj.Set("encode", func(str string) goja.ArrayBuffer {
+		return arrayBuffer([]byte(str))
+	})
+	_ = std.Set("text", textObj)
+
+	return std
+}
+
+// valueToBytes converts binary data passed from JS (a string, ArrayBuffer or typed array) to bytes.
+func valueToBytes(vm *goja.Runtime, v goja.Value) ([]byte, error) {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, nil
+	}
+	switch exported := v.Export().(type) {
+	case string:
+		return []byte(exported), nil
+	case []byte:
+		return exported, nil
+	case goja.ArrayBuffer:
+		return exported.Bytes(), nil
+	}
+	// typed arrays (like Uint8Array) are views on an ArrayBuffer.
+	if obj, isObject := v.(*goja.Object); isObject {
+		if buffer, isBuffer := exportOf(obj.Get("buffer")).(goja.ArrayBuffer); isBuffer {
+			offset := obj.Get("byteOffset").ToInteger()
+			length := obj.Get("byteLength").ToInteger()
+			return buffer.Bytes()[offset : offset+length], nil
+		}
+	}
+	return nil, fmt.Errorf("expected string, ArrayBuffer or typed array, got %s", v.String())
+}
+
+func exportOf(v goja.Value) interface{} {
+	if v == nil {
+		return nil
+	}
+	return v.Export()
+}
+
+// optionalString returns "" for omitted (or undefined/null) arguments, so that defaults can be applied.
+func optionalString(v goja.Value) string {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return ""
+	}
+	return v.String()
+}
+
+// decodeBase64 accepts standard and URL-safe base64, with or without padding.
+func decodeBase64(str string) ([]byte, error) {
+	str = strings.TrimRight(strings.TrimSpace(str), "=")
+	if strings.ContainsAny(str, "-_") {
+		return base64.RawURLEncoding.DecodeString(str)
+	}
+	return base64.RawStdEncoding.DecodeString(str)
+}
+
+func timeLayout(layout string) string {
+	if layout == "" {
+		return time.RFC3339
+	}
+	if named, ok := timeLayouts[layout]; ok {
+		return named
+	}
+	return layout
+}
+
+func loadLocation(zone string) (*time.Location, error) {
+	if zone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+func queryToMap(values url.Values) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for key, list := range values {
+		converted := make([]interface{}, len(list))
+		for i, v := range list {
+			converted[i] = v
+		}
+		result[key] = converted
+	}
+	return result
+}
+
+func decodeText(b []byte, encoding string) (string, error) {
+	switch strings.ToLower(strings.ReplaceAll(encoding, "_", "-")) {
+	case "", "utf-8", "utf8":
+		return strings.ToValidUTF8(string(b), "�"), nil
+	case "ascii", "us-ascii", "latin1", "iso-8859-1":
+		// ISO-8859-1 maps each byte to the code point of the same value; ASCII is a subset of it.
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	case "utf-16le", "utf-16be":
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("%s data must have an even length, was %d", encoding, len(b))
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if strings.HasSuffix(strings.ToLower(encoding), "be") {
+			order = binary.BigEndian
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", fmt.Errorf("unsupported text encoding %s - supported are utf-8, latin1 (iso-8859-1), ascii, utf-16le and utf-16be", encoding)
+}
@@ -0,0 +1,211 @@
+package goja
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+)
+
+// wrapJsStreamingScript wraps the user-defined script for RunStreamingScript; like wrapJsScript, it can use await.
+// In addition, the script can call emit(rows) to stream rows to the UI.
+func wrapJsStreamingScript(in string) string {
+	return fmt.Sprintf(`
+	"use strict";
+	(async function() {
+		const {nats, nc, js} = _setup(_nats, _bytesToStr, _strToBytes, _parseDuration)(__nc, undefined, __hooks);
+		const query = __query;
+		const emit = __emit;
+		%s;
+    })()
+`, in)
+}
+
+// FrameHandler receives the frames emitted by a streaming script; or the error which stopped the script.
+type FrameHandler func(frame *data.Frame, err error)
+
+// RunStreamingScript runs a free-form script which may keep running in the background: Rows passed to emit(rows)
+// are converted to frames and passed to onFrame; and subscription callbacks keep running until streamCtx is
+// cancelled. Afterwards, all subscriptions created by the script are ended. The script itself (until it returns) is
+// also stopped if ctx - the context of the query - is cancelled.
+//
+// The return value of the script (if any) is returned as initial frame; nil if the script returned nothing. The
+// script may use await; it is returned once all asynchronous calls completed (see RunScript).
+//
+// As a goja runtime is not goroutine-safe, a streaming script gets its own runtime (instead of one from the
+// gojaPool); and all subscription callbacks are run one after another on an event loop.
+//
+// The limits given via WithLimits apply to the script itself, and to each subscription callback individually.
+//
+// Messages logged by the script are attached as notices to the next frame (initial or emitted).
+func RunStreamingScript(ctx, streamCtx context.Context, nc *nats.Conn, jsFn string, onFrame FrameHandler, opts ...Option) (*data.Frame, error) {
+	if jsFn == "" {
+		return nil, fmt.Errorf("script must be specified")
+	}
+	o := buildOptions(opts)
+	vm := newRuntime()
+	loop := newEventLoop(streamCtx, o.limits)
+	scriptCtx, cancelScript := untilEither(ctx, streamCtx)
+	defer cancelScript()
+
+	if err := vm.Set("__nc", newScriptConn(nc, o.permissions)); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__query", o.query.toJs(vm)); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__hooks", loop.hooks(vm, onFrame)); err != nil {
+		return nil, err
+	}
+	logs := newScriptLogs(o.serverLog)
+	if err := vm.Set("__logs", logs); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__modules", newModuleLoader(o.modules)); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("__emit", func(rows interface{}) error {
+		frame, err := convertResult(rows, o.frameOptions()...)
+		if err != nil {
+			return err
+		}
+		logs.attachTo(frame)
+		onFrame(frame, nil)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	resultWrapper, err := runGuarded(scriptCtx, vm, loop.limits, func() (goja.Value, error) {
+		return runUserScript(vm, jsFn, StreamingScript, o.language)
+	})
+	if err != nil {
+		loop.stop()
+		return nil, scriptError(err, jsFn, StreamingScript, o.language)
+	}
+	go loop.run()
+
+	if goja.IsUndefined(resultWrapper) || goja.IsNull(resultWrapper) {
+		return nil, nil
+	}
+	frame, err := convertResult(resultWrapper.Export(), o.frameOptions()...)
+	if err != nil {
+		loop.stop()
+		return nil, err
+	}
+	logs.attachTo(frame)
+	return frame, nil
+}
+
+// untilEither returns a context which is cancelled once a or b is cancelled.
+func untilEither(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	go func() {
+		select {
+		case <-b.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// eventLoop runs the callbacks of a streaming script one after another on a single goroutine, until its
+// context is cancelled.
+type eventLoop struct {
+	ctx    context.Context
+	limits Limits
+	jobs   chan func()
+
+	mu            sync.Mutex
+	subscriptions []*nats.Subscription
+	stopped       bool
+}
+
+func newEventLoop(ctx context.Context, limits Limits) *eventLoop {
+	return &eventLoop{
+		ctx:    ctx,
+		limits: limits,
+		// buffered, so that NATS callbacks which arrive while the script is still running do not block.
+		jobs: make(chan func(), 1000),
+	}
+}
+
+// hooks returns the JS hooks object for _setup, which routes subscription callbacks through the event loop.
+func (l *eventLoop) hooks(vm *goja.Runtime, onFrame FrameHandler) *goja.Object {
+	hooks := vm.NewObject()
+	_ = hooks.Set("schedule", func(cb goja.Callable) nats.MsgHandler {
+		return func(msg *nats.Msg) {
+			l.enqueue(func() {
+				_, err := runGuarded(l.ctx, vm, l.limits, func() (goja.Value, error) {
+					return cb(goja.Undefined(), vm.ToValue(msg))
+				})
+				if err != nil && l.ctx.Err() == nil {
+					onFrame(nil, fmt.Errorf("error in subscription callback: %w", err))
+					l.stop()
+				}
+			})
+		}
+	})
+	_ = hooks.Set("track", func(subscription *nats.Subscription) *nats.Subscription {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.stopped {
+			// the script was stopped while creating the subscription
+			_ = subscription.Unsubscribe()
+		} else {
+			l.subscriptions = append(l.subscriptions, subscription)
+		}
+		return subscription
+	})
+	return hooks
+}
+
+func (l *eventLoop) enqueue(job func()) {
+	if l.isStopped() {
+		return
+	}
+	select {
+	case <-l.ctx.Done():
+	case l.jobs <- job:
+	}
+}
+
+// run processes jobs until the context is cancelled.
+func (l *eventLoop) run() {
+	defer l.stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case job := <-l.jobs:
+			job()
+			if l.isStopped() {
+				return
+			}
+		}
+	}
+}
+
+func (l *eventLoop) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// stop ends all subscriptions created by the script; no further callbacks are run afterwards.
+func (l *eventLoop) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	for _, subscription := range l.subscriptions {
+		_ = subscription.Unsubscribe()
+	}
+	l.subscriptions = nil
+}
@@ -0,0 +1,36 @@
+package goja
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestStreamingScriptAwait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	frame, err := RunStreamingScript(ctx, ctx, nil, `
+		const v = await Promise.resolve(2);
+		return {v};
+	`, func(*data.Frame, error) {})
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if v := frame.Fields[0].At(0); *v.(*int64) != 2 {
+		t.Fatalf("expected 2, got %v", v)
+	}
+}
+
+func TestStreamingScriptQueryCancellation(t *testing.T) {
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	defer cancelStream()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// the stream is still running; but the query was cancelled.
+	_, err := RunStreamingScript(ctx, streamCtx, nil, `while(true) {}`, func(*data.Frame, error) {})
+	assertLimitError(t, err, "cancelled")
+}
@@ -0,0 +1,116 @@
+package goja
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/dop251/goja"
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/go-sourcemap/sourcemap"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// Language is the language a user-defined script is written in.
+type Language string
+
+const (
+	// JavaScript scripts are run as they are (this is the default).
+	JavaScript Language = "javascript"
+	// TypeScript scripts are transpiled to JavaScript first, see transpile. Types are not checked by the backend -
+	// this is left to the query editor.
+	TypeScript Language = "typescript"
+)
+
+// WithLanguage sets the language of the user-defined script(s); JavaScript if not given.
+func WithLanguage(language Language) Option {
+	return func(o *options) {
+		o.language = language
+	}
+}
+
+// transpiled is a (wrapped) TypeScript script, transpiled to JavaScript.
+type transpiled struct {
+	js        string
+	sourceMap *sourcemap.Consumer
+}
+
+// transpileCache contains the transpiled scripts by the hash of their TypeScript source, like programCache.
+var transpileCache = ttlcache.New[string, *transpiled](
+	ttlcache.WithCapacity[string, *transpiled](programCacheSize),
+)
+
+// transpileError is returned by transpile if the TypeScript script has a syntax error. Line and Column (both
+// 1-based) refer to the given (wrapped) script.
+type transpileError struct {
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *transpileError) Error() string {
+	return e.Message
+}
+
+// transpile transpiles the given TypeScript script to JavaScript which goja can run, from transpileCache if
+// possible. Type annotations are just removed; newer syntax (f.e. class fields) is lowered.
+func transpile(ts string) (*transpiled, error) {
+	hash := sha256.Sum256([]byte(ts))
+	key := hex.EncodeToString(hash[:])
+	if item := transpileCache.Get(key); item != nil {
+		return item.Value(), nil
+	}
+
+	result := api.Transform(ts, api.TransformOptions{
+		Loader:     api.LoaderTS,
+		Target:     api.ES2020,
+		Sourcemap:  api.SourceMapExternal,
+		Sourcefile: "script.ts",
+	})
+	if len(result.Errors) > 0 {
+		message := result.Errors[0]
+		err := &transpileError{Message: message.Text}
+		if location := message.Location; location != nil && location.Column <= len(location.LineText) {
+			// esbuild columns are 0-based byte offsets.
+			err.Line = location.Line
+			err.Column = len([]rune(location.LineText[:location.Column])) + 1
+		}
+		return nil, err
+	}
+	sourceMap, err := sourcemap.Parse("script.ts.map", result.Map)
+	if err != nil {
+		return nil, err
+	}
+	t := &transpiled{js: string(result.Code), sourceMap: sourceMap}
+	transpileCache.Set(key, t, ttlcache.NoTTL)
+	return t, nil
+}
+
+// sourcePosition maps a (1-based) position in the transpiled script to the position in the TypeScript script.
+func (t *transpiled) sourcePosition(line, column int) (sourceLine, sourceColumn int, ok bool) {
+	_, _, sourceLine, sourceColumn, ok = t.sourceMap.Source(line, column-1)
+	return sourceLine, sourceColumn + 1, ok
+}
+
+// runUserScript runs the user-defined script jsFn wrapped like kind on vm - transpiled first if it is TypeScript.
+// Errors are in terms of the wrapped script; see scriptError for mapping them to jsFn.
+func runUserScript(vm *goja.Runtime, jsFn string, kind ScriptKind, language Language) (goja.Value, error) {
+	wrapped := kind.wrap(jsFn)
+	if language == TypeScript {
+		t, err := transpile(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = t.js
+	}
+	return runCached(vm, wrapped)
+}
+
+// typeScriptPosition maps a position in the transpiled script (see runUserScript) to the wrapped TypeScript script,
+// so that it can be mapped to jsFn by userPosition.
+func (k ScriptKind) typeScriptPosition(jsFn string, line, column int) (int, int, bool) {
+	t, err := transpile(k.wrap(jsFn))
+	if err != nil {
+		return 0, 0, false
+	}
+	return t.sourcePosition(line, column)
+}
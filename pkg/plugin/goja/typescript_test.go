@@ -0,0 +1,117 @@
+package goja
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestTypeScript(t *testing.T) {
+	msg := &nats.Msg{Data: []byte(`{"temperature": 21.5, "sensor": "kitchen"}`)}
+	frames, err := ConvertMessage(context.Background(), nil, msg, `
+		interface Reading {
+			temperature: number;
+			sensor: string;
+		}
+		enum Unit { Celsius = "celsius" }
+		const reading = JSON.parse(msg.Data) as Reading;
+		const row: Record<string, unknown> = {...reading, unit: Unit.Celsius};
+		return row;
+	`, WithLanguage(TypeScript))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if len(frames) != 1 || frames[0].Rows() != 1 || len(frames[0].Fields) != 3 {
+		t.Fatalf("expected a single row with 3 fields, got %v", frames)
+	}
+	unit, _ := frames[0].FieldByName("unit")
+	if unit == nil {
+		t.Fatalf("expected field unit")
+	}
+	if value, ok := unit.ConcreteAt(0); !ok || value != "celsius" {
+		t.Errorf("expected unit celsius")
+	}
+
+	frames, err = RunScript(context.Background(), nil, `
+		const values: number[] = await Promise.all([1, 2].map(async (i: number) => i * 2));
+		return values.map((value) => ({value}));
+	`, WithLanguage(TypeScript))
+	if err != nil {
+		t.Fatalf("script failed: %s", err)
+	}
+	if frames[0].Rows() != 2 {
+		t.Errorf("expected 2 rows, got %d", frames[0].Rows())
+	}
+}
+
+func TestTypeScriptIsTranspiledOnce(t *testing.T) {
+	first, err := transpile(FreeFormScript.wrap(`const a: number = 1; return {a};`))
+	if err != nil {
+		t.Fatalf("could not transpile: %s", err)
+	}
+	second, err := transpile(FreeFormScript.wrap(`const a: number = 1; return {a};`))
+	if err != nil {
+		t.Fatalf("could not transpile: %s", err)
+	}
+	if first != second {
+		t.Errorf("expected the transpiled script to be cached")
+	}
+}
+
+func TestTypeScriptErrorPositions(t *testing.T) {
+	tests := []struct {
+		name            string
+		ts              string
+		expectedMessage string
+		expectedLine    int
+		expectedColumn  int
+		expectedStack   []string
+	}{
+		{
+			name:            "syntax error",
+			ts:              "const a: number = 1;\nconst b: = 2;\nreturn {a, b};",
+			expectedMessage: `Unexpected "="`,
+			expectedLine:    2,
+			expectedColumn:  10,
+		},
+		{
+			name:            "runtime error after type declarations",
+			ts:              "interface Data {\n\tx?: {y: number};\n}\nconst data: Data = JSON.parse(msg.Data);\nreturn {y: data.x.y};",
+			expectedMessage: "TypeError: Cannot read property 'y' of undefined",
+			expectedLine:    5,
+			expectedColumn:  19,
+			expectedStack:   []string{"line 5, column 19"},
+		},
+		{
+			name:            "runtime error in nested function",
+			ts:              "function parse(data: string): any {\n\treturn JSON.parse(data);\n}\nreturn parse(msg.Data + '{');",
+			expectedMessage: "SyntaxError: Unexpected token at the end: {",
+			expectedLine:    2,
+			expectedColumn:  14,
+			expectedStack:   []string{"parse (line 2, column 14)", "line 4, column 8"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ConvertMessage(context.Background(), nil, &nats.Msg{Data: []byte(`{}`)}, test.ts, WithLanguage(TypeScript))
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("expected a script error, got: %v", err)
+			}
+			if scriptErr.Message != test.expectedMessage || scriptErr.Line != test.expectedLine || scriptErr.Column != test.expectedColumn {
+				t.Errorf("expected %q at %d:%d, got %q at %d:%d", test.expectedMessage, test.expectedLine, test.expectedColumn, scriptErr.Message, scriptErr.Line, scriptErr.Column)
+			}
+			if !reflect.DeepEqual(scriptErr.Stack, test.expectedStack) {
+				t.Errorf("expected stack %v, got %v", test.expectedStack, scriptErr.Stack)
+			}
+
+			checkErr := Check(test.ts, MessageScript, WithLanguage(TypeScript))
+			if test.expectedStack == nil && !reflect.DeepEqual(checkErr, scriptErr) {
+				t.Errorf("expected Check to report the same error, got: %v", checkErr)
+			}
+		})
+	}
+}
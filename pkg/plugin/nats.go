@@ -9,10 +9,18 @@ import (
 
 func (ds *Datasource) connectNats(options *MyDataSourceOptions, secureOptions *MySecureJsonData) (*nats.Conn, error) {
 	ds.natsConnOnce.Do(func() {
+		// the connection is shared by all queries and streams of the datasource, so we never give up reconnecting.
+		// Streams are informed about interruptions, see onNatsDisconnect and onNatsReconnect.
+		opts := []nats.Option{
+			nats.MaxReconnects(-1),
+			nats.DisconnectErrHandler(ds.onNatsDisconnect),
+			nats.ReconnectHandler(ds.onNatsReconnect),
+		}
+
 		if options.Authentication == AuthenticationNone {
-			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl)
+			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, opts...)
 		} else if options.Authentication == AuthenticationNkey {
-			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, nats.Nkey(
+			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, append(opts, nats.Nkey(
 				options.Nkey,
 				func(nonce []byte) ([]byte, error) {
 					kp, err := nkeys.FromSeed([]byte(secureOptions.NkeySeed))
@@ -25,9 +33,9 @@ func (ds *Datasource) connectNats(options *MyDataSourceOptions, secureOptions *M
 					sig, _ := kp.Sign(nonce)
 					return sig, nil
 				},
-			))
+			))...)
 		} else if options.Authentication == AuthenticationUserPass {
-			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, nats.UserInfo(options.Username, secureOptions.Password))
+			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, append(opts, nats.UserInfo(options.Username, secureOptions.Password))...)
 		} else if options.Authentication == AuthenticationJWT {
 			// Implemented after nats.UserCredentials(), but without temp file
 			jwtAsByte := []byte(secureOptions.Jwt)
@@ -46,7 +54,7 @@ func (ds *Datasource) connectNats(options *MyDataSourceOptions, secureOptions *M
 				return sig, nil
 			}
 
-			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, nats.UserJWT(userCB, sigCB))
+			ds.natsConn, ds.natsConnErr = nats.Connect(options.NatsUrl, append(opts, nats.UserJWT(userCB, sigCB))...)
 		} else {
 			// TODO: TOKEN AUTH
 			ds.natsConnErr = fmt.Errorf("TODO")
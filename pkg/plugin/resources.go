@@ -0,0 +1,257 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/nats-io/nats.go"
+	"github.com/sandstormmedia/nats/pkg/plugin/convert"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+	"github.com/sandstormmedia/nats/pkg/plugin/goja"
+)
+
+// The resource endpoints support the query editor in writing scripts, without saving the panel first:
+//
+//   - POST /validate with the query as body compiles its scripts, and returns their syntax errors (with line and
+//     column relative to the user's script).
+//   - POST /preview with {query, message} runs the script of the query against the given sample message (or, for
+//     Script queries, without a message), and returns the resulting frames - or the error, with its position in the
+//     user's script. NATS is not touched: `nc` is null.
+
+// scriptFieldError is an error in one of the script fields (jsFn, jsInitFn, jsTeardownFn) - or the expressions
+// (filterExpression, columnExpressions) or mapping (mappingRows, mappingColumns) - of a query.
+type scriptFieldError struct {
+	Field string `json:"field"`
+	*goja.ScriptError
+}
+
+type validateResponse struct {
+	Errors []scriptFieldError `json:"errors"`
+}
+
+type previewRequest struct {
+	Query   queryModel     `json:"query"`
+	Message previewMessage `json:"message"`
+}
+
+// previewMessage is the sample message of a preview.
+type previewMessage struct {
+	Subject string              `json:"subject"`
+	Data    string              `json:"data"`
+	Headers map[string][]string `json:"headers"`
+}
+
+type previewResponse struct {
+	Frames data.Frames       `json:"frames"`
+	Error  *scriptFieldError `json:"error"`
+}
+
+// CallResource handles the resource endpoints of the query editor, see newResourceHandler.
+func (ds *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	return ds.resourceHandler.CallResource(ctx, req, sender)
+}
+
+func (ds *Datasource) newResourceHandler() backend.CallResourceHandler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", postOnly(ds.handleValidate))
+	mux.HandleFunc("/preview", postOnly(ds.handlePreview))
+	return httpadapter.New(mux)
+}
+
+func postOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (ds *Datasource) handleValidate(w http.ResponseWriter, r *http.Request) {
+	var qm queryModel
+	if err := json.NewDecoder(r.Body).Decode(&qm); err != nil {
+		http.Error(w, "query could not be parsed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := validateResponse{Errors: []scriptFieldError{}}
+	expressions, err := queryExpressions(qm)
+	if err != nil {
+		response.Errors = append(response.Errors, scriptFieldError{Field: "useExpressions", ScriptError: &goja.ScriptError{Message: err.Error()}})
+	}
+	if expressions != nil {
+		// the script is not used
+		if err := expressions.Check(); err != nil {
+			response.Errors = append(response.Errors, scriptFieldError{Field: expressionErrorField(err), ScriptError: &goja.ScriptError{Message: err.Error()}})
+		}
+		writeJson(w, response)
+		return
+	}
+	mapping, err := queryMapping(qm)
+	if err != nil {
+		response.Errors = append(response.Errors, scriptFieldError{Field: "useMapping", ScriptError: &goja.ScriptError{Message: err.Error()}})
+	}
+	if mapping != nil {
+		if err := mapping.Check(); err != nil {
+			response.Errors = append(response.Errors, scriptFieldError{Field: mappingErrorField(err), ScriptError: &goja.ScriptError{Message: err.Error()}})
+		}
+		writeJson(w, response)
+		return
+	}
+	for _, script := range scriptsOf(qm) {
+		if script.js == "" {
+			continue
+		}
+		err := goja.Check(script.js, script.kind, goja.WithLanguage(goja.Language(qm.ScriptLanguage)))
+		var scriptErr *goja.ScriptError
+		if errors.As(err, &scriptErr) {
+			response.Errors = append(response.Errors, scriptFieldError{Field: script.field, ScriptError: scriptErr})
+		} else if err != nil {
+			response.Errors = append(response.Errors, scriptFieldError{Field: script.field, ScriptError: &goja.ScriptError{Message: err.Error()}})
+		}
+	}
+	writeJson(w, response)
+}
+
+func (ds *Datasource) handlePreview(w http.ResponseWriter, r *http.Request) {
+	var req previewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "preview request could not be parsed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pCtx := httpadapter.PluginConfigFromContext(r.Context())
+	dataSourceOptions, _, err := ds.loadDataSourceOptions(pCtx)
+	if err != nil {
+		http.Error(w, "data source could not be loaded: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	qm := req.Query
+	scriptOpts := []goja.Option{
+		goja.WithLimits(scriptLimits(dataSourceOptions, qm)),
+		goja.WithServerLog(goja.ServerLogLevel(dataSourceOptions.ScriptServerLog)),
+		goja.WithPermissions(scriptPermissions(dataSourceOptions)),
+		goja.WithLanguage(goja.Language(qm.ScriptLanguage)),
+		goja.WithModules(scriptModules(dataSourceOptions)),
+		goja.WithArrayMode(framestruct.ArrayMode(qm.ArrayMode)),
+		// there is no time range for a preview, so query.from and query.to are null.
+		goja.WithQuery(queryContext(pCtx, backend.DataQuery{RefID: "preview"}, qm)),
+	}
+	converter, field, err := messageConverter(dataSourceOptions, qm, nil, scriptOpts)
+	if err != nil {
+		writeJson(w, previewResponse{Error: &scriptFieldError{Field: field, ScriptError: &goja.ScriptError{Message: err.Error()}}})
+		return
+	}
+	msg := &nats.Msg{
+		Subject: req.Message.Subject,
+		Data:    []byte(req.Message.Data),
+		Header:  req.Message.Headers,
+	}
+
+	var frames data.Frames
+	// the script field which failed
+	field = "jsFn"
+	switch {
+	case qm.QueryType == QueryTypeScript:
+		frames, err = goja.RunScript(r.Context(), nil, qm.JsFn, scriptOpts...)
+	case qm.QueryType == QueryTypeStreamingScript:
+		http.Error(w, "streaming scripts cannot be previewed", http.StatusBadRequest)
+		return
+	case qm.QueryType == QueryTypeSubscribe && qm.Stateful:
+		frames, field, err = previewStateful(r.Context(), qm, msg, scriptOpts)
+	default:
+		frames, err = converter.Convert(r.Context(), msg)
+		if errors.Is(err, convert.ErrMessageDiscarded) {
+			frames, err = discardedMessageFrames(), nil
+		}
+		if err != nil && qm.UseExpressions {
+			field = expressionErrorField(err)
+		}
+		if err != nil && qm.UseMapping {
+			field = mappingErrorField(err)
+		}
+	}
+
+	response := previewResponse{Frames: frames}
+	if err != nil {
+		var scriptErr *goja.ScriptError
+		if !errors.As(err, &scriptErr) {
+			scriptErr = &goja.ScriptError{Message: err.Error()}
+		}
+		response.Error = &scriptFieldError{Field: field, ScriptError: scriptErr}
+	}
+	writeJson(w, response)
+}
+
+// expressionErrorField returns the query field of a failed expression (see convert.ExpressionError).
+func expressionErrorField(err error) string {
+	var expressionErr *convert.ExpressionError
+	if errors.As(err, &expressionErr) && expressionErr.Column == "" {
+		return "filterExpression"
+	}
+	return "columnExpressions"
+}
+
+// mappingErrorField returns the query field of a failed mapping (see convert.MappingError).
+func mappingErrorField(err error) string {
+	var mappingErr *convert.MappingError
+	if errors.As(err, &mappingErr) && mappingErr.Column == "" {
+		return "mappingRows"
+	}
+	return "mappingColumns"
+}
+
+// previewStateful runs the init script, the script for the sample message and the teardown script of a stateful
+// subscription. On error, field is the query field of the failed script.
+func previewStateful(ctx context.Context, qm queryModel, msg *nats.Msg, scriptOpts []goja.Option) (frames data.Frames, field string, err error) {
+	converter, err := goja.NewStatefulConverter(ctx, nil, qm.JsFn, qm.JsInitFn, qm.JsTeardownFn, scriptOpts...)
+	if err != nil {
+		return nil, "jsInitFn", err
+	}
+	frame, err := converter.ConvertMessage(msg)
+	if closeErr := converter.Close(); err == nil && closeErr != nil {
+		return nil, "jsTeardownFn", closeErr
+	}
+	if err != nil {
+		return nil, "jsFn", err
+	}
+	return data.Frames{frame}, "", nil
+}
+
+// queryScript is a script of a query; field is the name of the query field containing it.
+type queryScript struct {
+	field string
+	js    string
+	kind  goja.ScriptKind
+}
+
+// scriptsOf returns the scripts of the given query, with the way they are run.
+func scriptsOf(qm queryModel) []queryScript {
+	switch {
+	case qm.QueryType == QueryTypeScript:
+		return []queryScript{{"jsFn", qm.JsFn, goja.FreeFormScript}}
+	case qm.QueryType == QueryTypeStreamingScript:
+		return []queryScript{{"jsFn", qm.JsFn, goja.StreamingScript}}
+	case qm.QueryType == QueryTypeSubscribe && qm.Stateful:
+		return []queryScript{
+			{"jsFn", qm.JsFn, goja.StatefulScript},
+			{"jsInitFn", qm.JsInitFn, goja.StatefulScript},
+			{"jsTeardownFn", qm.JsTeardownFn, goja.StatefulScript},
+		}
+	default:
+		return []queryScript{{"jsFn", qm.JsFn, goja.MessageScript}}
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sandstormmedia/nats/pkg/plugin/convert"
+)
+
+type resourceResponseRecorder struct {
+	responses []*backend.CallResourceResponse
+}
+
+func (r *resourceResponseRecorder) Send(resp *backend.CallResourceResponse) error {
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+// callResource calls the resource endpoint at path with the given body, and decodes the JSON response into result.
+func callResource(t *testing.T, path string, body interface{}, result interface{}) int {
+	t.Helper()
+	ds, pluginContext := newDatasourceForTesting()
+	encoded, err := json.Marshal(body)
+	AssertNoError(t, err)
+
+	recorder := &resourceResponseRecorder{}
+	err = ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: pluginContext,
+		Path:          path,
+		Method:        http.MethodPost,
+		URL:           path,
+		Body:          encoded,
+	}, recorder)
+	AssertNoError(t, err)
+	if len(recorder.responses) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(recorder.responses))
+	}
+	response := recorder.responses[0]
+	if response.Status == http.StatusOK {
+		if err := json.Unmarshal(response.Body, result); err != nil {
+			t.Fatalf("response could not be decoded: %s - was: %s", err, response.Body)
+		}
+	}
+	return response.Status
+}
+
+func TestResourceValidate(t *testing.T) {
+	var response validateResponse
+	status := callResource(t, "validate", queryModel{
+		QueryType:    QueryTypeSubscribe,
+		Stateful:     true,
+		JsFn:         "state.count++;\nreturn {count: state.count;",
+		JsInitFn:     "state.count = 0;",
+		JsTeardownFn: "log(state.count))",
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	AssertEqual(t, 2, len(response.Errors), "number of errors")
+	AssertEqual(t, "jsFn", response.Errors[0].Field, "field")
+	AssertEqual(t, 2, response.Errors[0].Line, "line")
+	AssertEqual(t, 27, response.Errors[0].Column, "column")
+	AssertEqual(t, "jsTeardownFn", response.Errors[1].Field, "field")
+	AssertEqual(t, 1, response.Errors[1].Line, "line")
+}
+
+func TestResourceValidateValidScript(t *testing.T) {
+	var response validateResponse
+	status := callResource(t, "validate", queryModel{
+		QueryType: QueryTypeScript,
+		JsFn:      `const reply = await nc.RequestAsync("a", "", "1s"); return JSON.parse(reply.Data);`,
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	AssertEqual(t, 0, len(response.Errors), "number of errors")
+}
+
+func TestResourcePreview(t *testing.T) {
+	var response struct {
+		Frames []json.RawMessage `json:"frames"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	status := callResource(t, "preview", previewRequest{
+		Query: queryModel{
+			QueryType: QueryTypeRequestReply,
+			JsFn:      `const parsed = JSON.parse(msg.Data); return {subject: msg.Subject, value: parsed.v * 2};`,
+		},
+		Message: previewMessage{Subject: "sensors.1", Data: `{"v": 21}`},
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error != nil {
+		t.Fatalf("preview failed: %s", response.Error.Message)
+	}
+	AssertEqual(t, 1, len(response.Frames), "number of frames")
+	var frame struct {
+		Data struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"data"`
+	}
+	AssertNoError(t, json.Unmarshal(response.Frames[0], &frame))
+	AssertEqual[interface{}](t, "sensors.1", frame.Data.Values[0][0], "subject")
+	AssertEqual[interface{}](t, float64(42), frame.Data.Values[1][0], "value")
+}
+
+func TestResourcePreviewDoesNotTouchNats(t *testing.T) {
+	var response previewResponse
+	status := callResource(t, "preview", previewRequest{
+		Query: queryModel{
+			QueryType: QueryTypeScript,
+			JsFn:      `nc.Publish("orders.delete", "all"); return {};`,
+		},
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error == nil {
+		t.Fatalf("expected the script to fail without NATS connection")
+	}
+}
+
+func TestResourcePreviewReportsErrorPosition(t *testing.T) {
+	var response previewResponse
+	status := callResource(t, "preview", previewRequest{
+		Query: queryModel{
+			QueryType: QueryTypeSubscribe,
+			Stateful:  true,
+			JsFn:      `return {count: state.count};`,
+			JsInitFn:  "state.count = 0;\nstate.nested.count = 0;",
+		},
+		Message: previewMessage{Subject: "sensors.1", Data: `{}`},
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error == nil {
+		t.Fatalf("expected the init script to fail")
+	}
+	AssertEqual(t, "jsInitFn", response.Error.Field, "field")
+	AssertEqual(t, 2, response.Error.Line, "line")
+	AssertEqual(t, "state.nested.count = 0;\n      ^", response.Error.Snippet, "snippet")
+}
+
+func TestResourceValidateTypeScript(t *testing.T) {
+	var response validateResponse
+	status := callResource(t, "validate", queryModel{
+		QueryType:      QueryTypeScript,
+		ScriptLanguage: "typescript",
+		JsFn:           "const servers: string[] = [];\nconst count: = servers.length;\nreturn {count};",
+	}, &response)
+
+	AssertEqual(t, http.StatusOK, status, "status")
+	AssertEqual(t, 1, len(response.Errors), "number of errors")
+	AssertEqual(t, 2, response.Errors[0].Line, "line")
+	AssertEqual(t, 14, response.Errors[0].Column, "column")
+}
+
+func TestResourcePreviewExpressions(t *testing.T) {
+	query := queryModel{
+		QueryType:         QueryTypeSubscribe,
+		UseExpressions:    true,
+		FilterExpression:  `data.v > 20`,
+		ColumnExpressions: []convert.ExpressionColumn{{Name: "doubled", Expression: `data.v * 2.0`}},
+	}
+	var response previewResponse
+	status := callResource(t, "preview", previewRequest{Query: query, Message: previewMessage{Data: `{"v": 21}`}}, &response)
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error != nil {
+		t.Fatalf("preview failed: %s", response.Error.Message)
+	}
+	AssertEqual(t, 1, len(response.Frames), "number of frames")
+	value, _ := response.Frames[0].Fields[0].ConcreteAt(0)
+	AssertEqual[interface{}](t, 42.0, value, "doubled")
+
+	response = previewResponse{}
+	callResource(t, "preview", previewRequest{Query: query, Message: previewMessage{Data: `{"v": 1}`}}, &response)
+	AssertEqual(t, 1, len(response.Frames), "number of frames")
+	AssertEqual(t, 0, response.Frames[0].Rows(), "rows of a discarded message")
+
+	var validation validateResponse
+	query.ColumnExpressions[0].Expression = `data.v *`
+	callResource(t, "validate", query, &validation)
+	AssertEqual(t, 1, len(validation.Errors), "number of errors")
+	AssertEqual(t, "columnExpressions", validation.Errors[0].Field, "field")
+}
+
+func TestResourcePreviewMapping(t *testing.T) {
+	query := queryModel{
+		QueryType:      QueryTypeRequestReply,
+		UseMapping:     true,
+		MappingRows:    "sensors",
+		MappingColumns: []convert.MappingColumn{{Name: "celsius", Path: "values[0]", Type: convert.MappingNumber}},
+	}
+	var response previewResponse
+	status := callResource(t, "preview", previewRequest{Query: query, Message: previewMessage{Data: `{"sensors": [{"values": [21.5]}, {"values": [22]}]}`}}, &response)
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error != nil {
+		t.Fatalf("preview failed: %s", response.Error.Message)
+	}
+	AssertEqual(t, 2, response.Frames[0].Rows(), "rows")
+
+	response = previewResponse{}
+	callResource(t, "preview", previewRequest{Query: query, Message: previewMessage{Data: `{"sensors": [{"values": ["warm"]}]}`}}, &response)
+	if response.Error == nil {
+		t.Fatalf("expected the mapping to fail")
+	}
+	AssertEqual(t, "mappingColumns", response.Error.Field, "field")
+
+	var validation validateResponse
+	query.MappingRows = "sensors[?"
+	callResource(t, "validate", query, &validation)
+	AssertEqual(t, 1, len(validation.Errors), "number of errors")
+	AssertEqual(t, "mappingRows", validation.Errors[0].Field, "field")
+}
+
+func TestResourcePreviewArrayMode(t *testing.T) {
+	var response previewResponse
+	status := callResource(t, "preview", previewRequest{
+		Query:   queryModel{QueryType: QueryTypeRequestReply, ArrayMode: "explode"},
+		Message: previewMessage{Data: `{"id": "s1", "tags": ["a", "b", "c"]}`},
+	}, &response)
+	AssertEqual(t, http.StatusOK, status, "status")
+	if response.Error != nil {
+		t.Fatalf("preview failed: %s", response.Error.Message)
+	}
+	AssertEqual(t, 3, response.Frames[0].Rows(), "rows")
+}
@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"github.com/nats-io/nats.go"
+)
+
+// streamResponse is the state shared between a SUBSCRIBE query (which receives the NATS messages) and
+// RunStream (which forwards them via Grafana Live to the user).
+type streamResponse struct {
+	onNewMessages          chan bool
+	cancelNatsSubscription context.CancelFunc
+	// set to true once the NATS subscription is set up. Required for deterministic tests.
+	subscribed bool
+
+	// policy controls how frames are forwarded to the user; it is immutable.
+	policy streamOutputPolicy
+
+	// mu protects all fields below, as they are written from NATS callbacks and read from RunStream.
+	mu         sync.Mutex
+	buffer     streamBuffer
+	currentErr error
+	// lastFrame is the frame of the latest message; it is used as schema when we need to send notices without data.
+	lastFrame *data.Frame
+	// subscription is the NATS subscription feeding this stream; nil once it was ended on purpose.
+	//
+	// It is never re-created: the NATS client re-sends all subscriptions on reconnect, and the shared connection is
+	// never closed (see connectNats and CheckHealth) - so the subscription stays valid across interruptions, see
+	// onNatsReconnect.
+	subscription *nats.Subscription
+	// disconnectedAt is the time the NATS connection was lost; zero while connected.
+	disconnectedAt time.Time
+	// pendingNotices are attached to the next frame sent to the user.
+	pendingNotices []data.Notice
+}
+
+// defaultStreamSubscribeTimeout is the default of Datasource.streamSubscribeTimeout.
+const defaultStreamSubscribeTimeout = 5 * time.Minute
+
+// newStream registers a new stream for the query, which the UI can then subscribe to via Grafana Live (see
+// streamingResponse). The returned context is cancelled once the stream ends.
+func (ds *Datasource) newStream(qm queryModel) (string, *streamResponse, context.Context, error) {
+	requestUuid := uuid.NewString()
+	if len(qm.StreamRequestUuidForTesting) > 0 {
+		requestUuid = qm.StreamRequestUuidForTesting
+	}
+
+	policy, err := newStreamOutputPolicy(qm)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sr := &streamResponse{
+		onNewMessages: make(chan bool, 100), // we use a buffered channel here, because we do not want to block at all, if possible.
+		policy:        policy,
+		buffer:        streamBuffer{policy: policy},
+	}
+	sr.cancelNatsSubscription = func() {
+		cancel()
+		sr.unsubscribe()
+	}
+
+	// if no panel subscribes in time (f.e. because it was closed meanwhile), the stream is ended, see NewDatasource.
+	ds.streamResponsesSoFar.Set(requestUuid, sr, ds.streamSubscribeTimeout)
+	return requestUuid, sr, ctx, nil
+}
+
+// streamingResponse returns the initial frame of a stream, linked to the Grafana Live channel of the stream.
+func (ds *Datasource) streamingResponse(requestUuid string, firstFrame *data.Frame) backend.DataResponse {
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: ds.uid,
+		Path:      requestUuid, // because request UUID is random, we cannot snoop on other people's values (security). and we have one subscription per user (which is what we want in our case)
+	}
+	if firstFrame.Meta == nil {
+		firstFrame.SetMeta(&data.FrameMeta{})
+	}
+	firstFrame.Meta.Channel = channel.String()
+	return backend.DataResponse{
+		Frames: data.Frames{
+			firstFrame,
+		},
+		Status: backend.StatusOK,
+	}
+}
+
+// signal wakes up RunStream. It never blocks: if a signal is already pending, RunStream will pick up the latest state anyways.
+func (sr *streamResponse) signal() {
+	select {
+	case sr.onNewMessages <- true:
+	default:
+	}
+}
+
+// addFrame buffers the converted message until RunStream sends it (depending on the streamOutputPolicy).
+func (sr *streamResponse) addFrame(frame *data.Frame) {
+	sr.mu.Lock()
+	sr.buffer.add(frame)
+	sr.lastFrame = frame
+	sr.mu.Unlock()
+	sr.signal()
+}
+
+func (sr *streamResponse) setErr(err error) {
+	sr.mu.Lock()
+	sr.currentErr = err
+	sr.mu.Unlock()
+	sr.signal()
+}
+
+// next returns the frames to be sent to the user now (if any), with all pending notices attached.
+func (sr *streamResponse) next() ([]*data.Frame, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.currentErr != nil {
+		return nil, sr.currentErr
+	}
+	frames := sr.buffer.flush()
+
+	if len(sr.pendingNotices) > 0 {
+		if len(frames) == 0 && sr.lastFrame != nil {
+			// no new data, but we still want to tell the user right away.
+			frames = append(frames, emptyFrameLike(sr.lastFrame))
+		}
+		if len(frames) > 0 {
+			frames[len(frames)-1].AppendNotices(sr.pendingNotices...)
+			sr.pendingNotices = nil
+		}
+	}
+	return frames, nil
+}
+
+// unsubscribe ends the NATS subscription for good (i.e. it is not re-established on reconnect).
+func (sr *streamResponse) unsubscribe() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.subscription != nil {
+		_ = sr.subscription.Unsubscribe()
+		sr.subscription = nil
+	}
+}
+
+func (sr *streamResponse) connectionLost(at time.Time) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.disconnectedAt.IsZero() {
+		sr.disconnectedAt = at
+	}
+}
+
+// connectionRestored reports the gap since connectionLost to the user.
+func (sr *streamResponse) connectionRestored(at time.Time) {
+	sr.mu.Lock()
+	if !sr.disconnectedAt.IsZero() {
+		sr.pendingNotices = append(sr.pendingNotices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf(
+				"NATS connection was interrupted from %s to %s (%s) - messages published in this period are missing.",
+				sr.disconnectedAt.Format(time.RFC3339),
+				at.Format(time.RFC3339),
+				at.Sub(sr.disconnectedAt).Round(time.Millisecond),
+			),
+		})
+		sr.disconnectedAt = time.Time{}
+	}
+	sr.mu.Unlock()
+	sr.signal()
+}
+
+// emptyFrameLike returns a frame without rows, with the same name and fields as the given frame.
+func emptyFrameLike(frame *data.Frame) *data.Frame {
+	fields := make([]*data.Field, 0, len(frame.Fields))
+	for _, f := range frame.Fields {
+		field := data.NewFieldFromFieldType(f.Type(), 0)
+		field.Name = f.Name
+		field.Labels = f.Labels
+		fields = append(fields, field)
+	}
+	return data.NewFrame(frame.Name, fields...)
+}
+
+// onNatsDisconnect marks all open streams as interrupted, so that the gap can be reported once we are connected again.
+func (ds *Datasource) onNatsDisconnect(_ *nats.Conn, err error) {
+	log.DefaultLogger.Warn(fmt.Sprintf("NATS connection lost: %v", err))
+	now := time.Now()
+	for _, item := range ds.streamResponsesSoFar.Items() {
+		item.Value().connectionLost(now)
+	}
+}
+
+// onNatsReconnect reports the interruption to all open streams.
+func (ds *Datasource) onNatsReconnect(nc *nats.Conn) {
+	log.DefaultLogger.Info(fmt.Sprintf("NATS connection re-established to %s", nc.ConnectedUrl()))
+	now := time.Now()
+	// the NATS client has already re-sent all subscriptions; we wait until the server has processed them, so that
+	// messages shown to the user after the gap notice are not missed.
+	if err := nc.FlushTimeout(5 * time.Second); err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("NATS flush after reconnect failed: %s", err))
+	}
+	for _, item := range ds.streamResponsesSoFar.Items() {
+		item.Value().connectionRestored(now)
+	}
+}
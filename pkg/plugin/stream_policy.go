@@ -0,0 +1,286 @@
+package plugin
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sandstormmedia/nats/pkg/plugin/framestruct"
+)
+
+// maxPendingFrames limits how many converted messages are buffered per stream, f.e. while nobody is watching it.
+const maxPendingFrames = 1000
+
+// streamMessagesTotal counts all messages received by streams, by what happened to them. Exposed via the
+// plugin metrics endpoint of Grafana.
+var streamMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "grafana_plugin",
+	Name:      "nats_stream_messages_total",
+	Help:      "Messages received by SUBSCRIBE streams; result is one of sent, coalesced, dropped or sampled_out.",
+}, []string{"result"})
+
+// streamOutputPolicy controls how converted messages of a stream are forwarded to Grafana Live.
+// The zero value forwards every message as its own frame, as fast as possible.
+type streamOutputPolicy struct {
+	// maxFps limits the frames per second sent to the user; 0 = unlimited.
+	maxFps float64
+	// coalesce merges all messages since the last frame into one multi-row frame. Otherwise, only the latest
+	// message is sent if maxFps is hit.
+	coalesce bool
+	// sampling is one of StreamSamplingNone, StreamSamplingEveryNth or StreamSamplingReservoir.
+	sampling string
+	// sampleSize is N for StreamSamplingEveryNth, and the reservoir size for StreamSamplingReservoir.
+	sampleSize int
+}
+
+func newStreamOutputPolicy(qm queryModel) (streamOutputPolicy, error) {
+	policy := streamOutputPolicy{
+		maxFps:     qm.StreamMaxFps,
+		coalesce:   qm.StreamCoalesce,
+		sampling:   qm.StreamSampling,
+		sampleSize: qm.StreamSampleSize,
+	}
+	if policy.maxFps < 0 {
+		return policy, fmt.Errorf("max frames per second must not be negative, was %v", policy.maxFps)
+	}
+	switch policy.sampling {
+	case StreamSamplingNone:
+	case StreamSamplingEveryNth, StreamSamplingReservoir:
+		if policy.sampleSize < 1 {
+			return policy, fmt.Errorf("sample size must be at least 1 for sampling %s", policy.sampling)
+		}
+		if policy.sampling == StreamSamplingReservoir && policy.maxFps <= 0 {
+			// the reservoir is emptied on every frame sent; so it only makes sense with a fixed rate.
+			return policy, fmt.Errorf("reservoir sampling requires max frames per second to be set")
+		}
+	default:
+		return policy, fmt.Errorf("invalid stream sampling: %s", policy.sampling)
+	}
+	return policy, nil
+}
+
+// active is true if any output policy is configured; only then we report statistics to the user.
+func (p streamOutputPolicy) active() bool {
+	return p.maxFps > 0 || p.coalesce || p.sampling != StreamSamplingNone
+}
+
+// tickInterval returns the time between two frames, or 0 if frames are sent as soon as possible.
+func (p streamOutputPolicy) tickInterval() time.Duration {
+	if p.maxFps <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / p.maxFps)
+}
+
+// streamStats are the message counters of a single stream.
+type streamStats struct {
+	received   int64
+	sent       int64
+	coalesced  int64
+	dropped    int64
+	sampledOut int64
+}
+
+func (s *streamStats) countSent(n int) {
+	s.sent += int64(n)
+	streamMessagesTotal.WithLabelValues("sent").Add(float64(n))
+}
+
+func (s *streamStats) countCoalesced(n int) {
+	s.coalesced += int64(n)
+	streamMessagesTotal.WithLabelValues("coalesced").Add(float64(n))
+}
+
+func (s *streamStats) countDropped(n int) {
+	s.dropped += int64(n)
+	streamMessagesTotal.WithLabelValues("dropped").Add(float64(n))
+}
+
+func (s *streamStats) countSampledOut(n int) {
+	s.sampledOut += int64(n)
+	streamMessagesTotal.WithLabelValues("sampled_out").Add(float64(n))
+}
+
+func (s *streamStats) queryStats() []data.QueryStat {
+	stat := func(displayName string, value int64) data.QueryStat {
+		return data.QueryStat{
+			FieldConfig: data.FieldConfig{DisplayName: displayName},
+			Value:       float64(value),
+		}
+	}
+	return []data.QueryStat{
+		stat("Messages received", s.received),
+		stat("Messages sent", s.sent),
+		stat("Messages coalesced", s.coalesced),
+		stat("Messages dropped", s.dropped),
+		stat("Messages sampled out", s.sampledOut),
+	}
+}
+
+// pendingFrame is a converted message which was not sent to the user yet.
+type pendingFrame struct {
+	// seq is the number of the message in the stream; used to restore the order after reservoir sampling.
+	seq   int64
+	frame *data.Frame
+}
+
+// streamBuffer collects the converted messages of a stream between two frames sent to the user, and applies
+// the streamOutputPolicy. It is not thread-safe; streamResponse guards it.
+type streamBuffer struct {
+	policy  streamOutputPolicy
+	stats   streamStats
+	pending []pendingFrame
+	// seenInWindow counts messages since the last flush, for reservoir sampling.
+	seenInWindow int
+}
+
+// add applies sampling to the given message, and buffers it if it is kept.
+func (b *streamBuffer) add(frame *data.Frame) {
+	b.stats.received++
+	b.seenInWindow++
+	pf := pendingFrame{seq: b.stats.received, frame: frame}
+
+	switch b.policy.sampling {
+	case StreamSamplingEveryNth:
+		if b.stats.received%int64(b.policy.sampleSize) != 0 {
+			b.stats.countSampledOut(1)
+			return
+		}
+	case StreamSamplingReservoir:
+		// Algorithm R: every message of the window has the same chance to end up in the reservoir.
+		if len(b.pending) >= b.policy.sampleSize {
+			j := rand.Intn(b.seenInWindow)
+			if j < b.policy.sampleSize {
+				b.pending[j] = pf
+			}
+			b.stats.countSampledOut(1)
+			return
+		}
+	}
+
+	if len(b.pending) >= maxPendingFrames {
+		b.pending = b.pending[1:]
+		b.stats.countDropped(1)
+	}
+	b.pending = append(b.pending, pf)
+}
+
+// flush returns the frames to be sent to the user now, and empties the buffer.
+func (b *streamBuffer) flush() []*data.Frame {
+	pending := b.pending
+	b.pending = nil
+	b.seenInWindow = 0
+	if len(pending) == 0 {
+		return nil
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].seq < pending[j].seq
+	})
+	frames := make([]*data.Frame, 0, len(pending))
+	for _, pf := range pending {
+		frames = append(frames, pf.frame)
+	}
+
+	if b.policy.coalesce && len(frames) > 1 {
+		merged, err := mergeFrames(frames)
+		if err == nil {
+			b.stats.countSent(1)
+			b.stats.countCoalesced(len(frames) - 1)
+			frames = []*data.Frame{merged}
+		} else if b.policy.maxFps <= 0 {
+			// the messages have incompatible schemas, so we have to send them one by one.
+			b.stats.countSent(len(frames))
+		} else {
+			// ... which is not allowed by the rate limit.
+			b.stats.countSent(1)
+			b.stats.countDropped(len(frames) - 1)
+			frames = frames[len(frames)-1:]
+		}
+	} else if b.policy.maxFps > 0 && len(frames) > 1 {
+		// rate limited: only the latest message is shown.
+		b.stats.countSent(1)
+		b.stats.countDropped(len(frames) - 1)
+		frames = frames[len(frames)-1:]
+	} else {
+		b.stats.countSent(len(frames))
+	}
+
+	if b.policy.active() {
+		stats := b.stats.queryStats()
+		for _, frame := range frames {
+			if frame.Meta == nil {
+				frame.SetMeta(&data.FrameMeta{})
+			}
+			frame.Meta.Stats = stats
+		}
+	}
+	return frames
+}
+
+// mergeFrames concatenates the rows of the given frames into a single frame. Fields are matched by name;
+// rows of frames without a certain field get a null value there. Fields with conflicting types are widened
+// (see framestruct.FieldFromValues); frames with missing values in non-nullable fields cannot be merged.
+func mergeFrames(frames []*data.Frame) (*data.Frame, error) {
+	merged := data.NewFrame(frames[0].Name)
+	fieldIndex := make(map[string]int)
+	rows := 0
+	for _, frame := range frames {
+		frameRows, err := frame.RowLen()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range frame.Fields {
+			idx, exists := fieldIndex[f.Name]
+			if !exists {
+				if rows > 0 && !f.Type().Nullable() {
+					return nil, fmt.Errorf("field %s is missing in earlier frames, but is not nullable", f.Name)
+				}
+				field := data.NewFieldFromFieldType(f.Type(), rows)
+				field.Name = f.Name
+				field.Labels = f.Labels
+				field.Config = f.Config
+				idx = len(merged.Fields)
+				fieldIndex[f.Name] = idx
+				merged.Fields = append(merged.Fields, field)
+			} else if merged.Fields[idx].Type() != f.Type() {
+				// f.e. 1 in one message, and 1.5 in the next: the field is widened like within a message.
+				values := append(fieldValues(merged.Fields[idx]), fieldValues(f)...)
+				widened := framestruct.FieldFromValues(f.Name, values)
+				widened.Labels = merged.Fields[idx].Labels
+				widened.Config = merged.Fields[idx].Config
+				merged.Fields[idx] = widened
+				continue
+			}
+			for i := 0; i < frameRows; i++ {
+				merged.Fields[idx].Append(f.At(i))
+			}
+		}
+		rows += frameRows
+
+		for _, field := range merged.Fields {
+			if field.Len() < rows && !field.Type().Nullable() {
+				return nil, fmt.Errorf("field %s is missing in some frames, but is not nullable", field.Name)
+			}
+			for field.Len() < rows {
+				field.Append(nil)
+			}
+		}
+		if frame.Meta != nil && len(frame.Meta.Notices) > 0 {
+			merged.AppendNotices(frame.Meta.Notices...)
+		}
+	}
+	return merged, nil
+}
+
+// fieldValues returns the values of a field, as returned by At.
+func fieldValues(f *data.Field) []interface{} {
+	values := make([]interface{}, f.Len())
+	for i := range values {
+		values[i] = f.At(i)
+	}
+	return values
+}
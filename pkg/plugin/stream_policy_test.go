@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func frameWithRow(name string, value int64) *data.Frame {
+	return data.NewFrame("result", data.NewField(name, nil, []*int64{&value}))
+}
+
+func TestStreamBufferWithoutPolicySendsEveryMessage(t *testing.T) {
+	b := streamBuffer{}
+	b.add(frameWithRow("i1", 1))
+	b.add(frameWithRow("i1", 2))
+
+	frames := b.flush()
+	AssertEqual(t, 2, len(frames), "number of frames")
+	AssertEqual(t, true, frames[0].Meta == nil, "no stats without policy")
+	AssertEqual(t, 0, len(b.flush()), "number of frames after flush")
+}
+
+func TestStreamBufferCoalesce(t *testing.T) {
+	b := streamBuffer{policy: streamOutputPolicy{coalesce: true}}
+	b.add(frameWithRow("i1", 1))
+	b.add(frameWithRow("i2", 2))
+	b.add(frameWithRow("i1", 3))
+
+	frames := b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, 3, frames[0].Rows(), "rows")
+	AssertEqual(t, 2, len(frames[0].Fields), "fields")
+	AssertEqual(t, int64(3), *frames[0].Fields[0].At(2).(*int64), "i1 of row 3")
+	AssertEqual(t, true, frames[0].Fields[1].At(0).(*int64) == nil, "i2 of row 1")
+	AssertEqual(t, int64(2), b.stats.coalesced, "coalesced messages")
+	AssertEqual(t, "Messages coalesced", frames[0].Meta.Stats[2].DisplayName, "stats name")
+	AssertEqual(t, float64(2), frames[0].Meta.Stats[2].Value, "stats value")
+}
+
+func TestStreamBufferCoalesceWidensFieldTypes(t *testing.T) {
+	b := streamBuffer{policy: streamOutputPolicy{coalesce: true}}
+	b.add(frameWithRow("v", 1))
+	f := 1.5
+	b.add(data.NewFrame("result", data.NewField("v", nil, []*float64{&f})))
+
+	frames := b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, data.FieldTypeNullableFloat64, frames[0].Fields[0].Type(), "type")
+	AssertEqual(t, 1.0, *frames[0].Fields[0].At(0).(*float64), "v of row 1")
+	AssertEqual(t, 1.5, *frames[0].Fields[0].At(1).(*float64), "v of row 2")
+
+	b.add(frameWithRow("v", 1))
+	b.add(frameWithRow("w", 2))
+	s := "n/a"
+	b.add(data.NewFrame("result", data.NewField("v", nil, []*string{&s})))
+
+	frames = b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, data.FieldTypeNullableString, frames[0].Fields[0].Type(), "type")
+	AssertEqual(t, 3, frames[0].Rows(), "rows")
+	AssertEqual(t, "1", *frames[0].Fields[0].At(0).(*string), "v of row 1")
+	AssertEqual(t, true, frames[0].Fields[0].At(1).(*string) == nil, "v of row 2")
+	AssertEqual(t, "n/a", *frames[0].Fields[0].At(2).(*string), "v of row 3")
+}
+
+func TestStreamBufferRateLimitKeepsLatestMessage(t *testing.T) {
+	b := streamBuffer{policy: streamOutputPolicy{maxFps: 1}}
+	b.add(frameWithRow("i1", 1))
+	b.add(frameWithRow("i1", 2))
+
+	frames := b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, int64(2), *frames[0].Fields[0].At(0).(*int64), "latest value")
+	AssertEqual(t, int64(1), b.stats.dropped, "dropped messages")
+}
+
+func TestStreamBufferEveryNthSampling(t *testing.T) {
+	b := streamBuffer{policy: streamOutputPolicy{coalesce: true, sampling: StreamSamplingEveryNth, sampleSize: 3}}
+	for i := int64(1); i <= 7; i++ {
+		b.add(frameWithRow("i1", i))
+	}
+
+	frames := b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, 2, frames[0].Rows(), "rows")
+	AssertEqual(t, int64(3), *frames[0].Fields[0].At(0).(*int64), "1st sampled value")
+	AssertEqual(t, int64(6), *frames[0].Fields[0].At(1).(*int64), "2nd sampled value")
+	AssertEqual(t, int64(5), b.stats.sampledOut, "sampled out messages")
+}
+
+func TestStreamBufferReservoirSampling(t *testing.T) {
+	b := streamBuffer{policy: streamOutputPolicy{maxFps: 1, coalesce: true, sampling: StreamSamplingReservoir, sampleSize: 4}}
+	for i := int64(1); i <= 100; i++ {
+		b.add(frameWithRow("i1", i))
+	}
+
+	frames := b.flush()
+	AssertEqual(t, 1, len(frames), "number of frames")
+	AssertEqual(t, 4, frames[0].Rows(), "rows")
+	for i := 1; i < 4; i++ {
+		// the original message order is kept
+		if *frames[0].Fields[0].At(i - 1).(*int64) >= *frames[0].Fields[0].At(i).(*int64) {
+			t.Fatalf("sampled messages are not in order")
+		}
+	}
+	AssertEqual(t, int64(96), b.stats.sampledOut, "sampled out messages")
+}
+
+func TestStreamOutputPolicyValidation(t *testing.T) {
+	_, err := newStreamOutputPolicy(queryModel{StreamSampling: "UNKNOWN"})
+	AssertEqual(t, true, err != nil, "unknown sampling is an error")
+	_, err = newStreamOutputPolicy(queryModel{StreamSampling: StreamSamplingEveryNth})
+	AssertEqual(t, true, err != nil, "missing sample size is an error")
+	_, err = newStreamOutputPolicy(queryModel{StreamSampling: StreamSamplingReservoir, StreamSampleSize: 3})
+	AssertEqual(t, true, err != nil, "reservoir without max fps is an error")
+	_, err = newStreamOutputPolicy(queryModel{StreamSampling: StreamSamplingReservoir, StreamSampleSize: 3, StreamMaxFps: 2})
+	AssertNoError(t, err)
+}
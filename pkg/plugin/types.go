@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/sandstormmedia/nats/pkg/plugin/convert"
 )
 
 const AuthenticationNone = "NONE"
@@ -16,6 +18,42 @@ type MyDataSourceOptions struct {
 	Authentication string `json:"authentication"`
 	Nkey           string `json:"nkey"`
 	Username       string `json:"username"`
+
+	// defaults for the resource limits of scripts, which can be overridden per query. See goja.Limits.
+	ScriptTimeout    Duration `json:"scriptTimeout"`
+	ScriptMaxNatsOps int      `json:"scriptMaxNatsOps"`
+	// WasmMaxMemoryMb limits the memory of WebAssembly transforms; JavaScript memory is not limited.
+	WasmMaxMemoryMb int `json:"wasmMaxMemoryMb"`
+	// ScriptServerLog is the level at which script logs are written to the Grafana server log, see goja.ServerLogLevel.
+	ScriptServerLog string `json:"scriptServerLog"`
+
+	// permissions of scripts on the NATS connection; only configurable per data source. See goja.Permissions.
+	// The subject patterns are separated by commas or whitespace.
+	ScriptReadOnly       bool   `json:"scriptReadOnly"`
+	ScriptPublishAllow   string `json:"scriptPublishAllow"`
+	ScriptPublishDeny    string `json:"scriptPublishDeny"`
+	ScriptRequestAllow   string `json:"scriptRequestAllow"`
+	ScriptRequestDeny    string `json:"scriptRequestDeny"`
+	ScriptSubscribeAllow string `json:"scriptSubscribeAllow"`
+	ScriptSubscribeDeny  string `json:"scriptSubscribeDeny"`
+
+	// ScriptModules is the script library: modules which all scripts of the data source can require(name).
+	ScriptModules []ScriptModule `json:"scriptModules"`
+	// WasmModules are WebAssembly modules, which queries can use to convert messages instead of a script.
+	WasmModules []WasmModule `json:"wasmModules"`
+}
+
+// ScriptModule is a named JS module of the script library, see goja.Modules.
+type ScriptModule struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// WasmModule is a named WebAssembly module, see convert.WasmTransform.
+type WasmModule struct {
+	Name string `json:"name"`
+	// Wasm is the binary module, base64-encoded.
+	Wasm string `json:"wasm"`
 }
 
 type MySecureJsonData struct {
@@ -27,14 +65,40 @@ type MySecureJsonData struct {
 const QueryTypeRequestReply = "REQUEST_REPLY"
 const QueryTypeSubscribe = "SUBSCRIBE"
 const QueryTypeScript = "SCRIPT"
+const QueryTypeStreamingScript = "STREAMING_SCRIPT"
+
+const StreamSamplingNone = ""
+const StreamSamplingEveryNth = "EVERY_NTH"
+const StreamSamplingReservoir = "RESERVOIR"
 
 type queryModel struct {
-	QueryType                   string   `json:"queryType"`
-	NatsSubject                 string   `json:"natsSubject"`
-	RequestTimeout              Duration `json:"requestTimeout"`
-	RequestData                 string   `json:"requestData"`
-	JsFn                        string   `json:"jsFn"`
-	StreamRequestUuidForTesting string   `json:"testing_streamRequestUuid"` // for deterministic tests only
+	QueryType                   string                     `json:"queryType"`
+	NatsSubject                 string                     `json:"natsSubject"`
+	RequestTimeout              Duration                   `json:"requestTimeout"`
+	RequestData                 string                     `json:"requestData"`
+	JsFn                        string                     `json:"jsFn"`
+	ScriptLanguage              string                     `json:"scriptLanguage"`            // "javascript" (default) or "typescript"; applies to all scripts of the query.
+	WasmModule                  string                     `json:"wasmModule"`                // REQUEST_REPLY and SUBSCRIBE only: name of the data source's WebAssembly module converting the messages instead of jsFn.
+	ArrayMode                   string                     `json:"arrayMode"`                 // how arrays nested in the results are converted: "json" (default), "explode" or "index", see framestruct.ArrayMode.
+	UseExpressions              bool                       `json:"useExpressions"`            // REQUEST_REPLY and SUBSCRIBE only: convert the messages by filterExpression and columnExpressions (CEL) instead of jsFn.
+	FilterExpression            string                     `json:"filterExpression"`          // with useExpressions: messages for which it is false are discarded.
+	ColumnExpressions           []convert.ExpressionColumn `json:"columnExpressions"`         // with useExpressions: the fields of the resulting frame; the payload as it is if empty.
+	UseMapping                  bool                       `json:"useMapping"`                // REQUEST_REPLY and SUBSCRIBE only: convert the messages by mappingRows and mappingColumns (JMESPath) instead of jsFn.
+	MappingRows                 string                     `json:"mappingRows"`               // with useMapping: selects the rows from the payload, see convert.Mapping.
+	MappingColumns              []convert.MappingColumn    `json:"mappingColumns"`            // with useMapping: the fields of the resulting frame; the rows as they are if empty.
+	FirstMessageTimeout         Duration                   `json:"firstMessageTimeout"`       // SUBSCRIBE only: how long to wait for the 1st message. 0 = return immediately.
+	StreamMaxFps                float64                    `json:"streamMaxFps"`              // SUBSCRIBE only: max. frames per second sent to the UI. 0 = unlimited.
+	StreamCoalesce              bool                       `json:"streamCoalesce"`            // SUBSCRIBE only: merge messages since the last frame into one multi-row frame.
+	StreamSampling              string                     `json:"streamSampling"`            // SUBSCRIBE only: one of the StreamSampling* constants.
+	StreamSampleSize            int                        `json:"streamSampleSize"`          // SUBSCRIBE only: N for EVERY_NTH, reservoir size for RESERVOIR sampling.
+	Stateful                    bool                       `json:"stateful"`                  // SUBSCRIBE only: keep a `state` object across messages, see goja.StatefulConverter.
+	JsInitFn                    string                     `json:"jsInitFn"`                  // SUBSCRIBE only: runs once when a stateful stream starts.
+	JsTeardownFn                string                     `json:"jsTeardownFn"`              // SUBSCRIBE only: runs once when a stateful stream ends.
+	ScriptTimeout               Duration                   `json:"scriptTimeout"`             // can only lower the data source limit; for long-running scripts, per message/callback.
+	ScriptMaxNatsOps            int                        `json:"scriptMaxNatsOps"`          // can only lower the data source limit.
+	WasmMaxMemoryMb             int                        `json:"wasmMaxMemoryMb"`           // can only lower the data source limit.
+	Variables                   map[string]string          `json:"variables"`                 // template variables, interpolated by the frontend; exposed to scripts as query.variables.
+	StreamRequestUuidForTesting string                     `json:"testing_streamRequestUuid"` // for deterministic tests only
 }
 
 type Duration struct {
@@ -53,6 +117,11 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	case float64:
 		d.Duration = time.Duration(value)
 	case string:
+		if value == "" {
+			// an emptied input field in the query editor
+			d.Duration = 0
+			return nil
+		}
 		d.Duration, err = time.ParseDuration(value)
 		if err != nil {
 			return err
@@ -4,8 +4,8 @@ import {
   DataSourcePluginOptionsEditorProps,
   onUpdateDatasourceSecureJsonDataOption, onUpdateDatasourceJsonDataOptionSelect
 } from '@grafana/data';
-import {Select, InlineField, Input, TextArea, FieldSet} from '@grafana/ui';
-import {AuthenticationOptions, MyDataSourceOptions, MySecureJsonData} from '../types';
+import {Select, InlineField, InlineSwitch, Input, TextArea, FieldSet, Button, HorizontalGroup} from '@grafana/ui';
+import {AuthenticationOptions, MyDataSourceOptions, MySecureJsonData, ScriptModule, ScriptServerLogOptions, WasmModule} from '../types';
 
 // https://github.com/grafana/grafana/tree/main/packages/grafana-ui/src/components
 
@@ -14,12 +14,81 @@ interface Props extends DataSourcePluginOptionsEditorProps<MyDataSourceOptions,
 interface State {}
 
 export class ConfigEditor extends PureComponent<Props, State> {
+  onUpdateNumber = (key: keyof MyDataSourceOptions) => (event: React.SyntheticEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const value = parseInt(event.currentTarget.value, 10);
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: isNaN(value) ? undefined : value,
+      },
+    });
+  };
+
+  onUpdateBool = (key: keyof MyDataSourceOptions) => (event: React.SyntheticEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: event.currentTarget.checked,
+      },
+    });
+  };
+
+  // the modules of the script library are validated by the health check, when the data source is saved.
+  onUpdateModules = (modules: ScriptModule[]) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        scriptModules: modules,
+      },
+    });
+  };
+
+  onUpdateModule = (index: number, key: keyof ScriptModule) => (event: React.SyntheticEvent<HTMLInputElement | HTMLTextAreaElement>) => {
+    const modules = [...(this.props.options.jsonData.scriptModules || [])];
+    modules[index] = {...modules[index], [key]: event.currentTarget.value};
+    this.onUpdateModules(modules);
+  };
+
+  onUpdateWasmModules = (modules: WasmModule[]) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        wasmModules: modules,
+      },
+    });
+  };
+
+  // reads the selected .wasm file as base64.
+  onUploadWasm = (index: number) => (event: React.ChangeEvent<HTMLInputElement>) => {
+    const file = event.currentTarget.files?.[0];
+    if (!file) {
+      return;
+    }
+    const reader = new FileReader();
+    reader.onload = () => {
+      const dataUrl = reader.result as string;
+      const modules = [...(this.props.options.jsonData.wasmModules || [])];
+      modules[index] = {...modules[index], wasm: dataUrl.substring(dataUrl.indexOf(',') + 1)};
+      this.onUpdateWasmModules(modules);
+    };
+    reader.readAsDataURL(file);
+  };
+
   render() {
     const { options } = this.props;
     const { jsonData } = options;
     const secureJsonData = (options.secureJsonData || ({} as MySecureJsonData));
 
     return (
+      <>
       <FieldSet>
         <InlineField label="NATS Server URL" tooltip="demo.nats.io:4222 or tls://demo.nats.io:4222">
           <Input
@@ -90,7 +159,145 @@ export class ConfigEditor extends PureComponent<Props, State> {
                 </InlineField>
             </>
             : null}
+
+        <InlineField label="Script Timeout" tooltip="Time limit for each script run (f.e. 10s); can be lowered per query. Default: 30s">
+          <Input
+              className="width-10"
+              value={jsonData.scriptTimeout}
+              placeholder="30s"
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptTimeout')}
+          />
+        </InlineField>
+        <InlineField label="Script Max. NATS Operations" tooltip="Limit of NATS calls (publish, request, subscribe, ...) per script run; can be lowered per query. Empty: unlimited">
+          <Input
+              className="width-10"
+              type="number"
+              value={jsonData.scriptMaxNatsOps}
+              onChange={this.onUpdateNumber('scriptMaxNatsOps')}
+          />
+        </InlineField>
+        <InlineField label="WebAssembly Max. Memory (MB)" tooltip="Limit of the memory of WebAssembly transforms; can be lowered per query. It does not apply to scripts: JavaScript memory is not limited. Empty: unlimited">
+          <Input
+              className="width-10"
+              type="number"
+              value={jsonData.wasmMaxMemoryMb}
+              onChange={this.onUpdateNumber('wasmMaxMemoryMb')}
+          />
+        </InlineField>
+        <InlineField label="Script Server Log" tooltip="Whether log(...) and console.* output of scripts is also written to the Grafana server log. It is always shown as notices on the frame (panel inspector).">
+          <Select
+              width={20}
+              options={ScriptServerLogOptions}
+              value={jsonData.scriptServerLog || 'info'}
+              onChange={onUpdateDatasourceJsonDataOptionSelect(this.props, 'scriptServerLog')}
+          />
+        </InlineField>
+        <InlineField label="Script Read-Only" tooltip="Scripts cannot publish (neither NATS nor JetStream), and cannot modify KV and object store buckets. Requests and subscriptions are still allowed, except for requests to the JetStream API which are not read-only, and to KV and object store subjects.">
+          <InlineSwitch
+              value={jsonData.scriptReadOnly || false}
+              onChange={this.onUpdateBool('scriptReadOnly')}
+          />
+        </InlineField>
+        <InlineField label="Script Publish Allowed Subjects" tooltip="Subjects scripts may publish to, separated by commas; * and > wildcards are supported. Empty: all subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptPublishAllow}
+              placeholder="events.>, audit.*"
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptPublishAllow')}
+          />
+        </InlineField>
+        <InlineField label="Script Publish Denied Subjects" tooltip="Subjects scripts must not publish to, separated by commas; * and > wildcards are supported. Takes precedence over the allowed subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptPublishDeny}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptPublishDeny')}
+          />
+        </InlineField>
+        <InlineField label="Script Request Allowed Subjects" tooltip="Subjects scripts may send requests to, separated by commas; * and > wildcards are supported. Empty: all subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptRequestAllow}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptRequestAllow')}
+          />
+        </InlineField>
+        <InlineField label="Script Request Denied Subjects" tooltip="Subjects scripts must not send requests to, separated by commas; * and > wildcards are supported. Takes precedence over the allowed subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptRequestDeny}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptRequestDeny')}
+          />
+        </InlineField>
+        <InlineField label="Script Subscribe Allowed Subjects" tooltip="Subjects scripts may subscribe to, separated by commas; * and > wildcards are supported. Empty: all subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptSubscribeAllow}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptSubscribeAllow')}
+          />
+        </InlineField>
+        <InlineField label="Script Subscribe Denied Subjects" tooltip="Subjects scripts must not subscribe to, separated by commas; * and > wildcards are supported. Takes precedence over the allowed subjects.">
+          <Input
+              className="width-27"
+              value={jsonData.scriptSubscribeDeny}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'scriptSubscribeDeny')}
+          />
+        </InlineField>
+      </FieldSet>
+      <FieldSet label="Script Library">
+        {(jsonData.scriptModules || []).map((module, index) =>
+          <div key={index}>
+            <HorizontalGroup>
+              <InlineField label="Module Name" tooltip="Scripts load the module via require(name).">
+                <Input
+                    className="width-20"
+                    value={module.name}
+                    placeholder="helpers"
+                    onChange={this.onUpdateModule(index, 'name')}
+                />
+              </InlineField>
+              <Button variant="secondary" icon="trash-alt" aria-label="Remove module"
+                      onClick={() => this.onUpdateModules((jsonData.scriptModules || []).filter((_, i) => i !== index))}/>
+            </HorizontalGroup>
+            <TextArea
+                rows={8}
+                value={module.source}
+                placeholder={'exports.ping = function(subject) {\n  ...\n};'}
+                onChange={this.onUpdateModule(index, 'source')}
+            />
+          </div>
+        )}
+        <Button variant="secondary" icon="plus"
+                onClick={() => this.onUpdateModules([...(jsonData.scriptModules || []), {name: '', source: ''}])}>
+          Add Module
+        </Button>
+      </FieldSet>
+      <FieldSet label="WebAssembly Modules">
+        {(jsonData.wasmModules || []).map((module, index) =>
+          <HorizontalGroup key={index}>
+            <InlineField label="Module Name" tooltip="Request/Reply and Subscribe queries can convert messages with this module instead of a script.">
+              <Input
+                  className="width-20"
+                  value={module.name}
+                  placeholder="plc-decoder"
+                  onChange={(event) => {
+                    const modules = [...(jsonData.wasmModules || [])];
+                    modules[index] = {...module, name: event.currentTarget.value};
+                    this.onUpdateWasmModules(modules);
+                  }}
+              />
+            </InlineField>
+            <InlineField label=".wasm File" tooltip={module.wasm ? `${Math.round(module.wasm.length * 3 / 4 / 1024)} KB` : 'No module uploaded yet'}>
+              <input type="file" accept=".wasm,application/wasm" onChange={this.onUploadWasm(index)}/>
+            </InlineField>
+            <Button variant="secondary" icon="trash-alt" aria-label="Remove WebAssembly module"
+                    onClick={() => this.onUpdateWasmModules((jsonData.wasmModules || []).filter((_, i) => i !== index))}/>
+          </HorizontalGroup>
+        )}
+        <Button variant="secondary" icon="plus"
+                onClick={() => this.onUpdateWasmModules([...(jsonData.wasmModules || []), {name: '', wasm: ''}])}>
+          Add WebAssembly Module
+        </Button>
       </FieldSet>
+      </>
     );
   }
 }
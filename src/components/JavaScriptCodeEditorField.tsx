@@ -1,19 +1,30 @@
 import type * as monacoType from 'monaco-editor/esm/vs/editor/editor.api';
-import React, {useCallback, useRef} from 'react';
+import React, {useCallback, useEffect, useRef} from 'react';
 
 import {CodeEditor, Monaco} from '@grafana/ui';
+import {ScriptError, ScriptLanguage} from '../types';
 // inspired by https://github.com/grafana/grafana/blob/78184f37c444bd8c36437498bde365a6a81bb71d/public/app/plugins/datasource/cloudwatch/components/MathExpressionQueryField.tsx
 
 
 export interface Props {
     onChange: (query: string) => void;
     expression: string;
+    // errors of the script (f.e. from the preview), which are highlighted in the editor.
+    errors?: ScriptError[];
+    // the language of the script; JavaScript if not given.
+    language?: ScriptLanguage;
     //datasource: CloudWatchDatasource;
 }
 
+const markerOwner = 'nats-script';
+
 
 // extra libraries
 const libSource = `
+/**
+ * The NATS connection of the data source. It is shared by all queries, so Close(), Drain() and Flush() fail; and
+ * the data source may restrict the subjects scripts can publish, request and subscribe to.
+ */
 declare class Conn {
     /**
      * AuthRequired will return if the connected server requires authorization.
@@ -24,6 +35,19 @@ declare class Conn {
      * Request/Reply
      */
     Request(subj: string, data: string, timeout: string): Msg;
+
+    /**
+     * Like Request, but does not block: use await (Script only) or .then(), f.e. to run requests concurrently:
+     * const [a, b] = await Promise.all([nc.RequestAsync("a", "", "1s"), nc.RequestAsync("b", "", "1s")]);
+     */
+    RequestAsync(subj: string, data: string, timeout: string): Promise<Msg>;
+
+    RequestMsgAsync(msg: Msg, timeout: string): Promise<Msg>;
+
+    /**
+     * Sends all requests concurrently; failed requests (f.e. timeouts) result in null.
+     */
+    RequestAll(requests: Array<{ subject: string; data: string }>, timeout: string): Promise<Array<Msg | null>>;
     
     /**
      * Publish publishes the data argument to the given subject. The data argument is left untouched and needs to be correctly interpreted on the receiver. 
@@ -40,6 +64,8 @@ declare class Conn {
      */
     PublishRequest(subj: string, reply: string, data: string);
 
+    Subscribe(subj: string, cb: (msg: Msg) => void): Subscription;
+
     
     SubscribeSync(subj: string): Subscription;
     
@@ -47,6 +73,227 @@ declare class Conn {
 }
 
 declare var nc: Conn;
+
+/** options of all JetStream calls */
+declare type JetStreamOptions = {
+    /** f.e. "1s"; default 5s */
+    timeout?: string;
+    /** GetMsg and GetLastMsg only: use direct get, so that any replica can serve the message */
+    direct?: boolean;
+};
+
+/** a message stored in a stream */
+declare type StreamMsg = { Subject: string; Sequence: number; Header: Record<string, string[]>; Data: string; Time: number };
+
+/** a KV entry; Created is in Unix milliseconds */
+declare type KeyValueEntry = { Bucket: string; Key: string; Value: string; Revision: number; Created: number; Operation: string };
+
+/**
+ * JetStream: infos are returned as plain objects with the field names of the JetStream JSON API.
+ */
+declare namespace js {
+    function StreamNames(opts?: JetStreamOptions): string[];
+    function StreamInfo(stream: string, opts?: JetStreamOptions): any;
+    function ConsumerNames(stream: string, opts?: JetStreamOptions): string[];
+    function ConsumerInfo(stream: string, consumer: string, opts?: JetStreamOptions): any;
+    /** returns the PubAck, f.e. {stream: "ORDERS", seq: 1} */
+    function Publish(subj: string, data: BinaryData, opts?: JetStreamOptions): { stream: string; seq: number; duplicate?: boolean };
+    /** like Publish, but does not block the script */
+    function PublishAsync(subj: string, data: BinaryData, opts?: JetStreamOptions): Promise<{ stream: string; seq: number; duplicate?: boolean }>;
+    /** null if the message does not exist */
+    function GetMsg(stream: string, seq: number, opts?: JetStreamOptions): StreamMsg | null;
+    /** null if the message does not exist */
+    function GetLastMsg(stream: string, subject: string, opts?: JetStreamOptions): StreamMsg | null;
+    /**
+     * Pulls up to batch messages from an existing durable pull consumer; fewer (or none) if no more messages arrive within the timeout.
+     * The messages must be acknowledged via msg.Ack().
+     */
+    function Fetch(stream: string, consumer: string, batch: number, opts?: JetStreamOptions): Msg[];
+    /** like Fetch, but does not block the script */
+    function FetchAsync(stream: string, consumer: string, batch: number, opts?: JetStreamOptions): Promise<Msg[]>;
+    function KeyValue(bucket: string, opts?: JetStreamOptions): KeyValueBucket;
+    function ObjectStore(bucket: string, opts?: JetStreamOptions): ObjectStoreBucket;
+}
+
+declare class KeyValueBucket {
+    /** null if the key does not exist */
+    Get(key: string, opts?: JetStreamOptions): KeyValueEntry | null;
+    /** like Get, but does not block the script */
+    GetAsync(key: string, opts?: JetStreamOptions): Promise<KeyValueEntry | null>;
+    /** returns the new revision */
+    Put(key: string, value: BinaryData, opts?: JetStreamOptions): number;
+    /** only if the key does not exist yet; returns the new revision */
+    Create(key: string, value: BinaryData, opts?: JetStreamOptions): number;
+    Delete(key: string, opts?: JetStreamOptions): void;
+    Keys(opts?: JetStreamOptions): string[];
+    History(key: string, opts?: JetStreamOptions): KeyValueEntry[];
+}
+
+declare class ObjectStoreBucket {
+    /** the content as string; null if the object does not exist */
+    Get(name: string, opts?: JetStreamOptions): string | null;
+    /** the content as binary data; null if the object does not exist */
+    GetRaw(name: string, opts?: JetStreamOptions): ArrayBuffer | null;
+    /** the ObjectInfo; null if the object does not exist */
+    GetInfo(name: string, opts?: JetStreamOptions): any;
+    /** returns the ObjectInfo */
+    Put(name: string, data: BinaryData, opts?: JetStreamOptions): any;
+    Delete(name: string, opts?: JetStreamOptions): void;
+    List(opts?: JetStreamOptions): any[];
+}
+
+/**
+ * Request/Reply and Script only: return multiple named frames, f.e.
+ * return frames({servers: [...], routes: [...]});
+ */
+declare function frames(named: Record<string, object | object[]>): object;
+
+/**
+ * Config of frame(rows, config); uses the JSON names of Grafana's field config and frame meta.
+ */
+interface FrameConfig {
+    /** name of the frame */
+    name?: string;
+    /** field config per field name, f.e. {temperature: {unit: "celsius", decimals: 1}} */
+    fields?: Record<string, {
+        displayName?: string;
+        displayNameFromDS?: string;
+        description?: string;
+        unit?: string;
+        decimals?: number;
+        min?: number | null;
+        max?: number | null;
+        thresholds?: { mode: 'absolute' | 'percentage'; steps: Array<{ value: number | null; color: string }> };
+        mappings?: any[];
+        color?: any;
+        links?: any[];
+        noValue?: string;
+        custom?: Record<string, any>;
+        [key: string]: any;
+    }>;
+    /** frame meta, f.e. {preferredVisualisationType: "table", executedQueryString: "..."} */
+    meta?: {
+        preferredVisualisationType?: 'graph' | 'table' | 'logs' | 'trace' | 'nodeGraph' | 'flamegraph' | 'rawPrometheus';
+        executedQueryString?: string;
+        custom?: any;
+        [key: string]: any;
+    };
+}
+
+/**
+ * Sets field config and frame meta on the frame of the given rows, f.e.
+ * return frame(rows, {fields: {temperature: {unit: "celsius"}}});
+ */
+declare function frame(rows: object | object[], config?: FrameConfig): object;
+
+/**
+ * Loads a module of the script library of the data source (configured in the data source settings), and returns
+ * its exports.
+ */
+declare function require(name: string): any;
+
+/**
+ * Streaming Script only: streams the given rows to the UI.
+ */
+declare function emit(rows: object | object[]): void;
+
+/**
+ * Logs the given values; they are shown as notices on the resulting frame (panel inspector). Objects are logged as JSON.
+ */
+declare function log(...values: any[]): void;
+
+/**
+ * Like log(); warn and error are shown as warning / error notices.
+ */
+declare namespace console {
+    function log(...values: any[]): void;
+    function info(...values: any[]): void;
+    function debug(...values: any[]): void;
+    function warn(...values: any[]): void;
+    function error(...values: any[]): void;
+}
+
+/**
+ * Stateful Subscribe only: kept across all messages of the stream.
+ */
+declare var state: any;
+
+/**
+ * The Grafana query the script runs for (read-only).
+ */
+declare const query: {
+    refId: string;
+    /** start of the dashboard time range, in Unix milliseconds */
+    from: number | null;
+    /** end of the dashboard time range, in Unix milliseconds */
+    to: number | null;
+    intervalMs: number;
+    maxDataPoints: number;
+    /** template variables of the dashboard, already interpolated */
+    variables: Record<string, string>;
+    /** the user who sent the query; null f.e. for alerting */
+    user: { login: string; name: string; email: string; role: string } | null;
+};
+
+/** binary data: strings are used as UTF-8 */
+declare type BinaryData = string | ArrayBuffer | Uint8Array;
+
+/**
+ * Standard library for message processing (Go-backed).
+ */
+declare namespace std {
+    namespace base64 {
+        function encode(data: BinaryData): string;
+        /** accepts standard and URL-safe base64, with or without padding */
+        function decode(str: string): ArrayBuffer;
+        function decodeString(str: string): string;
+    }
+    namespace hex {
+        function encode(data: BinaryData): string;
+        function decode(str: string): ArrayBuffer;
+    }
+    /** all hashes are returned hex-encoded */
+    namespace hash {
+        function md5(data: BinaryData): string;
+        function sha1(data: BinaryData): string;
+        function sha256(data: BinaryData): string;
+        function sha512(data: BinaryData): string;
+    }
+    function hmac(algorithm: 'md5' | 'sha1' | 'sha256' | 'sha512', key: BinaryData, data: BinaryData): string;
+    /**
+     * layout is a name (RFC3339, RFC3339Nano, RFC1123, RFC1123Z, RFC822, RFC822Z, Kitchen, DateTime, DateOnly,
+     * TimeOnly) or a Go layout like "2006-01-02 15:04"; zone is an IANA time zone like "Europe/Berlin".
+     */
+    namespace time {
+        /** returns Unix milliseconds */
+        function parse(value: string, layout?: string, zone?: string): number;
+        function format(unixMillis: number, layout?: string, zone?: string): string;
+    }
+    namespace url {
+        function parse(str: string): {
+            scheme: string;
+            username: string;
+            host: string;
+            hostname: string;
+            port: string;
+            path: string;
+            query: Record<string, string[]>;
+            fragment: string;
+        };
+        function parseQuery(str: string): Record<string, string[]>;
+        function encodeQuery(params: Record<string, string | number | boolean | Array<string | number | boolean>>): string;
+    }
+    namespace gzip {
+        function compress(data: BinaryData): ArrayBuffer;
+        /** at most 64 MB */
+        function decompress(data: BinaryData): ArrayBuffer;
+    }
+    namespace text {
+        function decode(data: BinaryData, encoding?: 'utf-8' | 'latin1' | 'iso-8859-1' | 'ascii' | 'utf-16le' | 'utf-16be'): string;
+        function encode(str: string): ArrayBuffer;
+    }
+}
+
 declare namespace nats {
     function NewMsg(subject: string): Msg;
 }
@@ -59,6 +306,14 @@ declare class Msg {
      * The message payload
      */
     Data: string;
+    /**
+     * Acknowledges a JetStream message (see js.Fetch)
+     */
+    Ack(): void;
+    /**
+     * The message payload as binary data, f.e. for std.gzip.decompress(msg.RawData)
+     */
+    readonly RawData: ArrayBuffer;
 }
 
 declare type Header = {
@@ -85,10 +340,39 @@ const libUri = 'ts:filename/facts.d.ts';
     title: '',
 };*/
 
-export function JavaScriptCodeEditorField({expression: expression, onChange}: React.PropsWithChildren<Props>) {
+export function JavaScriptCodeEditorField({expression: expression, onChange, errors, language}: React.PropsWithChildren<Props>) {
     const containerRef = useRef<HTMLDivElement>(null);
+    const editorRef = useRef<{ editor: monacoType.editor.IStandaloneCodeEditor, monaco: Monaco }>();
+
+    // highlight the errors with a position; they are cleared once the script is changed.
+    const updateMarkers = useCallback(() => {
+        const model = editorRef.current?.editor.getModel();
+        if (!editorRef.current || !model) {
+            return;
+        }
+        const monaco = editorRef.current.monaco;
+        monaco.editor.setModelMarkers(model, markerOwner, (errors || []).filter((error) => error.line > 0).map((error) => ({
+            severity: monaco.MarkerSeverity.Error,
+            message: error.message,
+            startLineNumber: error.line,
+            startColumn: error.column,
+            endLineNumber: error.line,
+            endColumn: model.getLineMaxColumn(Math.min(error.line, model.getLineCount())),
+        })));
+    }, [errors]);
+    useEffect(updateMarkers, [updateMarkers]);
+
     const onEditorMount = useCallback(
         (editor: monacoType.editor.IStandaloneCodeEditor, monaco: Monaco) => {
+            editorRef.current = {editor, monaco};
+            updateMarkers();
+            editor.onDidChangeModelContent(() => {
+                const model = editor.getModel();
+                if (model) {
+                    monaco.editor.setModelMarkers(model, markerOwner, []);
+                }
+            });
+
             //editor.onDidFocusEditorText(() => editor.trigger(TRIGGER_SUGGEST.id, TRIGGER_SUGGEST.id, {}));
             editor.addCommand(monaco.KeyMod.Shift | monaco.KeyCode.Enter, () => {
                 const text = editor.getValue();
@@ -112,7 +396,7 @@ export function JavaScriptCodeEditorField({expression: expression, onChange}: Re
             editor.onDidContentSizeChange(updateElementHeight);
             updateElementHeight();
         },
-        [onChange]
+        [onChange, updateMarkers]
     );
 
     return (
@@ -137,7 +421,7 @@ export function JavaScriptCodeEditorField({expression: expression, onChange}: Re
                     },
                 }}
 
-                language="javascript"
+                language={language === 'typescript' ? 'typescript' : 'javascript'}
                 value={expression}
                 onBlur={(value) => {
                     if (value !== expression) {
@@ -145,7 +429,9 @@ export function JavaScriptCodeEditorField({expression: expression, onChange}: Re
                     }
                 }}
                 onBeforeEditorMount={(monaco: Monaco) => {
+                    // the typings are the same for JavaScript and TypeScript scripts.
                     monaco.languages.typescript.javascriptDefaults.addExtraLib(libSource, libUri);
+                    monaco.languages.typescript.typescriptDefaults.addExtraLib(libSource, libUri);
                     // When resolving definitions and references, the editor will try to use created models.
                     // Creating a model for the library allows "peek definition/references" commands to work with the library.
                     const parsedLibUri = monaco.Uri.parse(libUri)
@@ -159,6 +445,12 @@ export function JavaScriptCodeEditorField({expression: expression, onChange}: Re
                         noSyntaxValidation: false,
                         diagnosticCodesToIgnore: [/* top-level return */ 1108]
                     });
+                    monaco.languages.typescript.typescriptDefaults.setDiagnosticsOptions({
+                        noSemanticValidation: false,
+                        noSyntaxValidation: false,
+                        // scripts are wrapped in an (async) function by the backend.
+                        diagnosticCodesToIgnore: [/* top-level return */ 1108, /* top-level await */ 1375, 1378]
+                    });
 
                 }}
 
@@ -1,11 +1,29 @@
 import React, {PureComponent} from 'react';
-import {Alert, ButtonCascader, CascaderOption, Field, FieldSet, Input, RadioButtonGroup} from '@grafana/ui';
+import {Alert, Button, ButtonCascader, CascaderOption, Field, FieldSet, HorizontalGroup, Input, RadioButtonGroup, Select, Switch} from '@grafana/ui';
 import {
     QueryEditorProps
 } from '@grafana/data';
 import {DataSource} from '../datasource';
-import {MyDataSourceOptions, MyQuery, QueryTypeOptions, QueryTypes} from '../types';
+import {
+    ArrayMode,
+    ArrayModeOptions,
+    ExpressionColumn,
+    MappingColumn,
+    MappingType,
+    MappingTypeOptions,
+    MyDataSourceOptions,
+    MyQuery,
+    QueryTypeOptions,
+    QueryTypes,
+    ScriptField,
+    ScriptFieldError,
+    ScriptLanguage,
+    ScriptLanguageOptions,
+    StreamSampling,
+    StreamSamplingOptions
+} from '../types';
 import {JavaScriptCodeEditorField} from "./JavaScriptCodeEditorField";
+import {ScriptPreview} from "./ScriptPreview";
 
 type Props = QueryEditorProps<DataSource, MyQuery, MyDataSourceOptions>;
 
@@ -16,6 +34,21 @@ function onChange(props: Props, fieldName: string) {
     }
 }
 
+function onChangeNumber(props: Props, fieldName: string) {
+    return (event: React.SyntheticEvent<HTMLInputElement>) => {
+        const value = parseFloat(event.currentTarget.value);
+        props.onChange({...props.query, [fieldName]: isNaN(value) ? undefined : value});
+        props.onRunQuery();
+    }
+}
+
+function onChangeBool(props: Props, fieldName: string) {
+    return (event: React.SyntheticEvent<HTMLInputElement>) => {
+        props.onChange({...props.query, [fieldName]: event.currentTarget.checked});
+        props.onRunQuery();
+    }
+}
+
 function onChangeJs(props: Props, fieldName: string) {
     return (value: string) => {
         props.onChange({...props.query, [fieldName]: value});
@@ -31,7 +64,7 @@ function onQueryTypeChange<TVal>(props: Props, fieldName: string) {
     }
 }
 
-type SCRIPT_IDS = "default" | "headers" | "scripting_multipleRequests" | "scripting_multipleResponses";
+type SCRIPT_IDS = "default" | "headers" | "scripting_multipleRequests" | "scripting_multipleResponses" | "scripting_multipleFrames" | "streaming_correlation";
 
 const scripts: {  [prop in SCRIPT_IDS]: string} = {
     default: `
@@ -87,6 +120,33 @@ const scripts: {  [prop in SCRIPT_IDS]: string} = {
           delete parsed.statsz.routes;
           result.push(parsed);
     }
+    `,
+    scripting_multipleFrames: `
+        // frames() returns multiple named frames, which can f.e. be used in different
+        // panel transformations.
+        const varz = JSON.parse(nc.Request("$SYS.REQ.SERVER.PING.VARZ", "", "50ms").Data);
+        const routez = JSON.parse(nc.Request("$SYS.REQ.SERVER.PING.ROUTEZ", "", "50ms").Data);
+        
+        return frames({
+            server: {name: varz.data.server_name, connections: varz.data.connections},
+            routes: routez.data.routes || [],
+        });
+    `,
+    streaming_correlation: `
+        // A streaming script keeps running as long as the panel is shown. Rows passed
+        // to emit() are streamed to the UI.
+        //
+        // Here, we correlate two subjects: every order is shown together with the
+        // latest known price of its product.
+        const prices = {};
+        nc.Subscribe("prices.*", (msg) => {
+            const price = JSON.parse(msg.Data);
+            prices[price.product] = price.value;
+        });
+        nc.Subscribe("orders", (msg) => {
+            const order = JSON.parse(msg.Data);
+            emit({...order, price: prices[order.product]});
+        });
     `
 };
 
@@ -114,7 +174,7 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
                 href="https://pkg.go.dev/github.com/nats-io/nats.go#Msg" target="_blank" rel="noreferrer">nats.Msg</a>.<br/>
                 Supported Return values: A map <code>{'{k: "v"}'}</code>, a list of maps <code>{'[{k: "v"}]'}</code>,
                 a <a href="https://pkg.go.dev/github.com/grafana/grafana-plugin-sdk-go@v0.147.0/data#Frame"
-                     target="_blank" rel="noreferrer">data.Frame</a>.
+                     target="_blank" rel="noreferrer">data.Frame</a>, or multiple frames via <code>{'frames({name: rows, ...})'}</code>.
             </>,
             mapFnExamples: [
                 {
@@ -150,7 +210,8 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
             mapFnLabel: 'Message Mapping JavaScript',
             mapFnDescription: <>
                 Input: <code>msg</code> contains the received message as a <a
-                href="https://pkg.go.dev/github.com/nats-io/nats.go#Msg" target="_blank" rel="noreferrer">nats.Msg</a>.<br/>
+                href="https://pkg.go.dev/github.com/nats-io/nats.go#Msg" target="_blank" rel="noreferrer">nats.Msg</a>;
+                in stateful mode, <code>state</code> is kept across messages.<br/>
                 Supported Return values: A map <code>{'{k: "v"}'}</code>.
             </>,
             mapFnExamples: [
@@ -180,7 +241,7 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
                 - to <em>collect/reduce multiple responses</em> into a single UI response,<br/>
                 - other advanced cases.<br/>
 
-                <p>The free-form script can return results directly or <em>stream them</em> to the UI. See the inline
+                <p>The free-form script returns its results directly; to <em>stream them</em> to the UI, use the Streaming Script mode. See the inline
                     script examples, they are heavily commented.</p>
 
                 <p>The API is basically like the Go API, but with errors transparently handled.</p>
@@ -194,8 +255,9 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
                     <a href="https://pkg.go.dev/github.com/nats-io/nats.go#Conn.Subscribe">nc.Subscribe()</a>,
                     <a href="https://pkg.go.dev/github.com/nats-io/nats.go#Conn.Request">nc.Request()</a><br/> (or any
                     other interaction).<br/>
-                    Supported Return values: <a href="https://pkg.go.dev/github.com/grafana/grafana-plugin-sdk-go@v0.147.0/data#Frame"
-                    target="_blank" rel="noreferrer">data.Frame</a> or an error.
+                    Supported Return values: A map <code>{'{k: "v"}'}</code>, a list of maps <code>{'[{k: "v"}]'}</code>,
+                    a <a href="https://pkg.go.dev/github.com/grafana/grafana-plugin-sdk-go@v0.147.0/data#Frame"
+                    target="_blank" rel="noreferrer">data.Frame</a>, or multiple frames via <code>{'frames({name: rows, ...})'}</code>.
                 </>,
             mapFnExamples: [
                 {
@@ -208,12 +270,47 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
                     title: 'a request which triggers multiple responses',
                     value: "scripting_multipleResponses" as "scripting_multipleResponses"
 
+                },
+                {
+                    label: 'multiple frames',
+                    title: 'return multiple named frames',
+                    value: "scripting_multipleFrames" as "scripting_multipleFrames"
                 }
             ]
 
         };
     }
 
+    if (queryType === "STREAMING_SCRIPT") {
+        return {
+            title: 'Streaming Script mode explained',
+            content: <>
+                <p>A free-form script which <em>keeps running</em> as long as the panel is shown: Subscriptions created
+                    by the script stay active, and every call to <code>emit(rows)</code> streams the given rows via
+                    <a href="https://grafana.com/docs/grafana/latest/setup-grafana/set-up-grafana-live/"
+                       target="_blank" rel="noreferrer">Grafana Live</a> to the panel.</p>
+
+                <p>This way, you can correlate messages of multiple subjects, or keep state across messages.
+                    All subscriptions are ended when the panel is closed.</p>
+            </>,
+            mapFnLabel: 'JavaScript to set up subscriptions and emit rows',
+            mapFnDescription:
+                <>
+                    Input: <code>nc</code> the <a
+                    href="https://pkg.go.dev/github.com/nats-io/nats.go#Conn" target="_blank" rel="noreferrer">nats.Conn</a>,
+                    <code>emit(rows)</code> to stream a map <code>{'{k: "v"}'}</code> or a list of maps to the UI.<br/>
+                    Supported Return values (optional, shown initially): A map <code>{'{k: "v"}'}</code>, a list of maps <code>{'[{k: "v"}]'}</code>.
+                </>,
+            mapFnExamples: [
+                {
+                    label: 'correlate subjects',
+                    title: 'combine messages of two subjects',
+                    value: "streaming_correlation" as "streaming_correlation"
+                }
+            ]
+        };
+    }
+
     return {
         title: '',
         content: <>
@@ -228,7 +325,49 @@ function explanationForQueryType(queryType: QueryTypes): { title: string, conten
     };
 }
 
-export class QueryEditor extends PureComponent<Props> {
+interface State {
+    // errors of the last script check or preview, see ScriptPreview.
+    scriptErrors: ScriptFieldError[];
+}
+
+export class QueryEditor extends PureComponent<Props, State> {
+    state: State = {scriptErrors: []};
+
+    errorsOf(field: ScriptField) {
+        return this.state.scriptErrors.filter((error) => error.field === field);
+    }
+
+    // the message of the first error of the given field, for Field's error.
+    errorMessageOf(field: ScriptField) {
+        return this.errorsOf(field)[0]?.message;
+    }
+
+    onChangeColumnExpressions(columns: ExpressionColumn[]) {
+        this.props.onChange({...this.props.query, columnExpressions: columns});
+        this.props.onRunQuery();
+    }
+
+    onChangeMappingColumns(columns: MappingColumn[]) {
+        this.props.onChange({...this.props.query, mappingColumns: columns});
+        this.props.onRunQuery();
+    }
+
+    onChangeMappingColumn(index: number, key: keyof MappingColumn) {
+        return (value: string | undefined) => {
+            const columns = [...(this.props.query.mappingColumns || [])];
+            columns[index] = {...columns[index], [key]: value};
+            this.onChangeMappingColumns(columns);
+        };
+    }
+
+    onChangeColumnExpression(index: number, key: keyof ExpressionColumn) {
+        return (event: React.SyntheticEvent<HTMLInputElement>) => {
+            const columns = [...(this.props.query.columnExpressions || [])];
+            columns[index] = {...columns[index], [key]: event.currentTarget.value};
+            this.onChangeColumnExpressions(columns);
+        };
+    }
+
     render() {
         const query = this.props.query;
 
@@ -262,17 +401,275 @@ export class QueryEditor extends PureComponent<Props> {
                         onChange={onChange(this.props, 'requestTimeout')}
                     />
                 </Field>
+                {query.queryType === "SUBSCRIBE" ?
+                    <Field label="First Message Timeout"
+                           description="How long to wait for the first message before showing the panel (f.e. 2s). Empty: do not wait, all messages are streamed.">
+                        <Input
+                            className="width-4"
+                            value={query.firstMessageTimeout}
+                            onChange={onChange(this.props, 'firstMessageTimeout')}
+                        />
+                    </Field>
+                    : undefined}
+                {query.queryType === "SUBSCRIBE" || query.queryType === "STREAMING_SCRIPT" ?
+                    <>
+                        <Field label="Max Frames per Second"
+                               description="Limit how often the panel is updated for busy subjects. Empty: update on every message.">
+                            <Input
+                                className="width-4"
+                                type="number"
+                                value={query.streamMaxFps}
+                                onChange={onChangeNumber(this.props, 'streamMaxFps')}
+                            />
+                        </Field>
+                        <Field label="Coalesce Messages"
+                               description="Merge all messages since the last update into one multi-row frame, instead of only showing the latest one.">
+                            <Switch
+                                value={query.streamCoalesce}
+                                onChange={onChangeBool(this.props, 'streamCoalesce')}
+                            />
+                        </Field>
+                        <Field label="Sampling">
+                            <RadioButtonGroup<StreamSampling>
+                                options={StreamSamplingOptions}
+                                value={query.streamSampling || ""}
+                                onChange={onQueryTypeChange(this.props, 'streamSampling')}
+                            />
+                        </Field>
+                        {query.streamSampling ?
+                            <Field label="Sample Size" description="N for every Nth message; messages per frame for reservoir sampling.">
+                                <Input
+                                    className="width-4"
+                                    type="number"
+                                    value={query.streamSampleSize}
+                                    onChange={onChangeNumber(this.props, 'streamSampleSize')}
+                                />
+                            </Field>
+                            : undefined}
+                    </>
+                    : undefined}
+                {(query.queryType === "REQUEST_REPLY" || query.queryType === "SUBSCRIBE") && !query.stateful && this.props.datasource.instanceSettings.jsonData.wasmModules?.length ?
+                    <Field label="Transform"
+                           description="Convert the messages with a WebAssembly module of the data source, instead of the script below.">
+                        <Select<string>
+                            className="width-20"
+                            options={[
+                                {label: 'Script', value: ''},
+                                ...this.props.datasource.instanceSettings.jsonData.wasmModules.map((module) => ({label: module.name, value: module.name})),
+                            ]}
+                            value={query.wasmModule || ''}
+                            onChange={(selected) => onQueryTypeChange<string | undefined>(this.props, 'wasmModule')(selected.value || undefined)}
+                        />
+                    </Field>
+                    : undefined}
+                {(query.queryType === "REQUEST_REPLY" || query.queryType === "SUBSCRIBE") && !query.stateful && !query.wasmModule && !query.useMapping ?
+                    <Field label="Use Expressions"
+                           description="Filter and convert the messages with CEL expressions instead of the script below - a lot cheaper for busy subjects."
+                           invalid={this.errorsOf('useExpressions').length > 0}
+                           error={this.errorMessageOf('useExpressions')}>
+                        <Switch
+                            value={query.useExpressions}
+                            onChange={onChangeBool(this.props, 'useExpressions')}
+                        />
+                    </Field>
+                    : undefined}
+                {query.useExpressions ?
+                    <>
+                        <Field label="Filter"
+                               description={<>Messages are discarded if it is false, f.e. <code>data.temperature &gt; 20.0 &amp;&amp; subject.startsWith("plc.")</code>. Available: <code>data</code> (the JSON payload), <code>subject</code>, <code>headers</code>.</>}
+                               invalid={this.errorsOf('filterExpression').length > 0}
+                               error={this.errorMessageOf('filterExpression')}>
+                            <Input
+                                className="width-40"
+                                value={query.filterExpression}
+                                placeholder="true"
+                                onChange={onChange(this.props, 'filterExpression')}
+                            />
+                        </Field>
+                        <Field label="Columns"
+                               description="The fields of the frame, each computed by an expression. Empty: the payload as it is."
+                               invalid={this.errorsOf('columnExpressions').length > 0}
+                               error={this.errorMessageOf('columnExpressions')}>
+                            <>
+                                {(query.columnExpressions || []).map((column, index) =>
+                                    <HorizontalGroup key={index}>
+                                        <Input
+                                            className="width-12"
+                                            value={column.name}
+                                            placeholder="name"
+                                            onChange={this.onChangeColumnExpression(index, 'name')}
+                                        />
+                                        <Input
+                                            className="width-30"
+                                            value={column.expression}
+                                            placeholder="data.temperature * 1.8 + 32.0"
+                                            onChange={this.onChangeColumnExpression(index, 'expression')}
+                                        />
+                                        <Button variant="secondary" icon="trash-alt" aria-label="Remove column"
+                                                onClick={() => this.onChangeColumnExpressions((query.columnExpressions || []).filter((_, i) => i !== index))}/>
+                                    </HorizontalGroup>
+                                )}
+                                <Button variant="secondary" icon="plus"
+                                        onClick={() => this.onChangeColumnExpressions([...(query.columnExpressions || []), {name: '', expression: ''}])}>
+                                    Add Column
+                                </Button>
+                            </>
+                        </Field>
+                    </>
+                    : undefined}
+                {(query.queryType === "REQUEST_REPLY" || query.queryType === "SUBSCRIBE") && !query.stateful && !query.wasmModule && !query.useExpressions ?
+                    <Field label="Use Mapping"
+                           description="Extract the fields of the messages declaratively with JMESPath, instead of the script below."
+                           invalid={this.errorsOf('useMapping').length > 0}
+                           error={this.errorMessageOf('useMapping')}>
+                        <Switch
+                            value={query.useMapping}
+                            onChange={onChangeBool(this.props, 'useMapping')}
+                        />
+                    </Field>
+                    : undefined}
+                {query.useMapping ?
+                    <>
+                        <Field label="Rows"
+                               description={<>Selects the rows from the JSON payload; an array results in a row per element, f.e. <code>plc.sensors[?active]</code>. Empty: the payload itself.</>}
+                               invalid={this.errorsOf('mappingRows').length > 0}
+                               error={this.errorMessageOf('mappingRows')}>
+                            <Input
+                                className="width-40"
+                                value={query.mappingRows}
+                                placeholder="@"
+                                onChange={onChange(this.props, 'mappingRows')}
+                            />
+                        </Field>
+                        <Field label="Columns"
+                               description="The fields of the frame: a path relative to the row (f.e. a.b[0].c), the type, and an optional default for missing values. Empty: the rows as they are."
+                               invalid={this.errorsOf('mappingColumns').length > 0}
+                               error={this.errorMessageOf('mappingColumns')}>
+                            <>
+                                {(query.mappingColumns || []).map((column, index) =>
+                                    <HorizontalGroup key={index}>
+                                        <Input
+                                            className="width-12"
+                                            value={column.name}
+                                            placeholder="name"
+                                            onChange={(event) => this.onChangeMappingColumn(index, 'name')(event.currentTarget.value)}
+                                        />
+                                        <Input
+                                            className="width-20"
+                                            value={column.path}
+                                            placeholder="values[0].celsius"
+                                            onChange={(event) => this.onChangeMappingColumn(index, 'path')(event.currentTarget.value)}
+                                        />
+                                        <Select<MappingType>
+                                            className="width-10"
+                                            options={MappingTypeOptions}
+                                            value={column.type || 'string'}
+                                            onChange={(selected) => this.onChangeMappingColumn(index, 'type')(selected.value)}
+                                        />
+                                        <Input
+                                            className="width-8"
+                                            value={column.default}
+                                            placeholder="default"
+                                            onChange={(event) => this.onChangeMappingColumn(index, 'default')(event.currentTarget.value || undefined)}
+                                        />
+                                        <Button variant="secondary" icon="trash-alt" aria-label="Remove column"
+                                                onClick={() => this.onChangeMappingColumns((query.mappingColumns || []).filter((_, i) => i !== index))}/>
+                                    </HorizontalGroup>
+                                )}
+                                <Button variant="secondary" icon="plus"
+                                        onClick={() => this.onChangeMappingColumns([...(query.mappingColumns || []), {name: '', path: '', type: 'string'}])}>
+                                    Add Column
+                                </Button>
+                            </>
+                        </Field>
+                    </>
+                    : undefined}
+                <Field label="Nested Arrays" description="How arrays inside the results (f.e. tags: [...]) are converted.">
+                    <RadioButtonGroup<ArrayMode>
+                        options={ArrayModeOptions}
+                        value={query.arrayMode || "json"}
+                        onChange={onQueryTypeChange(this.props, 'arrayMode')}
+                    />
+                </Field>
+                <Field label="Script Language" description="Applies to all scripts of the query.">
+                    <RadioButtonGroup<ScriptLanguage>
+                        options={ScriptLanguageOptions}
+                        value={query.scriptLanguage || "javascript"}
+                        onChange={onQueryTypeChange(this.props, 'scriptLanguage')}
+                    />
+                </Field>
                 <Field label={explanation.mapFnLabel} style={{width: '100%'}}
                        description={explanation.mapFnDescription}>
                     <JavaScriptCodeEditorField
                         expression={query.jsFn}
                         onChange={onChangeJs(this.props, 'jsFn')}
+                        errors={this.errorsOf('jsFn')}
+                        language={query.scriptLanguage}
                     />
                 </Field>
                 {explanation.mapFnExamples ?
                     <ButtonCascader options={explanation.mapFnExamples} onChange={(value) => onChangeJs(this.props, 'jsFn')(scripts[value[0] as SCRIPT_IDS])}>
                         Example Code
                     </ButtonCascader> : null}
+                <Field label="Script Limits"
+                       description="Time limit (f.e. 10s) and max. NATS operations per script run - and, with a WebAssembly module, its max. memory (MB); can only lower the data source limits. Empty: use the data source limits.">
+                    <HorizontalGroup>
+                        <Input
+                            className="width-4"
+                            placeholder="timeout"
+                            value={query.scriptTimeout}
+                            onChange={onChange(this.props, 'scriptTimeout')}
+                        />
+                        <Input
+                            className="width-4"
+                            type="number"
+                            placeholder="NATS ops"
+                            value={query.scriptMaxNatsOps}
+                            onChange={onChangeNumber(this.props, 'scriptMaxNatsOps')}
+                        />
+                        {query.wasmModule ?
+                            <Input
+                                className="width-4"
+                                type="number"
+                                placeholder="wasm MB"
+                                value={query.wasmMaxMemoryMb}
+                                onChange={onChangeNumber(this.props, 'wasmMaxMemoryMb')}
+                            /> : null}
+                    </HorizontalGroup>
+                </Field>
+                {query.queryType === "SUBSCRIBE" ?
+                    <Field label="Stateful"
+                           description={<>Keep a <code>state</code> object across messages (f.e. for deltas, counters or moving averages), which the mapping script can read and modify.</>}>
+                        <Switch
+                            value={query.stateful}
+                            onChange={onChangeBool(this.props, 'stateful')}
+                        />
+                    </Field>
+                    : undefined}
+                {query.queryType === "SUBSCRIBE" && query.stateful ?
+                    <>
+                        <Field label="Init Script" style={{width: '100%'}}
+                               description={<>Runs once when the stream starts. Fill <code>state</code>, or return the initial state object.</>}>
+                            <JavaScriptCodeEditorField
+                                expression={query.jsInitFn || ''}
+                                onChange={onChangeJs(this.props, 'jsInitFn')}
+                                errors={this.errorsOf('jsInitFn')}
+                                language={query.scriptLanguage}
+                            />
+                        </Field>
+                        <Field label="Teardown Script" style={{width: '100%'}}
+                               description={<>Runs once when the stream ends, with access to the final <code>state</code>.</>}>
+                            <JavaScriptCodeEditorField
+                                expression={query.jsTeardownFn || ''}
+                                onChange={onChangeJs(this.props, 'jsTeardownFn')}
+                                errors={this.errorsOf('jsTeardownFn')}
+                                language={query.scriptLanguage}
+                            />
+                        </Field>
+                    </>
+                    : undefined}
+                <ScriptPreview datasource={this.props.datasource} query={query}
+                               onErrors={(scriptErrors) => this.setState({scriptErrors})}/>
             </FieldSet>
         );
     }
@@ -0,0 +1,118 @@
+import React, {useState} from 'react';
+import {Alert, Button, Field, HorizontalGroup, Input, TextArea} from '@grafana/ui';
+import {DataFrameJSON} from '@grafana/data';
+import {DataSource} from '../datasource';
+import {MyQuery, PreviewResponse, ScriptError, ScriptFieldError, ValidateResponse} from '../types';
+
+type Props = {
+    datasource: DataSource;
+    query: MyQuery;
+    // called with the errors of the last check or preview, so that they can be highlighted in the script editors.
+    onErrors?: (errors: ScriptFieldError[]) => void;
+};
+
+function formatError(error: ScriptError, field?: string): string {
+    const position = error.line > 0 ? ` (line ${error.line}, column ${error.column})` : '';
+    return (field ? `${field}: ` : '') + error.message + position;
+}
+
+// ErrorDetails renders an error with the affected line of the script, and its call stack.
+function ErrorDetails({error, field}: { error: ScriptError, field?: string }) {
+    return (
+        <div>
+            {formatError(error, field)}
+            {error.snippet ? <pre>{error.snippet}</pre> : undefined}
+            {error.stack && error.stack.length > 1 ? <pre>{error.stack.map((frame) => `at ${frame}`).join('\n')}</pre> : undefined}
+        </div>
+    );
+}
+
+// PreviewTable renders a frame of the /preview resource as plain table, with the messages logged by the script.
+function PreviewTable({frame}: { frame: DataFrameJSON }) {
+    const fields = frame.schema?.fields || [];
+    const values = frame.data?.values || [];
+    const rowCount = values.length > 0 ? values[0].length : 0;
+    const notices = frame.schema?.meta?.notices || [];
+    return (
+        <>
+        {notices.map((notice, i) =>
+            <Alert key={i} title={notice.text} severity={notice.severity === 'warning' || notice.severity === 'error' ? notice.severity : 'info'}/>
+        )}
+        <table className="filter-table">
+            <thead>
+            <tr>{fields.map((field, i) => <th key={i}>{field.name}</th>)}</tr>
+            </thead>
+            <tbody>
+            {Array.from({length: rowCount}, (_, row) =>
+                <tr key={row}>{values.map((column, i) => <td key={i}>{JSON.stringify(column[row])}</td>)}</tr>
+            )}
+            </tbody>
+        </table>
+        </>
+    );
+}
+
+// ScriptPreview checks the scripts of the query for syntax errors, and runs them against a sample message - without
+// saving the panel, and without touching NATS.
+export function ScriptPreview({datasource, query, onErrors}: Props) {
+    const [subject, setSubject] = useState(query.natsSubject || '');
+    const [data, setData] = useState('{}');
+    const [validation, setValidation] = useState<ValidateResponse>();
+    const [preview, setPreview] = useState<PreviewResponse>();
+    const [requestError, setRequestError] = useState<string>();
+
+    const handle = <T, >(request: Promise<T>, onResult: (result: T) => void) => {
+        setRequestError(undefined);
+        request.then(onResult).catch((err) => setRequestError(err?.data?.message || err?.message || String(err)));
+    };
+    const usesMessage = query.queryType === 'REQUEST_REPLY' || query.queryType === 'SUBSCRIBE';
+
+    return (
+        <>
+            {usesMessage ?
+                <Field label="Sample Message" description="Subject and data of the message the script is previewed with.">
+                    <>
+                        <Input className="width-27" value={subject} onChange={(e) => setSubject(e.currentTarget.value)}/>
+                        <TextArea rows={3} value={data} onChange={(e) => setData(e.currentTarget.value)}/>
+                    </>
+                </Field>
+                : undefined}
+            <HorizontalGroup>
+                <Button variant="secondary" size="sm" onClick={() => {
+                    setPreview(undefined);
+                    handle(datasource.validateScripts(query), (result) => {
+                        setValidation(result);
+                        onErrors?.(result.errors);
+                    });
+                }}>
+                    Check Syntax
+                </Button>
+                {query.queryType !== 'STREAMING_SCRIPT' ?
+                    <Button variant="secondary" size="sm" onClick={() => {
+                        setValidation(undefined);
+                        handle(datasource.previewScript(query, {subject, data}), (result) => {
+                            setPreview(result);
+                            onErrors?.(result.error ? [result.error] : []);
+                        });
+                    }}>
+                        Preview
+                    </Button>
+                    : undefined}
+            </HorizontalGroup>
+            {requestError ? <Alert title="Request failed" severity="error">{requestError}</Alert> : undefined}
+            {validation ?
+                validation.errors.length === 0 ?
+                    <Alert title="No syntax errors" severity="success"/> :
+                    <Alert title="Syntax errors" severity="error">
+                        {validation.errors.map((error, i) => <ErrorDetails key={i} error={error} field={error.field}/>)}
+                    </Alert>
+                : undefined}
+            {preview?.error ?
+                <Alert title="Script failed" severity="error">
+                    <ErrorDetails error={preview.error} field={preview.error.field !== 'jsFn' ? preview.error.field : undefined}/>
+                </Alert>
+                : undefined}
+            {preview?.frames?.map((frame, i) => <PreviewTable key={i} frame={frame}/>)}
+        </>
+    );
+}
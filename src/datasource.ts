@@ -1,7 +1,7 @@
-import { DataSourceInstanceSettings, CoreApp } from '@grafana/data';
-import { DataSourceWithBackend } from '@grafana/runtime';
+import { DataSourceInstanceSettings, CoreApp, ScopedVars } from '@grafana/data';
+import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
 
-import { MyQuery, MyDataSourceOptions, DEFAULT_QUERY } from './types';
+import { MyQuery, MyDataSourceOptions, DEFAULT_QUERY, PreviewMessage, PreviewResponse, ValidateResponse } from './types';
 
 export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<MyDataSourceOptions>) {
@@ -11,4 +11,28 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
   getDefaultQuery(_: CoreApp): Partial<MyQuery> {
     return DEFAULT_QUERY
   }
+
+  // the backend does not know about template variables; so we pass their current values along, to be
+  // available to scripts as query.variables.
+  applyTemplateVariables(query: MyQuery, scopedVars: ScopedVars): MyQuery {
+    const templateSrv = getTemplateSrv();
+    const variables: Record<string, string> = {};
+    for (const variable of templateSrv.getVariables()) {
+      variables[variable.name] = templateSrv.replace('${' + variable.name + '}', scopedVars);
+    }
+    return {
+      ...query,
+      variables,
+    };
+  }
+
+  // compiles the scripts of the query in the backend, and returns their syntax errors.
+  validateScripts(query: MyQuery): Promise<ValidateResponse> {
+    return this.postResource('validate', query);
+  }
+
+  // runs the script of the query against the sample message in the backend, without touching NATS.
+  previewScript(query: MyQuery, message: PreviewMessage): Promise<PreviewResponse> {
+    return this.postResource('preview', { query, message });
+  }
 }
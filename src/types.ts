@@ -1,16 +1,94 @@
-import {DataQuery, DataSourceJsonData, SelectableValue} from '@grafana/data';
+import {DataFrameJSON, DataQuery, DataSourceJsonData, SelectableValue} from '@grafana/data';
 // These need to be synced with types.go
 
-export type QueryTypes = "REQUEST_REPLY" | "SUBSCRIBE" | "SCRIPT";
+export type QueryTypes = "REQUEST_REPLY" | "SUBSCRIBE" | "SCRIPT" | "STREAMING_SCRIPT";
 export interface MyQuery extends DataQuery {
     queryType: QueryTypes;
     natsSubject: string;
     requestTimeout: string;
     requestData: string;
+    // for SUBSCRIBE: how long to wait for the 1st message before returning (f.e. "2s"). Empty = do not wait.
+    firstMessageTimeout?: string;
+    // for SUBSCRIBE and STREAMING_SCRIPT: output policy for streamed frames.
+    streamMaxFps?: number;
+    streamCoalesce?: boolean;
+    streamSampling?: StreamSampling;
+    streamSampleSize?: number;
+    // for SUBSCRIBE: keep a `state` object across messages, with optional init and teardown scripts.
+    stateful?: boolean;
+    jsInitFn?: string;
+    jsTeardownFn?: string;
+    // resource limits for scripts; override the data source defaults.
+    scriptTimeout?: string;
+    scriptMaxNatsOps?: number;
+    // memory limit of the WebAssembly module; JavaScript memory is not limited.
+    wasmMaxMemoryMb?: number;
+    // set by DataSource.applyTemplateVariables; available to scripts as query.variables.
+    variables?: Record<string, string>;
 
     // for REQUEST_REPLY and SUBSCRIBE, gets each individual message and can transform it.
     // for SCRIPT, can take control of any flow.
     jsFn: string;
+    // the language of all scripts of the query; JavaScript if empty.
+    scriptLanguage?: ScriptLanguage;
+    // for REQUEST_REPLY and SUBSCRIBE: name of a WebAssembly module of the data source, which converts the messages
+    // instead of jsFn.
+    wasmModule?: string;
+    // how arrays nested in the results are converted; JSON if empty.
+    arrayMode?: ArrayMode;
+    // for REQUEST_REPLY and SUBSCRIBE: convert the messages by CEL expressions instead of jsFn.
+    useExpressions?: boolean;
+    // with useExpressions: messages for which it is false are discarded.
+    filterExpression?: string;
+    // with useExpressions: the fields of the resulting frame; the payload as it is if empty.
+    columnExpressions?: ExpressionColumn[];
+    // for REQUEST_REPLY and SUBSCRIBE: convert the messages by a declarative JMESPath mapping instead of jsFn.
+    useMapping?: boolean;
+    // with useMapping: selects the rows from the payload; the payload itself if empty.
+    mappingRows?: string;
+    // with useMapping: the fields of the resulting frame; the rows as they are if empty.
+    mappingColumns?: MappingColumn[];
+}
+
+// a field of the frame converted by CEL expressions. Synced with convert.ExpressionColumn.
+export interface ExpressionColumn {
+    name: string;
+    expression: string;
+}
+
+// an error in a script; line and column refer to the user's script, and are 0 if unknown. Synced with goja.ScriptError.
+export interface ScriptError {
+    message: string;
+    line: number;
+    column: number;
+    // the affected line of the script, and a line marking the column with ^
+    snippet?: string;
+    // runtime errors only: the calls inside the user's script, innermost first
+    stack?: string[];
+}
+
+export type ScriptField = 'jsFn' | 'jsInitFn' | 'jsTeardownFn' | 'wasmModule' | 'useExpressions' | 'filterExpression' | 'columnExpressions'
+    | 'useMapping' | 'mappingRows' | 'mappingColumns';
+
+// an error in one of the script fields of a query
+export type ScriptFieldError = ScriptError & { field: ScriptField };
+
+// response of the /validate resource
+export interface ValidateResponse {
+    errors: ScriptFieldError[];
+}
+
+// sample message for the /preview resource
+export interface PreviewMessage {
+    subject: string;
+    data: string;
+    headers?: Record<string, string[]>;
+}
+
+// response of the /preview resource
+export interface PreviewResponse {
+    frames: DataFrameJSON[] | null;
+    error: ScriptFieldError | null;
 }
 
 export const QueryTypeOptions: Array<SelectableValue<QueryTypes>> = [
@@ -28,6 +106,89 @@ export const QueryTypeOptions: Array<SelectableValue<QueryTypes>> = [
         label: "Free-Form Script (advanced)",
         value: "SCRIPT",
         description: "Orchestrate complex interactions with NATS, like doing requests based on other responses; or reducing multiple responses to a single dataset."
+    },
+    {
+        label: "Streaming Script (advanced)",
+        value: "STREAMING_SCRIPT",
+        description: "A free-form script which keeps running while the panel is shown, and streams rows to the UI via emit(rows)."
+    }
+];
+
+export type StreamSampling = "" | "EVERY_NTH" | "RESERVOIR";
+
+export const StreamSamplingOptions: Array<SelectableValue<StreamSampling>> = [
+    {
+        label: "All messages",
+        value: "",
+        description: "Do not sample messages."
+    },
+    {
+        label: "Every Nth message",
+        value: "EVERY_NTH",
+        description: "Only show every Nth message."
+    },
+    {
+        label: "Reservoir",
+        value: "RESERVOIR",
+        description: "Show N random messages per frame (requires max frames per second)."
+    }
+];
+
+// synced with goja.Language
+export type ScriptLanguage = "javascript" | "typescript";
+
+export const ScriptLanguageOptions: Array<SelectableValue<ScriptLanguage>> = [
+    {
+        label: "JavaScript",
+        value: "javascript",
+    },
+    {
+        label: "TypeScript",
+        value: "typescript",
+        description: "Transpiled to JavaScript by the backend; types are only checked in the editor."
+    }
+];
+
+// a field of the frame converted by a mapping. Synced with convert.MappingColumn.
+export interface MappingColumn {
+    name: string;
+    // JMESPath expression, relative to the row
+    path: string;
+    type?: MappingType;
+    // used if the value is null or missing, as text
+    default?: string;
+}
+
+// synced with convert.MappingType
+export type MappingType = "string" | "number" | "integer" | "boolean" | "time" | "json";
+
+export const MappingTypeOptions: Array<SelectableValue<MappingType>> = [
+    {label: "String", value: "string"},
+    {label: "Number", value: "number"},
+    {label: "Integer", value: "integer"},
+    {label: "Boolean", value: "boolean"},
+    {label: "Time", value: "time", description: "RFC 3339 strings, or milliseconds since the epoch."},
+    {label: "JSON", value: "json"},
+];
+
+// synced with framestruct.ArrayMode
+export type ArrayMode = "json" | "explode" | "index";
+
+export const ArrayModeOptions: Array<SelectableValue<ArrayMode>> = [
+    {
+        label: "JSON",
+        value: "json",
+        description: "Keep each array as a single field, containing the array as JSON."
+    },
+    {
+        label: "Explode",
+        value: "explode",
+        description: "A row per array element, with the other fields repeated."
+    },
+    {
+        label: "Index",
+        value: "index",
+        description: "A field per array element: tags.0, tags.1, ..."
     }
 ];
 
@@ -39,6 +200,25 @@ export const DEFAULT_QUERY: Partial<MyQuery> = {
 
 type AuthenticationModes = "NONE" | "NKEY" | "USERPASS" | "JWT";
 
+// synced with goja.ServerLogLevel
+type ScriptServerLogLevel = "info" | "debug" | "off";
+
+export const ScriptServerLogOptions: Array<SelectableValue<ScriptServerLogLevel>> = [
+    {
+        label: "Info",
+        value: "info",
+        description: "Write script logs to the server log at info level (default)."
+    }, {
+        label: "Debug",
+        value: "debug",
+        description: "Write script logs to the server log at debug level."
+    }, {
+        label: "Off",
+        value: "off",
+        description: "Only show script logs as notices on the frame."
+    }
+];
+
 export const AuthenticationOptions = [
     {
         label: "no authentication",
@@ -63,6 +243,39 @@ export interface MyDataSourceOptions extends DataSourceJsonData {
     authentication: AuthenticationModes;
     nkey?: string;
     username?: string;
+
+    // default resource limits for scripts, which can be overridden per query.
+    scriptTimeout?: string;
+    scriptMaxNatsOps?: number;
+    // memory limit of WebAssembly transforms; JavaScript memory is not limited.
+    wasmMaxMemoryMb?: number;
+    // level at which script logs are written to the Grafana server log; they are always shown as notices on the frame.
+    scriptServerLog?: ScriptServerLogLevel;
+
+    // permissions of scripts on the NATS connection; subject patterns are separated by commas.
+    scriptReadOnly?: boolean;
+    scriptPublishAllow?: string;
+    scriptPublishDeny?: string;
+    scriptRequestAllow?: string;
+    scriptRequestDeny?: string;
+    scriptSubscribeAllow?: string;
+    scriptSubscribeDeny?: string;
+
+    // the script library: modules which all scripts of the data source can require(name). Synced with ScriptModule.
+    scriptModules?: ScriptModule[];
+    // WebAssembly modules, which Request/Reply and Subscribe queries can use instead of a script. Synced with WasmModule.
+    wasmModules?: WasmModule[];
+}
+
+export interface ScriptModule {
+    name: string;
+    source: string;
+}
+
+export interface WasmModule {
+    name: string;
+    // the binary module, base64-encoded
+    wasm: string;
 }
 
 // These need to be synced with types.go